@@ -0,0 +1,107 @@
+package ollamatokenizer
+
+import (
+	"cmp"
+	"slices"
+	"unicode"
+	"unicode/utf8"
+)
+
+// InputAnalysis describes the scripts a text is written in, see AnalyzeInput.
+type InputAnalysis struct {
+	// Runes is the number of characters of the text.
+	Runes int
+	// NonASCIIShare is the share of characters outside of ASCII, between 0 and 1.
+	NonASCIIShare float64
+	// Scripts are the scripts of the letters of the text, most frequent first.
+	// Characters shared between scripts (digits, punctuation, whitespace) are not counted.
+	Scripts []ScriptShare
+	// Mixed is set if more than one script makes up a significant share of the letters.
+	Mixed bool
+	// SuggestMultilingual is set if a significant share of the letters is not Latin.
+	// Tokenizers trained mostly on English text tend to split these into many tokens,
+	// a tokenizer with a multilingual vocabulary likely counts more efficiently.
+	SuggestMultilingual bool
+}
+
+// ScriptShare is the number of letters of a text in one script.
+type ScriptShare struct {
+	// Script is the Unicode script name, e.g. "Latin" or "Han". Letters of
+	// scripts that aren't detected individually are reported as "Other".
+	Script string
+	Runes  int
+	// Share is the share of the letters of the text in the script, between 0 and 1.
+	Share float64
+}
+
+const (
+	// mixedScriptShare is the share of letters from which a script counts for Mixed.
+	mixedScriptShare = 0.1
+	// multilingualShare is the share of non-Latin letters from which SuggestMultilingual is set.
+	multilingualShare = 0.2
+)
+
+// analyzedScripts are detected by AnalyzeInput, roughly ordered by how common they are.
+var analyzedScripts = []string{
+	"Latin", "Han", "Cyrillic", "Arabic", "Devanagari", "Hiragana", "Katakana", "Hangul",
+	"Greek", "Hebrew", "Thai", "Bengali", "Tamil", "Telugu", "Georgian", "Armenian", "Ethiopic",
+}
+
+// AnalyzeInput reports the scripts and the share of non-ASCII characters of the text.
+// The analysis is advisory, it helps to pick a model before counting and needs no model.
+func AnalyzeInput(text string) InputAnalysis {
+	var analysis InputAnalysis
+	counts := make(map[string]int)
+	letters := 0
+	nonASCII := 0
+	for _, r := range text {
+		analysis.Runes++
+		if r >= utf8.RuneSelf {
+			nonASCII++
+		}
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		counts[scriptOf(r)]++
+	}
+	if analysis.Runes == 0 {
+		return analysis
+	}
+	analysis.NonASCIIShare = float64(nonASCII) / float64(analysis.Runes)
+
+	significant := 0
+	nonLatin := 0
+	for script, n := range counts {
+		share := float64(n) / float64(letters)
+		analysis.Scripts = append(analysis.Scripts, ScriptShare{Script: script, Runes: n, Share: share})
+		if share >= mixedScriptShare {
+			significant++
+		}
+		if script != "Latin" {
+			nonLatin += n
+		}
+	}
+	slices.SortFunc(analysis.Scripts, func(a, b ScriptShare) int {
+		if c := cmp.Compare(b.Runes, a.Runes); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Script, b.Script)
+	})
+	analysis.Mixed = significant > 1
+	analysis.SuggestMultilingual = letters > 0 && float64(nonLatin)/float64(letters) >= multilingualShare
+	return analysis
+}
+
+// scriptOf returns the script of the letter r.
+func scriptOf(r rune) string {
+	if r < utf8.RuneSelf {
+		return "Latin"
+	}
+	for _, name := range analyzedScripts {
+		if unicode.Is(unicode.Scripts[name], r) {
+			return name
+		}
+	}
+	return "Other"
+}
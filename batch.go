@@ -0,0 +1,116 @@
+package ollamatokenizer
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// BatchStats summarizes the token counts of a batch of prompts, see CountTokensBatchStats.
+type BatchStats struct {
+	// Prompts is the number of counted prompts.
+	Prompts int
+	Total   int
+	Min     int
+	Max     int
+	Mean    float64
+	// P50, P95 and P99 are percentiles of the counts by the nearest-rank method:
+	// the smallest count that at least the given share of the prompts doesn't exceed.
+	P50 int
+	P95 int
+	P99 int
+}
+
+// forEach calls fn for each index below n on a pool of at most batchConcurrency goroutines
+// and returns once all calls returned.
+func (c *ollamatokenizer) forEach(n int, fn func(i int)) {
+	c.mu.RLock()
+	workers := c.batchConcurrency
+	c.mu.RUnlock()
+	parallelFor(workers, n, fn)
+}
+
+// parallelFor calls fn for each index below n on a pool of at most workers goroutines
+// and returns once all calls returned.
+func parallelFor(workers, n int, fn func(i int)) {
+	workers = min(workers, n)
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(next.Add(1)) - 1
+				if i >= n {
+					return
+				}
+				fn(i)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// CountTokensBatch implements Tokenizer.
+func (c *ollamatokenizer) CountTokensBatch(modelName string, prompts []string) ([]int, error) {
+	counts := make([]int, len(prompts))
+	errs := make([]error, len(prompts))
+	c.forEach(len(prompts), func(i int) {
+		counts[i], errs[i] = c.CountTokens(modelName, prompts[i])
+	})
+
+	// the error of the first failing prompt, so the same prompt is reported on every run.
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("counting prompt %d failed: %w", i, err)
+		}
+	}
+	return counts, nil
+}
+
+// TokenizeBatch implements Tokenizer.
+func (c *ollamatokenizer) TokenizeBatch(modelName string, prompts []string) ([][]int, error) {
+	tokens := make([][]int, len(prompts))
+	errs := make([]error, len(prompts))
+	c.forEach(len(prompts), func(i int) {
+		tokens[i], errs[i] = c.Tokenize(modelName, prompts[i])
+	})
+
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("tokenizing prompt %d failed: %w", i, err)
+		}
+	}
+	return tokens, nil
+}
+
+// CountTokensBatchStats implements Tokenizer.
+func (c *ollamatokenizer) CountTokensBatchStats(modelName string, prompts []string) (BatchStats, error) {
+	counts, err := c.CountTokensBatch(modelName, prompts)
+	if err != nil {
+		return BatchStats{}, err
+	}
+	return batchStats(counts), nil
+}
+
+// batchStats summarizes the counts, the counts are sorted in place.
+func batchStats(counts []int) BatchStats {
+	if len(counts) == 0 {
+		return BatchStats{}
+	}
+	slices.Sort(counts)
+
+	stats := BatchStats{Prompts: len(counts), Min: counts[0], Max: counts[len(counts)-1]}
+	for _, n := range counts {
+		stats.Total += n
+	}
+	stats.Mean = float64(stats.Total) / float64(len(counts))
+	rank := func(p float64) int {
+		return counts[int(math.Ceil(p/100*float64(len(counts))))-1]
+	}
+	stats.P50, stats.P95, stats.P99 = rank(50), rank(95), rank(99)
+	return stats
+}
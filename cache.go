@@ -0,0 +1,262 @@
+package ollamatokenizer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// cacheFileName is the name of a cached model file within the directory of its model.
+const cacheFileName = "model.gguf"
+
+// checksumSuffix is appended to the path of a cached model file for the file holding its SHA-256.
+const checksumSuffix = ".sha256"
+
+// cacheDir returns the directory downloaded models are cached in, see TokenizerWithCacheDir.
+func (c *ollamatokenizer) cacheDir() (string, error) {
+	c.mu.RLock()
+	dir := c.cacheDirPath
+	c.mu.RUnlock()
+	if dir != "" {
+		return dir, nil
+	}
+	return defaultCacheDir()
+}
+
+// defaultCacheDir returns the default cache directory, "~/.libollama/models".
+func defaultCacheDir() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get home directory: %w", err)
+	}
+	return filepath.Join(homeDir, ".libollama", "models"), nil
+}
+
+// CachePrunePolicy selects the cached model files removed by PruneCache.
+// Zero fields don't limit the cache.
+type CachePrunePolicy struct {
+	// MaxAge removes files that weren't loaded within MaxAge.
+	MaxAge time.Duration
+	// MaxBytes removes the least recently loaded files until the cache holds at most MaxBytes.
+	MaxBytes int64
+}
+
+// cacheEntry is a cached model file.
+type cacheEntry struct {
+	model    string
+	path     string
+	size     int64
+	lastUsed time.Time
+}
+
+// cacheEntries lists the cached model files, least recently loaded first.
+// A cache directory that doesn't exist yet is an empty cache.
+func (c *ollamatokenizer) cacheEntries() ([]cacheEntry, error) {
+	dir, err := c.cacheDir()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []cacheEntry
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && path == dir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() || d.Name() != cacheFileName {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		model, err := filepath.Rel(dir, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		entries = append(entries, cacheEntry{
+			model:    filepath.ToSlash(model),
+			path:     path,
+			size:     info.Size(),
+			lastUsed: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list model cache %s: %w", dir, err)
+	}
+	slices.SortFunc(entries, func(a, b cacheEntry) int {
+		return a.lastUsed.Compare(b.lastUsed)
+	})
+	return entries, nil
+}
+
+// touchCacheFile marks a cached model file as used at now, see CachePrunePolicy.
+func touchCacheFile(path string, now time.Time) {
+	_ = os.Chtimes(path, now, now)
+}
+
+// fileChecksum returns the hex encoded SHA-256 of the file.
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verifyCacheFile checks a cached model file against the checksum recorded when it was downloaded.
+// Files cached without a checksum (by earlier versions) are accepted as is.
+func verifyCacheFile(path string) error {
+	want, err := os.ReadFile(path + checksumSuffix)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read checksum of %s: %w", path, err)
+	}
+	got, err := fileChecksum(path)
+	if err != nil {
+		return fmt.Errorf("failed to compute checksum of %s: %w", path, err)
+	}
+	if got != strings.TrimSpace(string(want)) {
+		return fmt.Errorf("checksum mismatch of %s: got %s, recorded %s", path, got, strings.TrimSpace(string(want)))
+	}
+	return nil
+}
+
+// fileStamp identifies a version of a file by its size and modification time.
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+func statStamp(path string) (fileStamp, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{size: info.Size(), modTime: info.ModTime()}, nil
+}
+
+// verifyCachedFile is verifyCacheFile, skipping files this tokenizer already verified since they last
+// changed, so a multi-GB file isn't hashed again on every load.
+func (c *ollamatokenizer) verifyCachedFile(path string) error {
+	stamp, err := statStamp(path)
+	if err == nil {
+		c.mu.RLock()
+		verified, ok := c.verifiedFiles[path]
+		c.mu.RUnlock()
+		if ok && verified.size == stamp.size && verified.modTime.Equal(stamp.modTime) {
+			return nil
+		}
+	}
+	return verifyCacheFile(path)
+}
+
+// markVerified records the current version of the file as matching its checksum, see verifyCachedFile.
+// Call it again after touching the file, which changes its modification time.
+func (c *ollamatokenizer) markVerified(path string) {
+	stamp, err := statStamp(path)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		delete(c.verifiedFiles, path)
+		return
+	}
+	c.verifiedFiles[path] = stamp
+}
+
+// writeFileAtomic writes the data to path through a temporary file renamed over it,
+// so concurrent readers and writers (e.g. of other processes) never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// removeCacheFile removes a cached model file together with its checksum.
+func removeCacheFile(path string) error {
+	_ = os.Remove(path + checksumSuffix)
+	return os.Remove(path)
+}
+
+// CacheStats implements Tokenizer.
+func (c *ollamatokenizer) CacheStats() (entries int, totalBytes int64, err error) {
+	cached, err := c.cacheEntries()
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, e := range cached {
+		totalBytes += e.size
+	}
+	return len(cached), totalBytes, nil
+}
+
+// PruneCache implements Tokenizer.
+func (c *ollamatokenizer) PruneCache(policy CachePrunePolicy) (removed int, freedBytes int64, err error) {
+	if policy.MaxAge < 0 || policy.MaxBytes < 0 {
+		return 0, 0, fmt.Errorf("invalid prune policy: %+v", policy)
+	}
+	cached, err := c.cacheEntries()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// the lock keeps models from being added to the loaded ones while pruning, so the file of a loaded
+	// model is never removed. Downloads and loads in progress don't take it and aren't held back: a file
+	// removed before it was opened fails its load, and a cached one is downloaded again, see withModelFile.
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.clock.Now()
+	var total int64
+	for _, e := range cached {
+		total += e.size
+	}
+	for _, e := range cached {
+		expired := policy.MaxAge > 0 && now.Sub(e.lastUsed) > policy.MaxAge
+		oversized := policy.MaxBytes > 0 && total > policy.MaxBytes
+		if !expired && !oversized {
+			continue
+		}
+		// the file of a loaded model is in use, it is pruned once the model is unloaded.
+		if _, loaded := c.loadedModels[e.model]; loaded {
+			continue
+		}
+		if err := removeCacheFile(e.path); err != nil {
+			return removed, freedBytes, fmt.Errorf("failed to remove cached model %s: %w", e.model, err)
+		}
+		// remove the now empty model directory, it is recreated by the next download.
+		_ = os.Remove(filepath.Dir(e.path))
+		removed++
+		freedBytes += e.size
+		total -= e.size
+	}
+	return removed, freedBytes, nil
+}
@@ -0,0 +1,117 @@
+package ollamatokenizer
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ollama/ollama/api"
+	chattemplate "github.com/ollama/ollama/template"
+)
+
+// kvChatTemplate is the gguf metadata key of the (Jinja) chat template embedded in a model file.
+const kvChatTemplate = "tokenizer.chat_template"
+
+// chatMLTemplate renders the messages in the ChatML layout "<|im_start|>role\ncontent<|im_end|>\n",
+// followed by the prompt for the assistant's reply.
+const chatMLTemplate = "{{- range .Messages }}<|im_start|>{{ .Role }}\n{{ .Content }}<|im_end|>\n{{ end }}<|im_start|>assistant\n"
+
+var defaultChatTemplate = func() *chattemplate.Template {
+	t, err := chattemplate.Parse(chatMLTemplate)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}()
+
+// chatTemplate is the chat template of a model.
+type chatTemplate struct {
+	template *chattemplate.Template
+	// override is set for templates set by TokenizerWithChatTemplate, which outlive RemoveModel.
+	override bool
+}
+
+// ChatMessage is a message of a chat conversation.
+type ChatMessage struct {
+	// Role is the author of the message, e.g. "system", "user" or "assistant".
+	Role    string
+	Content string
+}
+
+// CountChatTokensCumulative implements Tokenizer.
+func (c *ollamatokenizer) CountChatTokensCumulative(modelName string, messages []ChatMessage) ([]int, int, error) {
+	cumulative := make([]int, len(messages))
+	for i := range messages {
+		// each prefix of the conversation is rendered the way CountChatTokens renders it,
+		// so the last running total is the count of the whole conversation.
+		count, err := c.CountChatTokens(modelName, messages[:i+1])
+		if err != nil {
+			return nil, 0, fmt.Errorf("message %d: %w", i, err)
+		}
+		cumulative[i] = count
+	}
+	if len(messages) == 0 {
+		return cumulative, 0, nil
+	}
+	return cumulative, cumulative[len(messages)-1], nil
+}
+
+// CountChatTokens implements Tokenizer.
+func (c *ollamatokenizer) CountChatTokens(modelName string, messages []ChatMessage) (int, error) {
+	rendered, err := c.renderChat(modelName, messages)
+	if err != nil {
+		return 0, err
+	}
+	return c.CountTokens(modelName, rendered)
+}
+
+// renderChat renders the messages with the chat template of the model.
+func (c *ollamatokenizer) renderChat(modelName string, messages []ChatMessage) (string, error) {
+	tmpl, err := c.chatTemplate(modelName)
+	if err != nil {
+		return "", err
+	}
+	msgs := make([]api.Message, len(messages))
+	for i, m := range messages {
+		msgs[i] = api.Message{Role: m.Role, Content: m.Content}
+	}
+	var rendered strings.Builder
+	if err := tmpl.Execute(&rendered, chattemplate.Values{Messages: msgs}); err != nil {
+		return "", fmt.Errorf("failed to render chat template of model %s: %w", modelName, err)
+	}
+	return rendered.String(), nil
+}
+
+// chatTemplate returns the chat template of the model: the template set by TokenizerWithChatTemplate,
+// or else the ollama template matching the one embedded in the model file, or else the ChatML layout.
+// Names that aren't configured get the ChatML layout, counting fails for them like CountTokens does.
+func (c *ollamatokenizer) chatTemplate(modelName string) (*chattemplate.Template, error) {
+	c.mu.RLock()
+	t, exists := c.chatTemplates[modelName]
+	c.mu.RUnlock()
+	if exists {
+		return t.template, nil
+	}
+
+	kv, err := c.modelMetadata(modelName)
+	if errors.Is(err, ErrModelNotFound) {
+		return defaultChatTemplate, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	t.template = defaultChatTemplate
+	if jinja, _ := kv[kvChatTemplate].(string); jinja != "" {
+		// like ollama, the Jinja template is replaced by the closest of the templates ollama ships.
+		if named, err := chattemplate.Named(jinja); err == nil {
+			if parsed, err := chattemplate.Parse(string(named.Bytes)); err == nil {
+				t.template = parsed
+			}
+		}
+	}
+
+	c.mu.Lock()
+	c.chatTemplates[modelName] = t
+	c.mu.Unlock()
+	return t.template, nil
+}
@@ -0,0 +1,246 @@
+package ollamatokenizer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ollama/ollama/llama"
+)
+
+// ChunkBySentences implements Tokenizer.
+func (c *ollamatokenizer) ChunkBySentences(modelName, text string, maxTokens int) ([]string, error) {
+	if maxTokens <= 0 {
+		return nil, fmt.Errorf("invalid max tokens: %d", maxTokens)
+	}
+	text, err := c.preprocess(text)
+	if err != nil {
+		return nil, err
+	}
+	if text == "" {
+		return nil, nil
+	}
+
+	if err := c.waitThrottle(context.Background()); err != nil {
+		return nil, err
+	}
+	model, _, release, err := c.acquireModelOrFallback(modelName)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	// chunks are counted as a whole, tokens may merge across sentences.
+	fits := func(s string) (bool, error) {
+		n, err := c.countChunks(model, s, true)
+		return n <= maxTokens, err
+	}
+
+	var chunks []string
+	current := ""
+	for _, sentence := range splitSentences(text) {
+		ok, err := fits(current + sentence)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			current += sentence
+			continue
+		}
+		if current != "" {
+			chunks = append(chunks, current)
+		}
+		if ok, err = fits(sentence); err != nil {
+			return nil, err
+		}
+		if ok {
+			current = sentence
+			continue
+		}
+		// the sentence alone exceeds the budget, split it and continue after the last part.
+		parts, err := c.hardSplit(model, sentence, maxTokens)
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, parts[:len(parts)-1]...)
+		current = parts[len(parts)-1]
+	}
+	if current != "" {
+		chunks = append(chunks, current)
+	}
+	return chunks, nil
+}
+
+// ChunkByTokens implements Tokenizer.
+func (c *ollamatokenizer) ChunkByTokens(modelName, text string, maxTokensPerChunk, overlapTokens int) ([]string, error) {
+	if maxTokensPerChunk <= 0 {
+		return nil, fmt.Errorf("invalid max tokens per chunk: %d", maxTokensPerChunk)
+	}
+	if overlapTokens < 0 || overlapTokens >= maxTokensPerChunk {
+		return nil, fmt.Errorf("invalid overlap of %d tokens for chunks of %d tokens", overlapTokens, maxTokensPerChunk)
+	}
+	text, err := c.preprocess(text)
+	if err != nil {
+		return nil, err
+	}
+	if text == "" {
+		return nil, nil
+	}
+
+	if err := c.waitThrottle(context.Background()); err != nil {
+		return nil, err
+	}
+	model, _, release, err := c.acquireModelOrFallback(modelName)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	n, err := c.countChunks(model, text, true)
+	if err != nil {
+		return nil, err
+	}
+	if n <= maxTokensPerChunk {
+		return []string{text}, nil
+	}
+	cuts, err := c.tokenBoundaries(model, text, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var chunks []string
+	for start := 0; ; {
+		// binary search the furthest cut at which the chunk still fits.
+		lo, hi := start, len(cuts)-1
+		for lo < hi {
+			mid := (lo + hi + 1) / 2
+			n, err := c.countChunks(model, text[cuts[start]:cuts[mid]], true)
+			if err != nil {
+				return nil, err
+			}
+			if n <= maxTokensPerChunk {
+				lo = mid
+			} else {
+				hi = mid - 1
+			}
+		}
+		end := lo
+		if end == start {
+			return nil, fmt.Errorf("max tokens per chunk %d is too small to hold a single token", maxTokensPerChunk)
+		}
+		chunks = append(chunks, text[cuts[start]:cuts[end]])
+		if end == len(cuts)-1 {
+			return chunks, nil
+		}
+
+		// the next chunk starts at the earliest cut whose overlap with the end of this one fits
+		// overlapTokens. It starts after this one, so the chunking always progresses.
+		lo, hi = start+1, end
+		for lo < hi {
+			mid := (lo + hi) / 2
+			n, err := c.countChunks(model, text[cuts[mid]:cuts[end]], false)
+			if err != nil {
+				return nil, err
+			}
+			if n <= overlapTokens {
+				hi = mid
+			} else {
+				lo = mid + 1
+			}
+		}
+		start = lo
+	}
+}
+
+// splitSentences splits the text after each sentence, the parts concatenate to the text.
+// A sentence ends after a run of '.', '!' or '?' that is followed by whitespace or the end
+// of the text, or after a newline. The whitespace following a sentence belongs to it.
+// This is a heuristic: abbreviations ("e.g. this") and decimals followed by a space end a sentence too.
+func splitSentences(text string) []string {
+	var sentences []string
+	start := 0
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		i += size
+		end := -1
+		switch {
+		case r == '\n':
+			end = i
+		case r == '.' || r == '!' || r == '?':
+			for i < len(text) && strings.ContainsRune(".!?", rune(text[i])) {
+				i++
+			}
+			if i == len(text) {
+				end = i
+				break
+			}
+			next, _ := utf8.DecodeRuneInString(text[i:])
+			if unicode.IsSpace(next) {
+				end = i
+			}
+		}
+		if end < 0 {
+			continue
+		}
+		// keep the following whitespace (up to and including a newline) with the sentence.
+		for end < len(text) && text[end-1] != '\n' {
+			next, size := utf8.DecodeRuneInString(text[end:])
+			if !unicode.IsSpace(next) {
+				break
+			}
+			end += size
+		}
+		sentences = append(sentences, text[start:end])
+		start, i = end, end
+	}
+	if start < len(text) {
+		sentences = append(sentences, text[start:])
+	}
+	return sentences
+}
+
+// hardSplit splits a sentence exceeding the budget into parts of at most maxTokens each.
+// Each part is the longest prefix that fits, shortened to end after whitespace if it contains any.
+func (c *ollamatokenizer) hardSplit(model *llama.Model, sentence string, maxTokens int) ([]string, error) {
+	var parts []string
+	for sentence != "" {
+		// the byte offsets at which a prefix ends on a character boundary.
+		var ends []int
+		for i := range sentence {
+			if i > 0 {
+				ends = append(ends, i)
+			}
+		}
+		ends = append(ends, len(sentence))
+
+		// binary search the longest prefix that fits, fitting is monotonic in the prefix length.
+		lo, hi := 0, len(ends)
+		for lo < hi {
+			mid := (lo + hi) / 2
+			n, err := c.countChunks(model, sentence[:ends[mid]], true)
+			if err != nil {
+				return nil, err
+			}
+			if n <= maxTokens {
+				lo = mid + 1
+			} else {
+				hi = mid
+			}
+		}
+		if lo == 0 {
+			return nil, fmt.Errorf("max tokens %d is too small to hold a single character", maxTokens)
+		}
+		end := ends[lo-1]
+		if end < len(sentence) {
+			if space := strings.LastIndexFunc(sentence[:end], unicode.IsSpace); space > 0 {
+				_, size := utf8.DecodeRuneInString(sentence[space:])
+				end = space + size
+			}
+		}
+		parts = append(parts, sentence[:end])
+		sentence = sentence[end:]
+	}
+	return parts, nil
+}
@@ -0,0 +1,24 @@
+package ollamatokenizer
+
+import (
+	"time"
+)
+
+// Clock is the source of time of the tokenizer, see TokenizerWithClock.
+// Implementations must be safe for concurrent use.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// After returns a channel receiving the current time once the duration d has elapsed.
+	// Waits select on it, so they can also give up once a context is done.
+	After(d time.Duration) <-chan time.Time
+}
+
+// systemClock is the wall clock, the default Clock.
+type systemClock struct{}
+
+// Now implements Clock.
+func (systemClock) Now() time.Time { return time.Now() }
+
+// After implements Clock.
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
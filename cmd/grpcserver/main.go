@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/contenox/ollamatokenizer"
+	"github.com/contenox/ollamatokenizer/tokenizergrpc"
+	"google.golang.org/grpc"
+)
+
+func main() {
+	addr := os.Getenv("ADDR")
+	if addr == "" {
+		addr = ":9090"
+	}
+
+	// Get fallback model (default to empty)
+	fallbackModel := os.Getenv("FALLBACK_MODEL")
+
+	// Get preload models
+	preloadModels := strings.Split(os.Getenv("PRELOAD_MODELS"), ",")
+
+	// Use default URLs if requested
+	useDefaultURLs := os.Getenv("USE_DEFAULT_URLS") == "true"
+
+	var tokenizerOpts []ollamatokenizer.TokenizerOption
+
+	// Only use custom models if USE_DEFAULT_URLS is not "true"
+	if !useDefaultURLs {
+		modelsEnv := os.Getenv("TOKENIZER_MODELS")
+		modelMap := make(map[string]string)
+		for _, kv := range strings.Split(modelsEnv, ",") {
+			parts := strings.SplitN(kv, "=", 2)
+			if len(parts) == 2 {
+				modelMap[parts[0]] = parts[1]
+			}
+		}
+		tokenizerOpts = append(tokenizerOpts, ollamatokenizer.TokenizerWithModelMap(modelMap))
+	}
+
+	// Cache downloaded models in a directory of its own if specified, e.g. a persistent volume
+	if cacheDir := os.Getenv("CACHE_DIR"); cacheDir != "" {
+		tokenizerOpts = append(tokenizerOpts, ollamatokenizer.TokenizerWithCacheDir(cacheDir))
+	}
+
+	// Add fallback model option if specified
+	if fallbackModel != "" {
+		tokenizerOpts = append(tokenizerOpts, ollamatokenizer.TokenizerWithFallbackModel(fallbackModel))
+	}
+
+	// Use the fallback model for configured models that fail to load, e.g. while their source is down
+	if os.Getenv("LOAD_FAILURE_FALLBACK") == "true" {
+		tokenizerOpts = append(tokenizerOpts, ollamatokenizer.TokenizerWithLoadFailureFallback(true))
+	}
+
+	// Fail with model not found instead of using the fallback model
+	if os.Getenv("STRICT_MODEL_MATCHING") == "true" {
+		tokenizerOpts = append(tokenizerOpts, ollamatokenizer.TokenizerWithStrictModelMatching(true))
+	}
+
+	// Preload models if specified
+	if len(preloadModels) > 0 && preloadModels[0] != "" {
+		tokenizerOpts = append(tokenizerOpts, ollamatokenizer.TokenizerWithPreloadedModels(preloadModels...))
+	}
+
+	tokenizer, err := ollamatokenizer.NewTokenizer(tokenizerOpts...)
+	if err != nil {
+		log.Fatalf("Failed to init tokenizer: %v", err)
+	}
+
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", addr, err)
+	}
+	server := grpc.NewServer()
+	tokenizergrpc.RegisterTokenizerServer(server, tokenizergrpc.NewService(tokenizer))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		log.Println("Tokenizer gRPC server listening on ", addr)
+		serveErr <- server.Serve(lis)
+	}()
+
+	select {
+	case err := <-serveErr:
+		log.Fatalf("Server failed: %v", err)
+	case <-ctx.Done():
+	}
+	stop()
+
+	// stop accepting calls and wait for the in-flight ones.
+	log.Println("Shutting down, draining calls in flight")
+	server.GracefulStop()
+	if err := tokenizer.Close(); err != nil {
+		log.Printf("Failed to close tokenizer: %v", err)
+	}
+	log.Println("Server stopped")
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/contenox/ollamatokenizer"
+)
+
+// canaryText is tokenized by the self-check. It mixes ASCII, punctuation and multibyte characters.
+const canaryText = "The quick brown fox jumps over the lazy dog. Größe, 東京, 🚀!"
+
+// canary periodically tokenizes canaryText to detect degradation (e.g. a broken model cache)
+// before requests fail. The server is not ready after threshold consecutive failures.
+type canary struct {
+	tokenizer ollamatokenizer.Tokenizer
+	model     string
+	interval  time.Duration
+	threshold int
+
+	mu                  sync.Mutex
+	checked             bool
+	consecutiveFailures int
+	failures            int
+	lastLatency         time.Duration
+	lastErr             error
+}
+
+// run checks immediately and then every interval until ctx is done.
+func (c *canary) run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		c.check()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *canary) check() {
+	start := time.Now()
+	count, err := c.tokenizer.CountTokens(c.model, canaryText)
+	if err == nil && count == 0 {
+		err = fmt.Errorf("no tokens for non-empty input")
+	}
+	latency := time.Since(start)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checked = true
+	c.lastLatency = latency
+	c.lastErr = err
+	if err != nil {
+		c.failures++
+		c.consecutiveFailures++
+		log.Printf("Canary check with model %s failed (%d in a row): %v", c.model, c.consecutiveFailures, err)
+		return
+	}
+	if c.consecutiveFailures >= c.threshold {
+		log.Printf("Canary check with model %s recovered", c.model)
+	}
+	c.consecutiveFailures = 0
+}
+
+// ready reports whether the server should receive traffic, with the reason if not.
+func (c *canary) ready() (bool, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.checked {
+		return false, "canary check pending"
+	}
+	if c.consecutiveFailures >= c.threshold {
+		return false, fmt.Sprintf("canary check failed %d times in a row: %v", c.consecutiveFailures, c.lastErr)
+	}
+	return true, ""
+}
+
+// writeMetrics writes the canary metrics in the Prometheus text format.
+func (c *canary) writeMetrics(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	up := 0
+	if c.checked && c.lastErr == nil {
+		up = 1
+	}
+	fmt.Fprintf(w, "# HELP ollamatokenizer_canary_up Whether the last canary check succeeded.\n")
+	fmt.Fprintf(w, "# TYPE ollamatokenizer_canary_up gauge\n")
+	fmt.Fprintf(w, "ollamatokenizer_canary_up{model=%q} %d\n", c.model, up)
+	fmt.Fprintf(w, "# HELP ollamatokenizer_canary_latency_seconds Latency of the last canary check.\n")
+	fmt.Fprintf(w, "# TYPE ollamatokenizer_canary_latency_seconds gauge\n")
+	fmt.Fprintf(w, "ollamatokenizer_canary_latency_seconds{model=%q} %g\n", c.model, c.lastLatency.Seconds())
+	fmt.Fprintf(w, "# HELP ollamatokenizer_canary_failures_total Failed canary checks.\n")
+	fmt.Fprintf(w, "# TYPE ollamatokenizer_canary_failures_total counter\n")
+	fmt.Fprintf(w, "ollamatokenizer_canary_failures_total{model=%q} %d\n", c.model, c.failures)
+}
@@ -1,11 +1,22 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/contenox/ollamatokenizer"
 )
@@ -27,6 +38,280 @@ type countRequest struct {
 
 type countResponse struct {
 	Count int `json:"count"`
+	// ModelUsed and UsedFallback are only set if the count comes from the load failure fallback.
+	ModelUsed    string `json:"model_used,omitempty"`
+	UsedFallback bool   `json:"used_fallback,omitempty"`
+}
+
+type batchItem struct {
+	Model  string `json:"model"`
+	Prompt string `json:"prompt"`
+}
+
+type batchResult struct {
+	Count *int   `json:"count,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// batchSummary aggregates the successful results of a batch.
+type batchSummary struct {
+	Items       int                      `json:"items"`
+	Errors      int                      `json:"errors"`
+	TotalTokens int                      `json:"total_tokens"`
+	Min         int                      `json:"min"`
+	Max         int                      `json:"max"`
+	Avg         float64                  `json:"avg"`
+	ByModel     map[string]*batchSummary `json:"by_model,omitempty"`
+}
+
+func (s *batchSummary) add(r batchResult) {
+	s.Items++
+	if r.Count == nil {
+		s.Errors++
+		return
+	}
+	count := *r.Count
+	succeeded := s.Items - s.Errors
+	if succeeded == 1 || count < s.Min {
+		s.Min = count
+	}
+	if count > s.Max {
+		s.Max = count
+	}
+	s.TotalTokens += count
+	s.Avg = float64(s.TotalTokens) / float64(succeeded)
+}
+
+// summarize aggregates the batch results, optionally grouped by model.
+func summarize(items []batchItem, results []batchResult, groupByModel bool) *batchSummary {
+	summary := &batchSummary{}
+	if groupByModel {
+		summary.ByModel = make(map[string]*batchSummary)
+	}
+	for i, r := range results {
+		summary.add(r)
+		if groupByModel {
+			group, ok := summary.ByModel[items[i].Model]
+			if !ok {
+				group = &batchSummary{}
+				summary.ByModel[items[i].Model] = group
+			}
+			group.add(r)
+		}
+	}
+	return summary
+}
+
+// maxBatchBodyBytes bounds /batch requests, which are decoded as a whole before counting.
+const maxBatchBodyBytes = 32 << 20
+
+type batchSummaryResponse struct {
+	Results []batchResult `json:"results"`
+	Summary *batchSummary `json:"summary"`
+}
+
+// streamProgress is interleaved with the results of /batch/stream.
+type streamProgress struct {
+	Done        int `json:"done"`
+	TokensSoFar int `json:"tokens_so_far"`
+}
+
+type streamProgressLine struct {
+	Progress streamProgress `json:"progress"`
+}
+
+// defaultProgressEvery is the number of items between progress lines of /batch/stream.
+const defaultProgressEvery = 1000
+
+type piecesRequest struct {
+	Model  string `json:"model"`
+	Prompt string `json:"prompt"`
+}
+
+type pieceResponse struct {
+	ID    int    `json:"id"`
+	Piece string `json:"piece"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+}
+
+// maxPiecesBodyBytes bounds /pieces requests. The response is a multiple of the input size,
+// the tokenizer's own input limit applies on top.
+const maxPiecesBodyBytes = 1 << 20
+
+type detokenizeRequest struct {
+	Model  string `json:"model"`
+	Tokens []int  `json:"tokens"`
+}
+
+type detokenizeResponse struct {
+	Text string `json:"text"`
+}
+
+type resolveRequest struct {
+	Model string `json:"model"`
+}
+
+type resolveResponse struct {
+	Resolved     string `json:"resolved"`
+	Exact        bool   `json:"exact"`
+	FallbackUsed bool   `json:"fallback_used"`
+	// Ambiguous lists the models that matched equally well, the resolved model is the first of them.
+	Ambiguous []string `json:"ambiguous,omitempty"`
+}
+
+type explainRequest struct {
+	Model string `json:"model"`
+	// Prompt is optional, if set it is counted with the model used.
+	Prompt string `json:"prompt,omitempty"`
+}
+
+type explainAttempt struct {
+	Model      string  `json:"model"`
+	Fallback   bool    `json:"fallback"`
+	Loaded     bool    `json:"loaded"`
+	Error      string  `json:"error,omitempty"`
+	DurationMS float64 `json:"duration_ms"`
+}
+
+type explainResponse struct {
+	Requested  string           `json:"requested"`
+	Resolution resolveResponse  `json:"resolution"`
+	Attempts   []explainAttempt `json:"attempts"`
+	Used       string           `json:"used,omitempty"`
+	Count      *int             `json:"count,omitempty"`
+}
+
+type modelInfoRequest struct {
+	Model string `json:"model"`
+}
+
+type modelInfoResponse struct {
+	Requested     string `json:"requested"`
+	Model         string `json:"model"`
+	FallbackUsed  bool   `json:"fallback_used"`
+	Architecture  string `json:"architecture"`
+	Name          string `json:"name,omitempty"`
+	TokenizerType string `json:"tokenizer_type"`
+	VocabSize     int    `json:"vocab_size"`
+	URL           string `json:"url"`
+	// Source is "network", "cache" or "local".
+	Source string `json:"source"`
+}
+
+type validateRequest struct {
+	Model     string `json:"model"`
+	Prompt    string `json:"prompt"`
+	MaxTokens int    `json:"max_tokens,omitempty"`
+}
+
+type validateResponse struct {
+	Fits  bool `json:"fits"`
+	Count int  `json:"count"`
+	Limit int  `json:"limit"`
+}
+
+// durationEnv reads a time.Duration (e.g. "30s") from the environment variable name, or returns def if unset.
+func durationEnv(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return d
+}
+
+// listEnv reads a comma separated list from the environment variable name, or returns nil if unset.
+func listEnv(name string) []string {
+	v := os.Getenv(name)
+	if v == "" {
+		return nil
+	}
+	return strings.Split(v, ",")
+}
+
+// modelIntsEnv reads a "model=n,..." list from the environment variable name, or returns nil if unset.
+func modelIntsEnv(name string) map[string]int {
+	v := os.Getenv(name)
+	if v == "" {
+		return nil
+	}
+	values := make(map[string]int)
+	for _, kv := range strings.Split(v, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		n, err := strconv.Atoi(parts[1])
+		if err != nil {
+			log.Fatalf("Invalid %s for model %s: %v", name, parts[0], err)
+		}
+		values[parts[0]] = n
+	}
+	return values
+}
+
+// countInFlight counts the requests being served by next, except for /metrics which reports the count.
+func countInFlight(next http.Handler, inFlight *atomic.Int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/metrics" {
+			inFlight.Add(1)
+			defer inFlight.Add(-1)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type errorResponse struct {
+	Error       string   `json:"error"`
+	Suggestions []string `json:"suggestions,omitempty"`
+}
+
+// writeError responds with the error of a tokenizer call, with a status code by the class of the error:
+// unknown models are answered with 404 as JSON including the suggested model names, invalid input
+// with 400, unreachable model sources with 503 and anything else with 500.
+func writeError(w http.ResponseWriter, msg string, err error) {
+	var unknown *ollamatokenizer.UnknownModelError
+	if errors.As(err, &unknown) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(errorResponse{Error: msg + ": " + err.Error(), Suggestions: unknown.Suggestions})
+		return
+	}
+	http.Error(w, msg+": "+err.Error(), errorStatus(err))
+}
+
+// errorStatus returns the HTTP status code for the error of a tokenizer call.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, ollamatokenizer.ErrModelNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ollamatokenizer.ErrInputTooLarge),
+		errors.Is(err, ollamatokenizer.ErrInvalidUTF8),
+		errors.Is(err, ollamatokenizer.ErrInvalidModelName),
+		errors.Is(err, ollamatokenizer.ErrUnknownTokenID):
+		return http.StatusBadRequest
+	case errors.Is(err, ollamatokenizer.ErrBackendUnavailable),
+		errors.Is(err, ollamatokenizer.ErrOfflineMode),
+		errors.Is(err, ollamatokenizer.ErrOverloaded):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ollamatokenizer.ErrRateLimited):
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// validModel rejects a request with an unsafe model name before it reaches the tokenizer or the logs.
+func validModel(w http.ResponseWriter, name string) bool {
+	if ollamatokenizer.ValidModelName(name) {
+		return true
+	}
+	http.Error(w, "invalid model name", http.StatusBadRequest)
+	return false
 }
 
 func main() {
@@ -58,6 +343,15 @@ func main() {
 			}
 		}
 		tokenizerOpts = append(tokenizerOpts, ollamatokenizer.TokenizerWithModelMap(modelMap))
+	} else if include, exclude := listEnv("DEFAULT_MODELS_INCLUDE"), listEnv("DEFAULT_MODELS_EXCLUDE"); include != nil || exclude != nil {
+		// Trim the built-in models, e.g. DEFAULT_MODELS_INCLUDE="tiny,phi-3" (with FALLBACK_MODEL=tiny,
+		// as the default fallback llama-3.1 is no longer registered)
+		tokenizerOpts = append(tokenizerOpts, ollamatokenizer.TokenizerWithDefaultModels(include, exclude))
+	}
+
+	// Cache downloaded models in a directory of its own if specified, e.g. a persistent volume
+	if cacheDir := os.Getenv("CACHE_DIR"); cacheDir != "" {
+		tokenizerOpts = append(tokenizerOpts, ollamatokenizer.TokenizerWithCacheDir(cacheDir))
 	}
 
 	// Add fallback model option if specified
@@ -65,26 +359,117 @@ func main() {
 		tokenizerOpts = append(tokenizerOpts, ollamatokenizer.TokenizerWithFallbackModel(fallbackModel))
 	}
 
-	// Preload models if specified
+	// Use the fallback model for configured models that fail to load, e.g. while their source is down
+	if os.Getenv("LOAD_FAILURE_FALLBACK") == "true" {
+		tokenizerOpts = append(tokenizerOpts, ollamatokenizer.TokenizerWithLoadFailureFallback(true))
+	}
+
+	// Fail with model not found instead of using the fallback model
+	if os.Getenv("STRICT_MODEL_MATCHING") == "true" {
+		tokenizerOpts = append(tokenizerOpts, ollamatokenizer.TokenizerWithStrictModelMatching(true))
+	}
+
+	// Preload models if specified, with PRELOAD_IN_BACKGROUND=true the server listens while they load
+	// and /readyz reports ready once they are loaded.
 	if len(preloadModels) > 0 && preloadModels[0] != "" {
-		tokenizerOpts = append(tokenizerOpts, ollamatokenizer.TokenizerWithPreloadedModels(preloadModels...))
+		if os.Getenv("PRELOAD_IN_BACKGROUND") == "true" {
+			tokenizerOpts = append(tokenizerOpts, ollamatokenizer.TokenizerWithBackgroundPreload(preloadModels...))
+		} else {
+			tokenizerOpts = append(tokenizerOpts, ollamatokenizer.TokenizerWithPreloadedModels(preloadModels...))
+		}
 	}
 
+	// Retry model downloads failing with network or 5xx errors if specified, e.g. RETRY_ATTEMPTS=3
+	// with RETRY_BASE_DELAY (default 1s) doubling per retry
+	if v := os.Getenv("RETRY_ATTEMPTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("Invalid RETRY_ATTEMPTS: %v", err)
+		}
+		tokenizerOpts = append(tokenizerOpts, ollamatokenizer.TokenizerWithRetry(n, durationEnv("RETRY_BASE_DELAY", time.Second)))
+	}
+
+	// Change how many models are preloaded at the same time if specified, e.g. PRELOAD_CONCURRENCY=4
+	if v := os.Getenv("PRELOAD_CONCURRENCY"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("Invalid PRELOAD_CONCURRENCY: %v", err)
+		}
+		tokenizerOpts = append(tokenizerOpts, ollamatokenizer.TokenizerWithPreloadConcurrency(n))
+	}
+
+	// Register context windows if specified, e.g. CONTEXT_WINDOWS="tiny=2048,llama-3.1=131072"
+	if windows := modelIntsEnv("CONTEXT_WINDOWS"); windows != nil {
+		tokenizerOpts = append(tokenizerOpts, ollamatokenizer.TokenizerWithContextWindows(windows))
+	}
+
+	// Cap the tokens produced per second if specified, e.g. MAX_TOKENS_PER_SECOND=200000
+	if v := os.Getenv("MAX_TOKENS_PER_SECOND"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("Invalid MAX_TOKENS_PER_SECOND: %v", err)
+		}
+		tokenizerOpts = append(tokenizerOpts, ollamatokenizer.TokenizerWithMaxTokensPerSecond(n))
+	}
+
+	// Change the maximum input size of /tokenize if specified, 0 means unlimited, e.g. MAX_INPUT_BYTES=1048576
+	if v := os.Getenv("MAX_INPUT_BYTES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("Invalid MAX_INPUT_BYTES: %v", err)
+		}
+		tokenizerOpts = append(tokenizerOpts, ollamatokenizer.TokenizerWithMaxInputBytes(n))
+	}
+
+	// Limit concurrent calls across all models if specified, e.g. MAX_CONCURRENCY=64
+	if v := os.Getenv("MAX_CONCURRENCY"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("Invalid MAX_CONCURRENCY: %v", err)
+		}
+		tokenizerOpts = append(tokenizerOpts, ollamatokenizer.TokenizerWithMaxConcurrency(n))
+	}
+
+	// With FAIL_FAST=true calls beyond MAX_CONCURRENCY fail with 503 and calls beyond
+	// MAX_TOKENS_PER_SECOND with 429 instead of waiting
+	tokenizerOpts = append(tokenizerOpts, ollamatokenizer.TokenizerWithFailFast(os.Getenv("FAIL_FAST") == "true"))
+
+	// Limit concurrent calls per model if specified, e.g. MODEL_CONCURRENCY="tiny=4,phi-3=2"
+	if limits := modelIntsEnv("MODEL_CONCURRENCY"); limits != nil {
+		tokenizerOpts = append(tokenizerOpts, ollamatokenizer.TokenizerWithPerModelConcurrency(limits))
+	}
+
+	// Collect the calls for /metrics
+	calls := newCallMetrics()
+	tokenizerOpts = append(tokenizerOpts, ollamatokenizer.TokenizerWithMetrics(calls))
+
 	tokenizer, err := ollamatokenizer.NewTokenizer(tokenizerOpts...)
 	if err != nil {
 		log.Fatalf("Failed to init tokenizer: %v", err)
 	}
 
+	readTimeout := durationEnv("READ_TIMEOUT", 30*time.Second)
+	writeTimeout := durationEnv("WRITE_TIMEOUT", 5*time.Minute)
+
 	http.HandleFunc("/tokenize", func(w http.ResponseWriter, r *http.Request) {
 		var req tokenizeRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			http.Error(w, "invalid request", http.StatusBadRequest)
 			return
 		}
+		if !validModel(w, req.Model) {
+			return
+		}
 
-		tokens, err := tokenizer.Tokenize(req.Model, req.Prompt)
+		tokens, err := tokenizer.TokenizeCtx(r.Context(), req.Model, req.Prompt)
 		if err != nil {
-			http.Error(w, "tokenize failed: "+err.Error(), http.StatusInternalServerError)
+			writeError(w, "tokenize failed", err)
+			return
+		}
+		// compact binary response for internal pipelines, decode with ollamatokenizer.DecodeTokensVarint.
+		if strings.Contains(r.Header.Get("Accept"), "application/octet-stream") {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			_, _ = w.Write(ollamatokenizer.EncodeTokensVarint(tokens))
 			return
 		}
 		resp := tokenizeResponse{Tokens: tokens, Count: len(tokens)}
@@ -99,13 +484,318 @@ func main() {
 			http.Error(w, "invalid request", http.StatusBadRequest)
 			return
 		}
+		if !validModel(w, req.Model) {
+			return
+		}
 
-		count, err := tokenizer.CountTokens(req.Model, req.Prompt)
+		res, err := tokenizer.CountTokensDetailedCtx(r.Context(), req.Model, req.Prompt)
 		if err != nil {
-			http.Error(w, "count tokens failed: "+err.Error(), http.StatusInternalServerError)
+			writeError(w, "count tokens failed", err)
 			return
 		}
-		resp := countResponse{Count: count}
+		resp := countResponse{Count: res.Count}
+		if res.UsedFallback {
+			resp.ModelUsed, resp.UsedFallback = res.Model, true
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+
+	// Count many (model, prompt) pairs in one round trip, results are returned in request order.
+	// With ?summary=true the results are wrapped in an object together with aggregated statistics,
+	// &group_by=model additionally aggregates per model.
+	http.HandleFunc("/batch", func(w http.ResponseWriter, r *http.Request) {
+		var items []batchItem
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBodyBytes)).Decode(&items); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+
+		// a fixed pool of workers, so a large batch doesn't start a goroutine per item.
+		results := make([]batchResult, len(items))
+		indexes := make(chan int)
+		var wg sync.WaitGroup
+		for range min(runtime.GOMAXPROCS(0), len(items)) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range indexes {
+					item := items[i]
+					if !ollamatokenizer.ValidModelName(item.Model) {
+						results[i] = batchResult{Error: "invalid model name"}
+						continue
+					}
+					count, err := tokenizer.CountTokensCtx(r.Context(), item.Model, item.Prompt)
+					if err != nil {
+						results[i] = batchResult{Error: err.Error()}
+						continue
+					}
+					results[i] = batchResult{Count: &count}
+				}
+			}()
+		}
+		for i := range items {
+			indexes <- i
+		}
+		close(indexes)
+		wg.Wait()
+
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Get("summary") == "true" {
+			summary := summarize(items, results, r.URL.Query().Get("group_by") == "model")
+			_ = json.NewEncoder(w).Encode(batchSummaryResponse{Results: results, Summary: summary})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(results)
+	})
+
+	// Count an NDJSON stream of batch items, writing one NDJSON result per item in request order.
+	// Every ?progress_every=N items (default 1000, 0 disables) and after the last item a progress
+	// line {"progress":{"done":N,"tokens_so_far":T}} is interleaved, so clients of long jobs can
+	// show progress. The timeouts apply per item instead of to the whole stream.
+	http.HandleFunc("/batch/stream", func(w http.ResponseWriter, r *http.Request) {
+		progressEvery := defaultProgressEvery
+		if v := r.URL.Query().Get("progress_every"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				http.Error(w, "invalid progress_every", http.StatusBadRequest)
+				return
+			}
+			progressEvery = n
+		}
+
+		rc := http.NewResponseController(w)
+		// results are written while the request is still being read.
+		if err := rc.EnableFullDuplex(); err != nil {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+
+		dec := json.NewDecoder(r.Body)
+		enc := json.NewEncoder(w)
+		var progress streamProgress
+		for {
+			_ = rc.SetReadDeadline(time.Now().Add(readTimeout))
+			_ = rc.SetWriteDeadline(time.Now().Add(writeTimeout))
+
+			var item batchItem
+			if err := dec.Decode(&item); err != nil {
+				if !errors.Is(err, io.EOF) {
+					// the status is already sent, report the error in the stream and stop.
+					_ = enc.Encode(batchResult{Error: "invalid request: " + err.Error()})
+				}
+				break
+			}
+
+			result := batchResult{}
+			if !ollamatokenizer.ValidModelName(item.Model) {
+				result.Error = "invalid model name"
+			} else if count, err := tokenizer.CountTokensCtx(r.Context(), item.Model, item.Prompt); err != nil {
+				result.Error = err.Error()
+			} else {
+				result.Count = &count
+				progress.TokensSoFar += count
+			}
+			progress.Done++
+			if err := enc.Encode(result); err != nil {
+				return
+			}
+
+			if progressEvery > 0 && progress.Done%progressEvery == 0 {
+				if err := enc.Encode(streamProgressLine{Progress: progress}); err != nil {
+					return
+				}
+				_ = rc.Flush()
+			}
+		}
+
+		if progressEvery > 0 && progress.Done%progressEvery != 0 {
+			_ = enc.Encode(streamProgressLine{Progress: progress})
+		}
+	})
+
+	// Return every token with its text and source span, e.g. for a tokenizer playground.
+	http.HandleFunc("/pieces", func(w http.ResponseWriter, r *http.Request) {
+		var req piecesRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPiecesBodyBytes)).Decode(&req); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		if !validModel(w, req.Model) {
+			return
+		}
+
+		pieces, err := tokenizer.TokenizePieces(req.Model, req.Prompt)
+		if err != nil {
+			writeError(w, "pieces failed", err)
+			return
+		}
+		resp := make([]pieceResponse, len(pieces))
+		for i, p := range pieces {
+			resp[i] = pieceResponse{ID: p.ID, Piece: p.Piece, Start: p.Start, End: p.End}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+
+	http.HandleFunc("/detokenize", func(w http.ResponseWriter, r *http.Request) {
+		var req detokenizeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		if !validModel(w, req.Model) {
+			return
+		}
+
+		text, err := tokenizer.Detokenize(req.Model, req.Tokens)
+		if err != nil {
+			writeError(w, "detokenize failed", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(detokenizeResponse{Text: text})
+	})
+
+	// Report which tokenizer model is used for a model name, so clients can detect misconfiguration early.
+	http.HandleFunc("/resolve", func(w http.ResponseWriter, r *http.Request) {
+		var req resolveRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		if !validModel(w, req.Model) {
+			return
+		}
+
+		resolution, err := tokenizer.ResolveModel(req.Model)
+		if err != nil {
+			writeError(w, "resolve failed", err)
+			return
+		}
+		resp := resolveResponse{
+			Resolved:     resolution.Resolved,
+			Exact:        resolution.Exact,
+			FallbackUsed: resolution.FallbackUsed,
+			Ambiguous:    resolution.Ambiguous,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+
+	// Debug endpoint showing the resolution chain of a model name: alias resolution, the load
+	// attempts including fallbacks with their outcome and timing, and the model finally used.
+	http.HandleFunc("/explain", func(w http.ResponseWriter, r *http.Request) {
+		var req explainRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		if !validModel(w, req.Model) {
+			return
+		}
+
+		explanation, err := tokenizer.ExplainModel(req.Model)
+		if err != nil {
+			writeError(w, "explain failed", err)
+			return
+		}
+		resp := explainResponse{
+			Requested: explanation.Requested,
+			Resolution: resolveResponse{
+				Resolved:     explanation.Resolution.Resolved,
+				Exact:        explanation.Resolution.Exact,
+				FallbackUsed: explanation.Resolution.FallbackUsed,
+			},
+			Attempts: make([]explainAttempt, len(explanation.Attempts)),
+			Used:     explanation.Used,
+		}
+		for i, a := range explanation.Attempts {
+			resp.Attempts[i] = explainAttempt{
+				Model:      a.Model,
+				Fallback:   a.Fallback,
+				Loaded:     a.Err == nil,
+				DurationMS: float64(a.Duration.Microseconds()) / 1000,
+			}
+			if a.Err != nil {
+				resp.Attempts[i].Error = a.Err.Error()
+			}
+		}
+		if req.Prompt != "" && explanation.Used != "" {
+			count, err := tokenizer.CountTokens(explanation.Used, req.Prompt)
+			if err != nil {
+				writeError(w, "count tokens failed", err)
+				return
+			}
+			resp.Count = &count
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+
+	// Describe the model a name resolves to, to verify which tokenizer it is and where it came from.
+	http.HandleFunc("/model-info", func(w http.ResponseWriter, r *http.Request) {
+		var req modelInfoRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		if !validModel(w, req.Model) {
+			return
+		}
+
+		info, err := tokenizer.ModelInfo(req.Model)
+		if err != nil {
+			writeError(w, "model info failed", err)
+			return
+		}
+		resp := modelInfoResponse{
+			Requested:     info.Requested,
+			Model:         info.Model,
+			FallbackUsed:  info.FallbackUsed,
+			Architecture:  info.Architecture,
+			Name:          info.Name,
+			TokenizerType: info.TokenizerType,
+			VocabSize:     info.VocabSize,
+			URL:           info.URL,
+			Source:        string(info.Source),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+
+	http.HandleFunc("/validate", func(w http.ResponseWriter, r *http.Request) {
+		var req validateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		if !validModel(w, req.Model) {
+			return
+		}
+
+		limit := req.MaxTokens
+		if limit <= 0 {
+			window, ok := tokenizer.ContextWindow(req.Model)
+			if !ok {
+				http.Error(w, "no max_tokens given and no known context window for model "+req.Model, http.StatusBadRequest)
+				return
+			}
+			limit = window
+		}
+
+		fits, count, err := tokenizer.FitsWithin(req.Model, req.Prompt, limit)
+		if err != nil {
+			writeError(w, "validate failed", err)
+			return
+		}
+		resp := validateResponse{Fits: fits, Count: count, Limit: limit}
 		w.Header().Set("Content-Type", "application/json")
 		_ = json.NewEncoder(w).Encode(resp)
 	})
@@ -115,8 +805,179 @@ func main() {
 		_, _ = w.Write([]byte("ok"))
 	})
 
-	log.Println("Tokenizer HTTP server listening on ", addr)
-	if err := http.ListenAndServe(addr, nil); err != nil {
+	// Tokenizer playground: POST a gguf file to register it as an ephemeral model for UPLOAD_TTL
+	// (default 1h), tokenizer.json files are rejected with 415. Enabled by UPLOAD_TOKEN, which clients
+	// send as "Authorization: Bearer <token>".
+	if uploadToken := os.Getenv("UPLOAD_TOKEN"); uploadToken != "" {
+		dir, err := os.MkdirTemp("", "ollamatokenizer-uploads-")
+		if err != nil {
+			log.Fatalf("Failed to create upload directory: %v", err)
+		}
+		maxBytes := int64(64 << 20)
+		if v := os.Getenv("UPLOAD_MAX_BYTES"); v != "" {
+			maxBytes, err = strconv.ParseInt(v, 10, 64)
+			if err != nil || maxBytes <= 0 {
+				log.Fatalf("Invalid UPLOAD_MAX_BYTES: %q", v)
+			}
+		}
+		http.Handle("/models/upload", &uploads{
+			tokenizer: tokenizer,
+			token:     uploadToken,
+			dir:       dir,
+			ttl:       durationEnv("UPLOAD_TTL", time.Hour),
+			maxBytes:  maxBytes,
+		})
+	}
+
+	// Periodic self-check feeding /readyz and /metrics, enabled by CANARY_INTERVAL (e.g. "30s").
+	// CANARY_MODEL defaults to the fallback model, CANARY_FAILURE_THRESHOLD (default 3) consecutive
+	// failures mark the server not ready.
+	var canaryCheck *canary
+	if interval := durationEnv("CANARY_INTERVAL", 0); interval > 0 {
+		model, err := tokenizer.OptimalTokenizerModel(os.Getenv("CANARY_MODEL"))
+		if err != nil {
+			log.Fatalf("Failed to resolve canary model: %v", err)
+		}
+		threshold := 3
+		if v := os.Getenv("CANARY_FAILURE_THRESHOLD"); v != "" {
+			threshold, err = strconv.Atoi(v)
+			if err != nil || threshold < 1 {
+				log.Fatalf("Invalid CANARY_FAILURE_THRESHOLD: %q", v)
+			}
+		}
+		canaryCheck = &canary{tokenizer: tokenizer, model: model, interval: interval, threshold: threshold}
+	}
+
+	// Models that must be serveable for the server to be ready, READY_MODELS (comma separated)
+	// defaults to the fallback model. STRICT_MODEL_MATCHING disables the fallback, so it must be set then.
+	readyModels := listEnv("READY_MODELS")
+	if readyModels == nil {
+		model, err := tokenizer.OptimalTokenizerModel("")
+		if err != nil {
+			log.Fatalf("Failed to resolve the fallback model, set READY_MODELS: %v", err)
+		}
+		readyModels = []string{model}
+	}
+
+	// Ready if the preloaded models are loaded, each of readyModels tokenizes and the canary (if enabled) passes.
+	// With ?verbose=true the status of each model is reported as JSON.
+	http.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if reason := preloadStatus(tokenizer); reason != "" {
+			if r.URL.Query().Get("verbose") == "true" {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				_ = json.NewEncoder(w).Encode(readinessResponse{Preload: reason})
+				return
+			}
+			http.Error(w, reason, http.StatusServiceUnavailable)
+			return
+		}
+		statuses, ready := checkModels(r.Context(), tokenizer, readyModels)
+		resp := readinessResponse{Models: statuses}
+		if canaryCheck != nil {
+			if canaryReady, reason := canaryCheck.ready(); !canaryReady {
+				ready = false
+				resp.Canary = reason
+			}
+		}
+		resp.Ready = ready
+
+		status := http.StatusOK
+		if !ready {
+			status = http.StatusServiceUnavailable
+		}
+		if r.URL.Query().Get("verbose") == "true" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			_ = json.NewEncoder(w).Encode(resp)
+			return
+		}
+		if !ready {
+			reason := resp.Canary
+			for _, s := range statuses {
+				if !s.Ready {
+					reason = "model " + s.Model + " not ready: " + s.Error
+					break
+				}
+			}
+			http.Error(w, reason, status)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+	})
+
+	var inFlight atomic.Int64
+
+	// Metrics in the Prometheus text format.
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		fmt.Fprintf(w, "# HELP ollamatokenizer_http_in_flight_requests HTTP requests currently being served.\n")
+		fmt.Fprintf(w, "# TYPE ollamatokenizer_http_in_flight_requests gauge\n")
+		fmt.Fprintf(w, "ollamatokenizer_http_in_flight_requests %d\n", inFlight.Load())
+		fmt.Fprintf(w, "# HELP ollamatokenizer_in_flight_calls Tokenizer calls currently using a model.\n")
+		fmt.Fprintf(w, "# TYPE ollamatokenizer_in_flight_calls gauge\n")
+		fmt.Fprintf(w, "ollamatokenizer_in_flight_calls %d\n", tokenizer.InFlight())
+		calls.writeMetrics(w, tokenizer.LoadedModels())
+		if canaryCheck != nil {
+			canaryCheck.writeMetrics(w)
+		}
+	})
+
+	// Timeouts protect against slow clients (e.g. slowloris). The write timeout is generous
+	// since the first request for a model may have to download it.
+	server := &http.Server{
+		Addr:              addr,
+		ReadHeaderTimeout: durationEnv("READ_HEADER_TIMEOUT", 10*time.Second),
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       durationEnv("IDLE_TIMEOUT", 2*time.Minute),
+		Handler:           countInFlight(http.DefaultServeMux, &inFlight),
+	}
+	shutdownTimeout := durationEnv("SHUTDOWN_TIMEOUT", 30*time.Second)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if canaryCheck != nil {
+		go canaryCheck.run(ctx)
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		log.Println("Tokenizer HTTP server listening on ", addr)
+		serveErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
 		log.Fatalf("Server failed: %v", err)
+	case <-ctx.Done():
+	}
+	stop()
+
+	// stop accepting requests and wait for the in-flight ones, logging the drain progress.
+	log.Printf("Shutting down, draining %d requests in flight (timeout %s)", inFlight.Load(), shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-shutdownCtx.Done():
+				return
+			case <-ticker.C:
+				log.Printf("Draining: %d requests in flight", inFlight.Load())
+			}
+		}
+	}()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Fatalf("Shutdown failed with %d requests in flight: %v", inFlight.Load(), err)
+	}
+	// all requests are done, free the models.
+	if err := tokenizer.Close(); err != nil {
+		log.Printf("Failed to close tokenizer: %v", err)
 	}
+	log.Println("Server stopped")
 }
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSummarize(t *testing.T) {
+	count := func(n int) batchResult { return batchResult{Count: &n} }
+	failed := batchResult{Error: "failed"}
+
+	tests := []struct {
+		name         string
+		items        []batchItem
+		results      []batchResult
+		groupByModel bool
+		want         *batchSummary
+	}{
+		{
+			name: "empty",
+			want: &batchSummary{},
+		},
+		{
+			name:    "only errors",
+			items:   []batchItem{{Model: "tiny"}, {Model: "phi-3"}},
+			results: []batchResult{failed, failed},
+			want:    &batchSummary{Items: 2, Errors: 2},
+		},
+		{
+			name:    "errors don't count towards the statistics",
+			items:   []batchItem{{Model: "tiny"}, {Model: "tiny"}, {Model: "tiny"}, {Model: "tiny"}},
+			results: []batchResult{failed, count(4), failed, count(2)},
+			want:    &batchSummary{Items: 4, Errors: 2, TotalTokens: 6, Min: 2, Max: 4, Avg: 3},
+		},
+		{
+			name:    "a zero count is the minimum",
+			items:   []batchItem{{Model: "tiny"}, {Model: "tiny"}},
+			results: []batchResult{count(5), count(0)},
+			want:    &batchSummary{Items: 2, TotalTokens: 5, Min: 0, Max: 5, Avg: 2.5},
+		},
+		{
+			name:         "grouped by model",
+			items:        []batchItem{{Model: "tiny"}, {Model: "phi-3"}, {Model: "tiny"}, {Model: "phi-3"}, {Model: "invalid"}},
+			results:      []batchResult{count(3), failed, count(7), count(10), failed},
+			groupByModel: true,
+			want: &batchSummary{
+				Items: 5, Errors: 2, TotalTokens: 20, Min: 3, Max: 10, Avg: 20.0 / 3,
+				ByModel: map[string]*batchSummary{
+					"tiny":    {Items: 2, TotalTokens: 10, Min: 3, Max: 7, Avg: 5},
+					"phi-3":   {Items: 2, Errors: 1, TotalTokens: 10, Min: 10, Max: 10, Avg: 10},
+					"invalid": {Items: 1, Errors: 1},
+				},
+			},
+		},
+		{
+			name:         "grouped without results",
+			groupByModel: true,
+			want:         &batchSummary{ByModel: map[string]*batchSummary{}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, summarize(tt.items, tt.results, tt.groupByModel))
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/contenox/ollamatokenizer"
+)
+
+// latencyBuckets are the upper bounds in seconds of the call latency histogram.
+var latencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// callLabels are the labels of the call metrics.
+type callLabels struct {
+	operation string
+	model     string
+	fallback  bool
+}
+
+func (l callLabels) String() string {
+	return fmt.Sprintf("operation=%q,model=%q,fallback=%q", l.operation, l.model, strconv.FormatBool(l.fallback))
+}
+
+// callSeries are the metrics of the calls with the same labels.
+type callSeries struct {
+	calls   int64
+	errors  int64
+	tokens  int64
+	buckets []int64 // cumulative counts per latency bucket
+	sum     float64
+}
+
+// callMetrics collects the tokenizer calls for /metrics in the Prometheus text format.
+type callMetrics struct {
+	mu     sync.Mutex
+	series map[callLabels]*callSeries
+	// retries counts the download retries by model.
+	retries map[string]int64
+}
+
+func newCallMetrics() *callMetrics {
+	return &callMetrics{series: make(map[callLabels]*callSeries), retries: make(map[string]int64)}
+}
+
+// ObserveRetry implements ollamatokenizer.RetryCollector.
+func (m *callMetrics) ObserveRetry(retry ollamatokenizer.RetryMetrics) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.retries[retry.Model]++
+}
+
+// ObserveCall implements ollamatokenizer.MetricsCollector.
+func (m *callMetrics) ObserveCall(call ollamatokenizer.CallMetrics) {
+	model := call.Model
+	// names that aren't configured come from clients, labeling by them would grow the metrics unboundedly.
+	if errors.Is(call.Err, ollamatokenizer.ErrModelNotFound) || errors.Is(call.Err, ollamatokenizer.ErrInvalidModelName) {
+		model = "unknown"
+	}
+	labels := callLabels{operation: call.Operation, model: model, fallback: call.FallbackUsed}
+	seconds := call.Duration.Seconds()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.series[labels]
+	if !ok {
+		s = &callSeries{buckets: make([]int64, len(latencyBuckets))}
+		m.series[labels] = s
+	}
+	s.calls++
+	if call.Err != nil {
+		s.errors++
+	}
+	s.tokens += int64(call.Tokens)
+	s.sum += seconds
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			s.buckets[i]++
+		}
+	}
+}
+
+// writeMetrics writes the call metrics and the loaded models in the Prometheus text format.
+func (m *callMetrics) writeMetrics(w io.Writer, loadedModels []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	labels := make([]callLabels, 0, len(m.series))
+	for l := range m.series {
+		labels = append(labels, l)
+	}
+	slices.SortFunc(labels, func(a, b callLabels) int {
+		if c := cmp.Compare(a.operation, b.operation); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(a.model, b.model); c != 0 {
+			return c
+		}
+		return cmp.Compare(strconv.FormatBool(a.fallback), strconv.FormatBool(b.fallback))
+	})
+
+	fmt.Fprintf(w, "# HELP ollamatokenizer_calls_total Tokenize and count calls.\n")
+	fmt.Fprintf(w, "# TYPE ollamatokenizer_calls_total counter\n")
+	for _, l := range labels {
+		fmt.Fprintf(w, "ollamatokenizer_calls_total{%s} %d\n", l, m.series[l].calls)
+	}
+	fmt.Fprintf(w, "# HELP ollamatokenizer_call_errors_total Failed tokenize and count calls.\n")
+	fmt.Fprintf(w, "# TYPE ollamatokenizer_call_errors_total counter\n")
+	for _, l := range labels {
+		fmt.Fprintf(w, "ollamatokenizer_call_errors_total{%s} %d\n", l, m.series[l].errors)
+	}
+	fmt.Fprintf(w, "# HELP ollamatokenizer_tokens_total Tokens produced by tokenize and count calls.\n")
+	fmt.Fprintf(w, "# TYPE ollamatokenizer_tokens_total counter\n")
+	for _, l := range labels {
+		fmt.Fprintf(w, "ollamatokenizer_tokens_total{%s} %d\n", l, m.series[l].tokens)
+	}
+	fmt.Fprintf(w, "# HELP ollamatokenizer_call_duration_seconds Latency of tokenize and count calls.\n")
+	fmt.Fprintf(w, "# TYPE ollamatokenizer_call_duration_seconds histogram\n")
+	for _, l := range labels {
+		s := m.series[l]
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(w, "ollamatokenizer_call_duration_seconds_bucket{%s,le=%q} %d\n", l, strconv.FormatFloat(bound, 'g', -1, 64), s.buckets[i])
+		}
+		fmt.Fprintf(w, "ollamatokenizer_call_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", l, s.calls)
+		fmt.Fprintf(w, "ollamatokenizer_call_duration_seconds_sum{%s} %g\n", l, s.sum)
+		fmt.Fprintf(w, "ollamatokenizer_call_duration_seconds_count{%s} %d\n", l, s.calls)
+	}
+
+	fmt.Fprintf(w, "# HELP ollamatokenizer_download_retries_total Retries of failed model downloads.\n")
+	fmt.Fprintf(w, "# TYPE ollamatokenizer_download_retries_total counter\n")
+	for _, model := range slices.Sorted(maps.Keys(m.retries)) {
+		fmt.Fprintf(w, "ollamatokenizer_download_retries_total{model=%q} %d\n", model, m.retries[model])
+	}
+
+	fmt.Fprintf(w, "# HELP ollamatokenizer_loaded_models Models resident in memory.\n")
+	fmt.Fprintf(w, "# TYPE ollamatokenizer_loaded_models gauge\n")
+	fmt.Fprintf(w, "ollamatokenizer_loaded_models %d\n", len(loadedModels))
+	fmt.Fprintf(w, "# HELP ollamatokenizer_model_loaded Whether the model is resident in memory.\n")
+	fmt.Fprintf(w, "# TYPE ollamatokenizer_model_loaded gauge\n")
+	for _, model := range loadedModels {
+		fmt.Fprintf(w, "ollamatokenizer_model_loaded{model=%q} 1\n", model)
+	}
+}
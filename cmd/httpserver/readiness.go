@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/contenox/ollamatokenizer"
+)
+
+// readinessText is tokenized to check that a model is serveable.
+const readinessText = "ready"
+
+type modelStatus struct {
+	Model string `json:"model"`
+	Ready bool   `json:"ready"`
+	Error string `json:"error,omitempty"`
+}
+
+type readinessResponse struct {
+	Ready bool `json:"ready"`
+	// Preload is the reason the background preload marks the server not ready, if it does.
+	Preload string `json:"preload,omitempty"`
+	// Canary is the reason the canary check marks the server not ready, if it does.
+	Canary string        `json:"canary,omitempty"`
+	Models []modelStatus `json:"models"`
+}
+
+// checkModels tokenizes readinessText with each model, loading it if needed, and reports whether all
+// of them are serveable. Only the given models are checked, so readiness never downloads the whole model map.
+// The calls are strict, so a load failure fallback can't answer for a broken model.
+// Once ctx is done, e.g. when the probe gives up, the remaining models are reported with the error of ctx.
+func checkModels(ctx context.Context, tokenizer ollamatokenizer.Tokenizer, models []string) ([]modelStatus, bool) {
+	statuses := make([]modelStatus, len(models))
+	ready := true
+	for i, model := range models {
+		statuses[i] = modelStatus{Model: model, Ready: true}
+		if _, err := tokenizer.TokenizeStrictCtx(ctx, model, readinessText); err != nil {
+			statuses[i] = modelStatus{Model: model, Error: err.Error()}
+			ready = false
+		}
+	}
+	return statuses, ready
+}
+
+// preloadStatus returns why the background preload keeps the server from being ready, or "" if it doesn't.
+// A failed preload keeps the server not ready for good, it is reported instead of waiting for it.
+func preloadStatus(tokenizer ollamatokenizer.Tokenizer) string {
+	if tokenizer.Ready() {
+		return ""
+	}
+	// a done context makes WaitReady report the state without waiting.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := tokenizer.WaitReady(ctx)
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "preloading models"
+	case err != nil:
+		return err.Error()
+	}
+	return ""
+}
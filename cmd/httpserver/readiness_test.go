@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/contenox/ollamatokenizer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckModels(t *testing.T) {
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(&http.Client{Timeout: 30 * time.Second}),
+		ollamatokenizer.TokenizerWithCustomModels(map[string]string{"broken": "http://127.0.0.1:1/model.gguf"}),
+		ollamatokenizer.TokenizerWithFallbackModel("tiny"),
+		ollamatokenizer.TokenizerWithLoadFailureFallback(true),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+	defer tokenizer.Close()
+
+	statuses, ready := checkModels(context.Background(), tokenizer, []string{"tiny"})
+	require.True(t, ready)
+	require.Equal(t, []modelStatus{{Model: "tiny", Ready: true}}, statuses)
+
+	// the fallback model answering doesn't make a broken model ready.
+	statuses, ready = checkModels(context.Background(), tokenizer, []string{"tiny", "broken"})
+	require.False(t, ready)
+	require.True(t, statuses[0].Ready)
+	require.False(t, statuses[1].Ready)
+	require.NotEmpty(t, statuses[1].Error)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, ready = checkModels(ctx, tokenizer, []string{"tiny"})
+	require.False(t, ready, "a done context should fail the check")
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/contenox/ollamatokenizer"
+	"github.com/ollama/ollama/fs/ggml"
+)
+
+// uploads registers uploaded gguf files as ephemeral models, removed again after ttl.
+type uploads struct {
+	tokenizer ollamatokenizer.Tokenizer
+	token     string
+	dir       string
+	ttl       time.Duration
+	maxBytes  int64
+}
+
+type uploadResponse struct {
+	Model     string    `json:"model"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// ServeHTTP handles POST /models/upload with the gguf file as the body.
+func (u *uploads) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(auth), []byte(u.token)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, u.maxBytes))
+	if err != nil {
+		http.Error(w, "invalid upload: "+err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err := validateGGUF(data); err != nil {
+		http.Error(w, "invalid upload: "+err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	suffix := make([]byte, 8)
+	_, _ = rand.Read(suffix)
+	name := "upload-" + hex.EncodeToString(suffix)
+	path := filepath.Join(u.dir, name+".gguf")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		http.Error(w, "failed to store upload: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := u.tokenizer.AddModel(name, "file://"+path); err != nil {
+		os.Remove(path)
+		http.Error(w, "failed to register upload: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// load it now, so a file the backend can't use is rejected right away. The call is strict, so a
+	// load failure fallback can't answer in place of the upload.
+	if _, err := u.tokenizer.TokenizeStrict(name, ""); err != nil {
+		u.remove(name, path)
+		http.Error(w, "invalid upload: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	expiresAt := time.Now().Add(u.ttl)
+	time.AfterFunc(u.ttl, func() { u.remove(name, path) })
+	log.Printf("Registered uploaded model %s (%d bytes) until %s", name, len(data), expiresAt.Format(time.RFC3339))
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(uploadResponse{Model: name, ExpiresAt: expiresAt})
+}
+
+func (u *uploads) remove(name, path string) {
+	if err := u.tokenizer.RemoveModel(name); err != nil {
+		log.Printf("Failed to remove uploaded model %s: %v", name, err)
+	}
+	os.Remove(path)
+}
+
+// errTokenizerJSON rejects Hugging Face tokenizer.json uploads, the llama.cpp backend only loads gguf files.
+var errTokenizerJSON = errors.New("tokenizer.json files are not supported, convert the tokenizer to gguf " +
+	"(e.g. with convert_hf_to_gguf.py --vocab-only from llama.cpp) and upload that")
+
+// validateGGUF checks the upload in Go before it reaches llama.cpp, which aborts the process
+// on some malformed vocabularies (e.g. duplicate tokens) instead of returning an error.
+// Only gguf files are supported, Hugging Face tokenizer.json files fail with errTokenizerJSON.
+func validateGGUF(data []byte) error {
+	if !bytes.HasPrefix(data, []byte("GGUF")) {
+		if trimmed := bytes.TrimSpace(data); bytes.HasPrefix(trimmed, []byte("{")) && json.Valid(trimmed) {
+			return errTokenizerJSON
+		}
+		return errors.New("not a gguf file, only gguf files are supported")
+	}
+	f, _, err := ggml.Decode(bytes.NewReader(data), -1)
+	if err != nil {
+		return fmt.Errorf("failed to parse gguf: %w", err)
+	}
+	kv := f.KV()
+	if _, ok := kv["tokenizer.ggml.tokens"]; !ok {
+		return errors.New("gguf file has no vocabulary")
+	}
+	tokens := kv.Strings("tokenizer.ggml.tokens")
+	seen := make(map[string]struct{}, len(tokens))
+	for id, token := range tokens {
+		if _, dup := seen[token]; dup {
+			return fmt.Errorf("duplicate token %q at id %d", token, id)
+		}
+		seen[token] = struct{}{}
+	}
+	return nil
+}
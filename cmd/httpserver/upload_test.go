@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/contenox/ollamatokenizer"
+	"github.com/ollama/ollama/fs/ggml"
+	"github.com/stretchr/testify/require"
+)
+
+// writeGGUF returns a gguf file with the given vocabulary and no tensors.
+func writeGGUF(t *testing.T, tokens []string) []byte {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "vocab.gguf")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	kv := ggml.KV{
+		"general.architecture":  "llama",
+		"tokenizer.ggml.model":  "gpt2",
+		"tokenizer.ggml.tokens": tokens,
+	}
+	require.NoError(t, ggml.WriteGGUF(f, kv, nil))
+	require.NoError(t, f.Close())
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return data
+}
+
+func TestValidateGGUF(t *testing.T) {
+	require.NoError(t, validateGGUF(writeGGUF(t, []string{"a", "b", "ab"})))
+	require.ErrorContains(t, validateGGUF(writeGGUF(t, []string{"a", "b", "a"})), `duplicate token "a" at id 2`)
+	require.ErrorIs(t, validateGGUF([]byte(` {"model":{"type":"BPE"}}`)), errTokenizerJSON)
+	require.ErrorContains(t, validateGGUF([]byte("plain text")), "not a gguf file")
+	require.ErrorContains(t, validateGGUF([]byte("GGUF")), "failed to parse gguf")
+}
+
+func TestUploads(t *testing.T) {
+	home, err := os.UserHomeDir()
+	require.NoError(t, err)
+	tiny, err := os.ReadFile(filepath.Join(home, ".libollama", "models", "tiny", "model.gguf"))
+	require.NoError(t, err)
+
+	// the load failure fallback must not let a broken upload through.
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(&http.Client{Timeout: 30 * time.Second}),
+		ollamatokenizer.TokenizerWithFallbackModel("tiny"),
+		ollamatokenizer.TokenizerWithLoadFailureFallback(true),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+	defer tokenizer.Close()
+	u := &uploads{
+		tokenizer: tokenizer,
+		token:     "secret",
+		dir:       t.TempDir(),
+		ttl:       200 * time.Millisecond,
+		maxBytes:  int64(len(tiny)),
+	}
+
+	upload := func(token string, body []byte) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/models/upload", bytes.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		u.ServeHTTP(w, r)
+		return w
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		body   []byte
+		status int
+	}{
+		{name: "no token", body: tiny, status: http.StatusUnauthorized},
+		{name: "wrong token", token: "guess", body: tiny, status: http.StatusUnauthorized},
+		{name: "tokenizer.json", token: "secret", body: []byte(`{"model":{"type":"BPE"}}`), status: http.StatusUnsupportedMediaType},
+		{name: "not gguf", token: "secret", body: []byte("plain text"), status: http.StatusUnsupportedMediaType},
+		{name: "duplicate tokens", token: "secret", body: writeGGUF(t, []string{"a", "b", "a"}), status: http.StatusUnsupportedMediaType},
+		{name: "too large", token: "secret", body: append(bytes.Clone(tiny), 0), status: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := upload(tt.token, tt.body)
+			require.Equal(t, tt.status, w.Code, w.Body.String())
+		})
+	}
+	w := upload("secret", []byte(`{"model":{"type":"BPE"}}`))
+	require.Contains(t, w.Body.String(), "tokenizer.json files are not supported")
+
+	// a valid gguf file the backend can't load, a BPE vocabulary without merges, is rejected.
+	before := tokenizer.AvailableModels()
+	w = upload("secret", writeGGUF(t, []string{"a", "b", "ab"}))
+	require.Equal(t, http.StatusUnprocessableEntity, w.Code, w.Body.String())
+	require.Equal(t, before, tokenizer.AvailableModels(), "the broken upload should be removed")
+
+	entries, err := os.ReadDir(u.dir)
+	require.NoError(t, err)
+	require.Empty(t, entries, "rejected uploads should not be stored")
+
+	w = httptest.NewRecorder()
+	u.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/models/upload", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	// an accepted upload is served until the ttl expires, then it is removed again.
+	w = upload("secret", tiny)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp uploadResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	require.Contains(t, tokenizer.AvailableModels(), resp.Model)
+	want, err := tokenizer.CountTokens("tiny", "Hello world!")
+	require.NoError(t, err)
+	count, err := tokenizer.CountTokens(resp.Model, "Hello world!")
+	require.NoError(t, err)
+	require.Equal(t, want, count)
+
+	require.Eventually(t, func() bool {
+		_, err := tokenizer.CountTokens(resp.Model, "Hello world!")
+		return err != nil
+	}, 5*time.Second, 20*time.Millisecond, "the upload should expire")
+	require.NotContains(t, tokenizer.AvailableModels(), resp.Model)
+	require.NoFileExists(t, filepath.Join(u.dir, resp.Model+".gguf"))
+}
@@ -0,0 +1,520 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/contenox/ollamatokenizer"
+)
+
+const usage = `Usage: tokenize <command> [flags]
+
+Commands:
+  tokens     tokenize a file (or stdin) and print the token IDs, the count or the pieces
+  count      count the tokens of files (or stdin) and print them as JSON, CSV or TSV
+  selftest   load a model, tokenize a known string and verify the result is stable
+  bench      measure the tokenization throughput and latency of a model
+  cache      show (cache info) or prune (cache prune) the models cached on disk
+
+The model map, fallback and model cache are configured via the same environment variables as the HTTP server:
+TOKENIZER_MODELS, USE_DEFAULT_URLS, FALLBACK_MODEL, LOAD_FAILURE_FALLBACK and CACHE_DIR.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "tokens":
+		stdout := os.Stdout
+		os.Stdout = os.Stderr
+		err = tokens(os.Args[2:], os.Stdin, stdout)
+	case "count":
+		// the library logs model loading to stdout, move that to stderr to keep the output parseable.
+		stdout := os.Stdout
+		os.Stdout = os.Stderr
+		err = count(os.Args[2:], os.Stdin, stdout)
+	case "selftest":
+		err = selftest(os.Args[2:])
+	case "bench":
+		err = bench(os.Args[2:])
+	case "cache":
+		err = cache(os.Args[2:])
+	case "-h", "-help", "--help", "help":
+		fmt.Print(usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// newTokenizer creates a tokenizer configured from the environment like cmd/httpserver.
+func newTokenizer(extra ...ollamatokenizer.TokenizerOption) (ollamatokenizer.Tokenizer, error) {
+	var tokenizerOpts []ollamatokenizer.TokenizerOption
+
+	// Only use custom models if USE_DEFAULT_URLS is not "true"
+	if os.Getenv("USE_DEFAULT_URLS") != "true" {
+		modelMap := make(map[string]string)
+		for _, kv := range strings.Split(os.Getenv("TOKENIZER_MODELS"), ",") {
+			parts := strings.SplitN(kv, "=", 2)
+			if len(parts) == 2 {
+				modelMap[parts[0]] = parts[1]
+			}
+		}
+		tokenizerOpts = append(tokenizerOpts, ollamatokenizer.TokenizerWithModelMap(modelMap))
+	}
+
+	if fallbackModel := os.Getenv("FALLBACK_MODEL"); fallbackModel != "" {
+		tokenizerOpts = append(tokenizerOpts, ollamatokenizer.TokenizerWithFallbackModel(fallbackModel))
+	}
+	if os.Getenv("LOAD_FAILURE_FALLBACK") == "true" {
+		tokenizerOpts = append(tokenizerOpts, ollamatokenizer.TokenizerWithLoadFailureFallback(true))
+	}
+	if cacheDir := os.Getenv("CACHE_DIR"); cacheDir != "" {
+		tokenizerOpts = append(tokenizerOpts, ollamatokenizer.TokenizerWithCacheDir(cacheDir))
+	}
+
+	return ollamatokenizer.NewTokenizer(append(tokenizerOpts, extra...)...)
+}
+
+// selfTestText is tokenized by the selftest. It mixes ASCII, punctuation and multibyte characters.
+const selfTestText = "The quick brown fox jumps over the lazy dog. Größe, 東京, 🚀!"
+
+func selftest(args []string) error {
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	model := fs.String("model", "", "model to test (default: the fallback model)")
+	runs := fs.Int("runs", 3, "number of times the text is tokenized to verify the count is stable")
+	expect := fs.Int("expect", 0, "expected token count, verified if set")
+	_ = fs.Parse(args)
+
+	if *runs < 1 {
+		return fmt.Errorf("runs must be at least 1")
+	}
+
+	tokenizer, err := newTokenizer()
+	if err != nil {
+		return fmt.Errorf("failed to init tokenizer: %w", err)
+	}
+
+	// an empty name resolves to the fallback model
+	resolved, err := tokenizer.OptimalTokenizerModel(*model)
+	if err != nil {
+		return fmt.Errorf("failed to resolve model %q: %w", *model, err)
+	}
+	fmt.Printf("selftest: using model %s\n", resolved)
+
+	tokens, err := tokenizer.Tokenize(resolved, selfTestText)
+	if err != nil {
+		return fmt.Errorf("selftest failed: tokenize: %w", err)
+	}
+	if len(tokens) == 0 {
+		return fmt.Errorf("selftest failed: no tokens for non-empty input")
+	}
+
+	for i := range *runs {
+		count, err := tokenizer.CountTokens(resolved, selfTestText)
+		if err != nil {
+			return fmt.Errorf("selftest failed: count tokens (run %d): %w", i+1, err)
+		}
+		if count != len(tokens) {
+			return fmt.Errorf("selftest failed: unstable count in run %d: got %d, want %d", i+1, count, len(tokens))
+		}
+	}
+
+	if *expect > 0 && len(tokens) != *expect {
+		return fmt.Errorf("selftest failed: got %d tokens, expected %d", len(tokens), *expect)
+	}
+
+	fmt.Printf("selftest: ok (%d tokens, stable over %d runs)\n", len(tokens), *runs)
+	return nil
+}
+
+func cache(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing cache command, one of: info, prune")
+	}
+	tokenizer, err := newTokenizer()
+	if err != nil {
+		return fmt.Errorf("failed to init tokenizer: %w", err)
+	}
+
+	switch args[0] {
+	case "info":
+		entries, totalBytes, err := tokenizer.CacheStats()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("cache: %d models, %d bytes\n", entries, totalBytes)
+		return nil
+	case "prune":
+		fs := flag.NewFlagSet("cache prune", flag.ExitOnError)
+		maxAge := fs.Duration("max-age", 0, "remove models not loaded within this duration (0: no limit)")
+		maxBytes := fs.Int64("max-bytes", 0, "remove the least recently loaded models until the cache holds at most this many bytes (0: no limit)")
+		_ = fs.Parse(args[1:])
+		if *maxAge == 0 && *maxBytes == 0 {
+			return fmt.Errorf("set -max-age and/or -max-bytes")
+		}
+
+		removed, freed, err := tokenizer.PruneCache(ollamatokenizer.CachePrunePolicy{MaxAge: *maxAge, MaxBytes: *maxBytes})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("cache: removed %d models, freed %d bytes\n", removed, freed)
+		return nil
+	default:
+		return fmt.Errorf("unknown cache command %q, one of: info, prune", args[0])
+	}
+}
+
+func bench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	model := fs.String("model", "", "model to benchmark (default: the fallback model)")
+	duration := fs.Duration("duration", 5*time.Second, "how long to run the benchmark")
+	concurrency := fs.Int("concurrency", runtime.GOMAXPROCS(0), "number of concurrent workers")
+	size := fs.Int("bytes", 1024, "size of the prompt in bytes")
+	_ = fs.Parse(args)
+
+	if *duration <= 0 {
+		return fmt.Errorf("duration must be positive")
+	}
+	if *concurrency < 1 {
+		return fmt.Errorf("concurrency must be at least 1")
+	}
+	if *size < 1 {
+		return fmt.Errorf("bytes must be at least 1")
+	}
+
+	tokenizer, err := newTokenizer()
+	if err != nil {
+		return fmt.Errorf("failed to init tokenizer: %w", err)
+	}
+	resolved, err := tokenizer.OptimalTokenizerModel(*model)
+	if err != nil {
+		return fmt.Errorf("failed to resolve model %q: %w", *model, err)
+	}
+
+	prompt := benchPrompt(*size)
+	// warm up, so loading the model isn't measured.
+	if _, err := tokenizer.CountTokens(resolved, prompt); err != nil {
+		return fmt.Errorf("bench failed: %w", err)
+	}
+	fmt.Printf("bench: model %s, %d byte prompt, %d workers, %s\n", resolved, len(prompt), *concurrency, *duration)
+
+	var (
+		mu        sync.Mutex
+		latencies []time.Duration
+		tokens    int
+		benchErr  error
+		wg        sync.WaitGroup
+	)
+	deadline := time.Now().Add(*duration)
+	start := time.Now()
+	for range *concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var local []time.Duration
+			localTokens := 0
+			for time.Now().Before(deadline) {
+				t := time.Now()
+				count, err := tokenizer.CountTokens(resolved, prompt)
+				if err != nil {
+					mu.Lock()
+					benchErr = err
+					mu.Unlock()
+					return
+				}
+				local = append(local, time.Since(t))
+				localTokens += count
+			}
+			mu.Lock()
+			latencies = append(latencies, local...)
+			tokens += localTokens
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	if benchErr != nil {
+		return fmt.Errorf("bench failed: %w", benchErr)
+	}
+	if len(latencies) == 0 {
+		return fmt.Errorf("bench failed: no requests completed within %s", *duration)
+	}
+
+	slices.Sort(latencies)
+	fmt.Printf("bench: %d requests, %.0f requests/sec, %.0f tokens/sec\n",
+		len(latencies), float64(len(latencies))/elapsed.Seconds(), float64(tokens)/elapsed.Seconds())
+	fmt.Printf("bench: latency p50 %s, p90 %s, p99 %s, max %s\n",
+		percentile(latencies, 50), percentile(latencies, 90), percentile(latencies, 99), latencies[len(latencies)-1])
+	return nil
+}
+
+// benchPrompt repeats the self-test text up to size bytes, cut at a character boundary.
+func benchPrompt(size int) string {
+	prompt := strings.Repeat(selfTestText+" ", size/len(selfTestText)+1)[:size]
+	for !utf8.ValidString(prompt) {
+		prompt = prompt[:len(prompt)-1]
+	}
+	return prompt
+}
+
+// percentile returns the p-th percentile of the sorted latencies.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	return sorted[(len(sorted)-1)*p/100]
+}
+
+// tokensOutput is the tokens -json output. Tokens, Count or Pieces is set as selected by the flags.
+type tokensOutput struct {
+	Model  string              `json:"model"`
+	Tokens []int               `json:"tokens,omitempty"`
+	Count  *int                `json:"count,omitempty"`
+	Pieces []tokensOutputPiece `json:"pieces,omitempty"`
+}
+
+type tokensOutputPiece struct {
+	ID    int    `json:"id"`
+	Piece string `json:"piece"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+}
+
+func tokens(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("tokens", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: tokenize tokens [flags] [file]\n\nThe file is tokenized, without a file stdin is read.\n"+
+			"The token IDs are printed separated by spaces, -count prints the count instead and -pieces a line per token.\n\n")
+		fs.PrintDefaults()
+	}
+	model := fs.String("model", "", "model to tokenize with (default: the fallback model)")
+	countOnly := fs.Bool("count", false, "print the number of tokens instead of the token IDs")
+	pieces := fs.Bool("pieces", false, "print a line per token with its ID and piece instead of the token IDs")
+	asJSON := fs.Bool("json", false, "print the output as a JSON object")
+	_ = fs.Parse(args)
+
+	if *countOnly && *pieces {
+		return fmt.Errorf("-count and -pieces are mutually exclusive")
+	}
+	if fs.NArg() > 1 {
+		return fmt.Errorf("at most one file can be tokenized, use count for several")
+	}
+	inputs, err := readInputs(fs.Args(), stdin, false)
+	if err != nil {
+		return err
+	}
+	input := inputs[0]
+
+	tokenizer, err := newTokenizer()
+	if err != nil {
+		return fmt.Errorf("failed to init tokenizer: %w", err)
+	}
+	// an empty name resolves to the fallback model
+	resolved, err := tokenizer.OptimalTokenizerModel(*model)
+	if err != nil {
+		return fmt.Errorf("failed to resolve model %q: %w", *model, err)
+	}
+
+	out := tokensOutput{Model: resolved}
+	var text strings.Builder
+	switch {
+	case *countOnly:
+		n, err := tokenizer.CountTokens(resolved, input)
+		if err != nil {
+			return fmt.Errorf("count tokens with %s: %w", resolved, err)
+		}
+		out.Count = &n
+		fmt.Fprintln(&text, n)
+	case *pieces:
+		tokens, err := tokenizer.TokenizePieces(resolved, input)
+		if err != nil {
+			return fmt.Errorf("tokenize with %s: %w", resolved, err)
+		}
+		out.Pieces = make([]tokensOutputPiece, len(tokens))
+		for i, p := range tokens {
+			out.Pieces[i] = tokensOutputPiece{ID: p.ID, Piece: p.Piece, Start: p.Start, End: p.End}
+			fmt.Fprintf(&text, "%d\t%q\n", p.ID, p.Piece)
+		}
+	default:
+		tokens, err := tokenizer.Tokenize(resolved, input)
+		if err != nil {
+			return fmt.Errorf("tokenize with %s: %w", resolved, err)
+		}
+		out.Tokens = tokens
+		ids := make([]string, len(tokens))
+		for i, id := range tokens {
+			ids[i] = strconv.Itoa(id)
+		}
+		fmt.Fprintln(&text, strings.Join(ids, " "))
+	}
+
+	if *asJSON {
+		return json.NewEncoder(stdout).Encode(out)
+	}
+	_, err = io.WriteString(stdout, text.String())
+	return err
+}
+
+// countRow is a row of the count output, see count.
+type countRow struct {
+	InputIndex int    `json:"input_index"`
+	Model      string `json:"model"`
+	TokenCount int    `json:"token_count"`
+	ByteCount  int    `json:"byte_count"`
+}
+
+// pieceRow is a row of the count -pieces output.
+type pieceRow struct {
+	InputIndex int    `json:"input_index"`
+	Model      string `json:"model"`
+	TokenIndex int    `json:"token_index"`
+	TokenID    int    `json:"token_id"`
+	Piece      string `json:"piece"`
+	Start      int    `json:"start"`
+	End        int    `json:"end"`
+}
+
+func count(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("count", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: tokenize count [flags] [file...]\n\nEach file is an input, without files stdin is read.\n\n")
+		fs.PrintDefaults()
+	}
+	models := fs.String("model", "", "comma separated models to count with (default: the fallback model)")
+	format := fs.String("format", "json", "output format: json, csv or tsv")
+	lines := fs.Bool("lines", false, "treat each line of the input as a separate input")
+	pieces := fs.Bool("pieces", false, "output a row per token with its piece and byte span instead of counts")
+	_ = fs.Parse(args)
+
+	if *format != "json" && *format != "csv" && *format != "tsv" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	inputs, err := readInputs(fs.Args(), stdin, *lines)
+	if err != nil {
+		return err
+	}
+
+	tokenizer, err := newTokenizer()
+	if err != nil {
+		return fmt.Errorf("failed to init tokenizer: %w", err)
+	}
+	var resolved []string
+	for _, model := range strings.Split(*models, ",") {
+		// an empty name resolves to the fallback model
+		name, err := tokenizer.OptimalTokenizerModel(strings.TrimSpace(model))
+		if err != nil {
+			return fmt.Errorf("failed to resolve model %q: %w", model, err)
+		}
+		resolved = append(resolved, name)
+	}
+
+	var header []string
+	var rows []any
+	var records [][]string
+	if *pieces {
+		header = []string{"input_index", "model", "token_index", "token_id", "piece", "start", "end"}
+	} else {
+		header = []string{"input_index", "model", "token_count", "byte_count"}
+	}
+	for i, input := range inputs {
+		for _, model := range resolved {
+			if !*pieces {
+				n, err := tokenizer.CountTokens(model, input)
+				if err != nil {
+					return fmt.Errorf("input %d: count tokens with %s: %w", i, model, err)
+				}
+				row := countRow{InputIndex: i, Model: model, TokenCount: n, ByteCount: len(input)}
+				rows = append(rows, row)
+				records = append(records, []string{strconv.Itoa(i), model, strconv.Itoa(n), strconv.Itoa(len(input))})
+				continue
+			}
+
+			tokens, err := tokenizer.TokenizePieces(model, input)
+			if err != nil {
+				return fmt.Errorf("input %d: tokenize with %s: %w", i, model, err)
+			}
+			for j, p := range tokens {
+				row := pieceRow{InputIndex: i, Model: model, TokenIndex: j, TokenID: p.ID, Piece: p.Piece, Start: p.Start, End: p.End}
+				rows = append(rows, row)
+				records = append(records, []string{
+					strconv.Itoa(i), model, strconv.Itoa(j), strconv.Itoa(p.ID), p.Piece, strconv.Itoa(p.Start), strconv.Itoa(p.End),
+				})
+			}
+		}
+	}
+
+	if *format == "json" {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		if rows == nil {
+			rows = []any{}
+		}
+		return enc.Encode(rows)
+	}
+	w := csv.NewWriter(stdout)
+	if *format == "tsv" {
+		w.Comma = '\t'
+	}
+	_ = w.Write(header)
+	_ = w.WriteAll(records)
+	return w.Error()
+}
+
+// readInputs reads each file as an input, or stdin if there are no files.
+// With lines set, each line of a file is an input instead.
+func readInputs(files []string, stdin io.Reader, lines bool) ([]string, error) {
+	readers := []io.Reader{stdin}
+	if len(files) > 0 {
+		readers = readers[:0]
+		for _, name := range files {
+			f, err := os.Open(name)
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			readers = append(readers, f)
+		}
+	}
+
+	var inputs []string
+	for _, r := range readers {
+		if !lines {
+			b, err := io.ReadAll(r)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read input: %w", err)
+			}
+			inputs = append(inputs, string(b))
+			continue
+		}
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(nil, 16<<20)
+		for scanner.Scan() {
+			inputs = append(inputs, scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read input: %w", err)
+		}
+	}
+	return inputs, nil
+}
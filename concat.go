@@ -0,0 +1,78 @@
+package ollamatokenizer
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/ollama/ollama/llama"
+)
+
+// concatWindow is the number of tokens on each side of the boundary re-tokenized by ConcatTokens.
+// A merge can span a whole word, which may be split into several byte or character tokens on its own.
+const concatWindow = 16
+
+// ConcatTokens implements Tokenizer.
+func (c *ollamatokenizer) ConcatTokens(modelName string, a, b []int) ([]int, error) {
+	model, release, err := c.acquireModel(modelName)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	// IDs are always checked, so an unknown ID fails regardless of where it is.
+	for i, id := range slices.Concat(a, b) {
+		if _, err := tokenPiece(model, modelName, id, i, UnknownIDError); err != nil {
+			return nil, err
+		}
+	}
+	if len(a) == 0 || len(b) == 0 {
+		return slices.Concat(a, b), nil
+	}
+
+	// the BOS of the second sequence would end up in the middle.
+	if model.AddBOSToken() && isBOS(model, b[0]) {
+		b = b[1:]
+	}
+
+	// re-tokenize the tokens around the boundary, if they tokenize to themselves on their own
+	// (the tokenization is local there), so tokens that merge across the boundary are merged.
+	start := max(len(a)-concatWindow, 0)
+	if start == 0 && isBOS(model, a[0]) {
+		start = 1
+	}
+	end := min(concatWindow, len(b))
+	left, right := a[start:], b[:end]
+	if len(left) == 0 || len(right) == 0 {
+		return slices.Concat(a, b), nil
+	}
+	leftText, rightText := piecesText(model, left), piecesText(model, right)
+	if !tokenizesTo(model, leftText, left) || !tokenizesTo(model, rightText, right) {
+		return slices.Concat(a, b), nil
+	}
+	merged, err := model.Tokenize(leftText+rightText, false, true)
+	if err != nil {
+		return slices.Concat(a, b), nil
+	}
+	return slices.Concat(a[:start], merged, b[end:]), nil
+}
+
+// isBOS reports whether id is the token the model adds at the start of a sequence.
+func isBOS(model *llama.Model, id int) bool {
+	bos, err := model.Tokenize("", true, false)
+	return err == nil && len(bos) == 1 && bos[0] == id
+}
+
+// piecesText concatenates the pieces of the tokens, which must be in the vocabulary.
+func piecesText(model *llama.Model, tokens []int) string {
+	var text strings.Builder
+	for _, id := range tokens {
+		text.WriteString(model.TokenToPiece(id))
+	}
+	return text.String()
+}
+
+// tokenizesTo reports whether text tokenizes to tokens, without special tokens added.
+func tokenizesTo(model *llama.Model, text string, tokens []int) bool {
+	got, err := model.Tokenize(text, false, true)
+	return err == nil && slices.Equal(got, tokens)
+}
@@ -0,0 +1,56 @@
+package ollamatokenizer
+
+import (
+	"fmt"
+)
+
+// EstimateCost implements Tokenizer.
+func (c *ollamatokenizer) EstimateCost(modelName, prompt string, pricePer1K float64) (tokens int, cost float64, err error) {
+	price, err := c.pricePer1K(modelName, pricePer1K)
+	if err != nil {
+		return 0, 0, err
+	}
+	tokens, err = c.CountTokens(modelName, prompt)
+	if err != nil {
+		return 0, 0, err
+	}
+	return tokens, costOf(tokens, price), nil
+}
+
+// EstimateCostBatch implements Tokenizer.
+func (c *ollamatokenizer) EstimateCostBatch(modelName string, prompts []string, pricePer1K float64) (tokens int, cost float64, err error) {
+	price, err := c.pricePer1K(modelName, pricePer1K)
+	if err != nil {
+		return 0, 0, err
+	}
+	counts, err := c.CountTokensBatch(modelName, prompts)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, n := range counts {
+		tokens += n
+	}
+	return tokens, costOf(tokens, price), nil
+}
+
+// pricePer1K returns the given price, or the registered price of the model if the given one is 0.
+func (c *ollamatokenizer) pricePer1K(modelName string, pricePer1K float64) (float64, error) {
+	if pricePer1K < 0 {
+		return 0, fmt.Errorf("invalid price per 1k tokens: %g", pricePer1K)
+	}
+	if pricePer1K > 0 {
+		return pricePer1K, nil
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	price, ok := c.pricing[modelName]
+	if !ok {
+		return 0, fmt.Errorf("no price given and none registered for model %s", modelName)
+	}
+	return price, nil
+}
+
+// costOf returns the cost of tokens at the price per 1000 tokens.
+func costOf(tokens int, pricePer1K float64) float64 {
+	return float64(tokens) / 1000 * pricePer1K
+}
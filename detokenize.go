@@ -0,0 +1,241 @@
+package ollamatokenizer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/ollama/ollama/llama"
+)
+
+// Detokenize implements Tokenizer.
+func (c *ollamatokenizer) Detokenize(modelName string, tokens []int) (string, error) {
+	c.mu.RLock()
+	handling := c.unknownIDs
+	c.mu.RUnlock()
+
+	rules, err := c.decodeRules(modelName)
+	if err != nil {
+		return "", err
+	}
+	model, release, err := c.acquireModel(modelName)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	var text strings.Builder
+	started := false
+	for i, id := range tokens {
+		piece, err := rules.piece(model, modelName, id, i, handling, &started)
+		if err != nil {
+			return "", err
+		}
+		text.WriteString(piece)
+	}
+	return text.String(), nil
+}
+
+// decodeRules are the model specifics of turning tokens back into text, like llama.cpp detokenizes
+// with special tokens removed.
+type decodeRules struct {
+	// control are the IDs of the control tokens (BOS, EOS, chat markers, ...), which decode to nothing.
+	control map[int]struct{}
+	// stripSpace removes the space the model prefixes the text with from the first piece.
+	stripSpace bool
+}
+
+// piece returns the text of the token at position. started is set once a token produced text, so the
+// prefixed space of the model is only removed from the first one.
+func (r *decodeRules) piece(model *llama.Model, modelName string, id, position int, handling UnknownIDHandling, started *bool) (string, error) {
+	if _, ok := r.control[id]; ok {
+		return "", nil
+	}
+	piece, err := tokenPiece(model, modelName, id, position, handling)
+	if err != nil {
+		return "", err
+	}
+	if !*started && piece != "" {
+		*started = true
+		if r.stripSpace {
+			piece = strings.TrimPrefix(piece, " ")
+		}
+	}
+	return piece, nil
+}
+
+// decodeRules returns the decode rules of the model, read from its file on first use.
+// Models without token types in their file treat their special tokens (except UNK) as control tokens.
+func (c *ollamatokenizer) decodeRules(modelName string) (*decodeRules, error) {
+	c.mu.RLock()
+	rules, exists := c.decodeRulesCache[modelName]
+	c.mu.RUnlock()
+	if exists {
+		return rules, nil
+	}
+
+	pipeline, err := c.PipelineInfo(modelName)
+	if err != nil {
+		return nil, err
+	}
+	rules = &decodeRules{control: make(map[int]struct{}), stripSpace: pipeline.AddSpacePrefix}
+	var types []uint32
+	err = c.withModelFile(context.Background(), modelName, func(modelPath string) error {
+		// the token types are as large as the vocabulary, so they are only read here.
+		kv, _, err := readMetadata(modelPath, -1)
+		if err != nil {
+			return fmt.Errorf("failed to read token types of model %s: %w", modelName, err)
+		}
+		types = kv.Uints(kvTokenType)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(types) > 0 {
+		for id, t := range types {
+			if t == tokenTypeControl {
+				rules.control[id] = struct{}{}
+			}
+		}
+	} else {
+		special, err := c.SpecialTokens(modelName)
+		if err != nil {
+			return nil, err
+		}
+		for name, id := range special.ByName {
+			if name != "unk" {
+				rules.control[id] = struct{}{}
+			}
+		}
+	}
+
+	c.mu.Lock()
+	c.decodeRulesCache[modelName] = rules
+	c.mu.Unlock()
+	return rules, nil
+}
+
+// ValidateTokens implements Tokenizer.
+func (c *ollamatokenizer) ValidateTokens(modelName string, tokens []int) error {
+	model, release, err := c.acquireModel(modelName)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	n := model.NumVocab()
+	for i, id := range tokens {
+		if id < 0 || id >= n {
+			return &InvalidTokenError{Model: modelName, Position: i, ID: id, VocabSize: n}
+		}
+	}
+	return nil
+}
+
+// tokenPiece returns the piece of the token at position, handling IDs outside of the vocabulary as configured.
+func tokenPiece(model *llama.Model, modelName string, id, position int, handling UnknownIDHandling) (string, error) {
+	// llama.cpp doesn't check the range of IDs, decoding an unknown one would crash.
+	n := model.NumVocab()
+	if id >= 0 && id < n {
+		return model.TokenToPiece(id), nil
+	}
+	switch {
+	case handling.skip:
+		return "", nil
+	case handling.replace:
+		return handling.replacement, nil
+	default:
+		return "", &InvalidTokenError{Model: modelName, Position: position, ID: id, VocabSize: n}
+	}
+}
+
+// Decoder decodes a stream of token IDs, e.g. generated by an LLM, to text one token at a time.
+// A character can be split over several tokens (byte-level BPE, SentencePiece byte fallback),
+// so bytes of incomplete UTF-8 sequences are held back until the sequence is complete.
+// It is safe for concurrent use, but the tokens of one stream must be decoded in order.
+type Decoder struct {
+	tokenizer *ollamatokenizer
+	model     string
+
+	mu       sync.Mutex
+	pending  []byte
+	position int
+	// started is set once a token of the stream produced text, see decodeRules.
+	started bool
+}
+
+// NewDecoder implements Tokenizer.
+func (c *ollamatokenizer) NewDecoder(modelName string) (*Decoder, error) {
+	// load the model now, so a misconfigured model fails here instead of on the first token.
+	_, release, err := c.acquireModel(modelName)
+	if err != nil {
+		return nil, err
+	}
+	release()
+	if _, err := c.decodeRules(modelName); err != nil {
+		return nil, err
+	}
+	return &Decoder{tokenizer: c, model: modelName}, nil
+}
+
+// Decode decodes the next token of the stream and returns the text completed by it, which is empty
+// if the token ends in an incomplete character. Bytes that can never form a valid character are
+// returned as the replacement character U+FFFD. Control tokens decode to nothing, like in Detokenize.
+// IDs outside of the vocabulary are handled as configured by TokenizerWithUnknownIDHandling.
+func (d *Decoder) Decode(id int) (string, error) {
+	d.tokenizer.mu.RLock()
+	handling := d.tokenizer.unknownIDs
+	d.tokenizer.mu.RUnlock()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	rules, err := d.tokenizer.decodeRules(d.model)
+	if err != nil {
+		return "", err
+	}
+	model, release, err := d.tokenizer.acquireModel(d.model)
+	if err != nil {
+		return "", err
+	}
+	piece, err := rules.piece(model, d.model, id, d.position, handling, &d.started)
+	release()
+	if err != nil {
+		return "", err
+	}
+	d.position++
+
+	d.pending = append(d.pending, piece...)
+	var text strings.Builder
+	for len(d.pending) > 0 {
+		r, size := utf8.DecodeRune(d.pending)
+		if r == utf8.RuneError && size <= 1 {
+			if !utf8.FullRune(d.pending) {
+				// the start of a character, completed by a later token.
+				break
+			}
+			text.WriteRune(utf8.RuneError)
+			d.pending = d.pending[1:]
+			continue
+		}
+		text.Write(d.pending[:size])
+		d.pending = d.pending[size:]
+	}
+	return text.String(), nil
+}
+
+// Flush ends the stream and returns the bytes held back for an incomplete character,
+// each replaced by U+FFFD. The Decoder can be used for a new stream afterwards.
+func (d *Decoder) Flush() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	text := strings.Repeat(string(utf8.RuneError), len(d.pending))
+	d.pending = nil
+	d.position = 0
+	d.started = false
+	return text
+}
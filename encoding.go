@@ -0,0 +1,360 @@
+package ollamatokenizer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Encoding is the result of encoding a text with a model.
+type Encoding struct {
+	// IDs are the token IDs of the encoded text, including special tokens added by the model.
+	IDs []int
+}
+
+// EncodeOption configures a single Encode call.
+type EncodeOption func(*encodeConfig) error
+
+type encodeConfig struct {
+	lowercase bool
+	// bos and eos force (true) or suppress (false) the token, nil keeps the model default.
+	bos *bool
+	eos *bool
+}
+
+// EncodeWithLowercase lowercases the text before it is encoded, e.g. to count tokens for
+// case-insensitive comparisons. This is in addition to, not instead of, the normalizer of the model,
+// which still runs afterwards. The counts change accordingly, and so do offsets: lowercasing may
+// change the byte length of a character, so they refer to the lowercased text.
+func EncodeWithLowercase(enabled bool) EncodeOption {
+	return func(cfg *encodeConfig) error {
+		cfg.lowercase = enabled
+		return nil
+	}
+}
+
+// EncodeWithBOS adds (true) or suppresses (false) the BOS token at the start of the sequence,
+// regardless of whether the model adds it by default, e.g. to add BOS only once when concatenating
+// segments. Adding it fails for models without a BOS token.
+func EncodeWithBOS(enabled bool) EncodeOption {
+	return func(cfg *encodeConfig) error {
+		cfg.bos = &enabled
+		return nil
+	}
+}
+
+// EncodeWithEOS adds (true) or suppresses (false) the EOS token at the end of the sequence,
+// regardless of whether the model adds it by default. Adding it fails for models without an EOS token.
+// An EOS token written out in the text itself (e.g. "</s>") is kept when suppressing.
+func EncodeWithEOS(enabled bool) EncodeOption {
+	return func(cfg *encodeConfig) error {
+		cfg.eos = &enabled
+		return nil
+	}
+}
+
+// Encode implements Tokenizer.
+func (c *ollamatokenizer) Encode(modelName, text string, opts ...EncodeOption) (Encoding, error) {
+	var cfg encodeConfig
+	for _, opt := range opts {
+		if err := opt(&cfg); err != nil {
+			return Encoding{}, fmt.Errorf("invalid encode option: %w", err)
+		}
+	}
+
+	if cfg.lowercase {
+		// preprocess first, lowercasing would replace invalid UTF-8 regardless of the configured mode.
+		preprocessed, err := c.preprocess(text)
+		if err != nil {
+			return Encoding{}, err
+		}
+		text = strings.ToLower(preprocessed)
+	}
+
+	tokens, err := c.Tokenize(modelName, text)
+	if err != nil {
+		return Encoding{}, err
+	}
+	if cfg.bos != nil || cfg.eos != nil {
+		if tokens, err = c.applySequenceTokens(modelName, tokens, cfg); err != nil {
+			return Encoding{}, err
+		}
+	}
+	return Encoding{IDs: tokens}, nil
+}
+
+// TokenizeWithSpecial implements Tokenizer.
+func (c *ollamatokenizer) TokenizeWithSpecial(modelName, prompt string, addBOS, addEOS bool) ([]int, error) {
+	tokens, err := c.Tokenize(modelName, prompt)
+	if err != nil {
+		return nil, err
+	}
+	special, err := c.SpecialTokens(modelName)
+	if err != nil {
+		return nil, err
+	}
+	cfg := encodeConfig{bos: &addBOS, eos: &addEOS}
+	if addBOS && !special.BOS.Present {
+		cfg.bos = nil
+	}
+	if addEOS && !special.EOS.Present {
+		cfg.eos = nil
+	}
+	return c.applySequenceTokens(modelName, tokens, cfg)
+}
+
+// applySequenceTokens adds or removes the BOS and EOS tokens of the tokens as configured.
+// Only tokens the model added by default are removed, not those parsed from the text.
+func (c *ollamatokenizer) applySequenceTokens(modelName string, tokens []int, cfg encodeConfig) ([]int, error) {
+	special, err := c.SpecialTokens(modelName)
+	if err != nil {
+		return nil, err
+	}
+	model, release, err := c.acquireModel(modelName)
+	if err != nil {
+		return nil, err
+	}
+	addsBOS := model.AddBOSToken()
+	release()
+	kv, err := c.modelMetadata(modelName)
+	if err != nil {
+		return nil, err
+	}
+	addsEOS, _ := kv[kvAddEOSToken].(bool)
+
+	if cfg.bos != nil {
+		hasBOS := special.BOS.Present && len(tokens) > 0 && tokens[0] == special.BOS.ID
+		switch {
+		case *cfg.bos && !special.BOS.Present:
+			return nil, fmt.Errorf("model %s has no BOS token", modelName)
+		case *cfg.bos && !hasBOS:
+			tokens = append([]int{special.BOS.ID}, tokens...)
+		case !*cfg.bos && hasBOS && addsBOS:
+			tokens = tokens[1:]
+		}
+	}
+	if cfg.eos != nil {
+		hasEOS := special.EOS.Present && len(tokens) > 0 && tokens[len(tokens)-1] == special.EOS.ID
+		switch {
+		case *cfg.eos && !special.EOS.Present:
+			return nil, fmt.Errorf("model %s has no EOS token", modelName)
+		case *cfg.eos && !hasEOS:
+			tokens = append(tokens, special.EOS.ID)
+		case !*cfg.eos && hasEOS && addsEOS:
+			tokens = tokens[:len(tokens)-1]
+		}
+	}
+	return tokens, nil
+}
+
+// Encoder counts the tokens of a text that grows by appending, e.g. a chat conversation,
+// without tokenizing the whole text again on every append. It is safe for concurrent use.
+//
+// Each appended text is tokenized on its own, so tokens are never merged across appends:
+// if the end of the previous text and the start of the appended one would merge into fewer tokens
+// (e.g. "Hel" + "lo"), or the model prefixes each text with a space (SentencePiece models),
+// the running total can be higher than CountTokens of the concatenated text.
+// Appending at natural boundaries such as whole messages keeps the difference small.
+type Encoder struct {
+	tokenizer *ollamatokenizer
+	model     string
+
+	mu      sync.Mutex
+	started bool
+	total   int
+}
+
+// NewEncoder implements Tokenizer.
+func (c *ollamatokenizer) NewEncoder(modelName string) (*Encoder, error) {
+	// load the model now, so a misconfigured model fails here instead of on the first append.
+	_, release, err := c.acquireModel(modelName)
+	if err != nil {
+		return nil, err
+	}
+	release()
+	return &Encoder{tokenizer: c, model: modelName}, nil
+}
+
+// Append counts the tokens of text and adds them to the running total.
+// Special tokens the model adds to a sequence (e.g. BOS) are counted once, with the first non-empty text.
+func (e *Encoder) Append(text string) (addedTokens int, totalTokens int, err error) {
+	text, err = e.tokenizer.preprocess(text)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.tokenizer.waitThrottle(context.Background()); err != nil {
+		return 0, 0, err
+	}
+	model, release, err := e.tokenizer.acquireModel(e.model)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer release()
+
+	added, err := e.tokenizer.countChunks(model, text, !e.started)
+	if err != nil {
+		return 0, 0, err
+	}
+	if text != "" {
+		e.started = true
+	}
+	e.total += added
+	return added, e.total, nil
+}
+
+// Total returns the number of tokens appended so far.
+func (e *Encoder) Total() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.total
+}
+
+// EncodeForEmbedding implements Tokenizer.
+func (c *ollamatokenizer) EncodeForEmbedding(modelName, text string, maxLen int) (Encoding, bool, error) {
+	if maxLen <= 0 {
+		return Encoding{}, false, fmt.Errorf("invalid max sequence length: %d", maxLen)
+	}
+	text, err := c.preprocess(text)
+	if err != nil {
+		return Encoding{}, false, err
+	}
+
+	// long documents are what gets truncated, so the input limit of Tokenize doesn't apply:
+	// the text is tokenized in chunks until more than maxLen tokens are produced.
+	if err := c.waitThrottle(context.Background()); err != nil {
+		return Encoding{}, false, err
+	}
+	model, used, release, err := c.acquireModelOrFallback(modelName)
+	if err != nil {
+		return Encoding{}, false, err
+	}
+	var tokens []int
+	firstChunk := 0
+	b := []byte(text)
+	i := 0
+	for {
+		end := min(i+maxPromptBytes, len(b))
+		for end < len(b) && end > i && !utf8.RuneStart(b[end]) {
+			end--
+		}
+		if end == i && end < len(b) {
+			end = i + 1
+		}
+		toks, err := model.Tokenize(string(b[i:end]), i == 0, true)
+		if err != nil {
+			release()
+			return Encoding{}, false, fmt.Errorf("tokenization failed for bytes %d-%d: %w", i, end, err)
+		}
+		c.throttle.take(len(toks))
+		if i == 0 {
+			firstChunk = len(toks)
+		}
+		tokens = append(tokens, toks...)
+		i = end
+		if i >= len(b) || len(tokens) > maxLen {
+			break
+		}
+	}
+	release()
+	complete := i >= len(b)
+
+	special, err := c.SpecialTokens(used)
+	if err != nil {
+		return Encoding{}, false, err
+	}
+	end, hasEnd := 0, false
+	if firstChunk > 0 && isSequenceEnd(special, tokens[firstChunk-1]) {
+		end, hasEnd = tokens[firstChunk-1], true
+		// the model closes the first chunk, but the sequence ends after the last one.
+		if firstChunk < len(tokens) {
+			tokens = slices.Delete(tokens, firstChunk-1, firstChunk)
+			if complete {
+				tokens = append(tokens, end)
+			}
+		}
+	}
+	if len(tokens) <= maxLen {
+		return Encoding{IDs: tokens}, false, nil
+	}
+
+	// keep the closing EOS/SEP token like embedding pipelines do, so the model still sees a terminated sequence.
+	truncated := slices.Clone(tokens[:maxLen])
+	if maxLen > 1 && hasEnd {
+		truncated[maxLen-1] = end
+	}
+	return Encoding{IDs: truncated}, true, nil
+}
+
+// isSequenceEnd reports whether id is the EOS or SEP token of the model.
+func isSequenceEnd(special SpecialTokens, id int) bool {
+	if special.EOS.Present && special.EOS.ID == id {
+		return true
+	}
+	sep, ok := special.ByName["sep"]
+	return ok && sep == id
+}
+
+// TokenizeFingerprint implements Tokenizer.
+func (c *ollamatokenizer) TokenizeFingerprint(modelName, prompt string) ([]int, string, error) {
+	tokens, err := c.Tokenize(modelName, prompt)
+	if err != nil {
+		return nil, "", err
+	}
+	return tokens, Fingerprint(tokens), nil
+}
+
+// Fingerprint returns a stable hash of the token sequence: the hex encoded SHA-256
+// over the token IDs, each encoded as a little-endian uint32.
+// Equal sequences always have equal fingerprints, across processes and platforms.
+func Fingerprint(tokens []int) string {
+	h := sha256.New()
+	buf := make([]byte, 4)
+	for _, t := range tokens {
+		binary.LittleEndian.PutUint32(buf, uint32(t))
+		h.Write(buf)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// TokensVarint implements Tokenizer.
+func (c *ollamatokenizer) TokensVarint(modelName, prompt string) ([]byte, error) {
+	tokens, err := c.Tokenize(modelName, prompt)
+	if err != nil {
+		return nil, err
+	}
+	return EncodeTokensVarint(tokens), nil
+}
+
+// EncodeTokensVarint encodes the token IDs as a sequence of unsigned varints (see encoding/binary),
+// a compact wire format: IDs below 16384 take at most 2 bytes. Use DecodeTokensVarint to decode it.
+func EncodeTokensVarint(tokens []int) []byte {
+	buf := make([]byte, 0, 2*len(tokens))
+	for _, t := range tokens {
+		buf = binary.AppendUvarint(buf, uint64(t))
+	}
+	return buf
+}
+
+// DecodeTokensVarint decodes token IDs encoded by EncodeTokensVarint.
+func DecodeTokensVarint(data []byte) ([]int, error) {
+	tokens := make([]int, 0, len(data)/2)
+	for offset := 0; offset < len(data); {
+		t, n := binary.Uvarint(data[offset:])
+		if n <= 0 || t > math.MaxInt32 {
+			return nil, fmt.Errorf("invalid varint token at byte %d", offset)
+		}
+		tokens = append(tokens, int(t))
+		offset += n
+	}
+	return tokens, nil
+}
@@ -0,0 +1,62 @@
+package ollamatokenizer
+
+import (
+	"math"
+	"strings"
+	"unicode/utf8"
+)
+
+// charsPerToken are rough averages of the ASCII characters per token of English text by model family,
+// matched by the prefix of the normalized model name (see NormalizeModelName).
+var charsPerToken = map[string]float64{
+	"llama3":  4.2,
+	"phi3":    3.6,
+	"granite": 4.0,
+}
+
+// defaultCharsPerToken is used for models of other families.
+const defaultCharsPerToken = 4.0
+
+// charsPerTokenOf returns the characters per token EstimateTokens assumes for the model.
+func charsPerTokenOf(modelName string) float64 {
+	normalized := NormalizeModelName(modelName)
+	for family, ratio := range charsPerToken {
+		if strings.HasPrefix(normalized, family) {
+			return ratio
+		}
+	}
+	return defaultCharsPerToken
+}
+
+// EstimateTokens implements Tokenizer.
+func (c *ollamatokenizer) EstimateTokens(modelName, prompt string) (int, error) {
+	c.mu.RLock()
+	_, configured := c.modelURLs[modelName]
+	_, loaded := c.loadedModels[modelName]
+	var err error
+	if !configured {
+		err = c.unknownModelLocked(modelName)
+	}
+	c.mu.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+	if loaded {
+		return c.CountTokens(modelName, prompt)
+	}
+	return estimateTokens(prompt, charsPerTokenOf(modelName)), nil
+}
+
+// estimateTokens estimates the tokens of the text from its characters: ASCII characters by the ratio,
+// other characters (e.g. CJK or emoji) are often split into tokens of their own, so they count one each.
+func estimateTokens(text string, charsPerToken float64) int {
+	ascii, other := 0, 0
+	for _, r := range text {
+		if r < utf8.RuneSelf {
+			ascii++
+		} else {
+			other++
+		}
+	}
+	return int(math.Ceil(float64(ascii)/charsPerToken)) + other
+}
@@ -0,0 +1,62 @@
+package ollamatokenizer
+
+import "time"
+
+// ModelExplanation is the resolution chain of a model name, see ExplainModel.
+type ModelExplanation struct {
+	// Requested is the model name as given.
+	Requested string
+	// Resolution is how the name resolved, see ResolveModel.
+	Resolution ModelResolution
+	// Attempts are the models tried in order: the resolved model, then the fallback
+	// if the resolved model failed to load and TokenizerWithLoadFailureFallback is enabled.
+	Attempts []LoadAttempt
+	// Used is the model tokenizer calls use, empty if no attempt succeeded.
+	Used string
+}
+
+// LoadAttempt is the outcome of loading a model.
+type LoadAttempt struct {
+	Model string
+	// Fallback is set if the model was tried because the previous attempt failed.
+	Fallback bool
+	// Err is nil if the model is loaded.
+	Err error
+	// Duration is how long loading took, including a download. It is near zero for loaded models.
+	Duration time.Duration
+}
+
+// ExplainModel implements Tokenizer.
+func (c *ollamatokenizer) ExplainModel(basedOnModel string) (ModelExplanation, error) {
+	resolution, err := c.ResolveModel(basedOnModel)
+	if err != nil {
+		return ModelExplanation{}, err
+	}
+	explanation := ModelExplanation{Requested: basedOnModel, Resolution: resolution}
+
+	attempt := c.attemptLoad(resolution.Resolved, false)
+	explanation.Attempts = append(explanation.Attempts, attempt)
+	if attempt.Err != nil {
+		fallback, ok := c.loadFailureFallbackFor(resolution.Resolved)
+		if !ok {
+			return explanation, nil
+		}
+		attempt = c.attemptLoad(fallback, true)
+		explanation.Attempts = append(explanation.Attempts, attempt)
+		if attempt.Err != nil {
+			return explanation, nil
+		}
+	}
+	explanation.Used = attempt.Model
+	return explanation, nil
+}
+
+// attemptLoad loads the model and reports the outcome.
+func (c *ollamatokenizer) attemptLoad(modelName string, fallback bool) LoadAttempt {
+	start := c.clock.Now()
+	_, release, err := c.acquireModel(modelName)
+	if err == nil {
+		release()
+	}
+	return LoadAttempt{Model: modelName, Fallback: fallback, Err: err, Duration: c.clock.Now().Sub(start)}
+}
@@ -0,0 +1,94 @@
+package ollamatokenizer
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// GoldenCase is an expected token count of a text, recorded to detect counts drifting between
+// versions of this package or of a model.
+type GoldenCase struct {
+	Model string `json:"model"`
+	Text  string `json:"text"`
+	Count int    `json:"count"`
+}
+
+//go:embed testdata/golden_counts.json
+var goldenCounts []byte
+
+// GoldenCases returns the golden cases this package is verified against, for the default models.
+// Run VerifyGoldenCases with them to check a deployment (e.g. pinned model revisions) counts the same.
+func GoldenCases() []GoldenCase {
+	cases, err := ReadGoldenCases(bytes.NewReader(goldenCounts))
+	if err != nil {
+		panic(fmt.Sprintf("invalid embedded golden cases: %v", err))
+	}
+	return cases
+}
+
+// ReadGoldenCases reads golden cases written by WriteGoldenCases.
+func ReadGoldenCases(r io.Reader) ([]GoldenCase, error) {
+	var cases []GoldenCase
+	if err := json.NewDecoder(r).Decode(&cases); err != nil {
+		return nil, fmt.Errorf("failed to read golden cases: %w", err)
+	}
+	return cases, nil
+}
+
+// WriteGoldenCases writes the golden cases as indented JSON.
+func WriteGoldenCases(w io.Writer, cases []GoldenCase) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(cases)
+}
+
+// RecordGoldenCases returns the cases with their counts set to the current GoldenCount.
+func RecordGoldenCases(tokenizer Tokenizer, cases []GoldenCase) ([]GoldenCase, error) {
+	recorded := make([]GoldenCase, len(cases))
+	for i, gc := range cases {
+		count, err := tokenizer.GoldenCount(gc.Model, gc.Text)
+		if err != nil {
+			return nil, fmt.Errorf("golden case %d (model %s): %w", i, gc.Model, err)
+		}
+		recorded[i] = GoldenCase{Model: gc.Model, Text: gc.Text, Count: count}
+	}
+	return recorded, nil
+}
+
+// VerifyGoldenCases checks the GoldenCount of each case against its recorded count,
+// returning an error listing every case that drifted or failed.
+func VerifyGoldenCases(tokenizer Tokenizer, cases []GoldenCase) error {
+	var errs []error
+	for i, gc := range cases {
+		count, err := tokenizer.GoldenCount(gc.Model, gc.Text)
+		switch {
+		case err != nil:
+			errs = append(errs, fmt.Errorf("golden case %d (model %s): %w", i, gc.Model, err))
+		case count != gc.Count:
+			errs = append(errs, fmt.Errorf("golden case %d (model %s, text %q): got %d tokens, recorded %d", i, gc.Model, gc.Text, count, gc.Count))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// GoldenCount implements Tokenizer.
+func (c *ollamatokenizer) GoldenCount(modelName, text string) (int, error) {
+	text, err := c.preprocess(text)
+	if err != nil {
+		return 0, err
+	}
+	if err := c.waitThrottle(context.Background()); err != nil {
+		return 0, err
+	}
+	model, release, err := c.acquireModel(modelName)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	return c.countChunks(model, text, true)
+}
@@ -0,0 +1,372 @@
+package ollamatokenizer
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+
+	"github.com/ollama/ollama/fs/ggml"
+)
+
+// gguf metadata keys describing the tokenizer of a model.
+const (
+	kvTokenizerModel        = "tokenizer.ggml.model"
+	kvTokenizerPre          = "tokenizer.ggml.pre"
+	kvAddSpacePrefix        = "tokenizer.ggml.add_space_prefix"
+	kvRemoveExtraWhitespace = "tokenizer.ggml.remove_extra_whitespaces"
+	kvPrecompiledCharsmap   = "tokenizer.ggml.precompiled_charsmap"
+	kvAddEOSToken           = "tokenizer.ggml.add_eos_token"
+	kvTokenType             = "tokenizer.ggml.token_type"
+	kvArchitecture          = "general.architecture"
+	kvName                  = "general.name"
+)
+
+// tokenTypeControl is the token type of control tokens in tokenizer.ggml.token_type, see llama_token_type.
+const tokenTypeControl = 3
+
+// specialTokenKeys maps the special token names reported by SpecialTokens to their gguf metadata keys.
+var specialTokenKeys = map[string]string{
+	"bos":  "tokenizer.ggml.bos_token_id",
+	"eos":  "tokenizer.ggml.eos_token_id",
+	"eot":  "tokenizer.ggml.eot_token_id",
+	"eom":  "tokenizer.ggml.eom_token_id",
+	"unk":  "tokenizer.ggml.unknown_token_id",
+	"sep":  "tokenizer.ggml.seperator_token_id",
+	"pad":  "tokenizer.ggml.padding_token_id",
+	"cls":  "tokenizer.ggml.cls_token_id",
+	"mask": "tokenizer.ggml.mask_token_id",
+}
+
+// defaultSpecialTokens are the special token IDs assumed per tokenizer model
+// when the metadata does not define them, mirroring the llama.cpp vocab loader.
+var defaultSpecialTokens = map[string]map[string]int{
+	"llama": {"bos": 1, "eos": 2, "unk": 0},
+	"bert":  {"bos": 101, "unk": 100, "sep": 102, "pad": 0, "mask": 103},
+	"gpt2":  {"bos": 11, "eos": 11},
+	"t5":    {"eos": 1, "unk": 2, "pad": 0},
+}
+
+// PipelineInfo describes the tokenization pipeline loaded for a model,
+// as read from the tokenizer metadata of its .gguf file.
+type PipelineInfo struct {
+	// ModelType is the tokenization algorithm: "BPE", "SPM" (SentencePiece), "WordPiece", "Unigram", "RWKV" or "none".
+	ModelType string
+	// TokenizerModel is the raw tokenizer.ggml.model value, e.g. "gpt2" or "llama".
+	TokenizerModel string
+	// PreTokenizer is the pre-tokenizer (tokenizer.ggml.pre) splitting the text before the model is applied.
+	// Only BPE models use a dedicated pre-tokenizer, all others report "default".
+	PreTokenizer string
+	// Normalizer describes the normalization applied before pre-tokenization:
+	// "precompiled_charsmap" for Unigram models shipping a charsmap, "sentencepiece" for SPM
+	// (spaces are escaped as ▁), "bert" for WordPiece (lowercasing and accent stripping) and "none" otherwise.
+	Normalizer string
+	// AddSpacePrefix reports whether a space is prepended to the input before tokenization.
+	AddSpacePrefix bool
+	// RemoveExtraWhitespaces reports whether consecutive whitespaces are merged before tokenization.
+	RemoveExtraWhitespaces bool
+	// ByteLevel reports whether the vocabulary is byte-level (GPT-2 style BPE): the text is mapped to
+	// bytes before merging, so characters outside of the vocabulary are split into byte tokens whose
+	// pieces are not valid UTF-8 on their own. Other models work on characters, falling back to
+	// byte tokens (SPM) or an unknown token (WordPiece) for characters outside of the vocabulary.
+	ByteLevel bool
+}
+
+// PipelineInfo implements Tokenizer.
+func (c *ollamatokenizer) PipelineInfo(modelName string) (PipelineInfo, error) {
+	kv, err := c.modelMetadata(modelName)
+	if err != nil {
+		return PipelineInfo{}, err
+	}
+
+	tokenizerModel, _ := kv[kvTokenizerModel].(string)
+	info := PipelineInfo{
+		TokenizerModel: tokenizerModel,
+		PreTokenizer:   "default",
+		Normalizer:     "none",
+	}
+
+	// defaults mirror the ones applied by the llama.cpp vocab loader.
+	switch tokenizerModel {
+	case "gpt2":
+		info.ModelType = "BPE"
+		info.ByteLevel = true
+		if pre, ok := kv[kvTokenizerPre].(string); ok && pre != "" {
+			info.PreTokenizer = pre
+		}
+	case "llama":
+		info.ModelType = "SPM"
+		info.Normalizer = "sentencepiece"
+		info.AddSpacePrefix = true
+	case "bert":
+		info.ModelType = "WordPiece"
+		info.Normalizer = "bert"
+	case "t5":
+		info.ModelType = "Unigram"
+		info.AddSpacePrefix = true
+		if _, ok := kv[kvPrecompiledCharsmap]; ok {
+			info.Normalizer = "precompiled_charsmap"
+		}
+	case "rwkv":
+		info.ModelType = "RWKV"
+	case "", "none", "no_vocab":
+		info.ModelType = "none"
+	default:
+		return PipelineInfo{}, fmt.Errorf("model %s uses unknown tokenizer model %q", modelName, tokenizerModel)
+	}
+
+	if v, ok := kv[kvAddSpacePrefix].(bool); ok {
+		info.AddSpacePrefix = v
+	}
+	if v, ok := kv[kvRemoveExtraWhitespace].(bool); ok {
+		info.RemoveExtraWhitespaces = v
+	}
+
+	return info, nil
+}
+
+// ModelSource is where the file of a model was taken from.
+type ModelSource string
+
+const (
+	// ModelSourceNetwork is a file downloaded by this tokenizer.
+	ModelSourceNetwork ModelSource = "network"
+	// ModelSourceCache is a file found in the download cache, downloaded earlier.
+	ModelSourceCache ModelSource = "cache"
+	// ModelSourceLocal is a local file configured as the model, see TokenizerWithLocalModel.
+	ModelSourceLocal ModelSource = "local"
+)
+
+// modelOrigin is where the file of a model was taken from.
+type modelOrigin struct {
+	url    string
+	source ModelSource
+}
+
+// ModelInfo describes a model, see ModelInfo.
+type ModelInfo struct {
+	// Requested is the model name as given.
+	Requested string
+	// Model is the model the name resolved to, see ResolveModel.
+	Model string
+	// FallbackUsed is set if the name resolved to the fallback model.
+	FallbackUsed bool
+	// Architecture is the model architecture (general.architecture), e.g. "llama" or "phi3".
+	Architecture string
+	// Name is the name the model file gives itself (general.name), empty if it has none.
+	Name string
+	// TokenizerType is the tokenization algorithm, e.g. "BPE" or "SPM", see PipelineInfo.ModelType.
+	TokenizerType string
+	VocabSize     int
+	// URL is the URL the file was taken from. For ModelSourceCache it is the URL of the first remote
+	// source, the cache doesn't record which source the file was downloaded from.
+	URL    string
+	Source ModelSource
+}
+
+// ModelInfo implements Tokenizer.
+func (c *ollamatokenizer) ModelInfo(modelName string) (ModelInfo, error) {
+	resolution, err := c.ResolveModel(modelName)
+	if err != nil {
+		return ModelInfo{}, err
+	}
+	resolved := resolution.Resolved
+	vocabSize, err := c.VocabSize(resolved)
+	if err != nil {
+		return ModelInfo{}, err
+	}
+	pipeline, err := c.PipelineInfo(resolved)
+	if err != nil {
+		return ModelInfo{}, err
+	}
+	kv, err := c.modelMetadata(resolved)
+	if err != nil {
+		return ModelInfo{}, err
+	}
+
+	info := ModelInfo{
+		Requested:     modelName,
+		Model:         resolved,
+		FallbackUsed:  resolution.FallbackUsed,
+		TokenizerType: pipeline.ModelType,
+		VocabSize:     vocabSize,
+	}
+	info.Architecture, _ = kv[kvArchitecture].(string)
+	info.Name, _ = kv[kvName].(string)
+	c.mu.RLock()
+	origin := c.modelOrigins[resolved]
+	c.mu.RUnlock()
+	info.URL, info.Source = origin.url, origin.source
+	return info, nil
+}
+
+// SpecialToken is a special token ID of a model. Present is false if the model does not define the token.
+type SpecialToken struct {
+	ID      int
+	Present bool
+}
+
+// SpecialTokens holds the special token IDs of a model.
+type SpecialTokens struct {
+	BOS SpecialToken
+	EOS SpecialToken
+	PAD SpecialToken
+	UNK SpecialToken
+	// ByName maps the name of every special token defined by the model to its ID.
+	// Names are "bos", "eos", "eot", "eom", "unk", "sep", "pad", "cls" and "mask".
+	ByName map[string]int
+}
+
+// IsByteLevel implements Tokenizer.
+func (c *ollamatokenizer) IsByteLevel(modelName string) (bool, error) {
+	info, err := c.PipelineInfo(modelName)
+	if err != nil {
+		return false, err
+	}
+	return info.ByteLevel, nil
+}
+
+// SpecialTokens implements Tokenizer.
+func (c *ollamatokenizer) SpecialTokens(modelName string) (SpecialTokens, error) {
+	model, release, err := c.acquireModel(modelName)
+	if err != nil {
+		return SpecialTokens{}, err
+	}
+	numVocab := model.NumVocab()
+	release()
+
+	kv, err := c.modelMetadata(modelName)
+	if err != nil {
+		return SpecialTokens{}, err
+	}
+
+	tokenizerModel, _ := kv[kvTokenizerModel].(string)
+	byName := make(map[string]int)
+	maps.Copy(byName, defaultSpecialTokens[tokenizerModel])
+	for name, key := range specialTokenKeys {
+		if id, ok := kv[key].(uint32); ok {
+			byName[name] = int(id)
+		}
+	}
+	// ids outside of the vocabulary are ignored by llama.cpp, so they are not reported either.
+	maps.DeleteFunc(byName, func(_ string, id int) bool {
+		return id < 0 || id >= numVocab
+	})
+
+	lookup := func(name string) SpecialToken {
+		id, ok := byName[name]
+		return SpecialToken{ID: id, Present: ok}
+	}
+	return SpecialTokens{
+		BOS:    lookup("bos"),
+		EOS:    lookup("eos"),
+		PAD:    lookup("pad"),
+		UNK:    lookup("unk"),
+		ByName: byName,
+	}, nil
+}
+
+// VocabSize implements Tokenizer.
+func (c *ollamatokenizer) VocabSize(modelName string) (int, error) {
+	model, release, err := c.acquireModel(modelName)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	return model.NumVocab(), nil
+}
+
+// maxVocabDiffSize caps the vocabulary size VocabDiff compares, to bound its memory and time.
+const maxVocabDiffSize = 1 << 20
+
+// VocabDiff implements Tokenizer.
+func (c *ollamatokenizer) VocabDiff(modelA, modelB string) (int, int, error) {
+	a, err := c.vocabPieces(modelA)
+	if err != nil {
+		return 0, 0, err
+	}
+	b, err := c.vocabPieces(modelB)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	onlyA, onlyB := 0, 0
+	for piece := range a {
+		if _, ok := b[piece]; !ok {
+			onlyA++
+		}
+	}
+	for piece := range b {
+		if _, ok := a[piece]; !ok {
+			onlyB++
+		}
+	}
+	return onlyA, onlyB, nil
+}
+
+// vocabPieces returns the set of decoded pieces of the model's vocabulary.
+func (c *ollamatokenizer) vocabPieces(modelName string) (map[string]struct{}, error) {
+	model, release, err := c.acquireModel(modelName)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	n := model.NumVocab()
+	if n > maxVocabDiffSize {
+		return nil, fmt.Errorf("vocabulary of model %s has %d entries, more than the %d that can be compared", modelName, n, maxVocabDiffSize)
+	}
+	pieces := make(map[string]struct{}, n)
+	for id := range n {
+		pieces[model.TokenToPiece(id)] = struct{}{}
+	}
+	return pieces, nil
+}
+
+// modelMetadata returns the gguf metadata of the given model, downloading the model if necessary.
+// Large arrays (like the vocabulary itself) are skipped. The metadata is cached in memory.
+func (c *ollamatokenizer) modelMetadata(modelName string) (ggml.KV, error) {
+	c.mu.RLock()
+	kv, exists := c.metadata[modelName]
+	c.mu.RUnlock()
+	if exists {
+		return kv, nil
+	}
+
+	err := c.withModelFile(context.Background(), modelName, func(modelPath string) error {
+		var err error
+		kv, _, err = readMetadata(modelPath, 0)
+		if err != nil {
+			return fmt.Errorf("failed to read metadata of model %s: %w", modelName, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.metadata[modelName] = kv
+	c.mu.Unlock()
+
+	return kv, nil
+}
+
+// readMetadata decodes the key-values of the gguf file at path and returns them with the size
+// of the header, metadata and tensor info sections in bytes, which hold the whole vocabulary.
+// The tensor data after them is not counted, a vocab only model never loads it.
+// Arrays larger than maxArraySize are not collected, see ggml.Decode.
+func readMetadata(path string, maxArraySize int) (ggml.KV, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	g, _, err := ggml.Decode(f, maxArraySize)
+	if err != nil {
+		return nil, 0, err
+	}
+	// the offset returned by Decode is the end of the tensor data, the size of the whole file.
+	return g.KV(), int64(g.Tensors().Offset), nil
+}
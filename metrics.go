@@ -0,0 +1,73 @@
+package ollamatokenizer
+
+import (
+	"time"
+)
+
+// Operations reported in CallMetrics.
+const (
+	OperationTokenize = "tokenize"
+	OperationCount    = "count"
+)
+
+// CallMetrics describes a finished Tokenize or CountTokens call, see MetricsCollector.
+type CallMetrics struct {
+	// Operation is OperationTokenize or OperationCount.
+	Operation string
+	// Model is the requested model.
+	Model string
+	// FallbackUsed is set if a fallback model produced the result (see TokenizerWithLoadFailureFallback).
+	FallbackUsed bool
+	// Cached is set if the result was served from the result cache.
+	Cached bool
+	// Tokens is the number of tokens produced, 0 on error.
+	Tokens   int
+	Duration time.Duration
+	Err      error
+}
+
+// MetricsCollector receives the measurements of the tokenizer, see TokenizerWithMetrics.
+// It decouples the tokenizer from a metrics library: an implementation can record to
+// Prometheus (e.g. a counter vector by model and fallback, and a latency histogram), OpenTelemetry
+// or logs. Implementations must be safe for concurrent use and should return quickly,
+// they are called synchronously at the end of each call.
+type MetricsCollector interface {
+	ObserveCall(call CallMetrics)
+}
+
+// RetryMetrics describes a retry of a failed model download, see TokenizerWithRetry.
+type RetryMetrics struct {
+	Model string
+	URL   string
+	// Attempt is the number of the upcoming attempt, 2 for the first retry.
+	Attempt int
+	// Delay is the backoff before the attempt.
+	Delay time.Duration
+	// Err is the transient failure of the previous attempt.
+	Err error
+}
+
+// RetryCollector is implemented by a MetricsCollector that also receives the download retries,
+// e.g. to count them per model so operators see when a model source is flaky.
+type RetryCollector interface {
+	ObserveRetry(retry RetryMetrics)
+}
+
+// observe reports a finished call to the collector, if one is configured.
+func (c *ollamatokenizer) observe(operation, modelName, used string, cached bool, start time.Time, tokens int, err error) {
+	c.mu.RLock()
+	collector := c.metrics
+	c.mu.RUnlock()
+	if collector == nil {
+		return
+	}
+	collector.ObserveCall(CallMetrics{
+		Operation:    operation,
+		Model:        modelName,
+		FallbackUsed: err == nil && used != modelName,
+		Cached:       cached,
+		Tokens:       tokens,
+		Duration:     c.clock.Now().Sub(start),
+		Err:          err,
+	})
+}
@@ -0,0 +1,400 @@
+package ollamatokenizer
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/ollama/ollama/llama"
+)
+
+// ModelOption configures a model registered via AddModel.
+type ModelOption func(*modelConfig) error
+
+type modelConfig struct {
+	contextWindow int
+	mirrors       []string
+	preload       bool
+}
+
+// ModelWithMirrors adds mirror URLs of the model, tried in order when downloading from the
+// url given to AddModel fails. Mirrors can also be listed in the url, separated by '|'.
+func ModelWithMirrors(urls ...string) ModelOption {
+	return func(cfg *modelConfig) error {
+		for _, u := range urls {
+			if u == "" || strings.Contains(u, mirrorSeparator) {
+				return fmt.Errorf("invalid mirror url %q", u)
+			}
+		}
+		cfg.mirrors = append(cfg.mirrors, urls...)
+		return nil
+	}
+}
+
+// ModelWithContextWindow registers the context window (in tokens) of the model, see ContextWindow.
+func ModelWithContextWindow(window int) ModelOption {
+	return func(cfg *modelConfig) error {
+		if window <= 0 {
+			return fmt.Errorf("invalid context window %d", window)
+		}
+		cfg.contextWindow = window
+		return nil
+	}
+}
+
+// ModelWithPreload loads the model while it is added, so AddModel fails for a model that can't be
+// downloaded or loaded instead of its first tokenization. A model that fails to load is not added.
+func ModelWithPreload(enabled bool) ModelOption {
+	return func(cfg *modelConfig) error {
+		cfg.preload = enabled
+		return nil
+	}
+}
+
+// maxModelNameLen is the maximum length of a model name in bytes.
+const maxModelNameLen = 256
+
+// modelNameSeparators are ignored when matching model names, see NormalizeModelName.
+const modelNameSeparators = "-_. "
+
+// NormalizeModelName returns the form ResolveModel matches model names in: lowercased, without
+// the tag (":latest") and without the separators '-', '_', '.' and ' ', so that e.g. "Llama_3.2",
+// "llama3-2" and "LLAMA3.2:8b" all normalize to "llama32".
+func NormalizeModelName(name string) string {
+	name, _, _ = strings.Cut(strings.ToLower(name), ":")
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(modelNameSeparators, r) {
+			return -1
+		}
+		return r
+	}, name)
+}
+
+// ValidModelName reports whether name is safe to use as a model name, e.g. before passing
+// a user-supplied name on. Valid names are at most 256 bytes of ASCII letters, digits and
+// '.', '_', '-', ':' and '/', and consist of '/'-separated segments that are neither empty,
+// "." nor "..". This rules out path traversal and control characters forging log lines.
+// Model names are part of the path of the cached model file, so the loader rejects other names.
+func ValidModelName(name string) bool {
+	if name == "" || len(name) > maxModelNameLen {
+		return false
+	}
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case strings.ContainsRune("._-:/", r):
+		default:
+			return false
+		}
+	}
+	for segment := range strings.SplitSeq(name, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// AddModel implements Tokenizer.
+func (c *ollamatokenizer) AddModel(name, url string, opts ...ModelOption) error {
+	if name == "" || url == "" {
+		return fmt.Errorf("model name and url must not be empty")
+	}
+	if !ValidModelName(name) {
+		return fmt.Errorf("%w: %q", ErrInvalidModelName, name)
+	}
+
+	var cfg modelConfig
+	for _, opt := range opts {
+		if err := opt(&cfg); err != nil {
+			return fmt.Errorf("invalid option for model %s: %w", name, err)
+		}
+	}
+
+	for _, mirror := range cfg.mirrors {
+		url += mirrorSeparator + mirror
+	}
+
+	c.mu.Lock()
+	existing, exists := c.modelURLs[name]
+	if exists && existing != url {
+		c.mu.Unlock()
+		return fmt.Errorf("model %s is already registered with url %s", name, existing)
+	}
+	c.modelURLs[name] = url
+	if cfg.contextWindow > 0 {
+		c.contextWindows[name] = cfg.contextWindow
+	}
+	c.mu.Unlock()
+
+	if !cfg.preload {
+		return nil
+	}
+	_, release, err := c.acquireModel(name)
+	if err != nil {
+		// a model registered before stays, it may load once the failure is resolved.
+		if !exists {
+			_ = c.RemoveModel(name)
+		}
+		return fmt.Errorf("failed to preload model %s: %w", name, err)
+	}
+	release()
+	return nil
+}
+
+// RemoveModel implements Tokenizer.
+func (c *ollamatokenizer) RemoveModel(name string) error {
+	c.mu.Lock()
+	if _, exists := c.modelURLs[name]; !exists {
+		err := c.unknownModelLocked(name)
+		c.mu.Unlock()
+		return err
+	}
+	delete(c.modelURLs, name)
+	delete(c.contextWindows, name)
+	delete(c.metadata, name)
+	delete(c.modelOrigins, name)
+	delete(c.decodeRulesCache, name)
+	if !c.chatTemplates[name].override {
+		delete(c.chatTemplates, name)
+	}
+	cache := c.resultCache
+	c.mu.Unlock()
+
+	// results of other backends are keyed by name and may outlive the model.
+	if lru, ok := cache.(*lruResultCache); ok {
+		lru.removeModel(name)
+	}
+
+	c.unloadModel(name)
+	return nil
+}
+
+// UnloadModel implements Tokenizer.
+func (c *ollamatokenizer) UnloadModel(name string) error {
+	c.mu.RLock()
+	_, exists := c.modelURLs[name]
+	var err error
+	if !exists {
+		err = c.unknownModelLocked(name)
+	}
+	c.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	if c.unloadModel(name) {
+		fmt.Printf("Unloaded model %s\n", name)
+	}
+	return nil
+}
+
+// ApproxMemoryUsage implements Tokenizer.
+func (c *ollamatokenizer) ApproxMemoryUsage() int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.memoryUsageLocked()
+}
+
+func (c *ollamatokenizer) memoryUsageLocked() int64 {
+	var total int64
+	for _, lm := range c.loadedModels {
+		total += lm.size
+	}
+	return total
+}
+
+// evictLocked unloads the least recently used models, except keep, while the loaded models exceed
+// the memory budget or the maximum number of loaded models. Models currently in use are skipped.
+// c.mu must be held for writing.
+func (c *ollamatokenizer) evictLocked(keep string) {
+	if c.maxMemoryBytes <= 0 && c.maxLoadedModels <= 0 {
+		return
+	}
+
+	usage := c.memoryUsageLocked()
+	exceeded := func() bool {
+		return (c.maxMemoryBytes > 0 && usage > c.maxMemoryBytes) ||
+			(c.maxLoadedModels > 0 && len(c.loadedModels) > c.maxLoadedModels)
+	}
+	if !exceeded() {
+		return
+	}
+
+	candidates := make([]string, 0, len(c.loadedModels))
+	for name := range c.loadedModels {
+		if name != keep {
+			candidates = append(candidates, name)
+		}
+	}
+	slices.SortFunc(candidates, func(a, b string) int {
+		return cmp.Compare(c.loadedModels[a].lastUsed.Load(), c.loadedModels[b].lastUsed.Load())
+	})
+
+	for _, name := range candidates {
+		if !exceeded() {
+			return
+		}
+		lm := c.loadedModels[name]
+		// holding the write lock would block until the model is no longer in use, skip it instead.
+		if !lm.mu.TryLock() {
+			continue
+		}
+		llama.FreeModel(lm.model)
+		lm.freed = true
+		lm.mu.Unlock()
+
+		delete(c.loadedModels, name)
+		usage -= lm.size
+		fmt.Printf("Evicted model %s to stay within the limits of loaded models\n", name)
+	}
+}
+
+// Close implements Tokenizer.
+func (c *ollamatokenizer) Close() error {
+	if c.stopPreload != nil {
+		c.stopPreload()
+	}
+	// a model being preloaded would be loaded after it was freed.
+	<-c.preloaded
+
+	for _, name := range c.LoadedModels() {
+		c.unloadModel(name)
+	}
+
+	c.mu.RLock()
+	cache := c.resultCache
+	c.mu.RUnlock()
+	if closer, ok := cache.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			return fmt.Errorf("failed to close result cache: %w", err)
+		}
+	}
+	return nil
+}
+
+// LoadedModels implements Tokenizer.
+func (c *ollamatokenizer) LoadedModels() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return slices.Sorted(maps.Keys(c.loadedModels))
+}
+
+// preload loads the models into memory, preloadConcurrency at a time, see TokenizerWithPreloadedModels.
+// It returns a *PreloadError if any of them fails to load.
+func (c *ollamatokenizer) preload(ctx context.Context, models []string) error {
+	models = slices.Compact(slices.Sorted(slices.Values(models)))
+	c.mu.RLock()
+	workers := c.preloadConcurrency
+	c.mu.RUnlock()
+
+	errs := make([]error, len(models))
+	parallelFor(workers, len(models), func(i int) {
+		_, errs[i] = c.loadModel(ctx, models[i])
+	})
+
+	failed := make(map[string]error)
+	for i, err := range errs {
+		if err != nil {
+			failed[models[i]] = err
+		}
+	}
+	if len(failed) > 0 {
+		return &PreloadError{Errors: failed}
+	}
+	return nil
+}
+
+// Ready implements Tokenizer.
+func (c *ollamatokenizer) Ready() bool {
+	select {
+	case <-c.preloaded:
+		return c.preloadErr == nil
+	default:
+		return false
+	}
+}
+
+// WaitReady implements Tokenizer.
+func (c *ollamatokenizer) WaitReady(ctx context.Context) error {
+	select {
+	case <-c.preloaded:
+		return c.preloadErr
+	default:
+	}
+	select {
+	case <-c.preloaded:
+		return c.preloadErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// maxModelSuggestions is the maximum number of suggestions of an UnknownModelError.
+const maxModelSuggestions = 3
+
+// unknownModelLocked returns the error for an unknown model name, suggesting the configured models
+// whose name, or one of whose family aliases, is within a small edit distance of the name.
+// The caller must hold c.mu.
+func (c *ollamatokenizer) unknownModelLocked(modelName string) *UnknownModelError {
+	name := strings.ToLower(modelName)
+	// the closest distance per suggested model.
+	distances := make(map[string]int)
+	consider := func(candidate, model string) {
+		if _, configured := c.modelURLs[model]; !configured {
+			return
+		}
+		d := editDistance(name, strings.ToLower(candidate))
+		// allow about one edit per three characters, so short names don't match everything.
+		if d > max(2, len(name)/3) {
+			return
+		}
+		if prev, ok := distances[model]; !ok || d < prev {
+			distances[model] = d
+		}
+	}
+	for model := range c.modelURLs {
+		consider(model, model)
+	}
+	for _, mapping := range c.familyMappings {
+		for _, alias := range mapping.Substrings {
+			consider(alias, mapping.CanonicalName)
+		}
+	}
+
+	suggestions := slices.SortedFunc(maps.Keys(distances), func(a, b string) int {
+		if byDistance := cmp.Compare(distances[a], distances[b]); byDistance != 0 {
+			return byDistance
+		}
+		return cmp.Compare(a, b)
+	})
+	if len(suggestions) > maxModelSuggestions {
+		suggestions = suggestions[:maxModelSuggestions]
+	}
+	return &UnknownModelError{Model: modelName, Suggestions: suggestions}
+}
+
+// editDistance returns the Levenshtein distance between a and b in bytes.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,193 @@
+package ollamatokenizer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// TokenPiece is a token together with its decoded text and the span of the prompt it was produced from.
+type TokenPiece struct {
+	ID int
+	// Piece is the decoded text of the token. Byte-level tokens holding part of a multibyte
+	// character are returned as is, so a Piece is not necessarily valid UTF-8.
+	Piece string
+	// Start and End are the byte offsets [Start, End) of the span in the prompt.
+	// Tokens that don't come from the prompt (e.g. BOS) have an empty span.
+	Start int
+	End   int
+}
+
+// TokenizePieces implements Tokenizer.
+func (c *ollamatokenizer) TokenizePieces(modelName, prompt string) ([]TokenPiece, error) {
+	pieces, _, err := c.tokenizePieces(modelName, prompt)
+	return pieces, err
+}
+
+// tokenizePieces is TokenizePieces, also returning the offsets in the prompt of the byte
+// boundaries of the preprocessed prompt the spans refer to, see preprocessOffsets.
+func (c *ollamatokenizer) tokenizePieces(modelName, prompt string) ([]TokenPiece, []int, error) {
+	// preprocessing is idempotent, so tokenizing the preprocessed prompt gives the same tokens.
+	prompt, origin, err := c.preprocessOffsets(prompt)
+	if err != nil {
+		return nil, nil, err
+	}
+	// pieces are decoded with the model that produced the tokens, which may be the fallback.
+	tokens, used, err := c.tokenize(context.Background(), modelName, prompt)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	model, release, err := c.acquireModel(used)
+	if err != nil {
+		return nil, nil, err
+	}
+	pieces := make([]TokenPiece, len(tokens))
+	for i, id := range tokens {
+		pieces[i] = TokenPiece{ID: id, Piece: model.TokenToPiece(id)}
+	}
+	release()
+
+	alignPieces(prompt, pieces)
+	return pieces, origin, nil
+}
+
+// TokenSpan is a token together with the span of the prompt it was produced from, see TokenizeWithOffsets.
+type TokenSpan struct {
+	ID int
+	// Start and End are the byte offsets [Start, End) of the span in the original prompt, before
+	// the input normalizations.
+	Start int
+	End   int
+}
+
+// TokenizeWithOffsets implements Tokenizer.
+func (c *ollamatokenizer) TokenizeWithOffsets(modelName, prompt string) ([]TokenSpan, error) {
+	pieces, origin, err := c.tokenizePieces(modelName, prompt)
+	if err != nil {
+		return nil, err
+	}
+	// the spans of the pieces refer to the preprocessed prompt, they are translated back to the prompt.
+	spans := make([]TokenSpan, len(pieces))
+	for i, p := range pieces {
+		spans[i] = TokenSpan{ID: p.ID, Start: origin[p.Start], End: origin[p.End]}
+	}
+	return spans, nil
+}
+
+// DetailedTokens are the tokens of a prompt together with their pieces, see TokenizeDetailed.
+type DetailedTokens struct {
+	IDs []int
+	// Pieces are the decoded texts of the tokens in order, as is like TokenPiece.Piece, so a piece
+	// is not necessarily valid UTF-8.
+	Pieces []string
+	// Escaped are the Pieces escaped like TokenizeToPieces: bytes that aren't part of a valid UTF-8
+	// sequence are written as \xNN, so each one is valid UTF-8 and no byte is lost.
+	Escaped []string
+}
+
+// TokenizeToPieces implements Tokenizer.
+func (c *ollamatokenizer) TokenizeToPieces(modelName, prompt string) ([]string, error) {
+	detailed, err := c.TokenizeDetailed(modelName, prompt)
+	if err != nil {
+		return nil, err
+	}
+	return detailed.Escaped, nil
+}
+
+// TokenizeDetailed implements Tokenizer.
+func (c *ollamatokenizer) TokenizeDetailed(modelName, prompt string) (DetailedTokens, error) {
+	pieces, err := c.TokenizePieces(modelName, prompt)
+	if err != nil {
+		return DetailedTokens{}, err
+	}
+	detailed := DetailedTokens{
+		IDs:     make([]int, len(pieces)),
+		Pieces:  make([]string, len(pieces)),
+		Escaped: make([]string, len(pieces)),
+	}
+	for i, p := range pieces {
+		detailed.IDs[i] = p.ID
+		detailed.Pieces[i] = p.Piece
+		detailed.Escaped[i] = escapePiece(p.Piece)
+	}
+	return detailed, nil
+}
+
+// escapePiece returns the piece with each byte that isn't part of a valid UTF-8 sequence
+// escaped as \xNN, e.g. the first byte of a character split over byte-level tokens.
+// Valid pieces are returned as is.
+func escapePiece(piece string) string {
+	if utf8.ValidString(piece) {
+		return piece
+	}
+	var sb strings.Builder
+	for i := 0; i < len(piece); {
+		r, size := utf8.DecodeRuneInString(piece[i:])
+		if r == utf8.RuneError && size <= 1 {
+			fmt.Fprintf(&sb, "\\x%02x", piece[i])
+			i++
+			continue
+		}
+		sb.WriteString(piece[i : i+size])
+		i += size
+	}
+	return sb.String()
+}
+
+// alignPieces sets the spans of the pieces by matching them against the prompt in order.
+// A piece matches exactly, after whitespace the tokenizer added or normalized away (e.g. the
+// SentencePiece space prefix), or case-insensitively. Pieces that don't match get an empty span.
+// The spans never overlap and cover the whole prompt: skipped bytes belong to the following
+// piece, and trailing unmatched bytes to the last piece that matched (or the last piece if none did).
+func alignPieces(prompt string, pieces []TokenPiece) {
+	cursor := 0
+	lastMatched := -1
+	for i := range pieces {
+		start, end, ok := matchPiece(prompt, cursor, pieces[i].Piece)
+		if !ok {
+			pieces[i].Start, pieces[i].End = cursor, cursor
+			continue
+		}
+		pieces[i].Start, pieces[i].End = start, end
+		cursor = end
+		lastMatched = i
+	}
+
+	if cursor < len(prompt) && len(pieces) > 0 {
+		// if no piece matched at all, the whole prompt belongs to the last piece.
+		if lastMatched < 0 {
+			lastMatched = len(pieces) - 1
+		}
+		pieces[lastMatched].End = len(prompt)
+		for i := lastMatched + 1; i < len(pieces); i++ {
+			pieces[i].Start, pieces[i].End = len(prompt), len(prompt)
+		}
+	}
+}
+
+// matchPiece finds the span of piece in the prompt at cursor. The span starts at cursor.
+func matchPiece(prompt string, cursor int, piece string) (start, end int, ok bool) {
+	rest := prompt[cursor:]
+	if piece == "" {
+		return 0, 0, false
+	}
+	if strings.HasPrefix(rest, piece) {
+		return cursor, cursor + len(piece), true
+	}
+
+	trimmedPiece := strings.TrimLeft(piece, " ")
+	trimmedRest := strings.TrimLeft(rest, " \t\r\n")
+	skipped := len(rest) - len(trimmedRest)
+	if trimmedPiece == "" {
+		if skipped > 0 {
+			return cursor, cursor + skipped, true
+		}
+		return 0, 0, false
+	}
+	if len(trimmedRest) >= len(trimmedPiece) && strings.EqualFold(trimmedRest[:len(trimmedPiece)], trimmedPiece) {
+		return cursor, cursor + skipped + len(trimmedPiece), true
+	}
+	return 0, 0, false
+}
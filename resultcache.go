@@ -0,0 +1,107 @@
+package ollamatokenizer
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+)
+
+// ResultCacheKey identifies a cached result by model and the SHA-256 of the prompt.
+type ResultCacheKey struct {
+	Model     string
+	InputHash [sha256.Size]byte
+}
+
+// NewResultCacheKey returns the key under which results for the prompt are cached.
+func NewResultCacheKey(model, prompt string) ResultCacheKey {
+	return ResultCacheKey{Model: model, InputHash: sha256.Sum256([]byte(prompt))}
+}
+
+// CachedResult is a cached tokenization result.
+// Tokens is nil if only the count is known (the prompt was counted but never tokenized).
+type CachedResult struct {
+	Count  int
+	Tokens []int
+}
+
+// ResultCache stores tokenization results, see TokenizerWithResultCacheBackend.
+// Implementations must be safe for concurrent use. A shared backend (e.g. Redis) can be used
+// to share results between instances, failures should be reported as a cache miss.
+type ResultCache interface {
+	// Get returns the cached result for the key, or false on a cache miss.
+	Get(key ResultCacheKey) (CachedResult, bool)
+	// Set stores the result for the key.
+	Set(key ResultCacheKey, result CachedResult)
+}
+
+// NewLRUResultCache returns an in-memory ResultCache holding up to size results,
+// evicting the least recently used result when full.
+// This is the backend used by TokenizerWithResultCache.
+func NewLRUResultCache(size int) ResultCache {
+	return newLRUResultCache(size)
+}
+
+type resultEntry struct {
+	key    ResultCacheKey
+	result CachedResult
+}
+
+// lruResultCache is a fixed size, concurrency safe LRU ResultCache.
+type lruResultCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List // front is most recently used
+	entries map[ResultCacheKey]*list.Element
+}
+
+func newLRUResultCache(size int) *lruResultCache {
+	return &lruResultCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[ResultCacheKey]*list.Element, size),
+	}
+}
+
+// Get implements ResultCache.
+func (l *lruResultCache) Get(key ResultCacheKey) (CachedResult, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	elem, ok := l.entries[key]
+	if !ok {
+		return CachedResult{}, false
+	}
+	l.order.MoveToFront(elem)
+	return elem.Value.(*resultEntry).result, true
+}
+
+// Set implements ResultCache.
+func (l *lruResultCache) Set(key ResultCacheKey, result CachedResult) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if elem, ok := l.entries[key]; ok {
+		elem.Value.(*resultEntry).result = result
+		l.order.MoveToFront(elem)
+		return
+	}
+	l.entries[key] = l.order.PushFront(&resultEntry{key: key, result: result})
+	if l.order.Len() > l.size {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.entries, oldest.Value.(*resultEntry).key)
+	}
+}
+
+// removeModel drops all cached results of the model.
+func (l *lruResultCache) removeModel(model string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, elem := range l.entries {
+		if key.Model == model {
+			l.order.Remove(elem)
+			delete(l.entries, key)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package ollamatokenizer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"time"
+)
+
+// transientError marks a download failure that may succeed when retried:
+// a network error or a 5xx response, see TokenizerWithRetry.
+type transientError struct {
+	err error
+}
+
+func (e *transientError) Error() string { return e.err.Error() }
+
+func (e *transientError) Unwrap() error { return e.err }
+
+// isTransient reports whether retrying the download that failed with err may succeed.
+func isTransient(err error) bool {
+	var transient *transientError
+	return errors.As(err, &transient)
+}
+
+// errorRecordingReader records the error reading from r, to tell network failures while reading
+// a response body apart from failures writing the download.
+type errorRecordingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *errorRecordingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// maxRetryDelay caps the backoff before the jitter, so many retries or a large base delay don't
+// wait for hours (or, once the doubling overflows, not at all).
+const maxRetryDelay = 30 * time.Second
+
+// retryDelay returns the backoff before the given retry (1 for the first one): baseDelay doubled per
+// retry up to maxRetryDelay, with a jitter of ±50% so clients failing together don't retry in lockstep.
+func retryDelay(baseDelay time.Duration, retry int) time.Duration {
+	if baseDelay <= 0 {
+		return 0
+	}
+	delay := min(baseDelay, maxRetryDelay)
+	for i := 1; i < retry && delay < maxRetryDelay; i++ {
+		delay = min(2*delay, maxRetryDelay)
+	}
+	return delay/2 + rand.N(delay)
+}
+
+// downloadWithRetry downloads like downloadFile, retrying transient failures as configured by
+// TokenizerWithRetry. It gives up without waiting if the backoff would outlast the deadline of ctx.
+func (c *ollamatokenizer) downloadWithRetry(ctx context.Context, modelName, urlStr, destPath string) error {
+	c.mu.RLock()
+	maxAttempts, baseDelay, clock := c.retryAttempts, c.retryBaseDelay, c.clock
+	collector, _ := c.metrics.(RetryCollector)
+	c.mu.RUnlock()
+
+	for attempt := 1; ; attempt++ {
+		err := c.downloadFile(ctx, urlStr, destPath)
+		if err == nil || attempt >= maxAttempts || !isTransient(err) || ctx.Err() != nil {
+			return err
+		}
+		delay := retryDelay(baseDelay, attempt)
+		if deadline, ok := ctx.Deadline(); ok && deadline.Sub(clock.Now()) < delay {
+			return err
+		}
+		fmt.Printf("Download of model %s from %s failed: %v, retrying in %s (attempt %d of %d)\n", modelName, urlStr, err, delay, attempt+1, maxAttempts)
+		if collector != nil {
+			collector.ObserveRetry(RetryMetrics{Model: modelName, URL: urlStr, Attempt: attempt + 1, Delay: delay, Err: err})
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-clock.After(delay):
+		}
+	}
+}
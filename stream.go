@@ -0,0 +1,148 @@
+package ollamatokenizer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ollama/ollama/llama"
+)
+
+// streamProgressInterval is the minimum interval between two progress callbacks of CountTokensStream.
+const streamProgressInterval = 100 * time.Millisecond
+
+// maxPendingInput bounds the input CountTokensReader holds back waiting for a safe cut, see readerCut.
+const maxPendingInput = 4 * maxPromptBytes
+
+// CountTokensStream implements Tokenizer.
+func (c *ollamatokenizer) CountTokensStream(ctx context.Context, modelName string, r io.Reader, progress func(tokensSoFar int)) (int, error) {
+	return c.countReader(ctx, modelName, r, progress)
+}
+
+// CountTokensReader implements Tokenizer.
+func (c *ollamatokenizer) CountTokensReader(modelName string, r io.Reader) (int, error) {
+	total, err := c.countReader(context.Background(), modelName, r, nil)
+	if err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// countReader counts the text read from r in the chunks countChunks cuts the whole text in, so the
+// count equals CountTokens of the whole text. progress, if not nil, is called with the tokens counted
+// so far at most every streamProgressInterval and once with the total at the end. It returns the
+// tokens counted so far, also on error.
+func (c *ollamatokenizer) countReader(ctx context.Context, modelName string, r io.Reader, progress func(tokensSoFar int)) (int, error) {
+	raw := make([]byte, 0, maxPromptBytes)
+	readBuf := make([]byte, maxPromptBytes)
+	var pending []byte // preprocessed text not counted yet
+	total := 0
+	counted := false
+	used := modelName
+	lastProgress := c.clock.Now()
+
+	// count counts a chunk like countChunks would at the same offset of the whole prompt.
+	count := func(chunk []byte) error {
+		if err := c.waitThrottle(ctx); err != nil {
+			return err
+		}
+		// the model is acquired per chunk, so a slow reader doesn't hold it.
+		var model *llama.Model
+		var release func()
+		var err error
+		if counted {
+			model, release, err = c.acquireModelContext(ctx, used)
+		} else {
+			// the first chunk decides on the fallback, the rest is counted with the same model.
+			model, used, release, err = c.acquireModelOrFallbackContext(ctx, modelName)
+		}
+		if err != nil {
+			return err
+		}
+		defer release()
+		toks, err := model.Tokenize(string(chunk), !counted, true)
+		if err != nil {
+			return fmt.Errorf("tokenization failed for bytes %d-%d: %w", total, total+len(chunk), err)
+		}
+		total += len(toks)
+		c.throttle.take(len(toks))
+		counted = true
+		return nil
+	}
+
+	for eof := false; !eof; {
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+		n, err := r.Read(readBuf)
+		raw = append(raw, readBuf[:n]...)
+		switch {
+		case errors.Is(err, io.EOF):
+			eof = true
+		case err != nil:
+			return total, fmt.Errorf("failed to read input: %w", err)
+		}
+
+		cut := len(raw)
+		if !eof {
+			cut = readerCut(raw)
+		}
+		text, err := c.preprocess(string(raw[:cut]))
+		if err != nil {
+			return total, err
+		}
+		pending = append(pending, text...)
+		raw = append(raw[:0], raw[cut:]...)
+
+		// the chunks are cut like countChunks cuts the whole prompt, only the last one may be shorter.
+		for len(pending) > maxPromptBytes {
+			end := maxPromptBytes
+			for end > 0 && !utf8.RuneStart(pending[end]) {
+				end--
+			}
+			if end == 0 {
+				end = 1
+			}
+			if err := count(pending[:end]); err != nil {
+				return total, err
+			}
+			pending = append(pending[:0], pending[end:]...)
+		}
+
+		if progress != nil && !eof && c.clock.Now().Sub(lastProgress) >= streamProgressInterval {
+			progress(total)
+			lastProgress = c.clock.Now()
+		}
+	}
+	if len(pending) > 0 {
+		if err := count(pending); err != nil {
+			return total, err
+		}
+	}
+	if progress != nil {
+		progress(total)
+	}
+	return total, nil
+}
+
+// readerCut returns up to where CountTokensReader can preprocess the input read so far as if it was
+// preprocessed whole: after the last complete, valid character that isn't a '\r' (which may start a
+// "\r\n" line ending). Incomplete or invalid trailing bytes are held back, unless more than
+// maxPendingInput bytes are, so runs of invalid bytes are replaced like in the whole input.
+func readerCut(raw []byte) int {
+	for end := len(raw); end > 0; {
+		r, size := utf8.DecodeLastRune(raw[:end])
+		invalid := r == utf8.RuneError && size == 1
+		if !invalid && r != '\r' {
+			return end
+		}
+		end -= size
+	}
+	if len(raw) > maxPendingInput {
+		return len(raw)
+	}
+	return 0
+}
@@ -0,0 +1,88 @@
+package ollamatokenizer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// tokenThrottle limits the tokens produced per second with a token bucket holding up to one
+// second worth of tokens. The size of a result is only known after tokenizing, so a result
+// is taken from the bucket afterwards, possibly overdrawing it; later calls then wait until
+// the bucket is refilled.
+type tokenThrottle struct {
+	mu        sync.Mutex
+	rate      float64
+	available float64
+	last      time.Time
+	clock     Clock
+}
+
+func newTokenThrottle(tokensPerSecond int, clock Clock) *tokenThrottle {
+	return &tokenThrottle{
+		rate:      float64(tokensPerSecond),
+		available: float64(tokensPerSecond),
+		last:      clock.Now(),
+		clock:     clock,
+	}
+}
+
+// refillLocked adds the tokens accrued since the last refill.
+func (t *tokenThrottle) refillLocked() {
+	now := t.clock.Now()
+	t.available = min(t.rate, t.available+now.Sub(t.last).Seconds()*t.rate)
+	t.last = now
+}
+
+// wait blocks until the bucket is no longer overdrawn, or fails with the error of ctx once it is done.
+// A nil throttle never waits.
+func (t *tokenThrottle) wait(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	for {
+		delay := t.delay()
+		if delay == 0 {
+			return nil
+		}
+		select {
+		case <-t.clock.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// allow fails with ErrRateLimited instead of waiting while the bucket is overdrawn.
+func (t *tokenThrottle) allow() error {
+	if t == nil {
+		return nil
+	}
+	if delay := t.delay(); delay > 0 {
+		return fmt.Errorf("%w: budget of %.0f tokens per second exhausted, retry in %s", ErrRateLimited, t.rate, delay.Round(time.Millisecond))
+	}
+	return nil
+}
+
+// delay returns how long until the bucket is no longer overdrawn, at least a millisecond, or 0 if it isn't.
+func (t *tokenThrottle) delay() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.refillLocked()
+	if t.available > 0 {
+		return 0
+	}
+	return max(time.Duration(-t.available/t.rate*float64(time.Second)), time.Millisecond)
+}
+
+// take removes n produced tokens from the bucket.
+func (t *tokenThrottle) take(n int) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.refillLocked()
+	t.available -= float64(n)
+}
@@ -1,25 +1,253 @@
 package ollamatokenizer
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
 	"unicode/utf8"
 
 	"maps"
 
+	"github.com/ollama/ollama/fs/ggml"
 	"github.com/ollama/ollama/llama"
+	chattemplate "github.com/ollama/ollama/template"
 )
 
 // maximum prompt size in bytes to prevent potential segfaults
 // observed with very large inputs (e.g., >16KB) in the underlying library.
 const maxPromptBytes = 16 * 1024 // 16 KiB
 
+// ErrInvalidUTF8 is returned for prompts containing malformed UTF-8 when InvalidUTF8Error is configured.
+var ErrInvalidUTF8 = errors.New("invalid UTF-8 in prompt")
+
+// ErrUnsupportedBackend is returned for model map entries selecting a backend this package cannot load.
+var ErrUnsupportedBackend = errors.New("unsupported tokenizer backend")
+
+// ErrOfflineMode is returned when a model would have to be downloaded while TokenizerWithOffline is enabled.
+var ErrOfflineMode = errors.New("offline mode: network access disabled")
+
+// ErrUnknownModel is returned, wrapped in an *UnknownModelError, for model names that are not configured.
+var ErrUnknownModel = errors.New("unknown model")
+
+// ErrModelNotFound is ErrUnknownModel under the name used by the error classes of the HTTP server:
+// errors.Is(err, ErrModelNotFound) matches model names that are not configured.
+var ErrModelNotFound = ErrUnknownModel
+
+// ErrBackendUnavailable is wrapped by errors of a model whose source can't be reached,
+// e.g. a failed download or a missing local file. Retrying later may succeed.
+var ErrBackendUnavailable = errors.New("tokenizer backend unavailable")
+
+// ErrOverloaded is returned for calls beyond the limit of TokenizerWithMaxConcurrency if
+// TokenizerWithFailFast is enabled. Retrying later may succeed.
+var ErrOverloaded = errors.New("tokenizer overloaded")
+
+// ErrRateLimited is returned for calls while the budget of TokenizerWithMaxTokensPerSecond is exhausted
+// if TokenizerWithFailFast is enabled. Retrying later may succeed.
+var ErrRateLimited = errors.New("tokenizer rate limited")
+
+// UnknownModelError reports a model name that is not configured, together with similar configured names.
+type UnknownModelError struct {
+	Model string
+	// Suggestions are the configured models closest to Model by edit distance,
+	// directly or via the model family aliases, closest first. It may be empty.
+	Suggestions []string
+}
+
+func (e *UnknownModelError) Error() string {
+	if len(e.Suggestions) == 0 {
+		return fmt.Sprintf("unknown model '%s'", e.Model)
+	}
+	return fmt.Sprintf("unknown model '%s'; did you mean '%s'?", e.Model, strings.Join(e.Suggestions, "', '"))
+}
+
+// Unwrap returns ErrUnknownModel, so errors.Is(err, ErrUnknownModel) matches.
+func (e *UnknownModelError) Unwrap() error {
+	return ErrUnknownModel
+}
+
+// ErrInputTooLarge is returned, wrapped in an *InputTooLargeError, for prompts exceeding the input limit.
+var ErrInputTooLarge = errors.New("input too large")
+
+// InputTooLargeError reports a prompt exceeding the input limit, see TokenizerWithMaxInputBytes.
+type InputTooLargeError struct {
+	// Size is the size of the prompt in bytes, after the input normalizations.
+	Size int
+	// Limit is the configured maximum input size in bytes.
+	Limit int
+}
+
+func (e *InputTooLargeError) Error() string {
+	return fmt.Sprintf("input prompt size (%d bytes) exceeds maximum allowed size (%d bytes)", e.Size, e.Limit)
+}
+
+// Unwrap returns ErrInputTooLarge, so errors.Is(err, ErrInputTooLarge) matches.
+func (e *InputTooLargeError) Unwrap() error {
+	return ErrInputTooLarge
+}
+
+// PreloadError reports the models that failed to preload, see TokenizerWithPreloadedModels.
+type PreloadError struct {
+	// Errors maps each model that failed to preload to its error.
+	Errors map[string]error
+}
+
+func (e *PreloadError) Error() string {
+	models := slices.Sorted(maps.Keys(e.Errors))
+	if len(models) == 1 {
+		return fmt.Sprintf("failed to preload model %s: %v", models[0], e.Errors[models[0]])
+	}
+	msgs := make([]string, len(models))
+	for i, model := range models {
+		msgs[i] = fmt.Sprintf("%s: %v", model, e.Errors[model])
+	}
+	return fmt.Sprintf("failed to preload %d models: %s", len(models), strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the errors of the models, sorted by model, so errors.Is matches any of them.
+func (e *PreloadError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Errors))
+	for _, model := range slices.Sorted(maps.Keys(e.Errors)) {
+		errs = append(errs, e.Errors[model])
+	}
+	return errs
+}
+
+// MultiCountError reports the models that failed to count the prompt, see CountTokensMulti.
+type MultiCountError struct {
+	// Errors maps each model that failed to its error.
+	Errors map[string]error
+}
+
+func (e *MultiCountError) Error() string {
+	models := slices.Sorted(maps.Keys(e.Errors))
+	if len(models) == 1 {
+		return fmt.Sprintf("failed to count tokens with model %s: %v", models[0], e.Errors[models[0]])
+	}
+	msgs := make([]string, len(models))
+	for i, model := range models {
+		msgs[i] = fmt.Sprintf("%s: %v", model, e.Errors[model])
+	}
+	return fmt.Sprintf("failed to count tokens with %d models: %s", len(models), strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the errors of the models, sorted by model, so errors.Is matches any of them.
+func (e *MultiCountError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Errors))
+	for _, model := range slices.Sorted(maps.Keys(e.Errors)) {
+		errs = append(errs, e.Errors[model])
+	}
+	return errs
+}
+
+// ErrInvalidModelName is returned for model names rejected by ValidModelName.
+var ErrInvalidModelName = errors.New("invalid model name")
+
+// ErrUnknownTokenID is returned by Detokenize for token IDs outside of the vocabulary of the model
+// when UnknownIDError is configured.
+var ErrUnknownTokenID = errors.New("token ID out of vocabulary range")
+
+// InvalidTokenError reports a token ID outside of the vocabulary of the model, see ValidateTokens.
+type InvalidTokenError struct {
+	Model string
+	// Position is the index of the token in the sequence.
+	Position int
+	ID       int
+	// VocabSize is the size of the vocabulary, valid IDs are 0 to VocabSize-1.
+	VocabSize int
+}
+
+func (e *InvalidTokenError) Error() string {
+	return fmt.Sprintf("%v: token %d at position %d, model %s has %d tokens", ErrUnknownTokenID, e.ID, e.Position, e.Model, e.VocabSize)
+}
+
+// Unwrap returns ErrUnknownTokenID, so errors.Is(err, ErrUnknownTokenID) matches.
+func (e *InvalidTokenError) Unwrap() error {
+	return ErrUnknownTokenID
+}
+
+// Tokenizer backends that can be selected per model map entry with a "<backend>:" prefix,
+// e.g. "llama3=gguf:https://example.com/llama3.gguf".
+// Entries without a prefix use BackendGGUF.
+//
+// An entry may list mirrors after the primary URL, separated by mirrorSeparator, e.g.
+// "gguf:https://example.com/llama3.gguf|https://mirror.example.com/llama3.gguf".
+// The sources are tried in order until a download succeeds.
+const (
+	// BackendGGUF loads .gguf files via the ollama/ollama/llama tokenizer.
+	BackendGGUF = "gguf"
+	// BackendHF selects a Hugging Face tokenizer.json. Not supported yet.
+	BackendHF = "hf"
+	// BackendTiktoken selects a tiktoken encoding such as cl100k_base. Not supported yet.
+	BackendTiktoken = "tiktoken"
+	// BackendSPM selects a SentencePiece .model file. Not supported yet.
+	BackendSPM = "spm"
+)
+
+// InvalidUTF8Mode determines how malformed UTF-8 bytes in a prompt are treated before tokenization.
+type InvalidUTF8Mode int
+
+const (
+	// InvalidUTF8ReplaceChar replaces each run of invalid bytes with the replacement character U+FFFD.
+	// This is the default.
+	InvalidUTF8ReplaceChar InvalidUTF8Mode = iota
+	// InvalidUTF8Strip removes invalid bytes from the prompt.
+	InvalidUTF8Strip
+	// InvalidUTF8Error rejects prompts containing invalid bytes with ErrInvalidUTF8.
+	InvalidUTF8Error
+)
+
+// LineEndingMode determines how line endings in a prompt are normalized before tokenization.
+// Tokenizers usually encode "\r\n" differently from "\n", so the same text can count
+// differently depending on the platform it was written on.
+type LineEndingMode int
+
+const (
+	// LineEndingNone keeps line endings as they are. This is the default.
+	LineEndingNone LineEndingMode = iota
+	// LineEndingLF converts "\r\n" and lone "\r" line endings to "\n".
+	// Counts then no longer depend on the platform, and are usually lower for CRLF input.
+	LineEndingLF
+	// LineEndingStrip removes line breaks: each "\r\n", "\r" or "\n" is replaced by a single space,
+	// so words on adjacent lines stay separated.
+	LineEndingStrip
+)
+
+// UnknownIDHandling determines how Detokenize treats token IDs outside of the vocabulary of the model,
+// e.g. when decoding IDs from an untrusted source.
+type UnknownIDHandling struct {
+	skip        bool
+	replace     bool
+	replacement string
+}
+
+var (
+	// UnknownIDError rejects token sequences containing unknown IDs with ErrUnknownTokenID.
+	// This is the default.
+	UnknownIDError = UnknownIDHandling{}
+	// UnknownIDSkip drops unknown IDs from the decoded text.
+	UnknownIDSkip = UnknownIDHandling{skip: true}
+)
+
+// UnknownIDReplacementPiece decodes each unknown ID as piece, e.g. "\uFFFD" or "<unk>".
+func UnknownIDReplacementPiece(piece string) UnknownIDHandling {
+	return UnknownIDHandling{replace: true, replacement: piece}
+}
+
 // Tokenizer represents an interface for tokenizing text using a specific model.
 type Tokenizer interface {
 	// CountTokens counts the number of tokens in the given prompt using the specified model.
@@ -27,19 +255,315 @@ type Tokenizer interface {
 	// - When you need the token count but not the actual tokens.
 	// - For validating prompt length against model limits (e.g., before API calls).
 	CountTokens(modelName, prompt string) (int, error)
+	// CountTokensCtx is CountTokens, giving up once ctx is done: a download of the model is aborted,
+	// and long prompts stop being counted between chunks. The error then wraps the error of ctx.
+	CountTokensCtx(ctx context.Context, modelName, prompt string) (int, error)
+	// CountTokensCached counts the tokens like CountTokens and reports whether the count was served
+	// from the result cache (see TokenizerWithResultCache). Without a result cache, cached is always false.
+	CountTokensCached(modelName, prompt string) (count int, cached bool, err error)
+	// CountTokensLines counts the tokens of each "\n"-separated line of text and returns
+	// the per-line counts together with their total.
+	// Each line is counted on its own exactly as CountTokens would count it, so empty lines
+	// count 0 and the total is the sum of the per-line counts. This generally differs from
+	// CountTokens on the whole text, since the newlines themselves are not counted and each
+	// non-empty line gets its own BOS token.
+	// A trailing newline terminates the last line and does not start a new empty one.
+	CountTokensLines(modelName, text string) ([]int, int, error)
+	// CountTokensBoth returns the standard count of the prompt together with the count without
+	// the normalization this package applies (see TokenizerWithLineEndingNormalization), to show its effect.
+	// Invalid UTF-8 is handled in both counts as configured, since the backend requires valid UTF-8, and
+	// the normalizer of the model itself (e.g. SentencePiece) can't be bypassed with the llama.cpp backend.
+	// The counts are therefore equal unless line endings are normalized and the prompt contains "\r" or "\n".
+	CountTokensBoth(modelName, prompt string) (normalized int, raw int, err error)
+	// CountTokensBatch counts the tokens of each prompt like CountTokens, concurrently on at most
+	// as many goroutines as configured by TokenizerWithBatchConcurrency. The counts are returned in
+	// the order of the prompts. It fails with the error of the first prompt that can't be counted.
+	CountTokensBatch(modelName string, prompts []string) ([]int, error)
+	// TokenizeBatch is CountTokensBatch for Tokenize.
+	TokenizeBatch(modelName string, prompts []string) ([][]int, error)
+	// CountTokensBatchStats counts the tokens of each prompt and returns summary statistics of the
+	// counts (total, min, max, mean and percentiles), e.g. to profile a dataset.
+	// It fails with the error of the first prompt that can't be counted.
+	CountTokensBatchStats(modelName string, prompts []string) (BatchStats, error)
+	// CountChatTokensCumulative counts the tokens of a conversation, returning the running total after
+	// each message and the total of all messages, e.g. to show the remaining context in a chat UI.
+	// The running total after a message is the CountChatTokens count of the conversation up to it, so
+	// the total equals CountChatTokens of all messages, and the running totals of a conversation stay
+	// the same when messages are appended to it. No messages count 0.
+	CountChatTokensCumulative(modelName string, messages []ChatMessage) ([]int, int, error)
+	// CountChatTokens counts the tokens of a chat request the way the model sees it: the messages are
+	// rendered with the chat template of the model, including its role markers and the prompt for the
+	// assistant's reply. The template is the one set by TokenizerWithChatTemplate, or else the one
+	// embedded in the model file (matched to the equivalent ollama template), or else the ChatML layout.
+	CountChatTokens(modelName string, messages []ChatMessage) (int, error)
+	// CountToolTokens counts the tokens the tool definitions take up in the prompt of a function calling
+	// request: each tool serialized as JSON in the tool format of the model family (the llama 3 prompt for
+	// llama models, the <tools> block of Hermes style templates otherwise), including its surrounding text.
+	// Returns 0 for no tools.
+	CountToolTokens(modelName string, tools []ToolDef) (int, error)
+	// CountTokensFields counts the tokens of each named field, e.g. the parts of a structured prompt,
+	// and returns the per-field counts together with their total.
+	// Like CountTokensLines, each field is counted on its own as CountTokens would count it.
+	CountTokensFields(modelName string, fields map[string]string) (map[string]int, int, error)
+	// CountTokensTemplate executes the text/template tmpl with data and counts the tokens of the output.
+	// Missing map keys are an error instead of rendering "<no value>".
+	CountTokensTemplate(modelName, tmpl string, data any) (int, error)
+	// CompareCountsParallel counts the prompt with each of the given models concurrently,
+	// using at most as many models at a time as configured by TokenizerWithBatchConcurrency.
+	// It returns the counts of the models that succeeded and the errors of those that failed,
+	// both keyed by model name. Duplicate model names are counted once.
+	CompareCountsParallel(models []string, prompt string) (map[string]int, map[string]error)
+	// CountTokensMulti counts the prompt with each of the given models concurrently, like
+	// CompareCountsParallel, e.g. to find the model encoding a text most compactly. The counts are keyed
+	// by the model names as given, a name given more than once is counted once and appears once.
+	// If models fail, the counts of the others are still returned together with a *MultiCountError
+	// naming each failed model, so one bad model doesn't discard the result.
+	CountTokensMulti(models []string, prompt string) (map[string]int, error)
+	// WrapperOverhead returns the number of tokens a fixed prefix and suffix add around sampleContent,
+	// computed as count(prefix+sampleContent+suffix) - count(sampleContent).
+	// Tokenization is not additive at the boundaries, so the overhead may depend on the sample content.
+	// Use representative content when budgeting a template.
+	WrapperOverhead(modelName, prefix, suffix, sampleContent string) (int, error)
+	// ModelInfo resolves the model name like ResolveModel, loads the resolved model and describes it:
+	// its architecture, tokenizer type and vocabulary size as read from the model file, and the URL and
+	// source (network, download cache or local file) the file was taken from, to verify which tokenizer
+	// a name maps to.
+	ModelInfo(modelName string) (ModelInfo, error)
+	// ApproxMemoryUsage returns the approximate memory in bytes used by the loaded models.
+	// A model is estimated by the size of the tokenizer metadata (vocabulary, merges, scores) in its file.
+	ApproxMemoryUsage() int64
+	// AddModel registers a single model at runtime, without replacing the configured model map.
+	// It errors if the name is already registered with a different URL. The change is visible to
+	// AvailableModels immediately, ModelWithPreload additionally loads the model right away.
+	AddModel(name, url string, opts ...ModelOption) error
+	// RemoveModel unregisters the model and unloads it from memory once in-flight tokenizations finish.
+	RemoveModel(name string) error
+	// UnloadModel frees the memory of the loaded model once in-flight tokenizations of it finish, e.g. for
+	// models that have been idle. The model stays configured and is loaded again on its next use.
+	// Unloading a model that isn't loaded does nothing. Other models are not affected.
+	UnloadModel(name string) error
+	// LoadedModels returns the names of the models resident in memory, sorted by name.
+	LoadedModels() []string
+	// FitsWithin reports whether the prompt fits within maxTokens for the specified model,
+	// together with the prompt's token count.
+	FitsWithin(modelName, prompt string, maxTokens int) (bool, int, error)
+	// ContextWindow returns the registered context window (in tokens) of the specified model.
+	// The boolean is false if no context window is known for the model.
+	// Context windows are registered via TokenizerWithContextWindows.
+	ContextWindow(modelName string) (int, bool)
+	// CountTokensDetailed is CountTokensCached, additionally reporting whether the count exceeds
+	// the registered context window of the model.
+	CountTokensDetailed(modelName, prompt string) (CountResult, error)
+	// CountTokensDetailedCtx is CountTokensDetailed, giving up once ctx is done like CountTokensCtx.
+	// The result reports which model counted, so counts from a fallback can be logged or alerted on.
+	CountTokensDetailedCtx(ctx context.Context, modelName, prompt string) (CountResult, error)
+	// CountTokensStream counts the tokens of the text read from r, e.g. a huge document, without
+	// holding it in memory. It counts like CountTokensReader, so the count equals CountTokens of the
+	// whole text. progress, if not nil, is called with the tokens counted so far at most every 100ms and once
+	// with the total at the end. Once ctx is done, the count so far is returned with the error of ctx.
+	CountTokensStream(ctx context.Context, modelName string, r io.Reader, progress func(tokensSoFar int)) (int, error)
+	// CountTokensReader counts the tokens of the text read from r without holding it in memory, returning
+	// the same count as CountTokens of the whole text: the text is counted in the same chunks, and characters
+	// and line endings split between reads are put back together before counting.
+	CountTokensReader(modelName string, r io.Reader) (int, error)
+	// EstimateTokens returns an approximate token count of the prompt, e.g. for a gateway to cheaply reject
+	// prompts that are obviously too large. If the model is loaded, the count is exact as by CountTokens.
+	// Otherwise it is estimated from the characters of the prompt with a ratio per model family, without
+	// loading or downloading the model; the estimate may be off by a wide margin for code, numbers or
+	// non-English text. It fails for models that are not configured.
+	EstimateTokens(modelName, prompt string) (int, error)
+	// EstimateCost counts the tokens of the prompt like CountTokens and returns them together with their
+	// cost at pricePer1K per 1000 tokens. A pricePer1K of 0 uses the price registered via TokenizerWithPricing.
+	EstimateCost(modelName, prompt string, pricePer1K float64) (tokens int, cost float64, err error)
+	// EstimateCostBatch is EstimateCost for the sum of the prompts, counted like CountTokensBatch.
+	EstimateCostBatch(modelName string, prompts []string, pricePer1K float64) (tokens int, cost float64, err error)
+	// GoldenCount counts like CountTokens, but always with the specified model itself, bypassing the
+	// result cache and fallbacks, so the count reflects the model and this package only.
+	// See GoldenCase for verifying counts don't drift between versions.
+	GoldenCount(modelName, text string) (int, error)
+	// CountTokensAuthoritative counts like CountTokens, but only with the authoritative backend of the
+	// model registered via TokenizerWithAuthoritativeBackends and never with a fallback model.
+	// It fails if the model is configured with a different backend, instead of returning a count
+	// that silently differs from the authoritative one.
+	CountTokensAuthoritative(modelName, prompt string) (int, error)
+	// CountTokensPartial counts like CountTokens, checking ctx between the chunks large prompts are
+	// counted in. If ctx is done before the whole prompt is counted, the count of the chunks counted
+	// so far is returned with Partial set, together with the error of ctx. This gives an approximate
+	// but timely count for very large prompts, the partial count is lower than the full one.
+	// Waiting for the model, e.g. for its download, gives up once ctx is done too, counting 0.
+	// Results are not cached.
+	CountTokensPartial(ctx context.Context, modelName, prompt string) (PartialCount, error)
+	// PipelineInfo describes the normalizer, pre-tokenizer and model type (BPE, WordPiece, Unigram, ...)
+	// loaded for the specified model.
+	// Useful to understand why the same text counts differently between models.
+	PipelineInfo(modelName string) (PipelineInfo, error)
+	// IsByteLevel reports whether the specified model tokenizes byte-level (GPT-2 style BPE), see PipelineInfo.ByteLevel.
+	// Pieces of byte-level models may hold parts of a character, e.g. of CJK text or emoji.
+	IsByteLevel(modelName string) (bool, error)
+	// Encode encodes the text with the specified model, configured by per-call options.
+	// Without options it returns the same tokens as Tokenize.
+	Encode(modelName, text string, opts ...EncodeOption) (Encoding, error)
+	// TokenizeWithSpecial tokenizes like Tokenize, with (true) or without (false) the BOS and EOS
+	// tokens, regardless of whether the model adds them by default. Unlike EncodeWithBOS and
+	// EncodeWithEOS, adding a token the model does not define is a no-op instead of an error.
+	TokenizeWithSpecial(modelName, prompt string, addBOS, addEOS bool) ([]int, error)
+	// NewEncoder returns an Encoder counting the tokens of text appended incrementally with the specified model.
+	NewEncoder(modelName string) (*Encoder, error)
+	// EncodeForEmbedding encodes the text and truncates the encoding to maxLen tokens if needed,
+	// reporting whether it was truncated.
+	// A closing EOS/SEP token added by the model is kept as the last token of a truncated encoding.
+	// Texts of any size can be encoded, TokenizerWithMaxInputBytes doesn't apply, and tokenization
+	// stops once more than maxLen tokens are produced.
+	EncodeForEmbedding(modelName, text string, maxLen int) (Encoding, bool, error)
+	// TokenizePieces tokenizes the prompt and returns each token with its decoded text and the
+	// byte span of the prompt it covers, e.g. to highlight tokens in a UI.
+	// Spans refer to the prompt after the configured input normalizations (see TokenizerWithInvalidUTF8
+	// and TokenizerWithLineEndingNormalization) and cover it without gaps or overlaps.
+	TokenizePieces(modelName, prompt string) ([]TokenPiece, error)
+	// TokenizeWithOffsets is TokenizePieces without the decoded text: each token with the byte span
+	// [Start, End) of the prompt it was produced from. A multibyte character split over several
+	// byte-level tokens is split between their spans at byte granularity. Unlike the spans of
+	// TokenizePieces, the spans refer to the original prompt and cover it without gaps or overlaps:
+	// a span covers the bytes its token was produced from before the input normalizations, and bytes
+	// they removed belong to the span of the following token (or the last one at the end).
+	TokenizeWithOffsets(modelName, prompt string) ([]TokenSpan, error)
+	// TokenizeToPieces tokenizes the prompt and returns the decoded text of each token in order,
+	// e.g. to inspect BPE merges. Bytes that aren't valid UTF-8 on their own (byte-level tokens holding
+	// part of a character) are escaped as \xNN, so no byte is lost.
+	TokenizeToPieces(modelName, prompt string) ([]string, error)
+	// TokenizeDetailed is Tokenize, TokenizePieces and TokenizeToPieces in one call, tokenizing the
+	// prompt once: the pieces are returned both as is and escaped.
+	TokenizeDetailed(modelName, prompt string) (DetailedTokens, error)
+	// TokenizeFingerprint tokenizes the prompt and returns the tokens together with their Fingerprint,
+	// a stable hash usable as a cache key tied to the exact tokenization (e.g. for KV caches).
+	TokenizeFingerprint(modelName, prompt string) (tokens []int, fingerprint string, err error)
+	// VocabDiff compares the vocabularies of two models and returns how many entries only modelA
+	// and only modelB have. Entries are compared by their decoded text, so vocabularies using different
+	// representations (e.g. "Ġ" vs "▁" for spaces) are still comparable.
+	// Vocabularies of more than 2^20 entries are rejected to bound the work.
+	VocabDiff(modelA, modelB string) (onlyA, onlyB int, err error)
+	// SpecialTokens returns the special token IDs (BOS, EOS, PAD, UNK, ...) of the specified model.
+	// Use it to build token sequences that match what the model expects.
+	SpecialTokens(modelName string) (SpecialTokens, error)
+	// VocabSize returns the number of entries in the vocabulary of the specified model,
+	// token IDs are valid in [0, VocabSize).
+	VocabSize(modelName string) (int, error)
 	// Tokenize tokenizes the given prompt using the specified model.
+	// BPE models always apply their merges by rank (lowest first) like Hugging Face tokenizers and Ollama,
+	// the backend has no alternative (e.g. greedy) merge strategy, so counts match the reference counts.
 	Tokenize(modelName, prompt string) ([]int, error)
+	// TokenizeCtx is Tokenize, giving up once ctx is done, e.g. aborting a download of the model.
+	// The error then wraps the error of ctx.
+	TokenizeCtx(ctx context.Context, modelName, prompt string) ([]int, error)
+	// TokenizeStrict is Tokenize failing hard instead of using a fallback, e.g. for critical requests on a
+	// tokenizer that is lenient otherwise: a configured model that fails to load fails the call even if
+	// TokenizerWithLoadFailureFallback is enabled. Names that aren't configured fail with ErrModelNotFound,
+	// like they do for Tokenize, aliases are not resolved.
+	TokenizeStrict(modelName, prompt string) ([]int, error)
+	// TokenizeStrictCtx is TokenizeStrict, giving up once ctx is done like TokenizeCtx, e.g. for readiness
+	// probes that must check the named model itself.
+	TokenizeStrictCtx(ctx context.Context, modelName, prompt string) ([]int, error)
+	// CountTokensStrict is CountTokens failing hard instead of using a fallback, see TokenizeStrict.
+	CountTokensStrict(modelName, prompt string) (int, error)
+	// TokenizeAndCount tokenizes the prompt like Tokenize and returns the tokens together with
+	// their count, which is always len(tokens). Use it instead of calling Tokenize and CountTokens.
+	TokenizeAndCount(modelName, prompt string) ([]int, int, error)
+	// TokensVarint tokenizes the prompt like Tokenize and returns the tokens encoded by EncodeTokensVarint,
+	// a compact format for passing tokens between services.
+	TokensVarint(modelName, prompt string) ([]byte, error)
+	// ChunkBySentences splits the text into chunks of at most maxTokens tokens each (counted like
+	// CountTokens), breaking at sentence boundaries where possible. Sentences are packed into a chunk
+	// as long as they fit, a sentence exceeding the budget on its own is split, preferably at whitespace.
+	// Sentences end after '.', '!' or '?' followed by whitespace, and after newlines. The chunks
+	// concatenate to the preprocessed text, whitespace after a sentence stays with that sentence.
+	ChunkBySentences(modelName, text string, maxTokens int) ([]string, error)
+	// ChunkByTokens splits the text into chunks of at most maxTokensPerChunk tokens each (counted like
+	// CountTokens), e.g. to embed a large document. Consecutive chunks overlap by up to overlapTokens
+	// tokens of context, the start of a chunk repeats the end of the previous one. Chunks are cut between
+	// two tokens and never inside of a multibyte character. Text that fits is returned as a single chunk.
+	// The overlap must be smaller than the chunk size.
+	ChunkByTokens(modelName, text string, maxTokensPerChunk, overlapTokens int) ([]string, error)
+	// TruncateToTokens shortens the prompt to its longest start that counts at most maxTokens tokens
+	// (like CountTokens), e.g. to fit a context window. The prompt is cut between two tokens and never
+	// inside of a multibyte character. Prompts that fit are returned unchanged, after the configured
+	// input normalizations. With TruncateKeepTail the end of the prompt is kept instead.
+	TruncateToTokens(modelName, prompt string, maxTokens int, opts ...TruncateOption) (string, error)
+	// Detokenize converts token IDs of the specified model back to text by concatenating their pieces,
+	// like llama.cpp detokenizes with special tokens removed: control tokens (e.g. BOS "<s>" and EOS)
+	// decode to nothing, and the space models like SentencePiece prefix the text with is removed, so
+	// Detokenize(Tokenize(s)) == s. IDs outside of the vocabulary are handled as configured by
+	// TokenizerWithUnknownIDHandling.
+	Detokenize(modelName string, tokens []int) (string, error)
+	// ValidateTokens checks that all token IDs are in the vocabulary of the specified model, e.g. before
+	// passing generated IDs on. It returns an *InvalidTokenError with the position and value of the first
+	// invalid ID. An empty sequence is valid. Unlike Detokenize it ignores TokenizerWithUnknownIDHandling.
+	ValidateTokens(modelName string, tokens []int) error
+	// ConcatTokens joins two token sequences of the specified model, e.g. a cached tokenized system prompt
+	// and freshly tokenized user text, without tokenizing the first one again. The BOS token the model adds
+	// to the second sequence is dropped, and the tokens next to the boundary are tokenized again, so
+	// tokens merging across it (e.g. "Hel" + "lo") are merged. Where the tokens next to the boundary
+	// don't tokenize on their own to themselves (e.g. SentencePiece space prefixes), the tokenization
+	// there depends on more context and the sequences are concatenated as they are.
+	ConcatTokens(modelName string, a, b []int) ([]int, error)
+	// NewDecoder returns a Decoder decoding a stream of tokens of the specified model one token at a time.
+	NewDecoder(modelName string) (*Decoder, error)
 	// AvailableModels returns a list of available models that can be used for tokenization.
 	// This method is useful when you need to know which models are available for tokenization.
+	// The names are sorted, so the list only changes when models are added or removed.
 	AvailableModels() []string
 	// OptimalTokenizerModel returns the optimal model for tokenization based on the given model.
 	// This is useful when the basedOnModel is not available in the list of available models.
 	// The implementation is based on the tokenizer model mappings.
 	// Logic flow:
-	// - Checks for exact matches in configured models.
-	// - Falls back to substring matches (e.g., phi3 → phi-3).
-	// - Uses a fallback model (default: llama-3.1) if no match is found.
+	// - Checks for exact matches in configured models (ignoring case and tag).
+	// - Checks for configured models equal to the name after NormalizeModelName (e.g., Llama_3.2 → llama-3.2).
+	// - Falls back to substring matches of the normalized names (e.g., phi3 → phi-3),
+	//   the longest matching substring wins.
+	// - Uses a fallback model (default: llama-3.1) if no match is found. With TokenizerWithStrictModelMatching
+	//   it returns an *UnknownModelError instead. TokenizeStrict and CountTokensStrict don't change it, so
+	//   passing the result of a fallback resolution to them counts with the fallback model.
+	// Ties are broken by the lexicographically smallest model name, see ModelResolution.Ambiguous.
 	OptimalTokenizerModel(basedOnModel string) (string, error)
+	// InFlight returns the number of calls currently using a model, e.g. to watch requests drain on shutdown
+	// or to size TokenizerWithMaxConcurrency.
+	InFlight() int
+	// Ready reports whether the models preloaded via TokenizerWithBackgroundPreload are all loaded.
+	// It is always true without background preloading.
+	Ready() bool
+	// WaitReady waits until the background preload finished and returns its error, naming the models
+	// that failed to load, or ctx.Err() if ctx is done first. With an already done ctx it doesn't wait,
+	// reporting the preload error if preloading already finished.
+	WaitReady(ctx context.Context) error
+	// ResolveModel is OptimalTokenizerModel, additionally reporting how the model was resolved.
+	// It neither loads nor downloads models, so it can be used to preview what a name resolves to.
+	ResolveModel(basedOnModel string) (ModelResolution, error)
+	// CacheStats returns the number and total size of the model files cached on disk.
+	CacheStats() (entries int, totalBytes int64, err error)
+	// PruneCache removes cached model files as selected by the policy, least recently loaded first,
+	// and returns how many files were removed and their total size. Files of loaded models are kept.
+	// Removed models are downloaded again when they are used next. Downloads and loads in progress
+	// are not held back, pruning the file of a model being loaded may fail that load.
+	PruneCache(policy CachePrunePolicy) (removed int, freedBytes int64, err error)
+	// Close releases the resources of the tokenizer, e.g. on shutdown: it cancels a background preload,
+	// frees all loaded models once the calls in flight using them finish, and closes the result cache if
+	// it implements io.Closer. The tokenizer must not be used after Close. Cached model files are kept.
+	Close() error
+	// ExplainModel resolves the model name and loads the resolved model like a tokenizer call would,
+	// reporting each load attempt including fallbacks, to diagnose which model a count came from.
+	ExplainModel(basedOnModel string) (ModelExplanation, error)
+}
+
+// ModelResolution is the result of ResolveModel.
+type ModelResolution struct {
+	// Resolved is the model that is used for tokenization.
+	Resolved string
+	// Exact is set if the given name (ignoring case and tag) is a configured model.
+	Exact bool
+	// FallbackUsed is set if neither a configured model nor a family matched the name.
+	FallbackUsed bool
+	// Ambiguous lists all models that matched the name equally well, sorted, if there was more than one.
+	// Resolved is the first of them.
+	Ambiguous []string
 }
 
 // TokenizerModelMappings represents
@@ -49,6 +573,18 @@ type TokenizerModelMappings struct {
 	Substrings    []string
 }
 
+// defaultModelURLs returns the built-in models, see TokenizerWithDefaultModels.
+func defaultModelURLs() map[string]string {
+	return map[string]string{
+		"tiny":                  "https://huggingface.co/Hjgugugjhuhjggg/FastThink-0.5B-Tiny-Q2_K-GGUF/resolve/main/fastthink-0.5b-tiny-q2_k.gguf",
+		"llama-3.1":             "https://huggingface.co/bartowski/Meta-Llama-3.1-8B-Instruct-GGUF/resolve/main/Meta-Llama-3.1-8B-Instruct-IQ2_M.gguf",
+		"llama-3.2":             "https://huggingface.co/unsloth/Llama-3.2-3B-Instruct-GGUF/blob/main/Llama-3.2-3B-Instruct-Q2_K.gguf",
+		"granite-embedding-30m": "https://huggingface.co/bartowski/granite-embedding-30m-english-GGUF/resolve/main/granite-embedding-30m-english-f16.gguf",
+		// RESTRICTED: "gemma-2b":  "https://huggingface.co/google/gemma-2b-GGUF/resolve/main/gemma-2b.gguf",
+		"phi-3": "https://huggingface.co/microsoft/Phi-3-mini-4k-instruct-gguf/resolve/main/Phi-3-mini-4k-instruct-q4.gguf",
+	}
+}
+
 // NewTokenizer creates a new tokenizer instance with the specified options.
 // This implementation uses the tokenizer model mappings to determine the optimal model.
 // It does not determine the optimal model dynamically instead it uses the default and/or provided mappings.
@@ -74,15 +610,6 @@ type TokenizerModelMappings struct {
 // tokens, _ := tokenizer.Tokenize(model, "Hello, world!")
 // fmt.Printf("Tokens: %v\n", tokens)
 func NewTokenizer(opts ...TokenizerOption) (Tokenizer, error) {
-	defaultModelURLs := map[string]string{
-		"tiny":                  "https://huggingface.co/Hjgugugjhuhjggg/FastThink-0.5B-Tiny-Q2_K-GGUF/resolve/main/fastthink-0.5b-tiny-q2_k.gguf",
-		"llama-3.1":             "https://huggingface.co/bartowski/Meta-Llama-3.1-8B-Instruct-GGUF/resolve/main/Meta-Llama-3.1-8B-Instruct-IQ2_M.gguf",
-		"llama-3.2":             "https://huggingface.co/unsloth/Llama-3.2-3B-Instruct-GGUF/blob/main/Llama-3.2-3B-Instruct-Q2_K.gguf",
-		"granite-embedding-30m": "https://huggingface.co/bartowski/granite-embedding-30m-english-GGUF/resolve/main/granite-embedding-30m-english-f16.gguf",
-		// RESTRICTED: "gemma-2b":  "https://huggingface.co/google/gemma-2b-GGUF/resolve/main/gemma-2b.gguf",
-		"phi-3": "https://huggingface.co/microsoft/Phi-3-mini-4k-instruct-gguf/resolve/main/Phi-3-mini-4k-instruct-q4.gguf",
-	}
-
 	fallback := "llama-3.1"
 	// Heuristic Mapping: Define families and their canonical representatives.
 	familyMappings := []TokenizerModelMappings{
@@ -93,13 +620,25 @@ func NewTokenizer(opts ...TokenizerOption) (Tokenizer, error) {
 	}
 
 	rt := &ollamatokenizer{
-		modelURLs:      defaultModelURLs,
-		loadedModels:   make(map[string]*llama.Model),
-		httpClient:     http.DefaultClient,
-		mu:             sync.RWMutex{},
-		fallback:       fallback,
-		familyMappings: familyMappings,
-		token:          "",
+		modelURLs:        defaultModelURLs(),
+		loadedModels:     make(map[string]*loadedModel),
+		metadata:         make(map[string]ggml.KV),
+		chatTemplates:    make(map[string]chatTemplate),
+		modelOrigins:     make(map[string]modelOrigin),
+		decodeRulesCache: make(map[string]*decodeRules),
+		verifiedFiles:    make(map[string]fileStamp),
+		httpClient:       http.DefaultClient,
+		mu:               sync.RWMutex{},
+		fallback:         fallback,
+		familyMappings:   familyMappings,
+		token:            "",
+		contextWindows:   make(map[string]int),
+		batchConcurrency: runtime.GOMAXPROCS(0),
+		// preloading is mostly waiting for downloads, but loading a vocabulary is CPU-bound.
+		preloadConcurrency: runtime.NumCPU(),
+		clock:              systemClock{},
+		retryAttempts:      1,
+		maxInputBytes:      maxPromptBytes,
 	}
 
 	for _, opt := range opts {
@@ -107,18 +646,105 @@ func NewTokenizer(opts ...TokenizerOption) (Tokenizer, error) {
 			return nil, err
 		}
 	}
+	// names that match no model resolve to the fallback, so removing it with TokenizerWithDefaultModels
+	// requires choosing another one. Strict model matching never falls back.
+	if _, ok := rt.modelURLs[rt.fallback]; !ok && slices.Contains(rt.removedDefaults, rt.fallback) && !rt.strictModelMatching {
+		return nil, fmt.Errorf("fallback model: %w, register it or choose another one with TokenizerWithFallbackModel", rt.unknownModelLocked(rt.fallback))
+	}
+
+	if err := rt.preload(context.Background(), rt.preloadModels); err != nil {
+		return nil, err
+	}
+
+	rt.preloaded = make(chan struct{})
+	if len(rt.backgroundPreload) == 0 {
+		close(rt.preloaded)
+	} else {
+		var ctx context.Context
+		ctx, rt.stopPreload = context.WithCancel(context.Background())
+		go func() {
+			// written before preloaded is closed, which orders it before the reads of Ready and WaitReady.
+			rt.preloadErr = rt.preload(ctx, rt.backgroundPreload)
+			close(rt.preloaded)
+		}()
+	}
 
 	return rt, nil
 }
 
 type ollamatokenizer struct {
-	modelURLs      map[string]string
-	loadedModels   map[string]*llama.Model
+	modelURLs    map[string]string
+	loadedModels map[string]*loadedModel
+	metadata     map[string]ggml.KV
+	// chatTemplates are the chat templates of the models by name, see TokenizerWithChatTemplate.
+	// Overrides are set by the option, templates embedded in the model files are cached on first use.
+	chatTemplates map[string]chatTemplate
+	// decodeRulesCache holds the decode rules of the models by name, see Detokenize.
+	decodeRulesCache map[string]*decodeRules
+	// verifiedFiles are the versions of the cached model files whose checksum was verified, by path.
+	verifiedFiles map[string]fileStamp
+	// modelOrigins records where the file of each model was last taken from, see ModelInfo.
+	modelOrigins   map[string]modelOrigin
 	mu             sync.RWMutex
 	familyMappings []TokenizerModelMappings
 	fallback       string
 	httpClient     *http.Client
 	token          string
+	useMmap        bool
+	contextWindows map[string]int
+	// contextWindowWarnings logs a warning for counts exceeding the context window of the model.
+	contextWindowWarnings bool
+	invalidUTF8           InvalidUTF8Mode
+	lineEndings           LineEndingMode
+	unknownIDs            UnknownIDHandling
+	resultCache           ResultCache
+	maxMemoryBytes        int64
+	useClock              atomic.Int64
+	offline               bool
+	throttle              *tokenThrottle
+	// modelSlots limits the concurrent calls per model, see TokenizerWithPerModelConcurrency.
+	modelSlots map[string]chan struct{}
+	// callSlots limits the concurrent calls across all models, see TokenizerWithMaxConcurrency.
+	callSlots chan struct{}
+	// failFast fails calls beyond the limit of callSlots or the budget of throttle instead of waiting.
+	failFast bool
+	// inFlight counts the acquired, not yet released models, see InFlight.
+	inFlight atomic.Int64
+	// loadFailureFallback cascades to the fallback model if a configured model fails to load.
+	loadFailureFallback bool
+	// strictModelMatching disables all fallbacks, see TokenizerWithStrictModelMatching.
+	strictModelMatching bool
+	// removedDefaults are the built-in models TokenizerWithDefaultModels removed.
+	removedDefaults []string
+	// batchConcurrency is the size of the worker pool of batch calls.
+	batchConcurrency int
+	// authoritativeBackends maps models to the backend their counts must come from.
+	authoritativeBackends map[string]string
+	// pricing maps models to their price per 1000 tokens, see EstimateCost.
+	pricing map[string]float64
+	// maxInputBytes limits the prompts of Tokenize, 0 means unlimited.
+	maxInputBytes int
+	// maxLoadedModels limits the models resident in memory, 0 means unlimited.
+	maxLoadedModels int
+	// metrics receives the measurements of calls, nil disables them.
+	metrics MetricsCollector
+	// retryAttempts and retryBaseDelay configure the retries of downloads, see TokenizerWithRetry.
+	retryAttempts  int
+	retryBaseDelay time.Duration
+	// cacheDirPath overrides the directory of the model cache, see TokenizerWithCacheDir.
+	cacheDirPath string
+	// clock is the source of time of the throttle, cache pruning and progress reports.
+	clock Clock
+	// preloadModels are the models preloaded by NewTokenizer, preloadConcurrency of them at a time.
+	preloadModels      []string
+	preloadConcurrency int
+	// backgroundPreload are the models preloaded after NewTokenizer returns.
+	backgroundPreload []string
+	// preloaded is closed once the background preload finished, preloadErr is its failure.
+	preloaded  chan struct{}
+	preloadErr error
+	// stopPreload cancels the background preload, see Close.
+	stopPreload context.CancelFunc
 }
 
 // AvailableModels implements Tokenizer.
@@ -130,15 +756,29 @@ func (c *ollamatokenizer) AvailableModels() []string {
 	for model := range c.modelURLs {
 		models = append(models, model)
 	}
+	slices.Sort(models)
 	return models
 }
 
 type TokenizerOption func(*ollamatokenizer) error
 
+// validateModelNames returns ErrInvalidModelName for the first model name rejected by ValidModelName.
+func validateModelNames(models map[string]string) error {
+	for _, name := range slices.Sorted(maps.Keys(models)) {
+		if !ValidModelName(name) {
+			return fmt.Errorf("%w: %q", ErrInvalidModelName, name)
+		}
+	}
+	return nil
+}
+
 // Add or override model URLs without replacing the defaults.
 // This allows to expand or update the model URLs.
 func TokenizerWithCustomModels(models map[string]string) TokenizerOption {
 	return func(rt *ollamatokenizer) error {
+		if err := validateModelNames(models); err != nil {
+			return err
+		}
 		rt.mu.Lock()
 		defer rt.mu.Unlock()
 		maps.Copy(rt.modelURLs, models)
@@ -146,12 +786,96 @@ func TokenizerWithCustomModels(models map[string]string) TokenizerOption {
 	}
 }
 
+// TokenizerWithLocalModel adds a model read from the file at path, e.g. baked into a container image,
+// without downloading it. The file must exist and be readable, so a misconfigured path fails here.
+// Model map entries can point at local files as well, by a file:// URL or an absolute path.
+func TokenizerWithLocalModel(name, path string) TokenizerOption {
+	return func(rt *ollamatokenizer) error {
+		if !ValidModelName(name) {
+			return fmt.Errorf("%w: %q", ErrInvalidModelName, name)
+		}
+		path = strings.TrimPrefix(path, "file://")
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return fmt.Errorf("invalid path of model %s: %w", name, err)
+		}
+		if err := checkReadableFile(abs); err != nil {
+			return fmt.Errorf("model file of %s: %w", name, err)
+		}
+		rt.mu.Lock()
+		defer rt.mu.Unlock()
+		rt.modelURLs[name] = "file://" + abs
+		return nil
+	}
+}
+
+// checkReadableFile returns an error unless path is a regular file that can be opened for reading.
+func checkReadableFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+	return nil
+}
+
+// localModelPath returns the path of a model source pointing at a local file:
+// a file:// URL or an absolute path.
+func localModelPath(source string) (string, bool) {
+	if path, ok := strings.CutPrefix(source, "file://"); ok {
+		return path, true
+	}
+	if filepath.IsAbs(source) {
+		return source, true
+	}
+	return "", false
+}
+
 // TokenizerWithModelMap Replaces the default model URLs entirely.
 func TokenizerWithModelMap(models map[string]string) TokenizerOption {
 	return func(rt *ollamatokenizer) error {
+		if err := validateModelNames(models); err != nil {
+			return err
+		}
+		rt.mu.Lock()
+		defer rt.mu.Unlock()
+		// copied so runtime registrations never modify the caller's map.
+		rt.modelURLs = make(map[string]string, len(models))
+		maps.Copy(rt.modelURLs, models)
+		return nil
+	}
+}
+
+// TokenizerWithDefaultModels customizes which built-in models are registered.
+// If include is not empty, only the included built-in models are kept; excluded ones are removed.
+// Both must name built-in models. Custom models, including ones overriding a built-in model,
+// are not affected. Removing the fallback model (llama-3.1 by default) requires choosing a
+// registered one with TokenizerWithFallbackModel, or NewTokenizer fails.
+func TokenizerWithDefaultModels(include, exclude []string) TokenizerOption {
+	return func(rt *ollamatokenizer) error {
+		defaults := defaultModelURLs()
+		for _, name := range slices.Concat(include, exclude) {
+			if _, ok := defaults[name]; !ok {
+				return fmt.Errorf("unknown default model: %s", name)
+			}
+		}
+
 		rt.mu.Lock()
 		defer rt.mu.Unlock()
-		rt.modelURLs = models
+		for name, url := range defaults {
+			keep := (len(include) == 0 || slices.Contains(include, name)) && !slices.Contains(exclude, name)
+			if !keep && rt.modelURLs[name] == url {
+				delete(rt.modelURLs, name)
+				rt.removedDefaults = append(rt.removedDefaults, name)
+			}
+		}
 		return nil
 	}
 }
@@ -164,16 +888,86 @@ func TokenizerWithFallbackModel(model string) TokenizerOption {
 	}
 }
 
+// TokenizerWithChatTemplate sets the chat template CountChatTokens renders the messages of the model with,
+// for models whose file doesn't embed one or embeds one that isn't matched correctly.
+// The template uses the syntax of ollama (Modelfile TEMPLATE), e.g.
+// "{{ range .Messages }}<|{{ .Role }}|>{{ .Content }}{{ end }}<|assistant|>".
+func TokenizerWithChatTemplate(model, tmpl string) TokenizerOption {
+	return func(rt *ollamatokenizer) error {
+		t, err := chattemplate.Parse(tmpl)
+		if err != nil {
+			return fmt.Errorf("invalid chat template for model %s: %w", model, err)
+		}
+		rt.mu.Lock()
+		defer rt.mu.Unlock()
+		rt.chatTemplates[model] = chatTemplate{template: t, override: true}
+		return nil
+	}
+}
+
+// TokenizerWithLoadFailureFallback uses the fallback model if a configured model fails to
+// download or load, e.g. because its source is down. Each cascade is logged.
+// Models that are not configured at all still fail, and so does the fallback model itself.
+// Results from the fallback model are not stored in the result cache.
+func TokenizerWithLoadFailureFallback(enabled bool) TokenizerOption {
+	return func(rt *ollamatokenizer) error {
+		rt.mu.Lock()
+		defer rt.mu.Unlock()
+		rt.loadFailureFallback = enabled
+		return nil
+	}
+}
+
+// TokenizerWithStrictModelMatching disables the fallback model: OptimalTokenizerModel and ResolveModel
+// return an *UnknownModelError (matching ErrModelNotFound) for names that match neither a configured
+// model nor a model family instead of resolving them to the fallback, and configured models that fail
+// to load aren't counted with the fallback even if TokenizerWithLoadFailureFallback is enabled.
+// To fail hard only for some calls, use TokenizeStrict and CountTokensStrict instead.
+func TokenizerWithStrictModelMatching(enabled bool) TokenizerOption {
+	return func(rt *ollamatokenizer) error {
+		rt.mu.Lock()
+		defer rt.mu.Unlock()
+		rt.strictModelMatching = enabled
+		return nil
+	}
+}
+
 // TokenizerWithPreloadedModels Downloads the model and preloads models into memory.
 // Use this to make the first tokenizer usage more responsive.
 // Or to ensure the models are downloaded without errors.
+// The models are loaded concurrently once all options are applied, see TokenizerWithPreloadConcurrency.
+// NewTokenizer fails with a *PreloadError naming each model that failed to load.
 func TokenizerWithPreloadedModels(models ...string) TokenizerOption {
 	return func(rt *ollamatokenizer) error {
-		for _, m := range models {
-			if _, err := rt.loadModel(m); err != nil {
-				return fmt.Errorf("failed to preload model %s: %w", m, err)
-			}
+		rt.mu.Lock()
+		defer rt.mu.Unlock()
+		rt.preloadModels = append(rt.preloadModels, models...)
+		return nil
+	}
+}
+
+// TokenizerWithPreloadConcurrency sets how many models are preloaded (downloaded and loaded) at the same time
+// (default: runtime.NumCPU()).
+func TokenizerWithPreloadConcurrency(n int) TokenizerOption {
+	return func(rt *ollamatokenizer) error {
+		if n <= 0 {
+			return fmt.Errorf("invalid preload concurrency: %d", n)
 		}
+		rt.mu.Lock()
+		defer rt.mu.Unlock()
+		rt.preloadConcurrency = n
+		return nil
+	}
+}
+
+// TokenizerWithBackgroundPreload preloads the models like TokenizerWithPreloadedModels, but in the
+// background once NewTokenizer returns, so e.g. a server can listen while the models download.
+// Ready reports when all of them are loaded, WaitReady waits for it and reports preload failures.
+func TokenizerWithBackgroundPreload(models ...string) TokenizerOption {
+	return func(rt *ollamatokenizer) error {
+		rt.mu.Lock()
+		defer rt.mu.Unlock()
+		rt.backgroundPreload = append(rt.backgroundPreload, models...)
 		return nil
 	}
 }
@@ -200,162 +994,1177 @@ func TokenizerWithToken(token string) TokenizerOption {
 	}
 }
 
-// getModelURL resolves a model name to a download URL.
-func (c *ollamatokenizer) getModelURL(modelName string) (string, error) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-
-	url, ok := c.modelURLs[modelName]
-	if !ok {
-		return "", fmt.Errorf("unknown model: %s", modelName)
+// TokenizerWithMmap memory-maps the cached model files instead of reading them into the heap.
+// The OS page cache is then shared between loaded models (and processes), which reduces
+// memory usage when many models are resident.
+// On platforms without mmap support the underlying library falls back to in-memory loading.
+func TokenizerWithMmap(enabled bool) TokenizerOption {
+	return func(rt *ollamatokenizer) error {
+		rt.mu.Lock()
+		defer rt.mu.Unlock()
+		rt.useMmap = enabled
+		return nil
 	}
-	return url, nil
 }
 
-// downloadFile downloads a file from the given URL and writes it to destPath.
-func (c *ollamatokenizer) downloadFile(urlStr, destPath string) error {
-	fmt.Printf("Attempting to download %s to %s\n", urlStr, destPath)
-
-	req, err := http.NewRequest("GET", urlStr, nil)
-	if err != nil {
-		return fmt.Errorf("failed to create request for %s: %w", urlStr, err)
+// TokenizerWithContextWindows registers the context window (in tokens) for the given models.
+// Entries are added to, or override, the already registered windows.
+func TokenizerWithContextWindows(windows map[string]int) TokenizerOption {
+	return func(rt *ollamatokenizer) error {
+		rt.mu.Lock()
+		defer rt.mu.Unlock()
+		for model, window := range windows {
+			if window <= 0 {
+				return fmt.Errorf("invalid context window %d for model %s", window, model)
+			}
+			rt.contextWindows[model] = window
+		}
+		return nil
 	}
+}
 
-	c.mu.RLock()
-	token := c.token
-	c.mu.RUnlock()
-
-	// sanity check
-	_, err = url.Parse(urlStr)
-	if err != nil {
-		return fmt.Errorf("Could not parse URL %s: %w", urlStr, err)
+// TokenizerWithContextWindowWarnings logs a warning whenever a count returned by CountTokens
+// (or CountTokensCached, CountTokensDetailed) exceeds the registered context window of the model,
+// catching prompts that are too long at count time instead of at the model.
+// Models without a registered context window are never warned about.
+func TokenizerWithContextWindowWarnings(enabled bool) TokenizerOption {
+	return func(rt *ollamatokenizer) error {
+		rt.mu.Lock()
+		defer rt.mu.Unlock()
+		rt.contextWindowWarnings = enabled
+		return nil
 	}
+}
 
-	// Add Authorization header only if token is present
-	if token != "" {
-		req.Header.Add("Authorization", "Bearer "+token)
+// TokenizerWithInvalidUTF8 sets how malformed UTF-8 bytes in prompts are handled (default: InvalidUTF8ReplaceChar).
+func TokenizerWithInvalidUTF8(mode InvalidUTF8Mode) TokenizerOption {
+	return func(rt *ollamatokenizer) error {
+		if mode < InvalidUTF8ReplaceChar || mode > InvalidUTF8Error {
+			return fmt.Errorf("unknown invalid UTF-8 mode: %d", mode)
+		}
+		rt.mu.Lock()
+		defer rt.mu.Unlock()
+		rt.invalidUTF8 = mode
+		return nil
 	}
+}
 
-	// Use the configured HTTP client to perform the request
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed http request to %s: %w", urlStr, err)
-	}
-	defer resp.Body.Close()
+// mirrorSeparator separates the mirrors of a model map entry. A comma can't be used,
+// it separates the entries of TOKENIZER_MODELS.
+const mirrorSeparator = "|"
 
-	fmt.Printf("HTTP Status: %s\n", resp.Status)
-	if resp.StatusCode != http.StatusOK {
-		bodyBytes, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
-		errMsg := fmt.Sprintf("bad HTTP status: %s. Body glimpse: %s", resp.Status, string(bodyBytes))
-		// Add a hint if auth might be needed
-		if (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) && token == "" {
-			errMsg += " (Hint: Does this model require authentication?)"
+// splitBackend splits the optional "<backend>:" prefix off a model map entry.
+// Entries without a known backend prefix (e.g. plain https:// URLs) use BackendGGUF.
+func splitBackend(entry string) (backend, source string) {
+	prefix, rest, found := strings.Cut(entry, ":")
+	if found {
+		switch prefix {
+		case BackendGGUF, BackendHF, BackendTiktoken, BackendSPM:
+			return prefix, rest
 		}
-		return fmt.Errorf("%s", errMsg)
 	}
+	return BackendGGUF, entry
+}
 
-	// Create the destination file *after* successful status check
-	out, err := os.Create(destPath)
-	if err != nil {
-		return fmt.Errorf("failed to create file %s: %w", destPath, err)
+// TokenizerWithLineEndingNormalization sets how line endings are normalized before tokenization (default: LineEndingNone).
+func TokenizerWithLineEndingNormalization(mode LineEndingMode) TokenizerOption {
+	return func(rt *ollamatokenizer) error {
+		if mode < LineEndingNone || mode > LineEndingStrip {
+			return fmt.Errorf("unknown line ending mode: %d", mode)
+		}
+		rt.mu.Lock()
+		defer rt.mu.Unlock()
+		rt.lineEndings = mode
+		return nil
 	}
-	defer out.Close() // Ensure file is closed
+}
 
-	bytesWritten, err := io.Copy(out, resp.Body)
-	fmt.Printf("Bytes written: %d\n", bytesWritten)
-	if err != nil {
-		os.Remove(destPath)
-		return fmt.Errorf("failed to write file %s after %d bytes: %w", destPath, bytesWritten, err)
+// TokenizerWithResultCache caches up to size token counts in memory, keyed by model and a hash of the prompt.
+// Repeated counts of the same prompt are then served without tokenizing again.
+// Use CountTokensCached to observe whether a count was served from the cache.
+func TokenizerWithResultCache(size int) TokenizerOption {
+	return func(rt *ollamatokenizer) error {
+		if size <= 0 {
+			return fmt.Errorf("invalid result cache size: %d", size)
+		}
+		rt.mu.Lock()
+		defer rt.mu.Unlock()
+		rt.resultCache = newLRUResultCache(size)
+		return nil
 	}
+}
 
-	// Sync contents to disk
-	if err = out.Sync(); err != nil {
-		// Log sync errors but don't necessarily fail the download, consistent with original code
-		fmt.Printf("Warning: failed to sync file %s: %v\n", destPath, err)
+// TokenizerWithResultCacheBackend caches token counts and tokens in the given ResultCache,
+// e.g. a Redis backed implementation shared between instances.
+// TokenizerWithResultCache configures the in-memory LRU implementation instead.
+func TokenizerWithResultCacheBackend(cache ResultCache) TokenizerOption {
+	return func(rt *ollamatokenizer) error {
+		if cache == nil {
+			return fmt.Errorf("result cache backend must not be nil")
+		}
+		rt.mu.Lock()
+		defer rt.mu.Unlock()
+		rt.resultCache = cache
+		return nil
 	}
-
-	fmt.Printf("Successfully downloaded %s\n", destPath)
-	return nil
 }
 
-// downloadModel downloads the model if it doesn't already exist and returns the path.
-func (c *ollamatokenizer) downloadModel(modelName string) (string, error) {
-	homeDir, err := os.UserHomeDir()
+// TokenizerWithMaxMemoryBytes bounds the approximate memory used by loaded models to n bytes.
+// When loading a model exceeds the budget, the least recently used models are unloaded;
+// they are reloaded transparently on their next use. Models in use are never unloaded,
+// so the budget may be exceeded temporarily. 0 means unlimited (the default).
+// See ApproxMemoryUsage for how memory is estimated.
+func TokenizerWithMaxMemoryBytes(n int) TokenizerOption {
+	return func(rt *ollamatokenizer) error {
+		if n < 0 {
+			return fmt.Errorf("invalid memory limit: %d", n)
+		}
+		rt.mu.Lock()
+		defer rt.mu.Unlock()
+		rt.maxMemoryBytes = int64(n)
+		return nil
+	}
+}
+
+// TokenizerWithMaxLoadedModels keeps at most n models in memory. When loading a model exceeds it,
+// the least recently used models are unloaded; they are reloaded transparently on their next use.
+// Models in use are never unloaded, so the limit may be exceeded temporarily. 0 means unlimited
+// (the default). It can be combined with TokenizerWithMaxMemoryBytes, see LoadedModels.
+func TokenizerWithMaxLoadedModels(n int) TokenizerOption {
+	return func(rt *ollamatokenizer) error {
+		if n < 0 {
+			return fmt.Errorf("invalid max loaded models: %d", n)
+		}
+		rt.mu.Lock()
+		defer rt.mu.Unlock()
+		rt.maxLoadedModels = n
+		return nil
+	}
+}
+
+// TokenizerWithUnknownIDHandling sets how Detokenize treats token IDs outside of the vocabulary
+// (default: UnknownIDError).
+func TokenizerWithUnknownIDHandling(handling UnknownIDHandling) TokenizerOption {
+	return func(rt *ollamatokenizer) error {
+		rt.mu.Lock()
+		defer rt.mu.Unlock()
+		rt.unknownIDs = handling
+		return nil
+	}
+}
+
+// TokenizerWithOffline forbids downloading models, e.g. in air-gapped or test environments.
+// Only models in the local cache and local files can be used, models that would have to be
+// downloaded fail immediately with ErrOfflineMode instead of on a network timeout.
+func TokenizerWithOffline(enabled bool) TokenizerOption {
+	return func(rt *ollamatokenizer) error {
+		rt.mu.Lock()
+		defer rt.mu.Unlock()
+		rt.offline = enabled
+		return nil
+	}
+}
+
+// TokenizerWithMaxTokensPerSecond caps the tokens produced per second across all models,
+// e.g. to leave CPU for other services on a shared host. Limiting by tokens rather than requests
+// accounts for inputs of very different sizes. Calls block while the budget is exhausted, or fail with
+// ErrRateLimited if TokenizerWithFailFast is enabled; results served from the result cache are free.
+// 0 means unlimited (the default).
+func TokenizerWithMaxTokensPerSecond(n int) TokenizerOption {
+	return func(rt *ollamatokenizer) error {
+		if n < 0 {
+			return fmt.Errorf("invalid tokens per second limit: %d", n)
+		}
+		rt.mu.Lock()
+		defer rt.mu.Unlock()
+		rt.throttle = nil
+		if n > 0 {
+			rt.throttle = newTokenThrottle(n, rt.clock)
+		}
+		return nil
+	}
+}
+
+// TokenizerWithRetry retries model downloads failing with a network error or a 5xx response up to
+// maxAttempts times in total (default: 1, no retries), waiting baseDelay before the first retry and doubling
+// it for each further one up to 30s, with jitter. Other failures, e.g. a 404 for a missing model, are not retried.
+// A MetricsCollector that implements RetryCollector is notified of each retry.
+func TokenizerWithRetry(maxAttempts int, baseDelay time.Duration) TokenizerOption {
+	return func(rt *ollamatokenizer) error {
+		if maxAttempts < 1 {
+			return fmt.Errorf("invalid max attempts: %d", maxAttempts)
+		}
+		if baseDelay < 0 {
+			return fmt.Errorf("invalid retry delay: %s", baseDelay)
+		}
+		rt.mu.Lock()
+		defer rt.mu.Unlock()
+		rt.retryAttempts = maxAttempts
+		rt.retryBaseDelay = baseDelay
+		return nil
+	}
+}
+
+// TokenizerWithMetrics reports each Tokenize and CountTokens call (including the calls built on them,
+// e.g. the batch calls) to the collector: the model, whether the fallback was used, the tokens and the
+// latency. Combine it with LoadedModels for a gauge of the resident models.
+func TokenizerWithMetrics(collector MetricsCollector) TokenizerOption {
+	return func(rt *ollamatokenizer) error {
+		if collector == nil {
+			return fmt.Errorf("metrics collector cannot be nil")
+		}
+		rt.mu.Lock()
+		defer rt.mu.Unlock()
+		rt.metrics = collector
+		return nil
+	}
+}
+
+// TokenizerWithCacheDir sets the directory downloaded model files are cached in, instead of
+// "~/.libollama/models", e.g. a volume shared between restarts or processes. Each model is cached as
+// "<dir>/<model>/model.gguf" together with its SHA-256, which is verified before the file is used:
+// a corrupt file is downloaded again. Cached models are used without any network request.
+func TokenizerWithCacheDir(path string) TokenizerOption {
+	return func(rt *ollamatokenizer) error {
+		if path == "" {
+			return fmt.Errorf("cache dir cannot be empty")
+		}
+		rt.mu.Lock()
+		defer rt.mu.Unlock()
+		rt.cacheDirPath = path
+		return nil
+	}
+}
+
+// TokenizerWithMaxInputBytes sets the maximum size of prompts returning their tokens (Tokenize and the
+// calls built on it), larger prompts fail with an *InputTooLargeError. Counting calls aren't limited.
+// Prompts are tokenized in pieces of 16 KiB, so a limit above that doesn't strain the backend.
+// 0 means unlimited, the default is 16 KiB.
+func TokenizerWithMaxInputBytes(n int) TokenizerOption {
+	return func(rt *ollamatokenizer) error {
+		if n < 0 {
+			return fmt.Errorf("invalid max input bytes: %d", n)
+		}
+		rt.mu.Lock()
+		defer rt.mu.Unlock()
+		rt.maxInputBytes = n
+		return nil
+	}
+}
+
+// TokenizerWithClock replaces the wall clock the time-dependent features run on (the tokens per
+// second limit, the backoff of download retries, the age of cached files when pruning, progress
+// intervals and load durations),
+// e.g. so tests can advance time without sleeping. The order relative to
+// TokenizerWithMaxTokensPerSecond doesn't matter, the limit uses the clock either way.
+func TokenizerWithClock(clock Clock) TokenizerOption {
+	return func(rt *ollamatokenizer) error {
+		if clock == nil {
+			return fmt.Errorf("clock cannot be nil")
+		}
+		rt.mu.Lock()
+		defer rt.mu.Unlock()
+		rt.clock = clock
+		if rt.throttle != nil {
+			rt.throttle = newTokenThrottle(int(rt.throttle.rate), clock)
+		}
+		return nil
+	}
+}
+
+// TokenizerWithAuthoritativeBackends marks the backend whose counts are authoritative for the given
+// models, e.g. {"gpt-4o": BackendTiktoken}, for deployments where counts of a model may come from
+// different backends. CountTokensAuthoritative only counts with that backend, and a warning is logged
+// when a count of the model comes from a fallback model instead.
+// Only BackendGGUF can be loaded at the moment, so other authoritative backends fail to count.
+func TokenizerWithAuthoritativeBackends(backends map[string]string) TokenizerOption {
+	return func(rt *ollamatokenizer) error {
+		for model, backend := range backends {
+			switch backend {
+			case BackendGGUF, BackendHF, BackendTiktoken, BackendSPM:
+			default:
+				return fmt.Errorf("unknown backend %q for model %s", backend, model)
+			}
+		}
+		rt.mu.Lock()
+		defer rt.mu.Unlock()
+		rt.authoritativeBackends = maps.Clone(backends)
+		return nil
+	}
+}
+
+// TokenizerWithPricing registers the price per 1000 tokens of the given models, used by
+// EstimateCost and EstimateCostBatch when no price is passed. Entries are added to, or override,
+// the already registered prices.
+func TokenizerWithPricing(prices map[string]float64) TokenizerOption {
+	return func(rt *ollamatokenizer) error {
+		for model, price := range prices {
+			if price < 0 || math.IsNaN(price) || math.IsInf(price, 0) {
+				return fmt.Errorf("invalid price %g for model %s", price, model)
+			}
+		}
+		rt.mu.Lock()
+		defer rt.mu.Unlock()
+		if rt.pricing == nil {
+			rt.pricing = make(map[string]float64, len(prices))
+		}
+		maps.Copy(rt.pricing, prices)
+		return nil
+	}
+}
+
+// TokenizerWithBatchConcurrency sets the number of goroutines working on a batch call
+// (CountTokensBatch, TokenizeBatch, CountTokensBatchStats, CompareCountsParallel), so huge
+// batches don't spawn a goroutine per item and a batch call uses at most n CPUs (default: GOMAXPROCS).
+func TokenizerWithBatchConcurrency(n int) TokenizerOption {
+	return func(rt *ollamatokenizer) error {
+		if n <= 0 {
+			return fmt.Errorf("invalid batch concurrency: %d", n)
+		}
+		rt.mu.Lock()
+		defer rt.mu.Unlock()
+		rt.batchConcurrency = n
+		return nil
+	}
+}
+
+// TokenizerWithMaxConcurrency limits the number of calls using a model at the same time across all
+// models, so a flood of calls can't exhaust the memory. Calls beyond the limit wait until a running call
+// finishes, or fail with ErrOverloaded if TokenizerWithFailFast is enabled. Use InFlight to size the limit.
+// Calls never hold more than one model at a time, so the limit doesn't deadlock the batch worker pool.
+func TokenizerWithMaxConcurrency(n int) TokenizerOption {
+	return func(rt *ollamatokenizer) error {
+		if n <= 0 {
+			return fmt.Errorf("invalid max concurrency: %d", n)
+		}
+		rt.mu.Lock()
+		defer rt.mu.Unlock()
+		rt.callSlots = make(chan struct{}, n)
+		return nil
+	}
+}
+
+// TokenizerWithFailFast makes calls beyond the limit of TokenizerWithMaxConcurrency fail immediately
+// with ErrOverloaded, and calls beyond the budget of TokenizerWithMaxTokensPerSecond with ErrRateLimited,
+// instead of waiting, e.g. so a server can shed load.
+func TokenizerWithFailFast(enabled bool) TokenizerOption {
+	return func(rt *ollamatokenizer) error {
+		rt.mu.Lock()
+		defer rt.mu.Unlock()
+		rt.failFast = enabled
+		return nil
+	}
+}
+
+// TokenizerWithPerModelConcurrency limits the number of calls using a model at the same time,
+// so one heavily used model can't starve the others on a shared server.
+// Calls beyond the limit of a model wait until a running call finishes.
+// Models without a limit are unlimited (the default).
+func TokenizerWithPerModelConcurrency(limits map[string]int) TokenizerOption {
+	return func(rt *ollamatokenizer) error {
+		slots := make(map[string]chan struct{}, len(limits))
+		for model, limit := range limits {
+			if limit <= 0 {
+				return fmt.Errorf("invalid concurrency limit %d for model %s", limit, model)
+			}
+			slots[model] = make(chan struct{}, limit)
+		}
+		rt.mu.Lock()
+		defer rt.mu.Unlock()
+		rt.modelSlots = slots
+		return nil
+	}
+}
+
+// getModelURLs resolves a model name to its download URLs, the primary URL first.
+func (c *ollamatokenizer) getModelURLs(modelName string) ([]string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	entry, ok := c.modelURLs[modelName]
+	if !ok {
+		return nil, c.unknownModelLocked(modelName)
+	}
+
+	// only the gguf loader is available, other backends fail here instead of on a parse error later.
+	backend, sources := splitBackend(entry)
+	if backend != BackendGGUF {
+		return nil, fmt.Errorf("%w %q for model %s", ErrUnsupportedBackend, backend, modelName)
+	}
+	var urls []string
+	for _, u := range strings.Split(sources, mirrorSeparator) {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("no url configured for model %s", modelName)
+	}
+	return urls, nil
+}
+
+// downloadFile downloads a file from the given URL and writes it to destPath.
+// The request is aborted once ctx is done.
+func (c *ollamatokenizer) downloadFile(ctx context.Context, urlStr, destPath string) error {
+	fmt.Printf("Attempting to download %s to %s\n", urlStr, destPath)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", urlStr, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request for %s: %w", urlStr, err)
+	}
+
+	c.mu.RLock()
+	token := c.token
+	c.mu.RUnlock()
+
+	// sanity check
+	_, err = url.Parse(urlStr)
+	if err != nil {
+		return fmt.Errorf("Could not parse URL %s: %w", urlStr, err)
+	}
+
+	// Add Authorization header only if token is present
+	if token != "" {
+		req.Header.Add("Authorization", "Bearer "+token)
+	}
+
+	// Use the configured HTTP client to perform the request
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return &transientError{fmt.Errorf("failed http request to %s: %w", urlStr, err)}
+	}
+	defer resp.Body.Close()
+
+	fmt.Printf("HTTP Status: %s\n", resp.Status)
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		errMsg := fmt.Sprintf("bad HTTP status: %s. Body glimpse: %s", resp.Status, string(bodyBytes))
+		// Add a hint if auth might be needed
+		if (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) && token == "" {
+			errMsg += " (Hint: Does this model require authentication?)"
+		}
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return &transientError{errors.New(errMsg)}
+		}
+		return fmt.Errorf("%s", errMsg)
+	}
+
+	// Create the destination file *after* successful status check. The download goes to a temporary
+	// file renamed into place, so other processes sharing the cache never load a partial file.
+	out, err := os.CreateTemp(filepath.Dir(destPath), filepath.Base(destPath)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create file %s: %w", destPath, err)
+	}
+	defer os.Remove(out.Name()) // no-op after the rename
+	defer out.Close()           // Ensure file is closed
+
+	h := sha256.New()
+	body := &errorRecordingReader{r: resp.Body}
+	bytesWritten, err := io.Copy(io.MultiWriter(out, h), body)
+	fmt.Printf("Bytes written: %d\n", bytesWritten)
+	if err != nil {
+		err = fmt.Errorf("failed to write file %s after %d bytes: %w", destPath, bytesWritten, err)
+		if body.err != nil {
+			return &transientError{err}
+		}
+		return err
+	}
+
+	// Sync contents to disk
+	if err = out.Sync(); err != nil {
+		// Log sync errors but don't necessarily fail the download, consistent with original code
+		fmt.Printf("Warning: failed to sync file %s: %v\n", destPath, err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to write file %s: %w", destPath, err)
+	}
+	// the checksum of an earlier download is removed first, so a concurrent reader never checks the new
+	// file against it (and removes the good file as corrupt); until the new checksum is written the file
+	// is accepted as is.
+	if err := os.Remove(destPath + checksumSuffix); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove the old checksum of %s: %w", destPath, err)
+	}
+	if err := os.Rename(out.Name(), destPath); err != nil {
+		return fmt.Errorf("failed to move download to %s: %w", destPath, err)
+	}
+	// the checksum is verified before the cached file is used again.
+	if err := writeFileAtomic(destPath+checksumSuffix, []byte(hex.EncodeToString(h.Sum(nil))+"\n")); err != nil {
+		fmt.Printf("Warning: failed to write checksum of %s: %v\n", destPath, err)
+	} else {
+		c.markVerified(destPath)
+	}
+
+	fmt.Printf("Successfully downloaded %s\n", destPath)
+	return nil
+}
+
+// downloadModel downloads the model if it doesn't already exist and returns the path.
+// Models with a file:// URL or an absolute path are used in place. cached reports whether the file was
+// already in the download cache, see withModelFile. Once ctx is done, the download is aborted
+// and no further sources are tried.
+func (c *ollamatokenizer) downloadModel(ctx context.Context, modelName string) (path string, cached bool, err error) {
+	// the name becomes part of the cache path.
+	if !ValidModelName(modelName) {
+		return "", false, fmt.Errorf("%w: %q", ErrInvalidModelName, modelName)
+	}
+	modelURLs, err := c.getModelURLs(modelName)
+	if err != nil {
+		return "", false, err
+	}
+
+	root, err := c.cacheDir()
+	if err != nil {
+		return "", false, err
+	}
+	dir := filepath.Join(root, modelName)
+	destPath := filepath.Join(dir, cacheFileName)
+
+	c.mu.RLock()
+	offline := c.offline
+	c.mu.RUnlock()
+
+	// the sources are tried in order, a cached download is used before the first remote source.
+	var errs []error
+	checkedCache, skippedRemote := false, false
+	for i, modelURL := range modelURLs {
+		if path, ok := localModelPath(modelURL); ok {
+			if _, err := os.Stat(path); err != nil {
+				errs = append(errs, fmt.Errorf("%w: model file of %s: %w", ErrBackendUnavailable, modelName, err))
+				continue
+			}
+			if i > 0 {
+				fmt.Printf("Using mirror %s for model %s\n", modelURL, modelName)
+			}
+			c.recordOrigin(modelName, modelURL, ModelSourceLocal)
+			return path, false, nil
+		}
+
+		if !checkedCache {
+			checkedCache = true
+			if _, err := os.Stat(destPath); !os.IsNotExist(err) {
+				err := c.verifyCachedFile(destPath)
+				if err == nil {
+					touchCacheFile(destPath, c.clock.Now())
+					c.markVerified(destPath)
+					c.recordOrigin(modelName, modelURL, ModelSourceCache)
+					return destPath, true, nil
+				}
+				// a corrupt file is downloaded again.
+				fmt.Printf("Cached model %s is corrupt: %v, downloading it again\n", modelName, err)
+				if err := removeCacheFile(destPath); err != nil && !os.IsNotExist(err) {
+					return "", false, fmt.Errorf("failed to remove corrupt cached model %s: %w", modelName, err)
+				}
+			}
+		}
+		if offline {
+			skippedRemote = true
+			continue
+		}
+
+		if err := ctx.Err(); err != nil {
+			return "", false, err
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", false, fmt.Errorf("failed to create directory %s: %w", dir, err)
+		}
+		if err := c.downloadWithRetry(ctx, modelName, modelURL, destPath); err != nil {
+			if ctx.Err() != nil {
+				return "", false, err
+			}
+			if i < len(modelURLs)-1 {
+				fmt.Printf("Failed to download model %s from %s: %v, trying the next mirror\n", modelName, modelURL, err)
+			}
+			errs = append(errs, fmt.Errorf("%w: %w", ErrBackendUnavailable, err))
+			continue
+		}
+		fmt.Printf("Downloaded model %s from %s\n", modelName, modelURL)
+		c.recordOrigin(modelName, modelURL, ModelSourceNetwork)
+		return destPath, false, nil
+	}
+	if skippedRemote {
+		errs = append(errs, fmt.Errorf("%w: model %s is not cached at %s", ErrOfflineMode, modelName, destPath))
+	}
+	if len(errs) == 1 {
+		return "", false, errs[0]
+	}
+	return "", false, errors.Join(errs...)
+}
+
+// recordOrigin records where the file of the model was taken from, see ModelInfo.
+// A file this tokenizer downloaded stays reported as downloaded when it is used from the cache later.
+func (c *ollamatokenizer) recordOrigin(modelName, modelURL string, source ModelSource) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if source == ModelSourceCache && c.modelOrigins[modelName].source == ModelSourceNetwork {
+		return
+	}
+	c.modelOrigins[modelName] = modelOrigin{url: modelURL, source: source}
+}
+
+// withModelFile downloads the model if necessary and calls use with the path of the model file.
+// If use fails on a file from the download cache, e.g. because it is truncated or was written for
+// an incompatible library version, the cached file is removed and downloaded again once before
+// the error is returned. In offline mode the cached file is kept.
+func (c *ollamatokenizer) withModelFile(ctx context.Context, modelName string, use func(path string) error) error {
+	modelPath, cached, err := c.downloadModel(ctx, modelName)
+	if err != nil {
+		return fmt.Errorf("failed to download model %s: %w", modelName, err)
+	}
+	err = use(modelPath)
+
+	c.mu.RLock()
+	offline := c.offline
+	c.mu.RUnlock()
+	if err == nil || !cached || offline {
+		return err
+	}
+
+	fmt.Printf("Failed to use cached model %s: %v, downloading it again\n", modelName, err)
+	if rmErr := removeCacheFile(modelPath); rmErr != nil && !os.IsNotExist(rmErr) {
+		return fmt.Errorf("%w (removing cached file failed: %w)", err, rmErr)
+	}
+	modelPath, _, dlErr := c.downloadModel(ctx, modelName)
+	if dlErr != nil {
+		return fmt.Errorf("%w (download after removing cached file failed: %w)", err, dlErr)
+	}
+	return use(modelPath)
+}
+
+// loadedModel is a model resident in memory.
+type loadedModel struct {
+	// mu is held for reading while the model is in use and for writing while it is freed.
+	mu    sync.RWMutex
+	model *llama.Model
+	freed bool
+	// size approximates the memory used by the model, see ApproxMemoryUsage.
+	size int64
+	// lastUsed orders models by their last use for LRU eviction.
+	lastUsed atomic.Int64
+}
+
+// loadModel loads a model from disk, caching the loaded model in memory.
+// This function is safe for concurrent use.
+// Use acquireModel to actually use the model, it may be freed concurrently otherwise.
+// A download of the model is aborted once ctx is done.
+func (c *ollamatokenizer) loadModel(ctx context.Context, modelName string) (*loadedModel, error) {
+	c.mu.RLock()
+	if lm, exists := c.loadedModels[modelName]; exists {
+		c.mu.RUnlock()
+		return lm, nil
+	}
+	c.mu.RUnlock()
+
+	c.mu.RLock()
+	useMmap := c.useMmap
+	c.mu.RUnlock()
+
+	params := llama.ModelParams{
+		VocabOnly: true,
+		UseMmap:   useMmap,
+		Progress: func(f float32) {
+			fmt.Printf("Loading model %s: %.2f%%\n", modelName, f*100)
+		},
+	}
+
+	// Download the model if necessary.
+	var model *llama.Model
+	var size int64
+	err := c.withModelFile(ctx, modelName, func(modelPath string) error {
+		var err error
+		model, err = llama.LoadModelFromFile(modelPath, params)
+		if err != nil {
+			return fmt.Errorf("failed to load model %s from %s: %w", modelName, modelPath, err)
+		}
+
+		// a vocab only model keeps (roughly) the metadata section of the file in memory.
+		_, size, err = readMetadata(modelPath, 0)
+		if err != nil {
+			llama.FreeModel(model)
+			return fmt.Errorf("failed to read metadata of model %s from %s: %w", modelName, modelPath, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Acquire write lock to update the cache.
+	c.mu.Lock()
+	if lm, exists := c.loadedModels[modelName]; exists {
+		// loaded concurrently, ours was never shared so it can be freed right away.
+		c.mu.Unlock()
+		llama.FreeModel(model)
+		return lm, nil
+	}
+	lm := &loadedModel{model: model, size: size}
+	lm.lastUsed.Store(c.useClock.Add(1))
+	c.loadedModels[modelName] = lm
+	c.evictLocked(modelName)
+	c.mu.Unlock()
+
+	fmt.Printf("Successfully loaded model %s\n", modelName)
+	return lm, nil
+}
+
+// acquireModel loads the model and marks it as in use until release is called.
+// A model in use is never freed. It waits for a free slot if the model has a concurrency limit.
+func (c *ollamatokenizer) acquireModel(modelName string) (model *llama.Model, release func(), err error) {
+	return c.acquireModelContext(context.Background(), modelName)
+}
+
+// acquireModelContext is acquireModel, giving up waiting for a slot or loading the model once ctx is done.
+func (c *ollamatokenizer) acquireModelContext(ctx context.Context, modelName string) (model *llama.Model, release func(), err error) {
+	c.mu.RLock()
+	callSlots, failFast := c.callSlots, c.failFast
+	slots := c.modelSlots[modelName]
+	c.mu.RUnlock()
+	if callSlots != nil {
+		if failFast {
+			select {
+			case callSlots <- struct{}{}:
+			default:
+				return nil, nil, fmt.Errorf("%w: %d calls in flight", ErrOverloaded, cap(callSlots))
+			}
+		} else {
+			select {
+			case callSlots <- struct{}{}:
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			}
+		}
+	}
+	if slots != nil {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			if callSlots != nil {
+				<-callSlots
+			}
+			return nil, nil, ctx.Err()
+		}
+	}
+	releaseSlot := func() {
+		if slots != nil {
+			<-slots
+		}
+		if callSlots != nil {
+			<-callSlots
+		}
+	}
+
+	for {
+		lm, err := c.loadModel(ctx, modelName)
+		if err != nil {
+			releaseSlot()
+			return nil, nil, err
+		}
+		lm.mu.RLock()
+		if !lm.freed {
+			lm.lastUsed.Store(c.useClock.Add(1))
+			c.inFlight.Add(1)
+			release := func() {
+				c.inFlight.Add(-1)
+				lm.mu.RUnlock()
+				releaseSlot()
+			}
+			return lm.model, release, nil
+		}
+		// freed between loading and acquiring, load it again.
+		lm.mu.RUnlock()
+	}
+}
+
+// waitThrottle waits until the tokens per second budget allows another call, or fails with
+// ErrRateLimited instead if fail fast is enabled. Call it before acquiring the model, so a waiting
+// call doesn't hold it.
+func (c *ollamatokenizer) waitThrottle(ctx context.Context) error {
+	c.mu.RLock()
+	failFast := c.failFast
+	c.mu.RUnlock()
+	if failFast {
+		return c.throttle.allow()
+	}
+	return c.throttle.wait(ctx)
+}
+
+// acquireModelOrFallback is acquireModel, cascading to the fallback model if enabled by
+// TokenizerWithLoadFailureFallback and a configured model fails to load.
+// It returns the name of the model that was acquired.
+func (c *ollamatokenizer) acquireModelOrFallback(modelName string) (model *llama.Model, used string, release func(), err error) {
+	return c.acquireModelOrFallbackContext(context.Background(), modelName)
+}
+
+// acquireModelOrFallbackContext is acquireModelOrFallback, giving up once ctx is done.
+// A model that failed to load because ctx is done doesn't cascade to the fallback.
+// Neither do models of calls made strict by strictContext.
+func (c *ollamatokenizer) acquireModelOrFallbackContext(ctx context.Context, modelName string) (model *llama.Model, used string, release func(), err error) {
+	model, release, err = c.acquireModelContext(ctx, modelName)
+	if err == nil {
+		return model, modelName, release, nil
+	}
+
+	fallback, ok := c.loadFailureFallbackFor(modelName)
+	if !ok || ctx.Err() != nil || isStrict(ctx) {
+		return nil, "", nil, err
+	}
+
+	fmt.Printf("Failed to load model %s: %v, falling back to %s\n", modelName, err, fallback)
+	model, release, fallbackErr := c.acquireModelContext(ctx, fallback)
+	if fallbackErr != nil {
+		return nil, "", nil, fmt.Errorf("%w (fallback model %s: %w)", err, fallback, fallbackErr)
+	}
+	c.mu.RLock()
+	authoritative, ok := c.authoritativeBackends[modelName]
+	c.mu.RUnlock()
+	if ok {
+		fmt.Printf("Warning: model %s is counted with fallback model %s instead of its authoritative %s backend\n", modelName, fallback, authoritative)
+	}
+	return model, fallback, release, nil
+}
+
+// CountTokensAuthoritative implements Tokenizer.
+func (c *ollamatokenizer) CountTokensAuthoritative(modelName, prompt string) (int, error) {
+	c.mu.RLock()
+	authoritative, ok := c.authoritativeBackends[modelName]
+	entry, known := c.modelURLs[modelName]
+	var unknown error
+	if !known {
+		unknown = c.unknownModelLocked(modelName)
+	}
+	c.mu.RUnlock()
+	if !known {
+		return 0, unknown
+	}
+	if !ok {
+		return 0, fmt.Errorf("no authoritative backend registered for model %s", modelName)
+	}
+	if backend, _ := splitBackend(entry); backend != authoritative {
+		return 0, fmt.Errorf("model %s is configured with the %s backend, its authoritative backend is %s", modelName, backend, authoritative)
+	}
+
+	prompt, err := c.preprocess(prompt)
+	if err != nil {
+		return 0, err
+	}
+	if err := c.waitThrottle(context.Background()); err != nil {
+		return 0, err
+	}
+	// never the fallback model, the count has to come from the authoritative backend.
+	model, release, err := c.acquireModel(modelName)
 	if err != nil {
-		return "", fmt.Errorf("failed to get home directory: %w", err)
+		return 0, err
+	}
+	defer release()
+	return c.countChunks(model, prompt, true)
+}
+
+// loadFailureFallbackFor returns the model to cascade to if the model fails to load, see
+// TokenizerWithLoadFailureFallback. Unknown models and the fallback model itself don't cascade.
+func (c *ollamatokenizer) loadFailureFallbackFor(modelName string) (string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	_, known := c.modelURLs[modelName]
+	if !c.loadFailureFallback || c.strictModelMatching || !known || modelName == c.fallback {
+		return "", false
 	}
-	dir := filepath.Join(homeDir, ".libollama", "models", modelName)
+	return c.fallback, true
+}
+
+// InFlight implements Tokenizer.
+func (c *ollamatokenizer) InFlight() int {
+	return int(c.inFlight.Load())
+}
 
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return "", fmt.Errorf("failed to create directory %s: %w", dir, err)
+// unloadModel removes the model from memory once it is no longer in use.
+// It reports whether the model was loaded.
+func (c *ollamatokenizer) unloadModel(modelName string) bool {
+	c.mu.Lock()
+	lm, exists := c.loadedModels[modelName]
+	delete(c.loadedModels, modelName)
+	c.mu.Unlock()
+	if !exists {
+		return false
 	}
 
-	url, err := c.getModelURL(modelName)
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	llama.FreeModel(lm.model)
+	lm.freed = true
+	return true
+}
+
+// preprocess applies the configured input normalizations to the prompt before tokenization.
+func (c *ollamatokenizer) preprocess(prompt string) (string, error) {
+	prompt, err := c.sanitizeUTF8(prompt)
 	if err != nil {
 		return "", err
 	}
 
-	destPath := filepath.Join(dir, "model.gguf")
-	if _, err := os.Stat(destPath); os.IsNotExist(err) {
-		if err := c.downloadFile(url, destPath); err != nil {
-			return "", err
+	c.mu.RLock()
+	lineEndings := c.lineEndings
+	c.mu.RUnlock()
+
+	switch lineEndings {
+	case LineEndingLF:
+		prompt = strings.ReplaceAll(prompt, "\r\n", "\n")
+		prompt = strings.ReplaceAll(prompt, "\r", "\n")
+	case LineEndingStrip:
+		prompt = strings.ReplaceAll(prompt, "\r\n", " ")
+		prompt = strings.NewReplacer("\r", " ", "\n", " ").Replace(prompt)
+	}
+	return prompt, nil
+}
+
+// preprocessOffsets is preprocess, also returning the offset in the prompt of each byte boundary of
+// the preprocessed prompt: origin[i] for i in [0, len(preprocessed)], with origin[len(preprocessed)] ==
+// len(prompt). Bytes removed by the preprocessing belong to the following boundary, and boundaries
+// inside a replacement (e.g. U+FFFD for an invalid byte) map to the start of the replaced bytes.
+func (c *ollamatokenizer) preprocessOffsets(prompt string) (string, []int, error) {
+	c.mu.RLock()
+	mode, lineEndings := c.invalidUTF8, c.lineEndings
+	c.mu.RUnlock()
+
+	// the invalid bytes are replaced like sanitizeUTF8 replaces them: each run with one replacement.
+	if !utf8.ValidString(prompt) && mode == InvalidUTF8Error {
+		_, err := c.sanitizeUTF8(prompt)
+		return "", nil, err
+	}
+	replacement := "\uFFFD"
+	if mode == InvalidUTF8Strip {
+		replacement = ""
+	}
+	var sanitized strings.Builder
+	sanitizedOrigin := make([]int, 0, len(prompt)+1)
+	next := 0 // start of the bytes the next output byte is produced from
+	for i := 0; i < len(prompt); {
+		r, size := utf8.DecodeRuneInString(prompt[i:])
+		if r != utf8.RuneError || size != 1 {
+			sanitizedOrigin = append(sanitizedOrigin, next)
+			for k := 1; k < size; k++ {
+				sanitizedOrigin = append(sanitizedOrigin, i+k)
+			}
+			sanitized.WriteString(prompt[i : i+size])
+			i += size
+			next = i
+			continue
+		}
+		end := i
+		for end < len(prompt) {
+			r, size := utf8.DecodeRuneInString(prompt[end:])
+			if r != utf8.RuneError || size != 1 {
+				break
+			}
+			end++
+		}
+		for range len(replacement) {
+			sanitizedOrigin = append(sanitizedOrigin, next)
+		}
+		sanitized.WriteString(replacement)
+		if replacement != "" {
+			next = end
 		}
+		i = end
 	}
+	sanitizedOrigin = append(sanitizedOrigin, len(prompt))
 
-	return destPath, nil
+	// the line endings are normalized like preprocess normalizes them, each to a single byte.
+	text := sanitized.String()
+	if lineEndings != LineEndingLF && lineEndings != LineEndingStrip {
+		return text, sanitizedOrigin, nil
+	}
+	newline := byte('\n')
+	if lineEndings == LineEndingStrip {
+		newline = ' '
+	}
+	out := make([]byte, 0, len(text))
+	origin := make([]int, 0, len(text)+1)
+	for i := 0; i < len(text); i++ {
+		origin = append(origin, sanitizedOrigin[i])
+		switch {
+		case text[i] == '\r' && i+1 < len(text) && text[i+1] == '\n':
+			out = append(out, newline)
+			i++
+		case text[i] == '\r', text[i] == '\n':
+			out = append(out, newline)
+		default:
+			out = append(out, text[i])
+		}
+	}
+	origin = append(origin, len(prompt))
+	return string(out), origin, nil
 }
 
-// loadModel loads a model from disk, caching the loaded model in memory.
-// This function is safe for concurrent use.
-func (c *ollamatokenizer) loadModel(modelName string) (*llama.Model, error) {
-	c.mu.RLock()
-	if model, exists := c.loadedModels[modelName]; exists {
-		c.mu.RUnlock()
-		return model, nil
+// sanitizeUTF8 applies the configured InvalidUTF8Mode to the prompt.
+func (c *ollamatokenizer) sanitizeUTF8(prompt string) (string, error) {
+	if utf8.ValidString(prompt) {
+		return prompt, nil
 	}
+
+	c.mu.RLock()
+	mode := c.invalidUTF8
 	c.mu.RUnlock()
 
-	// Download the model if necessary.
-	modelPath, err := c.downloadModel(modelName)
+	switch mode {
+	case InvalidUTF8Strip:
+		return strings.ToValidUTF8(prompt, ""), nil
+	case InvalidUTF8Error:
+		offset := 0
+		for offset < len(prompt) {
+			r, size := utf8.DecodeRuneInString(prompt[offset:])
+			if r == utf8.RuneError && size == 1 {
+				break
+			}
+			offset += size
+		}
+		return "", fmt.Errorf("%w at byte %d", ErrInvalidUTF8, offset)
+	default:
+		return strings.ToValidUTF8(prompt, "\uFFFD"), nil
+	}
+}
+
+func (c *ollamatokenizer) CountTokens(modelName, prompt string) (int, error) {
+	return c.CountTokensCtx(context.Background(), modelName, prompt)
+}
+
+// CountTokensCtx implements Tokenizer.
+func (c *ollamatokenizer) CountTokensCtx(ctx context.Context, modelName, prompt string) (int, error) {
+	res, err := c.countTokensChecked(ctx, modelName, prompt)
+	return res.Count, err
+}
+
+// CountResult is the result of CountTokensDetailed.
+type CountResult struct {
+	Count int
+	// Cached is set if the count was served from the result cache.
+	Cached bool
+	// Oversized is set if the count exceeds the registered context window of the model.
+	// It is never set for models without a registered context window.
+	Oversized bool
+	// Model is the model that counted: the requested one, or the fallback if UsedFallback is set.
+	Model string
+	// UsedFallback is set if the requested model failed to load and the count comes from the
+	// fallback configured via TokenizerWithLoadFailureFallback, so it may differ from the real count.
+	UsedFallback bool
+}
+
+// CountTokensDetailed implements Tokenizer.
+func (c *ollamatokenizer) CountTokensDetailed(modelName, prompt string) (CountResult, error) {
+	return c.CountTokensDetailedCtx(context.Background(), modelName, prompt)
+}
+
+// CountTokensDetailedCtx implements Tokenizer.
+func (c *ollamatokenizer) CountTokensDetailedCtx(ctx context.Context, modelName, prompt string) (CountResult, error) {
+	return c.countTokensChecked(ctx, modelName, prompt)
+}
+
+// CountTokensCached implements Tokenizer.
+func (c *ollamatokenizer) CountTokensCached(modelName, prompt string) (int, bool, error) {
+	res, err := c.countTokensChecked(context.Background(), modelName, prompt)
+	return res.Count, res.Cached, err
+}
+
+// countTokensChecked counts like countTokensCached, warning about counts exceeding the context window.
+func (c *ollamatokenizer) countTokensChecked(ctx context.Context, modelName, prompt string) (CountResult, error) {
+	start := c.clock.Now()
+	count, used, cached, err := c.countTokensCached(ctx, modelName, prompt)
+	c.observe(OperationCount, modelName, used, cached, start, count, err)
 	if err != nil {
-		return nil, fmt.Errorf("failed to download model %s: %w", modelName, err)
+		return CountResult{}, err
 	}
 
-	params := llama.ModelParams{
-		VocabOnly: true,
-		Progress: func(f float32) {
-			fmt.Printf("Loading model %s: %.2f%%\n", modelName, f*100)
-		},
+	c.mu.RLock()
+	warn := c.contextWindowWarnings
+	window, ok := c.contextWindows[modelName]
+	c.mu.RUnlock()
+	if warn && ok && count > window {
+		fmt.Printf("Warning: prompt of %d tokens exceeds the context window of %d tokens of model %s\n", count, window, modelName)
 	}
+	return CountResult{
+		Count:        count,
+		Cached:       cached,
+		Oversized:    ok && count > window,
+		Model:        used,
+		UsedFallback: used != modelName,
+	}, nil
+}
 
-	model, err := llama.LoadModelFromFile(modelPath, params)
-	if err != nil {
-		return nil, fmt.Errorf("failed to load model %s from %s: %w", modelName, modelPath, err)
+// countTokensCached counts the tokens of the prompt, using the result cache if configured.
+// It returns the name of the model used and whether the count was cached.
+func (c *ollamatokenizer) countTokensCached(ctx context.Context, modelName, prompt string) (int, string, bool, error) {
+	c.mu.RLock()
+	cache := c.resultCache
+	c.mu.RUnlock()
+	if cache == nil {
+		count, used, err := c.countTokens(ctx, modelName, prompt)
+		return count, used, false, err
 	}
 
-	// Acquire write lock to update the cache.
-	c.mu.Lock()
-	c.loadedModels[modelName] = model
-	c.mu.Unlock()
+	key := NewResultCacheKey(modelName, prompt)
+	if result, ok := cache.Get(key); ok {
+		return result.Count, modelName, true, nil
+	}
+	count, used, err := c.countTokens(ctx, modelName, prompt)
+	if err != nil {
+		return 0, "", false, err
+	}
+	// results of the fallback model would outlive the outage of the requested model.
+	if used == modelName {
+		cache.Set(key, CachedResult{Count: count})
+	}
+	return count, used, false, nil
+}
 
-	fmt.Printf("Successfully loaded model %s\n", modelName)
-	return model, nil
+// countTokens counts the tokens of the prompt, bypassing the result cache.
+// It returns the name of the model used, see acquireModelOrFallback.
+func (c *ollamatokenizer) countTokens(ctx context.Context, modelName, prompt string) (int, string, error) {
+	prompt, err := c.preprocess(prompt)
+	if err != nil {
+		return 0, "", err
+	}
+	return c.countPreprocessed(ctx, modelName, prompt)
 }
 
-func (c *ollamatokenizer) CountTokens(modelName, prompt string) (int, error) {
+// countPreprocessed is countTokens for a prompt that is already preprocessed.
+func (c *ollamatokenizer) countPreprocessed(ctx context.Context, modelName, prompt string) (int, string, error) {
+	// wait before acquiring the model, so a waiting call doesn't hold it.
+	if err := c.waitThrottle(ctx); err != nil {
+		return 0, "", err
+	}
 	// For consistency, always use chunking approach or always use direct approach
 	// Option 1: Always use chunking (recommended)
-	model, err := c.loadModel(modelName)
+	model, used, release, err := c.acquireModelOrFallbackContext(ctx, modelName)
 	if err != nil {
-		return 0, err
+		return 0, "", err
+	}
+	defer release()
+
+	total, _, err := c.countChunksContext(ctx, model, prompt, true)
+	if err != nil {
+		return 0, "", err
 	}
+	return total, used, nil
+}
+
+// countChunks counts the tokens of the prompt in chunks of at most maxPromptBytes.
+// Special tokens (e.g. BOS) are only added to the first chunk, and only if addSpecial is set.
+// The produced tokens are taken from the throttle, callers wait for it before acquiring the model.
+func (c *ollamatokenizer) countChunks(model *llama.Model, prompt string, addSpecial bool) (int, error) {
+	total, _, err := c.countChunksContext(context.Background(), model, prompt, addSpecial)
+	return total, err
+}
 
+// countChunksContext is countChunks, stopping between chunks once ctx is done.
+// It returns the tokens and the prompt bytes counted so far, also on error.
+func (c *ollamatokenizer) countChunksContext(ctx context.Context, model *llama.Model, prompt string, addSpecial bool) (total int, counted int, err error) {
 	b := []byte(prompt)
-	total := 0
 	i := 0
-	isFirstChunk := true
+	isFirstChunk := addSpecial
 
 	for i < len(b) {
+		if err := ctx.Err(); err != nil {
+			return total, i, err
+		}
 		end := i + maxPromptBytes
 		if end >= len(b) {
 			end = len(b)
@@ -374,45 +2183,387 @@ func (c *ollamatokenizer) CountTokens(modelName, prompt string) (int, error) {
 
 		toks, err := model.Tokenize(chunk, addBOS, parseSpecial)
 		if err != nil {
-			return 0, fmt.Errorf("tokenization failed for bytes %d-%d: %w", i, end, err)
+			return total, i, fmt.Errorf("tokenization failed for bytes %d-%d: %w", i, end, err)
 		}
 		total += len(toks)
+		c.throttle.take(len(toks))
 		i = end
 		isFirstChunk = false
 	}
 
-	return total, nil
+	return total, i, nil
+}
+
+// PartialCount is the result of CountTokensPartial.
+type PartialCount struct {
+	// Count is the number of tokens, of the whole prompt unless Partial is set.
+	Count int
+	// Partial is set if ctx was done before the whole prompt was counted.
+	// Count then covers only the first CountedBytes bytes of the prompt.
+	Partial bool
+	// CountedBytes is the number of bytes of the preprocessed prompt that were counted.
+	CountedBytes int
+}
+
+// CountTokensPartial implements Tokenizer.
+func (c *ollamatokenizer) CountTokensPartial(ctx context.Context, modelName, prompt string) (PartialCount, error) {
+	prompt, err := c.preprocess(prompt)
+	if err != nil {
+		return PartialCount{}, err
+	}
+	if err := ctx.Err(); err != nil {
+		return PartialCount{Partial: prompt != ""}, err
+	}
+
+	if err := c.waitThrottle(ctx); err != nil {
+		return PartialCount{Partial: prompt != "" && errors.Is(err, ctx.Err())}, err
+	}
+	model, _, release, err := c.acquireModelOrFallbackContext(ctx, modelName)
+	if err != nil {
+		// nothing was counted when ctx expired while loading the model.
+		return PartialCount{Partial: prompt != "" && errors.Is(err, ctx.Err())}, err
+	}
+	defer release()
+
+	total, counted, err := c.countChunksContext(ctx, model, prompt, true)
+	result := PartialCount{Count: total, Partial: counted < len(prompt), CountedBytes: counted}
+	if err != nil && !errors.Is(err, ctx.Err()) {
+		return PartialCount{}, err
+	}
+	return result, err
+}
+
+// CountTokensBoth implements Tokenizer.
+func (c *ollamatokenizer) CountTokensBoth(modelName, prompt string) (normalized int, raw int, err error) {
+	normalized, err = c.CountTokens(modelName, prompt)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	preprocessed, err := c.preprocess(prompt)
+	if err != nil {
+		return 0, 0, err
+	}
+	// the backend requires valid UTF-8, so that is the only step applied to the raw prompt.
+	sanitized, err := c.sanitizeUTF8(prompt)
+	if err != nil {
+		return 0, 0, err
+	}
+	if sanitized == preprocessed {
+		return normalized, normalized, nil
+	}
+	raw, _, err = c.countPreprocessed(context.Background(), modelName, sanitized)
+	if err != nil {
+		return 0, 0, err
+	}
+	return normalized, raw, nil
+}
+
+// CountTokensLines implements Tokenizer.
+func (c *ollamatokenizer) CountTokensLines(modelName, text string) ([]int, int, error) {
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	if text == "" {
+		lines = nil
+	}
+
+	counts := make([]int, len(lines))
+	total := 0
+	for i, line := range lines {
+		count, err := c.CountTokens(modelName, line)
+		if err != nil {
+			return nil, 0, fmt.Errorf("counting line %d failed: %w", i+1, err)
+		}
+		counts[i] = count
+		total += count
+	}
+
+	return counts, total, nil
+}
+
+// CountTokensFields implements Tokenizer.
+func (c *ollamatokenizer) CountTokensFields(modelName string, fields map[string]string) (map[string]int, int, error) {
+	counts := make(map[string]int, len(fields))
+	total := 0
+	// sorted, so the same field is reported if several fail.
+	for _, name := range slices.Sorted(maps.Keys(fields)) {
+		count, err := c.CountTokens(modelName, fields[name])
+		if err != nil {
+			return nil, 0, fmt.Errorf("counting field %s failed: %w", name, err)
+		}
+		counts[name] = count
+		total += count
+	}
+
+	return counts, total, nil
+}
+
+// CountTokensTemplate implements Tokenizer.
+func (c *ollamatokenizer) CountTokensTemplate(modelName, tmpl string, data any) (int, error) {
+	t, err := template.New("prompt").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse template: %w", err)
+	}
+	var rendered strings.Builder
+	if err := t.Execute(&rendered, data); err != nil {
+		return 0, fmt.Errorf("failed to render template: %w", err)
+	}
+	return c.CountTokens(modelName, rendered.String())
+}
+
+// CompareCountsParallel implements Tokenizer.
+func (c *ollamatokenizer) CompareCountsParallel(models []string, prompt string) (map[string]int, map[string]error) {
+	counts := make(map[string]int)
+	errs := make(map[string]error)
+
+	var (
+		mu     sync.Mutex
+		seen   = make(map[string]struct{}, len(models))
+		unique []string
+	)
+	for _, model := range models {
+		if _, dup := seen[model]; dup {
+			continue
+		}
+		seen[model] = struct{}{}
+		unique = append(unique, model)
+	}
+
+	c.forEach(len(unique), func(i int) {
+		model := unique[i]
+		count, err := c.CountTokens(model, prompt)
+
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			errs[model] = err
+			return
+		}
+		counts[model] = count
+	})
+
+	return counts, errs
+}
+
+// CountTokensMulti implements Tokenizer.
+func (c *ollamatokenizer) CountTokensMulti(models []string, prompt string) (map[string]int, error) {
+	counts, errs := c.CompareCountsParallel(models, prompt)
+	if len(errs) > 0 {
+		return counts, &MultiCountError{Errors: errs}
+	}
+	return counts, nil
+}
+
+// WrapperOverhead implements Tokenizer.
+func (c *ollamatokenizer) WrapperOverhead(modelName, prefix, suffix, sampleContent string) (int, error) {
+	wrapped, err := c.CountTokens(modelName, prefix+sampleContent+suffix)
+	if err != nil {
+		return 0, err
+	}
+	content, err := c.CountTokens(modelName, sampleContent)
+	if err != nil {
+		return 0, err
+	}
+	return wrapped - content, nil
+}
+
+// FitsWithin implements Tokenizer.
+func (c *ollamatokenizer) FitsWithin(modelName, prompt string, maxTokens int) (bool, int, error) {
+	if maxTokens < 0 {
+		return false, 0, fmt.Errorf("invalid token limit: %d", maxTokens)
+	}
+	count, err := c.CountTokens(modelName, prompt)
+	if err != nil {
+		return false, 0, err
+	}
+	return count <= maxTokens, count, nil
+}
+
+// ContextWindow implements Tokenizer.
+func (c *ollamatokenizer) ContextWindow(modelName string) (int, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	window, ok := c.contextWindows[modelName]
+	return window, ok
 }
 
 // Tokenize tokenizes the given text using the specified model.
 func (c *ollamatokenizer) Tokenize(modelName, prompt string) ([]int, error) {
-	promptLen := len(prompt)
-	if promptLen > maxPromptBytes {
-		return []int{}, fmt.Errorf("input prompt size (%d bytes) exceeds maximum allowed size (%d bytes)", promptLen, maxPromptBytes)
+	return c.TokenizeCtx(context.Background(), modelName, prompt)
+}
+
+// TokenizeCtx implements Tokenizer.
+func (c *ollamatokenizer) TokenizeCtx(ctx context.Context, modelName, prompt string) ([]int, error) {
+	start := c.clock.Now()
+	tokens, used, cached, err := c.tokenizeCached(ctx, modelName, prompt)
+	c.observe(OperationTokenize, modelName, used, cached, start, len(tokens), err)
+	return tokens, err
+}
+
+// TokenizeStrict implements Tokenizer.
+func (c *ollamatokenizer) TokenizeStrict(modelName, prompt string) ([]int, error) {
+	return c.TokenizeStrictCtx(context.Background(), modelName, prompt)
+}
+
+// TokenizeStrictCtx implements Tokenizer.
+func (c *ollamatokenizer) TokenizeStrictCtx(ctx context.Context, modelName, prompt string) ([]int, error) {
+	return c.TokenizeCtx(strictContext(ctx), modelName, prompt)
+}
+
+// CountTokensStrict implements Tokenizer.
+func (c *ollamatokenizer) CountTokensStrict(modelName, prompt string) (int, error) {
+	return c.CountTokensCtx(strictContext(context.Background()), modelName, prompt)
+}
+
+// strictKey marks the context of a strict call, see TokenizeStrict.
+type strictKey struct{}
+
+// strictContext marks ctx so the call doesn't cascade to the fallback model.
+func strictContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, strictKey{}, true)
+}
+
+// isStrict reports whether ctx is marked by strictContext.
+func isStrict(ctx context.Context) bool {
+	strict, _ := ctx.Value(strictKey{}).(bool)
+	return strict
+}
+
+// tokenizeCached tokenizes the prompt, using the result cache if configured.
+// It returns the name of the model used and whether the tokens were cached.
+func (c *ollamatokenizer) tokenizeCached(ctx context.Context, modelName, prompt string) ([]int, string, bool, error) {
+	c.mu.RLock()
+	cache := c.resultCache
+	c.mu.RUnlock()
+	if cache == nil {
+		tokens, used, err := c.tokenize(ctx, modelName, prompt)
+		return tokens, used, false, err
+	}
+
+	// results holding only a count can't be used here, they are replaced by the full result.
+	key := NewResultCacheKey(modelName, prompt)
+	if result, ok := cache.Get(key); ok && result.Tokens != nil {
+		return slices.Clone(result.Tokens), modelName, true, nil
 	}
-	model, err := c.loadModel(modelName)
+	tokens, used, err := c.tokenize(ctx, modelName, prompt)
 	if err != nil {
-		return nil, err
+		return nil, "", false, err
+	}
+	if used == modelName {
+		cache.Set(key, CachedResult{Count: len(tokens), Tokens: slices.Clone(tokens)})
+	}
+	return tokens, used, false, nil
+}
+
+// TokenizeAndCount implements Tokenizer.
+func (c *ollamatokenizer) TokenizeAndCount(modelName, prompt string) ([]int, int, error) {
+	tokens, err := c.Tokenize(modelName, prompt)
+	if err != nil {
+		return nil, 0, err
+	}
+	return tokens, len(tokens), nil
+}
+
+// tokenize tokenizes the prompt, bypassing the result cache.
+// It returns the name of the model used, see acquireModelOrFallback.
+func (c *ollamatokenizer) tokenize(ctx context.Context, modelName, prompt string) ([]int, string, error) {
+	prompt, err := c.preprocess(prompt)
+	if err != nil {
+		return nil, "", err
+	}
+	c.mu.RLock()
+	limit := c.maxInputBytes
+	c.mu.RUnlock()
+	if limit > 0 && len(prompt) > limit {
+		return []int{}, "", &InputTooLargeError{Size: len(prompt), Limit: limit}
+	}
+	if err := c.waitThrottle(ctx); err != nil {
+		return nil, "", err
+	}
+	model, used, release, err := c.acquireModelOrFallbackContext(ctx, modelName)
+	if err != nil {
+		return nil, "", err
+	}
+	defer release()
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	if len(prompt) > maxPromptBytes {
+		tokens, err := c.tokenizeChunks(model, prompt)
+		if err != nil {
+			return nil, "", err
+		}
+		return tokens, used, nil
 	}
 	// TODO: true, true why do we need these parameters?
 	tokens, err := model.Tokenize(prompt, true, true)
 	if err != nil {
-		return nil, fmt.Errorf("tokenization failed: %w", err)
+		return nil, "", fmt.Errorf("tokenization failed: %w", err)
 	}
+	c.throttle.take(len(tokens))
 
+	return tokens, used, nil
+}
+
+// tokenizeChunks tokenizes the prompt in chunks of at most maxPromptBytes like countChunks,
+// adding special tokens (e.g. BOS) to the first chunk only.
+func (c *ollamatokenizer) tokenizeChunks(model *llama.Model, prompt string) ([]int, error) {
+	var tokens []int
+	b := []byte(prompt)
+	for i := 0; i < len(b); {
+		end := min(i+maxPromptBytes, len(b))
+		for end < len(b) && end > i && !utf8.RuneStart(b[end]) {
+			end--
+		}
+		if end == i {
+			end = i + 1
+		}
+		toks, err := model.Tokenize(string(b[i:end]), i == 0, true)
+		if err != nil {
+			return nil, fmt.Errorf("tokenization failed for bytes %d-%d: %w", i, end, err)
+		}
+		tokens = append(tokens, toks...)
+		c.throttle.take(len(toks))
+		i = end
+	}
 	return tokens, nil
 }
 
 func (c *ollamatokenizer) OptimalTokenizerModel(basedOnModel string) (string, error) {
+	resolution, err := c.ResolveModel(basedOnModel)
+	if err != nil {
+		return "", err
+	}
+	return resolution.Resolved, nil
+}
+
+// ResolveModel implements Tokenizer.
+func (c *ollamatokenizer) ResolveModel(basedOnModel string) (ModelResolution, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
 	if len(c.modelURLs) == 0 {
-		return "", fmt.Errorf("No models configured.")
+		return ModelResolution{}, fmt.Errorf("No models configured.")
 	}
 	basedOnModel = strings.ToLower(basedOnModel)
 	basedOnModel = strings.Split(basedOnModel, ":")[0]
 	if _, exists := c.modelURLs[basedOnModel]; exists {
-		return basedOnModel, nil
+		return ModelResolution{Resolved: basedOnModel, Exact: true}, nil
+	}
+	normalized := NormalizeModelName(basedOnModel)
+
+	var matches []string
+	for name := range c.modelURLs {
+		if NormalizeModelName(name) == normalized {
+			matches = append(matches, name)
+		}
+	}
+	if len(matches) > 0 {
+		return ambiguousResolution(matches), nil
 	}
 
+	// the longest matching substring is the most specific, e.g. llama32 matches llama3.2 rather than llama3.
+	longest := 0
 	for _, mapping := range c.familyMappings {
 		if _, canonicalExists := c.modelURLs[mapping.CanonicalName]; !canonicalExists {
 			continue
@@ -420,11 +2571,34 @@ func (c *ollamatokenizer) OptimalTokenizerModel(basedOnModel string) (string, er
 
 		// Check if the input model name contains any of the identifying substrings
 		for _, sub := range mapping.Substrings {
-			if strings.Contains(basedOnModel, sub) {
-				return mapping.CanonicalName, nil // Found a match, return the canonical representative's name
+			sub = NormalizeModelName(sub)
+			if sub == "" || len(sub) < longest || !strings.Contains(normalized, sub) {
+				continue
+			}
+			if len(sub) > longest {
+				longest, matches = len(sub), matches[:0]
+			}
+			if !slices.Contains(matches, mapping.CanonicalName) {
+				matches = append(matches, mapping.CanonicalName)
 			}
 		}
 	}
+	if len(matches) > 0 {
+		return ambiguousResolution(matches), nil
+	}
 
-	return c.fallback, nil
+	if c.strictModelMatching {
+		return ModelResolution{}, c.unknownModelLocked(basedOnModel)
+	}
+	return ModelResolution{Resolved: c.fallback, FallbackUsed: true}, nil
+}
+
+// ambiguousResolution resolves to the lexicographically smallest of the equally good matches.
+func ambiguousResolution(matches []string) ModelResolution {
+	slices.Sort(matches)
+	resolution := ModelResolution{Resolved: matches[0]}
+	if len(matches) > 1 {
+		resolution.Ambiguous = matches
+	}
+	return resolution
 }
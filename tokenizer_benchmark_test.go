@@ -1,10 +1,12 @@
 package ollamatokenizer_test
 
 import (
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -158,3 +160,100 @@ func BenchmarkTokenizeParallel_4KB_phi(b *testing.B) {
 func BenchmarkTokenizeParallel_16KB_phi(b *testing.B) {
 	benchmarkTokenize(b, 16384, true, "phi-3") // 16KB input
 }
+
+// benchText is a short prompt shaped like real input, mixing words, punctuation and multibyte characters.
+const benchText = "The quick brown fox jumps over the lazy dog. Größe, 東京, 🚀! "
+
+// Helper function to report tokens per second
+func showTokensPerSecond(b *testing.B, tokens int64) {
+	b.Helper()
+	elapsed := b.Elapsed().Seconds()
+	if elapsed > 0 {
+		b.ReportMetric(float64(tokens)/elapsed, "tokens/s")
+	}
+}
+
+func BenchmarkCountTokensShortPrompt_tiny(b *testing.B) {
+	defer quiet()()
+	tokenizer := createBenchTokenizer(b, "tiny")
+
+	b.SetBytes(int64(len(benchText)))
+	b.ReportAllocs()
+	var tokens int64
+	for b.Loop() {
+		count, err := tokenizer.CountTokens("tiny", benchText)
+		if err != nil {
+			b.Fatalf("count error: %v", err)
+		}
+		tokens += int64(count)
+	}
+	b.StopTimer()
+	showTokensPerSecond(b, tokens)
+}
+
+func BenchmarkCountTokensLargeInput_tiny(b *testing.B) {
+	defer quiet()()
+	tokenizer := createBenchTokenizer(b, "tiny")
+
+	// well over the 16KB prompt limit, so the input is counted in chunks.
+	input := strings.Repeat(benchText, 4096)
+	b.SetBytes(int64(len(input)))
+	b.ReportAllocs()
+	var tokens int64
+	for b.Loop() {
+		count, err := tokenizer.CountTokens("tiny", input)
+		if err != nil {
+			b.Fatalf("count error: %v", err)
+		}
+		tokens += int64(count)
+	}
+	b.StopTimer()
+	showTokensPerSecond(b, tokens)
+}
+
+func BenchmarkTokenizeBatch_tiny(b *testing.B) {
+	defer quiet()()
+	tokenizer := createBenchTokenizer(b, "tiny")
+
+	batch := make([]string, 100)
+	size := 0
+	for i := range batch {
+		batch[i] = fmt.Sprintf("Document %d: %s", i, strings.Repeat(benchText, i%8+1))
+		size += len(batch[i])
+	}
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	var tokens int64
+	for b.Loop() {
+		for _, prompt := range batch {
+			ids, err := tokenizer.Tokenize("tiny", prompt)
+			if err != nil {
+				b.Fatalf("batch tokenization error: %v", err)
+			}
+			tokens += int64(len(ids))
+		}
+	}
+	b.StopTimer()
+	showTokensPerSecond(b, tokens)
+}
+
+func BenchmarkCountTokensConcurrent_tiny(b *testing.B) {
+	defer quiet()()
+	tokenizer := createBenchTokenizer(b, "tiny")
+
+	b.SetBytes(int64(len(benchText)))
+	b.ReportAllocs()
+	var tokens atomic.Int64
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			count, err := tokenizer.CountTokens("tiny", benchText)
+			if err != nil {
+				b.Errorf("concurrent count error: %v", err)
+				return
+			}
+			tokens.Add(int64(count))
+		}
+	})
+	b.StopTimer()
+	showTokensPerSecond(b, tokens.Load())
+}
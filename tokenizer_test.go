@@ -1,15 +1,31 @@
 package ollamatokenizer_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"maps"
+	"math"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
 	"time"
+	"unicode/utf8"
 
 	"github.com/contenox/ollamatokenizer"
+	"github.com/ollama/ollama/fs/ggml"
 	"github.com/stretchr/testify/require"
 )
 
@@ -154,6 +170,20 @@ func TestAvailableModels(t *testing.T) {
 	if !modelFound {
 		t.Errorf("expected 'tiny' to be in the list of available models")
 	}
+
+	// the list is sorted and stable across calls.
+	require.True(t, slices.IsSorted(availableModels), "models should be sorted: %v", availableModels)
+	for range 10 {
+		require.Equal(t, availableModels, tokenizer.AvailableModels())
+	}
+	require.NoError(t, tokenizer.AddModel("aaa-first", "https://example.com/aaa.gguf"))
+	require.NoError(t, tokenizer.AddModel("zzz-last", "https://example.com/zzz.gguf"))
+	require.Equal(t, append(append([]string{"aaa-first"}, availableModels...), "zzz-last"), tokenizer.AvailableModels())
+
+	empty, err := ollamatokenizer.NewTokenizer(ollamatokenizer.TokenizerWithModelMap(map[string]string{}))
+	require.NoError(t, err)
+	require.NotNil(t, empty.AvailableModels())
+	require.Empty(t, empty.AvailableModels())
 }
 
 func TestOptimalTokenizerModel(t *testing.T) {
@@ -335,3 +365,3826 @@ func TestCountTokensLargeInput(t *testing.T) {
 
 	t.Logf("Successfully tokenized large input (%d bytes) into %d tokens", len(largeInput), count)
 }
+
+func TestCountTokensLines(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithFallbackModel("tiny"),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	hello, err := tokenizer.CountTokens("tiny", "Hello world!")
+	require.NoError(t, err)
+	bye, err := tokenizer.CountTokens("tiny", "Goodbye")
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name       string
+		input      string
+		wantCounts []int
+	}{
+		{name: "empty", input: "", wantCounts: []int{}},
+		{name: "single line", input: "Hello world!", wantCounts: []int{hello}},
+		{name: "multiple lines", input: "Hello world!\nGoodbye", wantCounts: []int{hello, bye}},
+		{name: "trailing newline", input: "Hello world!\nGoodbye\n", wantCounts: []int{hello, bye}},
+		{name: "empty lines", input: "Hello world!\n\nGoodbye", wantCounts: []int{hello, 0, bye}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			counts, total, err := tokenizer.CountTokensLines("tiny", tc.input)
+			require.NoError(t, err)
+			require.Equal(t, tc.wantCounts, counts)
+
+			sum := 0
+			for _, c := range counts {
+				sum += c
+			}
+			require.Equal(t, sum, total, "total should be the sum of the per-line counts")
+		})
+	}
+
+	_, _, err = tokenizer.CountTokensLines("invalid-model", "Test input")
+	require.Error(t, err)
+}
+
+func TestMmapOption(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithMmap(true),
+		ollamatokenizer.TokenizerWithPreloadedModels("tiny"),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer with mmap")
+
+	count, err := tokenizer.CountTokens("tiny", "Hello, mmap'd world!")
+	require.NoError(t, err)
+	require.Greater(t, count, 0)
+}
+
+func TestFitsWithin(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithContextWindows(map[string]int{"tiny": 2048}),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	window, ok := tokenizer.ContextWindow("tiny")
+	require.True(t, ok)
+	require.Equal(t, 2048, window)
+
+	_, ok = tokenizer.ContextWindow("phi-3")
+	require.False(t, ok, "phi-3 has no registered context window")
+
+	count, err := tokenizer.CountTokens("tiny", "Hello world!")
+	require.NoError(t, err)
+
+	fits, got, err := tokenizer.FitsWithin("tiny", "Hello world!", count)
+	require.NoError(t, err)
+	require.True(t, fits)
+	require.Equal(t, count, got)
+
+	fits, _, err = tokenizer.FitsWithin("tiny", "Hello world!", count-1)
+	require.NoError(t, err)
+	require.False(t, fits)
+
+	_, err = ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithContextWindows(map[string]int{"tiny": 0}),
+	)
+	require.Error(t, err, "a zero context window should be rejected")
+}
+
+func TestCompareCountsParallel(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithPreloadedModels("tiny", "granite-embedding-30m"),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	prompt := "Compare me across the fleet!"
+	counts, errs := tokenizer.CompareCountsParallel([]string{"tiny", "granite-embedding-30m", "invalid-model", "tiny"}, prompt)
+
+	require.Len(t, counts, 2)
+	require.Len(t, errs, 1)
+	require.Error(t, errs["invalid-model"])
+
+	for model, count := range counts {
+		want, err := tokenizer.CountTokens(model, prompt)
+		require.NoError(t, err)
+		require.Equal(t, want, count, "parallel count for %s should match CountTokens", model)
+	}
+}
+
+func TestCountTokensMulti(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	prompt := "Which model encodes this most compactly?"
+	counts, err := tokenizer.CountTokensMulti([]string{"tiny", "phi-3", "tiny"}, prompt)
+	require.NoError(t, err)
+	require.Len(t, counts, 2, "duplicate names should be counted once")
+	for model, count := range counts {
+		want, err := tokenizer.CountTokens(model, prompt)
+		require.NoError(t, err)
+		require.Equal(t, want, count, model)
+	}
+
+	// a failing model doesn't discard the counts of the others.
+	counts, err = tokenizer.CountTokensMulti([]string{"tiny", "invalid-model", "../escape"}, prompt)
+	var multiErr *ollamatokenizer.MultiCountError
+	require.ErrorAs(t, err, &multiErr)
+	require.Len(t, multiErr.Errors, 2)
+	require.ErrorIs(t, err, ollamatokenizer.ErrModelNotFound)
+	require.ErrorIs(t, err, ollamatokenizer.ErrInvalidModelName)
+	require.Equal(t, []string{"tiny"}, slices.Collect(maps.Keys(counts)))
+
+	counts, err = tokenizer.CountTokensMulti(nil, prompt)
+	require.NoError(t, err)
+	require.Empty(t, counts)
+}
+
+func TestPipelineInfo(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	info, err := tokenizer.PipelineInfo("tiny")
+	require.NoError(t, err)
+	require.Equal(t, "gpt2", info.TokenizerModel)
+	require.Equal(t, "BPE", info.ModelType)
+	require.NotEmpty(t, info.PreTokenizer)
+	require.Equal(t, "none", info.Normalizer)
+	require.True(t, info.ByteLevel)
+
+	byteLevel, err := tokenizer.IsByteLevel("tiny")
+	require.NoError(t, err)
+	require.True(t, byteLevel)
+	byteLevel, err = tokenizer.IsByteLevel("phi-3")
+	require.NoError(t, err)
+	require.False(t, byteLevel, "SentencePiece models are not byte-level")
+
+	_, err = tokenizer.PipelineInfo("invalid-model")
+	require.Error(t, err)
+	_, err = tokenizer.IsByteLevel("invalid-model")
+	require.Error(t, err)
+}
+
+func TestInvalidUTF8Modes(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	input := "Hello \xff\xfe world"
+
+	newTokenizer := func(opts ...ollamatokenizer.TokenizerOption) ollamatokenizer.Tokenizer {
+		tokenizer, err := ollamatokenizer.NewTokenizer(
+			append([]ollamatokenizer.TokenizerOption{ollamatokenizer.TokenizerWithHTTPClient(httpClient)}, opts...)...,
+		)
+		require.NoError(t, err, "failed to initialize tokenizer")
+		return tokenizer
+	}
+
+	t.Run("default replaces", func(t *testing.T) {
+		tokenizer := newTokenizer()
+		want, err := tokenizer.CountTokens("tiny", "Hello � world")
+		require.NoError(t, err)
+		got, err := tokenizer.CountTokens("tiny", input)
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	})
+
+	t.Run("replace", func(t *testing.T) {
+		tokenizer := newTokenizer(ollamatokenizer.TokenizerWithInvalidUTF8(ollamatokenizer.InvalidUTF8ReplaceChar))
+		want, err := tokenizer.Tokenize("tiny", "Hello � world")
+		require.NoError(t, err)
+		got, err := tokenizer.Tokenize("tiny", input)
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	})
+
+	t.Run("strip", func(t *testing.T) {
+		tokenizer := newTokenizer(ollamatokenizer.TokenizerWithInvalidUTF8(ollamatokenizer.InvalidUTF8Strip))
+		want, err := tokenizer.Tokenize("tiny", "Hello  world")
+		require.NoError(t, err)
+		got, err := tokenizer.Tokenize("tiny", input)
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		tokenizer := newTokenizer(ollamatokenizer.TokenizerWithInvalidUTF8(ollamatokenizer.InvalidUTF8Error))
+		_, err := tokenizer.CountTokens("tiny", input)
+		require.ErrorIs(t, err, ollamatokenizer.ErrInvalidUTF8)
+		require.Contains(t, err.Error(), "at byte 6")
+
+		_, err = tokenizer.Tokenize("tiny", input)
+		require.ErrorIs(t, err, ollamatokenizer.ErrInvalidUTF8)
+
+		_, err = tokenizer.CountTokens("tiny", "valid input")
+		require.NoError(t, err)
+	})
+}
+
+func TestSpecialTokens(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	special, err := tokenizer.SpecialTokens("tiny")
+	require.NoError(t, err)
+	require.True(t, special.EOS.Present, "tiny should define an EOS token")
+	require.Equal(t, special.EOS.ID, special.ByName["eos"])
+
+	for name, token := range map[string]ollamatokenizer.SpecialToken{
+		"bos": special.BOS, "eos": special.EOS, "pad": special.PAD, "unk": special.UNK,
+	} {
+		id, ok := special.ByName[name]
+		require.Equal(t, ok, token.Present, "presence of %s", name)
+		if ok {
+			require.Equal(t, id, token.ID, "id of %s", name)
+		}
+	}
+
+	_, err = tokenizer.SpecialTokens("invalid-model")
+	require.ErrorIs(t, err, ollamatokenizer.ErrModelNotFound)
+}
+
+func TestVocabSize(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	size, err := tokenizer.VocabSize("tiny")
+	require.NoError(t, err)
+	require.Positive(t, size)
+
+	special, err := tokenizer.SpecialTokens("tiny")
+	require.NoError(t, err)
+	for name, id := range special.ByName {
+		require.Less(t, id, size, "special token %s should be inside of the vocabulary", name)
+	}
+
+	_, err = tokenizer.VocabSize("invalid-model")
+	require.ErrorIs(t, err, ollamatokenizer.ErrModelNotFound)
+}
+
+func TestWrapperOverhead(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	prefix, suffix, content := "<question>", "</question>", "What is the capital of France?"
+	overhead, err := tokenizer.WrapperOverhead("tiny", prefix, suffix, content)
+	require.NoError(t, err)
+
+	wrapped, err := tokenizer.CountTokens("tiny", prefix+content+suffix)
+	require.NoError(t, err)
+	alone, err := tokenizer.CountTokens("tiny", content)
+	require.NoError(t, err)
+	require.Equal(t, wrapped-alone, overhead)
+	require.Greater(t, overhead, 0)
+
+	overhead, err = tokenizer.WrapperOverhead("tiny", "", "", content)
+	require.NoError(t, err)
+	require.Equal(t, 0, overhead, "an empty wrapper should add no tokens")
+}
+
+func TestModelMapBackends(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tinyURL := "https://huggingface.co/Hjgugugjhuhjggg/FastThink-0.5B-Tiny-Q2_K-GGUF/resolve/main/fastthink-0.5b-tiny-q2_k.gguf"
+
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithCustomModels(map[string]string{
+			"tiny-gguf":    "gguf:" + tinyURL,
+			"hf-model":     "hf:https://example.com/tokenizer.json",
+			"tiktoken-enc": "tiktoken:cl100k_base",
+			"spm-model":    "spm:file:///models/tokenizer.model",
+			"backend-typo": "ggfu:" + tinyURL,
+		}),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	t.Run("gguf", func(t *testing.T) {
+		want, err := tokenizer.CountTokens("tiny", "Hello world!")
+		require.NoError(t, err)
+		got, err := tokenizer.CountTokens("tiny-gguf", "Hello world!")
+		require.NoError(t, err)
+		require.Equal(t, want, got, "gguf: prefix should load the same model as the plain URL")
+	})
+
+	for _, model := range []string{"hf-model", "tiktoken-enc", "spm-model"} {
+		t.Run(model, func(t *testing.T) {
+			_, err := tokenizer.CountTokens(model, "Hello world!")
+			require.ErrorIs(t, err, ollamatokenizer.ErrUnsupportedBackend)
+		})
+	}
+
+	t.Run("unknown prefix is no backend", func(t *testing.T) {
+		_, err := tokenizer.CountTokens("backend-typo", "Hello world!")
+		require.Error(t, err)
+		require.NotErrorIs(t, err, ollamatokenizer.ErrUnsupportedBackend)
+	})
+}
+
+func TestEncodeForEmbedding(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	text := "This is a benchmark test string for measuring embedding performance"
+	tokens, err := tokenizer.Tokenize("granite-embedding-30m", text)
+	require.NoError(t, err)
+
+	enc, truncated, err := tokenizer.EncodeForEmbedding("granite-embedding-30m", text, len(tokens))
+	require.NoError(t, err)
+	require.False(t, truncated)
+	require.Equal(t, tokens, enc.IDs)
+
+	enc, truncated, err = tokenizer.EncodeForEmbedding("granite-embedding-30m", text, 4)
+	require.NoError(t, err)
+	require.True(t, truncated)
+	require.Len(t, enc.IDs, 4)
+	require.Equal(t, tokens[:3], enc.IDs[:3])
+
+	_, _, err = tokenizer.EncodeForEmbedding("granite-embedding-30m", text, 0)
+	require.Error(t, err)
+
+	// documents larger than the input limit of Tokenize are truncated, not rejected.
+	long := strings.Repeat(text+" ", 25000/len(text))
+	require.Greater(t, len(long), 16*1024)
+	_, err = tokenizer.Tokenize("granite-embedding-30m", long)
+	require.ErrorIs(t, err, ollamatokenizer.ErrInputTooLarge)
+	unlimited, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithMaxInputBytes(0),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+	all, err := unlimited.Tokenize("granite-embedding-30m", long)
+	require.NoError(t, err)
+
+	enc, truncated, err = tokenizer.EncodeForEmbedding("granite-embedding-30m", long, 16)
+	require.NoError(t, err)
+	require.True(t, truncated)
+	require.Len(t, enc.IDs, 16)
+	require.Equal(t, all[:15], enc.IDs[:15])
+
+	enc, truncated, err = tokenizer.EncodeForEmbedding("granite-embedding-30m", long, len(all)+1)
+	require.NoError(t, err)
+	require.False(t, truncated)
+	require.Len(t, enc.IDs, len(all), "a long document that fits is encoded completely")
+}
+
+func TestAddRemoveModel(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tinyURL := "https://huggingface.co/Hjgugugjhuhjggg/FastThink-0.5B-Tiny-Q2_K-GGUF/resolve/main/fastthink-0.5b-tiny-q2_k.gguf"
+
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	require.NoError(t, tokenizer.AddModel("tenant-tiny", tinyURL, ollamatokenizer.ModelWithContextWindow(1024)))
+	require.Contains(t, tokenizer.AvailableModels(), "tenant-tiny")
+	window, ok := tokenizer.ContextWindow("tenant-tiny")
+	require.True(t, ok)
+	require.Equal(t, 1024, window)
+
+	require.NoError(t, tokenizer.AddModel("tenant-tiny", tinyURL), "re-adding the same url should succeed")
+	require.Error(t, tokenizer.AddModel("tenant-tiny", "https://example.com/other.gguf"))
+	require.Error(t, tokenizer.AddModel("", tinyURL))
+
+	// tokenize concurrently while the model is removed, in-flight calls must not crash.
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			_, _ = tokenizer.Tokenize("tenant-tiny", fmt.Sprintf("Tenant request %d", id))
+		}(i)
+	}
+	_, err = tokenizer.Tokenize("tenant-tiny", "Hello tenant!")
+	require.NoError(t, err)
+	require.NoError(t, tokenizer.RemoveModel("tenant-tiny"))
+	wg.Wait()
+
+	require.NotContains(t, tokenizer.AvailableModels(), "tenant-tiny")
+	_, ok = tokenizer.ContextWindow("tenant-tiny")
+	require.False(t, ok)
+	_, err = tokenizer.Tokenize("tenant-tiny", "Hello tenant!")
+	require.Error(t, err, "removed model should no longer be usable")
+	require.Error(t, tokenizer.RemoveModel("tenant-tiny"))
+
+	require.NoError(t, tokenizer.AddModel("tenant-tiny", tinyURL, ollamatokenizer.ModelWithPreload(true)))
+	require.Contains(t, tokenizer.LoadedModels(), "tenant-tiny", "the model should be loaded while it is added")
+	require.NoError(t, tokenizer.RemoveModel("tenant-tiny"))
+
+	// nothing listens on port 1, so the download of the model fails.
+	err = tokenizer.AddModel("unreachable-model", "http://127.0.0.1:1/model.gguf", ollamatokenizer.ModelWithPreload(true))
+	require.ErrorIs(t, err, ollamatokenizer.ErrBackendUnavailable)
+	require.NotContains(t, tokenizer.AvailableModels(), "unreachable-model", "a model failing to preload should not be added")
+}
+
+func TestLineEndingNormalization(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	crlf := strings.Repeat("line with windows ending\r\n", 20) + "old mac\rending"
+
+	reference, err := ollamatokenizer.NewTokenizer(ollamatokenizer.TokenizerWithHTTPClient(httpClient))
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	testCases := []struct {
+		name       string
+		mode       ollamatokenizer.LineEndingMode
+		equivalent string
+	}{
+		{name: "none", mode: ollamatokenizer.LineEndingNone, equivalent: crlf},
+		{name: "lf", mode: ollamatokenizer.LineEndingLF, equivalent: strings.Repeat("line with windows ending\n", 20) + "old mac\nending"},
+		{name: "strip", mode: ollamatokenizer.LineEndingStrip, equivalent: strings.Repeat("line with windows ending ", 20) + "old mac ending"},
+	}
+
+	counts := make(map[string]int)
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tokenizer, err := ollamatokenizer.NewTokenizer(
+				ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+				ollamatokenizer.TokenizerWithLineEndingNormalization(tc.mode),
+			)
+			require.NoError(t, err, "failed to initialize tokenizer")
+
+			want, err := reference.CountTokens("tiny", tc.equivalent)
+			require.NoError(t, err)
+			got, err := tokenizer.CountTokens("tiny", crlf)
+			require.NoError(t, err)
+			require.Equal(t, want, got)
+			counts[tc.name] = got
+
+			tokens, err := tokenizer.Tokenize("tiny", crlf)
+			require.NoError(t, err)
+			require.Len(t, tokens, got)
+		})
+	}
+	t.Logf("counts for CRLF-heavy input per mode: %v", counts)
+}
+
+func TestCountTokensCached(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithResultCache(2),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	count, cached, err := tokenizer.CountTokensCached("tiny", "Hello cache!")
+	require.NoError(t, err)
+	require.False(t, cached, "first count should be a cache miss")
+
+	again, cached, err := tokenizer.CountTokensCached("tiny", "Hello cache!")
+	require.NoError(t, err)
+	require.True(t, cached, "second count should be a cache hit")
+	require.Equal(t, count, again)
+
+	_, cached, err = tokenizer.CountTokensCached("granite-embedding-30m", "Hello cache!")
+	require.NoError(t, err)
+	require.False(t, cached, "results are cached per model")
+
+	// the cache holds 2 entries, so a third prompt evicts the least recently used one.
+	_, _, err = tokenizer.CountTokensCached("tiny", "Another prompt")
+	require.NoError(t, err)
+	_, cached, err = tokenizer.CountTokensCached("tiny", "Hello cache!")
+	require.NoError(t, err)
+	require.False(t, cached, "evicted entry should be a cache miss")
+
+	uncached, err := ollamatokenizer.NewTokenizer(ollamatokenizer.TokenizerWithHTTPClient(httpClient))
+	require.NoError(t, err)
+	for range 2 {
+		_, cached, err = uncached.CountTokensCached("tiny", "Hello cache!")
+		require.NoError(t, err)
+		require.False(t, cached, "without a result cache nothing is cached")
+	}
+
+	_, err = ollamatokenizer.NewTokenizer(ollamatokenizer.TokenizerWithResultCache(0))
+	require.Error(t, err)
+}
+
+// mapResultCache is a minimal ResultCache backend.
+type mapResultCache struct {
+	mu   sync.Mutex
+	data map[ollamatokenizer.ResultCacheKey]ollamatokenizer.CachedResult
+}
+
+func (m *mapResultCache) Get(key ollamatokenizer.ResultCacheKey) (ollamatokenizer.CachedResult, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.data[key]
+	return r, ok
+}
+
+func (m *mapResultCache) Set(key ollamatokenizer.ResultCacheKey, result ollamatokenizer.CachedResult) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data[key] = result
+}
+
+func TestResultCacheBackend(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	backend := &mapResultCache{data: make(map[ollamatokenizer.ResultCacheKey]ollamatokenizer.CachedResult)}
+
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithResultCacheBackend(backend),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	tokens, err := tokenizer.Tokenize("tiny", "Shared cache")
+	require.NoError(t, err)
+
+	key := ollamatokenizer.NewResultCacheKey("tiny", "Shared cache")
+	stored, ok := backend.data[key]
+	require.True(t, ok, "tokenize result should be stored in the backend")
+	require.Equal(t, tokens, stored.Tokens)
+	require.Equal(t, len(tokens), stored.Count)
+
+	// a second instance sharing the backend is served from it.
+	other, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithResultCacheBackend(backend),
+	)
+	require.NoError(t, err)
+	count, cached, err := other.CountTokensCached("tiny", "Shared cache")
+	require.NoError(t, err)
+	require.True(t, cached)
+	require.Equal(t, len(tokens), count)
+
+	again, err := other.Tokenize("tiny", "Shared cache")
+	require.NoError(t, err)
+	require.Equal(t, tokens, again)
+	again[0] = -1
+	require.Equal(t, tokens, backend.data[key].Tokens, "callers must not be able to modify cached tokens")
+
+	_, err = ollamatokenizer.NewTokenizer(ollamatokenizer.TokenizerWithResultCacheBackend(nil))
+	require.Error(t, err)
+}
+
+func TestTokenizeFingerprint(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	tokens, fingerprint, err := tokenizer.TokenizeFingerprint("tiny", "Fingerprint me")
+	require.NoError(t, err)
+	want, err := tokenizer.Tokenize("tiny", "Fingerprint me")
+	require.NoError(t, err)
+	require.Equal(t, want, tokens)
+	require.Equal(t, ollamatokenizer.Fingerprint(tokens), fingerprint)
+	require.Len(t, fingerprint, 64)
+
+	_, other, err := tokenizer.TokenizeFingerprint("tiny", "Fingerprint you")
+	require.NoError(t, err)
+	require.NotEqual(t, fingerprint, other)
+
+	// sha256 over 01 00 00 00 02 00 00 00
+	require.Equal(t, "34fb5c825de7ca4aea6e712f19d439c1da0c92c37b423936c5f618545ca4fa1f", ollamatokenizer.Fingerprint([]int{1, 2}))
+}
+
+func TestMaxMemoryBytes(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+
+	unlimited, err := ollamatokenizer.NewTokenizer(ollamatokenizer.TokenizerWithHTTPClient(httpClient))
+	require.NoError(t, err, "failed to initialize tokenizer")
+	require.Zero(t, unlimited.ApproxMemoryUsage())
+
+	_, err = unlimited.Tokenize("tiny", "Hello memory!")
+	require.NoError(t, err)
+	tinySize := unlimited.ApproxMemoryUsage()
+	require.Greater(t, tinySize, int64(0))
+	_, err = unlimited.Tokenize("granite-embedding-30m", "Hello memory!")
+	require.NoError(t, err)
+	graniteSize := unlimited.ApproxMemoryUsage() - tinySize
+	require.Greater(t, graniteSize, int64(0))
+
+	// a budget below a single model keeps only the most recently loaded one.
+	limited, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithMaxMemoryBytes(1),
+	)
+	require.NoError(t, err)
+	_, err = limited.Tokenize("tiny", "Hello memory!")
+	require.NoError(t, err)
+	_, err = limited.Tokenize("granite-embedding-30m", "Hello memory!")
+	require.NoError(t, err)
+	require.Equal(t, graniteSize, limited.ApproxMemoryUsage(), "tiny should have been evicted")
+
+	// evicted models are reloaded on demand.
+	_, err = limited.Tokenize("tiny", "Hello again!")
+	require.NoError(t, err)
+	require.Equal(t, tinySize, limited.ApproxMemoryUsage())
+}
+
+// withTensorData returns the gguf file with a tensor of n float32s added to its tensor section,
+// so its size is dominated by tensor data like that of a real model.
+func withTensorData(t *testing.T, data []byte, n int) []byte {
+	t.Helper()
+	g, end, err := ggml.Decode(bytes.NewReader(data), -1)
+	require.NoError(t, err)
+	if len(g.Tensors().Items()) > 0 {
+		return data
+	}
+	alignment := g.KV().Uint("general.alignment", 32)
+
+	// without tensors, the file ends with the metadata.
+	var out bytes.Buffer
+	out.Write(data[:8])
+	_ = binary.Write(&out, binary.LittleEndian, uint64(1))
+	out.Write(data[16:end])
+	name := "token_embd.weight"
+	_ = binary.Write(&out, binary.LittleEndian, uint64(len(name)))
+	out.WriteString(name)
+	_ = binary.Write(&out, binary.LittleEndian, uint32(1)) // dimensions
+	_ = binary.Write(&out, binary.LittleEndian, uint64(n)) // shape
+	_ = binary.Write(&out, binary.LittleEndian, uint32(0)) // F32
+	_ = binary.Write(&out, binary.LittleEndian, uint64(0)) // offset in the tensor data
+	out.Write(make([]byte, (int(alignment)-out.Len()%int(alignment))%int(alignment)))
+	out.Write(make([]byte, 4*n))
+	return out.Bytes()
+}
+
+func TestApproxMemoryUsageVocabOnly(t *testing.T) {
+	defer quiet()()
+
+	home, err := os.UserHomeDir()
+	require.NoError(t, err)
+	tiny, err := os.ReadFile(filepath.Join(home, ".libollama", "models", "tiny", "model.gguf"))
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "weights.gguf")
+	require.NoError(t, os.WriteFile(path, withTensorData(t, tiny, 1<<20), 0o644))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithCustomModels(map[string]string{"weights": "file://" + path}),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+	_, err = tokenizer.Tokenize("weights", "Hello memory!")
+	require.NoError(t, err)
+
+	// only the metadata is loaded, the tensor data doesn't count.
+	usage := tokenizer.ApproxMemoryUsage()
+	require.Greater(t, usage, int64(0))
+	require.Less(t, usage, info.Size()-4<<20+4096)
+}
+
+func TestVocabDiff(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	onlyA, onlyB, err := tokenizer.VocabDiff("tiny", "tiny")
+	require.NoError(t, err)
+	require.Zero(t, onlyA, "a vocabulary has no entries missing in itself")
+	require.Zero(t, onlyB)
+
+	onlyA, onlyB, err = tokenizer.VocabDiff("tiny", "granite-embedding-30m")
+	require.NoError(t, err)
+	reversedA, reversedB, err := tokenizer.VocabDiff("granite-embedding-30m", "tiny")
+	require.NoError(t, err)
+	require.Equal(t, onlyA, reversedB)
+	require.Equal(t, onlyB, reversedA)
+	t.Logf("tiny vs granite: only tiny=%d, only granite=%d", onlyA, onlyB)
+
+	_, _, err = tokenizer.VocabDiff("tiny", "invalid-model")
+	require.Error(t, err)
+}
+
+func TestTokenizePieces(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	for _, model := range []string{"tiny", "phi-3", "granite-embedding-30m"} {
+		for _, input := range []string{"Hello world!", "Größe 東京 🚀 test", "  leading and trailing  ", ""} {
+			t.Run(model+"/"+input, func(t *testing.T) {
+				pieces, err := tokenizer.TokenizePieces(model, input)
+				require.NoError(t, err)
+
+				tokens, err := tokenizer.Tokenize(model, input)
+				require.NoError(t, err)
+				require.Len(t, pieces, len(tokens))
+
+				cursor := 0
+				for i, p := range pieces {
+					require.Equal(t, tokens[i], p.ID)
+					require.Equal(t, cursor, p.Start, "piece %d (%q) should start where the previous ended", i, p.Piece)
+					require.GreaterOrEqual(t, p.End, p.Start)
+					cursor = p.End
+				}
+				require.Equal(t, len(input), cursor, "spans should cover the whole input")
+			})
+		}
+	}
+}
+
+func TestLoadFailureFallback(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	// nothing listens on port 1, so the download of the model fails.
+	models := map[string]string{"unreachable-model": "http://127.0.0.1:1/model.gguf"}
+
+	strict, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithCustomModels(models),
+		ollamatokenizer.TokenizerWithFallbackModel("tiny"),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+	_, err = strict.CountTokens("unreachable-model", "Hello world!")
+	require.Error(t, err, "without the option a load failure should not cascade")
+
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithCustomModels(models),
+		ollamatokenizer.TokenizerWithFallbackModel("tiny"),
+		ollamatokenizer.TokenizerWithLoadFailureFallback(true),
+		ollamatokenizer.TokenizerWithResultCache(16),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	want, err := tokenizer.Tokenize("tiny", "Hello world!")
+	require.NoError(t, err)
+
+	tokens, err := tokenizer.Tokenize("unreachable-model", "Hello world!")
+	require.NoError(t, err)
+	require.Equal(t, want, tokens)
+
+	count, cached, err := tokenizer.CountTokensCached("unreachable-model", "Hello world!")
+	require.NoError(t, err)
+	require.Equal(t, len(want), count)
+	require.False(t, cached, "fallback results should not be cached for the requested model")
+	_, cached, err = tokenizer.CountTokensCached("unreachable-model", "Hello world!")
+	require.NoError(t, err)
+	require.False(t, cached, "fallback results should not be cached for the requested model")
+
+	pieces, err := tokenizer.TokenizePieces("unreachable-model", "Hello world!")
+	require.NoError(t, err)
+	require.Len(t, pieces, len(want))
+
+	result, err := tokenizer.CountTokensDetailed("unreachable-model", "Hello world!")
+	require.NoError(t, err)
+	require.Equal(t, len(want), result.Count)
+	require.True(t, result.UsedFallback, "the result should report the fallback")
+	require.Equal(t, "tiny", result.Model)
+	result, err = tokenizer.CountTokensDetailed("tiny", "Hello world!")
+	require.NoError(t, err)
+	require.False(t, result.UsedFallback)
+	require.Equal(t, "tiny", result.Model)
+
+	_, err = tokenizer.CountTokens("invalid-model", "Hello world!")
+	require.Error(t, err, "unknown models should not cascade")
+}
+
+func TestStrictModelMatching(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	// nothing listens on port 1, so the download of the model fails.
+	models := map[string]string{"unreachable-model": "http://127.0.0.1:1/model.gguf"}
+
+	lenient, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithCustomModels(models),
+		ollamatokenizer.TokenizerWithFallbackModel("tiny"),
+		ollamatokenizer.TokenizerWithLoadFailureFallback(true),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	// the strict calls fail hard on a tokenizer that falls back otherwise.
+	_, err = lenient.CountTokens("unreachable-model", "Hello world!")
+	require.NoError(t, err)
+	_, err = lenient.CountTokensStrict("unreachable-model", "Hello world!")
+	require.ErrorIs(t, err, ollamatokenizer.ErrBackendUnavailable)
+	_, err = lenient.TokenizeStrict("unreachable-model", "Hello world!")
+	require.ErrorIs(t, err, ollamatokenizer.ErrBackendUnavailable)
+	_, err = lenient.TokenizeStrictCtx(context.Background(), "unreachable-model", "Hello world!")
+	require.ErrorIs(t, err, ollamatokenizer.ErrBackendUnavailable)
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = lenient.TokenizeStrictCtx(canceled, "tiny", "Hello world!")
+	require.ErrorIs(t, err, context.Canceled)
+	_, err = lenient.CountTokensStrict("invalid-model", "Hello world!")
+	require.ErrorIs(t, err, ollamatokenizer.ErrModelNotFound)
+
+	want, err := lenient.Tokenize("tiny", "Hello world!")
+	require.NoError(t, err)
+	tokens, err := lenient.TokenizeStrict("tiny", "Hello world!")
+	require.NoError(t, err)
+	require.Equal(t, want, tokens)
+	count, err := lenient.CountTokensStrict("tiny", "Hello world!")
+	require.NoError(t, err)
+	require.Equal(t, len(want), count)
+
+	model, err := lenient.OptimalTokenizerModel("unknown-family")
+	require.NoError(t, err)
+	require.Equal(t, "tiny", model, "strict calls don't change the resolution")
+
+	strict, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithCustomModels(models),
+		ollamatokenizer.TokenizerWithFallbackModel("tiny"),
+		ollamatokenizer.TokenizerWithLoadFailureFallback(true),
+		ollamatokenizer.TokenizerWithStrictModelMatching(true),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+	_, err = strict.CountTokens("unreachable-model", "Hello world!")
+	require.ErrorIs(t, err, ollamatokenizer.ErrBackendUnavailable, "strict matching should disable the load failure fallback")
+	_, err = strict.OptimalTokenizerModel("unknown-family")
+	require.ErrorIs(t, err, ollamatokenizer.ErrModelNotFound)
+	_, err = strict.ResolveModel("")
+	require.ErrorIs(t, err, ollamatokenizer.ErrModelNotFound)
+
+	// configured models and families still resolve.
+	model, err = strict.OptimalTokenizerModel("TINY:latest")
+	require.NoError(t, err)
+	require.Equal(t, "tiny", model)
+	model, err = strict.OptimalTokenizerModel("phi3-mini")
+	require.NoError(t, err)
+	require.Equal(t, "phi-3", model)
+}
+
+func TestAnalyzeInput(t *testing.T) {
+	english := ollamatokenizer.AnalyzeInput("The quick brown fox jumps over the lazy dog.")
+	require.Equal(t, 44, english.Runes)
+	require.Zero(t, english.NonASCIIShare)
+	require.Len(t, english.Scripts, 1)
+	require.Equal(t, "Latin", english.Scripts[0].Script)
+	require.Equal(t, 1.0, english.Scripts[0].Share)
+	require.False(t, english.Mixed)
+	require.False(t, english.SuggestMultilingual)
+
+	mixed := ollamatokenizer.AnalyzeInput("Meeting in 東京都 with Иван, שלום!")
+	require.Greater(t, mixed.NonASCIIShare, 0.3)
+	require.Equal(t, "Latin", mixed.Scripts[0].Script)
+	scripts := make([]string, len(mixed.Scripts))
+	for i, s := range mixed.Scripts {
+		scripts[i] = s.Script
+	}
+	require.ElementsMatch(t, []string{"Latin", "Han", "Cyrillic", "Hebrew"}, scripts)
+	require.True(t, mixed.Mixed)
+	require.True(t, mixed.SuggestMultilingual)
+
+	japanese := ollamatokenizer.AnalyzeInput("東京はとても大きい都市です。")
+	require.Equal(t, "Hiragana", japanese.Scripts[0].Script)
+	require.True(t, japanese.SuggestMultilingual)
+
+	empty := ollamatokenizer.AnalyzeInput("")
+	require.Zero(t, empty.Runes)
+	require.Empty(t, empty.Scripts)
+	require.False(t, empty.SuggestMultilingual)
+}
+
+func TestResolveModel(t *testing.T) {
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithFallbackModel("tiny"),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	resolution, err := tokenizer.ResolveModel("Phi-3:latest")
+	require.NoError(t, err)
+	require.Equal(t, ollamatokenizer.ModelResolution{Resolved: "phi-3", Exact: true}, resolution)
+
+	resolution, err = tokenizer.ResolveModel("llama3.2-instruct")
+	require.NoError(t, err)
+	require.Equal(t, ollamatokenizer.ModelResolution{Resolved: "llama-3.2"}, resolution)
+
+	resolution, err = tokenizer.ResolveModel("unknown-model")
+	require.NoError(t, err)
+	require.Equal(t, ollamatokenizer.ModelResolution{Resolved: "tiny", FallbackUsed: true}, resolution)
+
+	for _, name := range []string{"Llama_3.2", "llama3-2", "LLAMA3.2", "llama 3.2:3b"} {
+		resolution, err = tokenizer.ResolveModel(name)
+		require.NoError(t, err)
+		require.Equal(t, ollamatokenizer.ModelResolution{Resolved: "llama-3.2"}, resolution, "resolution of %s", name)
+	}
+	resolution, err = tokenizer.ResolveModel("llama3")
+	require.NoError(t, err)
+	require.Equal(t, "llama-3.1", resolution.Resolved)
+
+	ambiguous, err := ollamatokenizer.NewTokenizer(ollamatokenizer.TokenizerWithCustomModels(map[string]string{
+		"foo_1": "https://example.com/foo_1.gguf",
+		"foo-1": "https://example.com/foo-1.gguf",
+	}))
+	require.NoError(t, err)
+	resolution, err = ambiguous.ResolveModel("FOO.1")
+	require.NoError(t, err)
+	require.Equal(t, ollamatokenizer.ModelResolution{Resolved: "foo-1", Ambiguous: []string{"foo-1", "foo_1"}}, resolution)
+
+	empty, err := ollamatokenizer.NewTokenizer(ollamatokenizer.TokenizerWithModelMap(map[string]string{}))
+	require.NoError(t, err)
+	_, err = empty.ResolveModel("tiny")
+	require.Error(t, err)
+}
+
+func TestEncodeWithLowercase(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithInvalidUTF8(ollamatokenizer.InvalidUTF8Error),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	tokens, err := tokenizer.Tokenize("tiny", "Hello WORLD")
+	require.NoError(t, err)
+	enc, err := tokenizer.Encode("tiny", "Hello WORLD")
+	require.NoError(t, err)
+	require.Equal(t, tokens, enc.IDs, "default behavior should be unchanged")
+
+	lowered, err := tokenizer.Tokenize("tiny", "hello world")
+	require.NoError(t, err)
+	enc, err = tokenizer.Encode("tiny", "Hello WORLD", ollamatokenizer.EncodeWithLowercase(true))
+	require.NoError(t, err)
+	require.Equal(t, lowered, enc.IDs)
+
+	enc, err = tokenizer.Encode("tiny", "Hello WORLD", ollamatokenizer.EncodeWithLowercase(false))
+	require.NoError(t, err)
+	require.Equal(t, tokens, enc.IDs)
+
+	_, err = tokenizer.Encode("tiny", "Hello \xff", ollamatokenizer.EncodeWithLowercase(true))
+	require.ErrorIs(t, err, ollamatokenizer.ErrInvalidUTF8, "lowercasing should not hide invalid input")
+}
+
+func TestInFlight(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithPreloadedModels("tiny"),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+	require.Zero(t, tokenizer.InFlight())
+
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			_, _ = tokenizer.CountTokens("tiny", fmt.Sprintf("In flight request %d", id))
+			_, _ = tokenizer.TokenizePieces("tiny", "Hello world!")
+		}(i)
+	}
+	wg.Wait()
+	_, _ = tokenizer.Tokenize("invalid-model", "Hello world!")
+	require.Zero(t, tokenizer.InFlight(), "all calls should have released their model")
+}
+
+func TestCountTokensTemplate(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	want, err := tokenizer.CountTokens("tiny", "Hello Ada, you have 3 new messages.")
+	require.NoError(t, err)
+
+	data := map[string]any{"Name": "Ada", "Count": 3}
+	count, err := tokenizer.CountTokensTemplate("tiny", "Hello {{.Name}}, you have {{.Count}} new messages.", data)
+	require.NoError(t, err)
+	require.Equal(t, want, count)
+
+	_, err = tokenizer.CountTokensTemplate("tiny", "Hello {{.Name", data)
+	require.Error(t, err, "invalid templates should fail")
+	_, err = tokenizer.CountTokensTemplate("tiny", "Hello {{.Missing}}", data)
+	require.Error(t, err, "missing keys should fail")
+	_, err = tokenizer.CountTokensTemplate("invalid-model", "Hello {{.Name}}", data)
+	require.Error(t, err)
+}
+
+func TestDetokenizeRoundTrip(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	inputs := []string{"Hello world", "Hello world!", "  leading spaces", "héllo wörld 👋", "line one\nline two"}
+	for _, model := range []string{"tiny", "phi-3"} {
+		for _, input := range inputs {
+			tokens, err := tokenizer.Tokenize(model, input)
+			require.NoError(t, err)
+			text, err := tokenizer.Detokenize(model, tokens)
+			require.NoError(t, err)
+			require.Equal(t, input, text, "%s should round-trip %q", model, input)
+
+			// a decoder drops the same tokens as Detokenize.
+			decoder, err := tokenizer.NewDecoder(model)
+			require.NoError(t, err)
+			var decoded strings.Builder
+			for _, id := range tokens {
+				piece, err := decoder.Decode(id)
+				require.NoError(t, err)
+				decoded.WriteString(piece)
+			}
+			decoded.WriteString(decoder.Flush())
+			require.Equal(t, input, decoded.String())
+		}
+	}
+}
+
+func TestDetokenizeUnknownIDs(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	newTokenizer := func(opts ...ollamatokenizer.TokenizerOption) ollamatokenizer.Tokenizer {
+		tokenizer, err := ollamatokenizer.NewTokenizer(append([]ollamatokenizer.TokenizerOption{
+			ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		}, opts...)...)
+		require.NoError(t, err, "failed to initialize tokenizer")
+		return tokenizer
+	}
+
+	strict := newTokenizer()
+	tokens, err := strict.Tokenize("tiny", "Hello world!")
+	require.NoError(t, err)
+	want, err := strict.Detokenize("tiny", tokens)
+	require.NoError(t, err)
+	require.Contains(t, want, "Hello world!")
+
+	outOfRange := []int{-1, 1 << 30}
+	withUnknown := append(slices.Clone(tokens[:1]), outOfRange[0])
+	withUnknown = append(withUnknown, tokens[1:]...)
+	withUnknown = append(withUnknown, outOfRange[1])
+
+	_, err = strict.Detokenize("tiny", withUnknown)
+	require.ErrorIs(t, err, ollamatokenizer.ErrUnknownTokenID, "unknown IDs should fail by default")
+
+	text, err := strict.Detokenize("tiny", nil)
+	require.NoError(t, err)
+	require.Empty(t, text, "no tokens should decode to an empty string")
+
+	skipping := newTokenizer(ollamatokenizer.TokenizerWithUnknownIDHandling(ollamatokenizer.UnknownIDSkip))
+	text, err = skipping.Detokenize("tiny", withUnknown)
+	require.NoError(t, err)
+	require.Equal(t, want, text)
+
+	replacing := newTokenizer(ollamatokenizer.TokenizerWithUnknownIDHandling(ollamatokenizer.UnknownIDReplacementPiece("<?>")))
+	text, err = replacing.Detokenize("tiny", withUnknown)
+	require.NoError(t, err)
+	first, err := replacing.Detokenize("tiny", tokens[:1])
+	require.NoError(t, err)
+	require.Equal(t, first+"<?>"+strings.TrimPrefix(want, first)+"<?>", text)
+
+	explicit := newTokenizer(ollamatokenizer.TokenizerWithUnknownIDHandling(ollamatokenizer.UnknownIDError))
+	_, err = explicit.Detokenize("tiny", outOfRange)
+	require.ErrorIs(t, err, ollamatokenizer.ErrUnknownTokenID)
+}
+
+func TestValidateTokens(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithUnknownIDHandling(ollamatokenizer.UnknownIDSkip),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	tokens, err := tokenizer.Tokenize("tiny", "Hello world!")
+	require.NoError(t, err)
+	require.NoError(t, tokenizer.ValidateTokens("tiny", tokens))
+	require.NoError(t, tokenizer.ValidateTokens("tiny", nil), "an empty sequence should be valid")
+	vocabSize, err := tokenizer.VocabSize("tiny")
+	require.NoError(t, err)
+	require.NoError(t, tokenizer.ValidateTokens("tiny", []int{0, vocabSize - 1}))
+
+	// the first invalid ID is reported, regardless of the unknown ID handling of Detokenize.
+	for _, tc := range []struct {
+		tokens   []int
+		position int
+		id       int
+	}{
+		{tokens: append(slices.Clone(tokens), vocabSize, -1), position: len(tokens), id: vocabSize},
+		{tokens: []int{-1}, position: 0, id: -1},
+	} {
+		err := tokenizer.ValidateTokens("tiny", tc.tokens)
+		require.ErrorIs(t, err, ollamatokenizer.ErrUnknownTokenID)
+		var invalid *ollamatokenizer.InvalidTokenError
+		require.ErrorAs(t, err, &invalid)
+		require.Equal(t, ollamatokenizer.InvalidTokenError{Model: "tiny", Position: tc.position, ID: tc.id, VocabSize: vocabSize}, *invalid)
+		require.Contains(t, err.Error(), fmt.Sprintf("token %d at position %d", tc.id, tc.position))
+	}
+
+	require.ErrorIs(t, tokenizer.ValidateTokens("invalid-model", tokens), ollamatokenizer.ErrModelNotFound)
+}
+
+func TestTokenizeAndCount(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	want, err := tokenizer.Tokenize("tiny", "Hello world!")
+	require.NoError(t, err)
+	tokens, count, err := tokenizer.TokenizeAndCount("tiny", "Hello world!")
+	require.NoError(t, err)
+	require.Equal(t, want, tokens)
+	require.Equal(t, len(tokens), count)
+
+	_, _, err = tokenizer.TokenizeAndCount("invalid-model", "Hello world!")
+	require.Error(t, err)
+}
+
+// referenceBPE applies merges by rank to the characters of word, like Hugging Face tokenizers.
+func referenceBPE(word string, merges []string) []string {
+	ranks := make(map[string]int, len(merges))
+	for i, merge := range merges {
+		ranks[merge] = i
+	}
+	var symbols []string
+	for _, r := range word {
+		symbols = append(symbols, string(r))
+	}
+	for {
+		best, bestRank := -1, math.MaxInt
+		for i := 0; i+1 < len(symbols); i++ {
+			if rank, ok := ranks[symbols[i]+" "+symbols[i+1]]; ok && rank < bestRank {
+				best, bestRank = i, rank
+			}
+		}
+		if best < 0 {
+			return symbols
+		}
+		pair := [2]string{symbols[best], symbols[best+1]}
+		var merged []string
+		for i := 0; i < len(symbols); i++ {
+			if i+1 < len(symbols) && symbols[i] == pair[0] && symbols[i+1] == pair[1] {
+				merged = append(merged, pair[0]+pair[1])
+				i++
+				continue
+			}
+			merged = append(merged, symbols[i])
+		}
+		symbols = merged
+	}
+}
+
+func TestBPEMergeOrderMatchesReference(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithPreloadedModels("tiny"),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+	info, err := tokenizer.PipelineInfo("tiny")
+	require.NoError(t, err)
+	if info.ModelType != "BPE" {
+		t.Skipf("model tiny uses %s, not BPE", info.ModelType)
+	}
+	special, err := tokenizer.SpecialTokens("tiny")
+	require.NoError(t, err)
+
+	home, err := os.UserHomeDir()
+	require.NoError(t, err)
+	f, err := os.Open(filepath.Join(home, ".libollama", "models", "tiny", "model.gguf"))
+	require.NoError(t, err)
+	defer f.Close()
+	model, _, err := ggml.Decode(f, -1)
+	require.NoError(t, err)
+	kv := model.KV()
+	merges := kv.Strings("tokenizer.ggml.merges")
+	ids := make(map[string]int)
+	for id, token := range kv.Strings("tokenizer.ggml.tokens") {
+		ids[token] = id
+	}
+
+	// single words of ASCII letters are neither split by the pre-tokenizer nor remapped to other bytes.
+	for _, word := range []string{"Hello", "hello", "lower", "newest", "tokenization", "Mississippi"} {
+		tokens, err := tokenizer.Tokenize("tiny", word)
+		require.NoError(t, err)
+		if special.BOS.Present && len(tokens) > 0 && tokens[0] == special.BOS.ID {
+			tokens = tokens[1:]
+		}
+
+		var want []int
+		for _, symbol := range referenceBPE(word, merges) {
+			id, ok := ids[symbol]
+			require.True(t, ok, "symbol %q of %q is not in the vocabulary", symbol, word)
+			want = append(want, id)
+		}
+		require.Equal(t, want, tokens, "tokens of %q", word)
+	}
+}
+
+func TestExplainModel(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithCustomModels(map[string]string{"unreachable-model": "http://127.0.0.1:1/model.gguf"}),
+		ollamatokenizer.TokenizerWithFallbackModel("tiny"),
+		ollamatokenizer.TokenizerWithLoadFailureFallback(true),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	explanation, err := tokenizer.ExplainModel("tiny")
+	require.NoError(t, err)
+	require.True(t, explanation.Resolution.Exact)
+	require.Len(t, explanation.Attempts, 1)
+	require.NoError(t, explanation.Attempts[0].Err)
+	require.Equal(t, "tiny", explanation.Used)
+
+	explanation, err = tokenizer.ExplainModel("unreachable-model")
+	require.NoError(t, err)
+	require.Equal(t, "unreachable-model", explanation.Resolution.Resolved)
+	require.Len(t, explanation.Attempts, 2)
+	require.Error(t, explanation.Attempts[0].Err)
+	require.False(t, explanation.Attempts[0].Fallback)
+	require.Equal(t, "tiny", explanation.Attempts[1].Model)
+	require.True(t, explanation.Attempts[1].Fallback)
+	require.NoError(t, explanation.Attempts[1].Err)
+	require.Equal(t, "tiny", explanation.Used)
+
+	explanation, err = tokenizer.ExplainModel("some-unknown-model")
+	require.NoError(t, err)
+	require.True(t, explanation.Resolution.FallbackUsed)
+	require.Equal(t, "tiny", explanation.Used)
+
+	strict, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithCustomModels(map[string]string{"unreachable-model": "http://127.0.0.1:1/model.gguf"}),
+	)
+	require.NoError(t, err)
+	explanation, err = strict.ExplainModel("unreachable-model")
+	require.NoError(t, err)
+	require.Len(t, explanation.Attempts, 1, "without the option there is no fallback attempt")
+	require.Empty(t, explanation.Used)
+}
+
+func TestPerModelConcurrency(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	_, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithPerModelConcurrency(map[string]int{"tiny": 0}),
+	)
+	require.Error(t, err, "limits must be positive")
+
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithPreloadedModels("tiny"),
+		ollamatokenizer.TokenizerWithPerModelConcurrency(map[string]int{"tiny": 2}),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	done := make(chan struct{})
+	maxInFlight := 0
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				maxInFlight = max(maxInFlight, tokenizer.InFlight())
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	prompt := strings.Repeat("Concurrency limited prompt. ", 200)
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := tokenizer.CountTokens("tiny", prompt)
+			require.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	close(done)
+	<-sampled
+
+	require.LessOrEqual(t, maxInFlight, 2, "no more than 2 calls should use the model at once")
+	require.Zero(t, tokenizer.InFlight())
+}
+
+func TestMaxConcurrency(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	_, err := ollamatokenizer.NewTokenizer(ollamatokenizer.TokenizerWithMaxConcurrency(0))
+	require.Error(t, err, "the limit must be positive")
+
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithPreloadedModels("tiny"),
+		ollamatokenizer.TokenizerWithMaxConcurrency(2),
+		ollamatokenizer.TokenizerWithBatchConcurrency(8),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	done := make(chan struct{})
+	maxInFlight := 0
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				maxInFlight = max(maxInFlight, tokenizer.InFlight())
+			}
+		}
+	}()
+
+	prompts := make([]string, 200)
+	for i := range prompts {
+		prompts[i] = strings.Repeat("Concurrency limited prompt. ", i%20+1)
+	}
+	// the batch worker pool is larger than the limit, it must neither deadlock nor exceed it.
+	counts, err := tokenizer.CountTokensBatch("tiny", prompts)
+	require.NoError(t, err)
+	require.Len(t, counts, len(prompts))
+	close(done)
+	<-sampled
+
+	require.LessOrEqual(t, maxInFlight, 2, "no more than 2 calls should use a model at once")
+	require.Zero(t, tokenizer.InFlight())
+}
+
+func TestFailFast(t *testing.T) {
+	defer quiet()()
+
+	t.Setenv("HOME", t.TempDir())
+	// the download of the slow model holds the only slot until it is released.
+	releaseDownload := make(chan struct{})
+	downloading := make(chan struct{})
+	var once sync.Once
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		once.Do(func() { close(downloading) })
+		<-releaseDownload
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithCustomModels(map[string]string{"slow": server.URL + "/slow.gguf"}),
+		ollamatokenizer.TokenizerWithMaxConcurrency(1),
+		ollamatokenizer.TokenizerWithFailFast(true),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	slowErr := make(chan error, 1)
+	go func() {
+		_, err := tokenizer.Tokenize("slow", "Hello world!")
+		slowErr <- err
+	}()
+	<-downloading
+
+	_, err = tokenizer.Tokenize("slow", "Hello world!")
+	require.ErrorIs(t, err, ollamatokenizer.ErrOverloaded, "calls beyond the limit should fail fast")
+
+	close(releaseDownload)
+	require.Error(t, <-slowErr)
+	_, err = tokenizer.Tokenize("slow", "Hello world!")
+	require.NotErrorIs(t, err, ollamatokenizer.ErrOverloaded, "the slot should be released after the call")
+}
+
+func TestEncoderAppend(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	_, err = tokenizer.NewEncoder("invalid-model")
+	require.Error(t, err)
+
+	encoder, err := tokenizer.NewEncoder("tiny")
+	require.NoError(t, err)
+
+	added, total, err := encoder.Append("")
+	require.NoError(t, err)
+	require.Zero(t, added, "empty text should add no tokens")
+	require.Zero(t, total)
+
+	first, err := tokenizer.CountTokens("tiny", "Hello world!")
+	require.NoError(t, err)
+	added, total, err = encoder.Append("Hello world!")
+	require.NoError(t, err)
+	require.Equal(t, first, added, "the first append should count like CountTokens")
+	require.Equal(t, first, total)
+
+	// messages ending in a newline don't merge with the next one.
+	whole, err := tokenizer.CountTokens("tiny", "Hello world!\nHow are you?\n")
+	require.NoError(t, err)
+	_, _, err = encoder.Append("\nHow are you?\n")
+	require.NoError(t, err)
+	require.Equal(t, whole, encoder.Total())
+
+	added, total, err = encoder.Append(strings.Repeat("long message ", 3000))
+	require.NoError(t, err)
+	require.Greater(t, added, 0)
+	require.Equal(t, encoder.Total(), total)
+}
+
+func TestOfflineMode(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	// make sure the model is cached.
+	online, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithPreloadedModels("tiny"),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+	want, err := online.CountTokens("tiny", "Hello world!")
+	require.NoError(t, err)
+
+	home, err := os.UserHomeDir()
+	require.NoError(t, err)
+	tinyPath := filepath.Join(home, ".libollama", "models", "tiny", "model.gguf")
+
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithOffline(true),
+		ollamatokenizer.TokenizerWithCustomModels(map[string]string{
+			"never-downloaded": "http://127.0.0.1:1/model.gguf",
+			"local-tiny":       "file://" + tinyPath,
+			"missing-file":     "file://" + filepath.Join(t.TempDir(), "missing.gguf"),
+		}),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	count, err := tokenizer.CountTokens("tiny", "Hello world!")
+	require.NoError(t, err, "cached models should be usable offline")
+	require.Equal(t, want, count)
+
+	count, err = tokenizer.CountTokens("local-tiny", "Hello world!")
+	require.NoError(t, err, "file:// models should be usable offline")
+	require.Equal(t, want, count)
+
+	_, err = tokenizer.CountTokens("never-downloaded", "Hello world!")
+	require.ErrorIs(t, err, ollamatokenizer.ErrOfflineMode)
+
+	_, err = tokenizer.CountTokens("missing-file", "Hello world!")
+	require.Error(t, err)
+	require.NotErrorIs(t, err, ollamatokenizer.ErrOfflineMode)
+}
+
+func TestPreloadConcurrency(t *testing.T) {
+	defer quiet()()
+
+	t.Setenv("HOME", t.TempDir())
+	// each download waits until both are in flight, they only get there if they run concurrently.
+	var inFlight atomic.Int32
+	bothArrived := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if inFlight.Add(1) == 2 {
+			close(bothArrived)
+		}
+		select {
+		case <-bothArrived:
+		case <-time.After(10 * time.Second):
+		}
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	_, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithCustomModels(map[string]string{
+			"first":  server.URL + "/first.gguf",
+			"second": server.URL + "/second.gguf",
+		}),
+		ollamatokenizer.TokenizerWithPreloadedModels("first", "second"),
+		ollamatokenizer.TokenizerWithPreloadConcurrency(2),
+	)
+	var preloadErr *ollamatokenizer.PreloadError
+	require.ErrorAs(t, err, &preloadErr)
+	require.Len(t, preloadErr.Errors, 2, "all failures should be reported")
+	require.Contains(t, preloadErr.Errors, "first")
+	require.Contains(t, preloadErr.Errors, "second")
+	require.ErrorIs(t, err, ollamatokenizer.ErrBackendUnavailable)
+	select {
+	case <-bothArrived:
+	default:
+		t.Fatal("the models should have been downloaded concurrently")
+	}
+
+	_, err = ollamatokenizer.NewTokenizer(ollamatokenizer.TokenizerWithPreloadConcurrency(0))
+	require.Error(t, err)
+}
+
+func TestBackgroundPreload(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+	require.True(t, tokenizer.Ready(), "without background preloading the tokenizer is ready right away")
+	require.NoError(t, tokenizer.WaitReady(context.Background()))
+
+	tokenizer, err = ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithBackgroundPreload("tiny"),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	require.NoError(t, tokenizer.WaitReady(ctx))
+	require.True(t, tokenizer.Ready())
+	require.Contains(t, tokenizer.LoadedModels(), "tiny")
+
+	// nothing listens on port 1, so the download of the model fails for good.
+	tokenizer, err = ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithCustomModels(map[string]string{"unreachable-model": "http://127.0.0.1:1/model.gguf"}),
+		ollamatokenizer.TokenizerWithBackgroundPreload("tiny", "unreachable-model"),
+	)
+	require.NoError(t, err, "background preload failures should not fail NewTokenizer")
+	err = tokenizer.WaitReady(ctx)
+	require.ErrorIs(t, err, ollamatokenizer.ErrBackendUnavailable)
+	require.ErrorContains(t, err, "unreachable-model")
+	require.False(t, tokenizer.Ready(), "a failed preload should keep the tokenizer not ready")
+
+	done, cancelDone := context.WithCancel(context.Background())
+	cancelDone()
+	require.Equal(t, err, tokenizer.WaitReady(done), "a finished preload should be reported without waiting")
+}
+
+func TestLocalModel(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	home, err := os.UserHomeDir()
+	require.NoError(t, err)
+	tinyPath := filepath.Join(home, ".libollama", "models", "tiny", "model.gguf")
+
+	online, err := ollamatokenizer.NewTokenizer(ollamatokenizer.TokenizerWithHTTPClient(httpClient))
+	require.NoError(t, err, "failed to initialize tokenizer")
+	want, err := online.Tokenize("tiny", "Hello world!")
+	require.NoError(t, err)
+
+	// local models are never downloaded, so they work offline next to the cached remote ones.
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithOffline(true),
+		ollamatokenizer.TokenizerWithCustomModels(map[string]string{"absolute-tiny": tinyPath}),
+		ollamatokenizer.TokenizerWithLocalModel("local-tiny", tinyPath),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+	for _, model := range []string{"absolute-tiny", "local-tiny", "tiny"} {
+		tokens, err := tokenizer.Tokenize(model, "Hello world!")
+		require.NoError(t, err, model)
+		require.Equal(t, want, tokens, model)
+	}
+
+	_, err = ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithLocalModel("missing", filepath.Join(t.TempDir(), "missing.gguf")),
+	)
+	require.Error(t, err, "a missing file should fail at registration")
+	_, err = ollamatokenizer.NewTokenizer(ollamatokenizer.TokenizerWithLocalModel("directory", t.TempDir()))
+	require.Error(t, err, "a directory should fail at registration")
+	_, err = ollamatokenizer.NewTokenizer(ollamatokenizer.TokenizerWithLocalModel("../escape", tinyPath))
+	require.ErrorIs(t, err, ollamatokenizer.ErrInvalidModelName)
+}
+
+func TestModelInfo(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	home, err := os.UserHomeDir()
+	require.NoError(t, err)
+	tinyPath := filepath.Join(home, ".libollama", "models", "tiny", "model.gguf")
+	tinyData, err := os.ReadFile(tinyPath)
+	require.NoError(t, err)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write(tinyData)
+	}))
+	defer server.Close()
+
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithLocalModel("local-tiny", tinyPath),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	info, err := tokenizer.ModelInfo("tiny")
+	require.NoError(t, err)
+	vocabSize, err := tokenizer.VocabSize("tiny")
+	require.NoError(t, err)
+	pipeline, err := tokenizer.PipelineInfo("tiny")
+	require.NoError(t, err)
+	require.Equal(t, "tiny", info.Requested)
+	require.Equal(t, "tiny", info.Model)
+	require.False(t, info.FallbackUsed)
+	require.NotEmpty(t, info.Architecture)
+	require.Equal(t, pipeline.ModelType, info.TokenizerType)
+	require.Equal(t, vocabSize, info.VocabSize)
+	require.Equal(t, ollamatokenizer.ModelSourceCache, info.Source)
+	require.True(t, strings.HasPrefix(info.URL, "https://"), info.URL)
+
+	info, err = tokenizer.ModelInfo("phi3:latest")
+	require.NoError(t, err)
+	require.Equal(t, "phi3:latest", info.Requested)
+	require.Equal(t, "phi-3", info.Model, "the resolved model should be described")
+
+	info, err = tokenizer.ModelInfo("local-tiny")
+	require.NoError(t, err)
+	require.Equal(t, ollamatokenizer.ModelSourceLocal, info.Source)
+	require.True(t, strings.HasPrefix(info.URL, "file://"), info.URL)
+
+	t.Setenv("HOME", t.TempDir())
+	tokenizer, err = ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithCustomModels(map[string]string{"served": server.URL + "/tiny.gguf"}),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+	info, err = tokenizer.ModelInfo("served")
+	require.NoError(t, err)
+	require.Equal(t, ollamatokenizer.ModelSourceNetwork, info.Source)
+	require.Equal(t, server.URL+"/tiny.gguf", info.URL)
+}
+
+func TestCountTokensFields(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	fields := map[string]string{
+		"system":  "You are a helpful assistant.",
+		"context": strings.Repeat("Some retrieved document text. ", 20),
+		"empty":   "",
+	}
+	counts, total, err := tokenizer.CountTokensFields("tiny", fields)
+	require.NoError(t, err)
+	require.Len(t, counts, len(fields))
+
+	sum := 0
+	for name, text := range fields {
+		want, err := tokenizer.CountTokens("tiny", text)
+		require.NoError(t, err)
+		require.Equal(t, want, counts[name], "field %s", name)
+		sum += want
+	}
+	require.Equal(t, sum, total)
+	require.Greater(t, counts["context"], counts["system"])
+
+	counts, total, err = tokenizer.CountTokensFields("tiny", nil)
+	require.NoError(t, err)
+	require.Empty(t, counts)
+	require.Zero(t, total)
+
+	_, _, err = tokenizer.CountTokensFields("invalid-model", fields)
+	require.Error(t, err)
+}
+
+func TestStaleCacheRedownload(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	online, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithPreloadedModels("tiny"),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+	want, err := online.CountTokens("tiny", "Hello world!")
+	require.NoError(t, err)
+
+	home, err := os.UserHomeDir()
+	require.NoError(t, err)
+	tiny, err := os.ReadFile(filepath.Join(home, ".libollama", "models", "tiny", "model.gguf"))
+	require.NoError(t, err)
+
+	var downloads atomic.Int32
+	var serveGarbage atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		downloads.Add(1)
+		if serveGarbage.Load() {
+			_, _ = w.Write([]byte("still not a gguf file"))
+			return
+		}
+		_, _ = w.Write(tiny)
+	}))
+	defer server.Close()
+
+	// simulates a cached file that fails to parse, e.g. one written by an incompatible version.
+	writeStale := func(model string) string {
+		dir := filepath.Join(home, ".libollama", "models", model)
+		require.NoError(t, os.MkdirAll(dir, 0o755))
+		path := filepath.Join(dir, "model.gguf")
+		require.NoError(t, os.WriteFile(path, []byte("not a gguf file"), 0o644))
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		return path
+	}
+	stalePath := writeStale("stale-cache-model")
+	brokenPath := writeStale("stale-cache-broken")
+
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithCustomModels(map[string]string{
+			"stale-cache-model":  server.URL + "/model.gguf",
+			"stale-cache-broken": server.URL + "/model.gguf",
+		}),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	count, err := tokenizer.CountTokens("stale-cache-model", "Hello world!")
+	require.NoError(t, err, "the stale cache entry should be downloaded again")
+	require.Equal(t, want, count)
+	require.EqualValues(t, 1, downloads.Load())
+	cached, err := os.ReadFile(stalePath)
+	require.NoError(t, err)
+	require.Equal(t, tiny, cached)
+
+	serveGarbage.Store(true)
+	_, err = tokenizer.CountTokens("stale-cache-broken", "Hello world!")
+	require.Error(t, err, "the error should be returned if the new download fails to parse too")
+	require.EqualValues(t, 2, downloads.Load(), "the file should be downloaded again only once")
+	_, err = os.Stat(brokenPath)
+	require.NoError(t, err)
+}
+
+func TestMaxTokensPerSecond(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	_, err := ollamatokenizer.NewTokenizer(ollamatokenizer.TokenizerWithMaxTokensPerSecond(-1))
+	require.Error(t, err)
+
+	prompt := strings.Repeat("Throttled tokens. ", 100)
+	unlimited, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+	count, err := unlimited.CountTokens("tiny", prompt)
+	require.NoError(t, err)
+
+	// the first call overdraws the bucket by a second worth of tokens, so the next call waits a second.
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithPreloadedModels("tiny"),
+		ollamatokenizer.TokenizerWithMaxTokensPerSecond(count/2),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	start := time.Now()
+	_, err = tokenizer.CountTokens("tiny", prompt)
+	require.NoError(t, err)
+	require.Less(t, time.Since(start), 500*time.Millisecond, "the first call should not wait")
+
+	start = time.Now()
+	_, err = tokenizer.Tokenize("tiny", prompt)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, time.Since(start), 700*time.Millisecond, "the second call should wait for the budget")
+}
+
+func TestDecoder(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	_, err = tokenizer.NewDecoder("invalid-model")
+	require.Error(t, err)
+
+	decoder, err := tokenizer.NewDecoder("tiny")
+	require.NoError(t, err)
+
+	text := "Streaming Größe, 東京 and 🚀!"
+	tokens, err := tokenizer.Tokenize("tiny", text)
+	require.NoError(t, err)
+	want, err := tokenizer.Detokenize("tiny", tokens)
+	require.NoError(t, err)
+
+	var streamed strings.Builder
+	for _, id := range tokens {
+		out, err := decoder.Decode(id)
+		require.NoError(t, err)
+		require.True(t, utf8.ValidString(out), "decoded text %q should be valid UTF-8", out)
+		streamed.WriteString(out)
+	}
+	require.Empty(t, decoder.Flush(), "the stream ends on a complete character")
+	require.Equal(t, want, streamed.String())
+
+	_, err = decoder.Decode(-1)
+	require.ErrorIs(t, err, ollamatokenizer.ErrUnknownTokenID)
+}
+
+func TestDefaultModels(t *testing.T) {
+	_, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithDefaultModels([]string{"no-such-default"}, nil),
+	)
+	require.Error(t, err)
+
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithDefaultModels([]string{"tiny", "phi-3"}, nil),
+		ollamatokenizer.TokenizerWithFallbackModel("tiny"),
+	)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"tiny", "phi-3"}, tokenizer.AvailableModels())
+
+	// excluding the fallback model, or not including it, requires choosing another one.
+	_, err = ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithDefaultModels([]string{"tiny", "phi-3"}, nil),
+	)
+	require.ErrorIs(t, err, ollamatokenizer.ErrUnknownModel)
+	_, err = ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithDefaultModels(nil, []string{"llama-3.1", "llama-3.2"}),
+	)
+	require.ErrorIs(t, err, ollamatokenizer.ErrUnknownModel)
+	require.ErrorContains(t, err, "TokenizerWithFallbackModel")
+	_, err = ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithDefaultModels(nil, []string{"llama-3.1"}),
+		ollamatokenizer.TokenizerWithStrictModelMatching(true),
+	)
+	require.NoError(t, err, "strict model matching doesn't use the fallback")
+
+	tokenizer, err = ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithDefaultModels(nil, []string{"llama-3.1", "llama-3.2"}),
+		ollamatokenizer.TokenizerWithCustomModels(map[string]string{"custom": "https://example.com/custom.gguf"}),
+		ollamatokenizer.TokenizerWithFallbackModel("tiny"),
+	)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"tiny", "granite-embedding-30m", "phi-3", "custom"}, tokenizer.AvailableModels())
+
+	// custom models overriding a default one are kept.
+	tokenizer, err = ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithCustomModels(map[string]string{"tiny": "https://example.com/tiny.gguf"}),
+		ollamatokenizer.TokenizerWithDefaultModels([]string{"phi-3"}, nil),
+		ollamatokenizer.TokenizerWithFallbackModel("phi-3"),
+	)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"tiny", "phi-3"}, tokenizer.AvailableModels())
+}
+
+func TestTokensVarint(t *testing.T) {
+	defer quiet()()
+
+	ids := []int{0, 1, 127, 128, 16383, 16384, 151643}
+	encoded := ollamatokenizer.EncodeTokensVarint(ids)
+	require.Len(t, encoded, 1+1+1+2+2+3+3)
+	decoded, err := ollamatokenizer.DecodeTokensVarint(encoded)
+	require.NoError(t, err)
+	require.Equal(t, ids, decoded)
+
+	decoded, err = ollamatokenizer.DecodeTokensVarint(nil)
+	require.NoError(t, err)
+	require.Empty(t, decoded)
+	_, err = ollamatokenizer.DecodeTokensVarint([]byte{0x80}) // truncated
+	require.Error(t, err)
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+	tokens, err := tokenizer.Tokenize("tiny", "Hello world!")
+	require.NoError(t, err)
+	encoded, err = tokenizer.TokensVarint("tiny", "Hello world!")
+	require.NoError(t, err)
+	decoded, err = ollamatokenizer.DecodeTokensVarint(encoded)
+	require.NoError(t, err)
+	require.Equal(t, tokens, decoded)
+}
+
+func TestCountTokensBoth(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	plain, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	text := "First line\r\nSecond line\r\nThird line"
+	want, err := plain.CountTokens("tiny", text)
+	require.NoError(t, err)
+	normalized, raw, err := plain.CountTokensBoth("tiny", text)
+	require.NoError(t, err)
+	require.Equal(t, want, normalized)
+	require.Equal(t, want, raw, "without normalization both counts are equal")
+
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithLineEndingNormalization(ollamatokenizer.LineEndingStrip),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+	stripped, err := tokenizer.CountTokens("tiny", text)
+	require.NoError(t, err)
+	normalized, raw, err = tokenizer.CountTokensBoth("tiny", text)
+	require.NoError(t, err)
+	require.Equal(t, stripped, normalized)
+	require.Equal(t, want, raw, "the raw count should skip the line ending normalization")
+
+	_, _, err = tokenizer.CountTokensBoth("invalid-model", text)
+	require.Error(t, err)
+}
+
+func TestChunkBySentences(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	text := "The first sentence. Is this the second one? Yes!\nA new line starts here and it goes on for quite a while without an end"
+	for _, maxTokens := range []int{8, 20, 40, 1000} {
+		chunks, err := tokenizer.ChunkBySentences("tiny", text, maxTokens)
+		require.NoError(t, err)
+		require.Equal(t, text, strings.Join(chunks, ""), "chunks should concatenate to the text")
+		for _, chunk := range chunks {
+			count, err := tokenizer.CountTokens("tiny", chunk)
+			require.NoError(t, err)
+			require.LessOrEqual(t, count, maxTokens, "chunk %q exceeds the budget", chunk)
+		}
+	}
+
+	count, err := tokenizer.CountTokens("tiny", text)
+	require.NoError(t, err)
+	chunks, err := tokenizer.ChunkBySentences("tiny", text, count)
+	require.NoError(t, err)
+	require.Equal(t, []string{text}, chunks, "text within the budget should be a single chunk")
+
+	first, err := tokenizer.CountTokens("tiny", "The first sentence. Is this the second one? ")
+	require.NoError(t, err)
+	chunks, err = tokenizer.ChunkBySentences("tiny", text, first)
+	require.NoError(t, err)
+	require.Equal(t, "The first sentence. Is this the second one? ", chunks[0], "chunks should break at sentence boundaries")
+
+	chunks, err = tokenizer.ChunkBySentences("tiny", "", 10)
+	require.NoError(t, err)
+	require.Empty(t, chunks)
+
+	_, err = tokenizer.ChunkBySentences("tiny", text, 1)
+	require.Error(t, err, "a budget holding only BOS can't hold any text")
+	_, err = tokenizer.ChunkBySentences("tiny", text, 0)
+	require.Error(t, err)
+}
+
+func TestContextWindowWarnings(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithContextWindows(map[string]int{"tiny": 4}),
+		ollamatokenizer.TokenizerWithContextWindowWarnings(true),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	// capture what the tokenizer logs.
+	logged := func(call func()) string {
+		out, err := os.CreateTemp(t.TempDir(), "stdout")
+		require.NoError(t, err)
+		defer out.Close()
+		stdout := os.Stdout
+		os.Stdout = out
+		call()
+		os.Stdout = stdout
+		data, err := os.ReadFile(out.Name())
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	var result ollamatokenizer.CountResult
+	output := logged(func() {
+		result, err = tokenizer.CountTokensDetailed("tiny", "Hello world!")
+	})
+	require.NoError(t, err)
+	require.Greater(t, result.Count, 4)
+	require.True(t, result.Oversized)
+	require.Contains(t, output, "exceeds the context window")
+
+	output = logged(func() {
+		result, err = tokenizer.CountTokensDetailed("tiny", "Hi")
+	})
+	require.NoError(t, err)
+	require.False(t, result.Oversized)
+	require.NotContains(t, output, "exceeds the context window")
+
+	// without a registered window nothing is reported.
+	output = logged(func() {
+		result, err = tokenizer.CountTokensDetailed("granite-embedding-30m", "Hello world!")
+	})
+	require.NoError(t, err)
+	require.False(t, result.Oversized)
+	require.NotContains(t, output, "exceeds the context window")
+}
+
+func TestCountTokensPartial(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	prompt := strings.Repeat("The quick brown fox jumps over the lazy dog. ", 4000)
+	full, err := tokenizer.CountTokens("tiny", prompt)
+	require.NoError(t, err)
+
+	result, err := tokenizer.CountTokensPartial(context.Background(), "tiny", prompt)
+	require.NoError(t, err)
+	require.Equal(t, ollamatokenizer.PartialCount{Count: full, CountedBytes: len(prompt)}, result)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result, err = tokenizer.CountTokensPartial(ctx, "tiny", prompt)
+	require.ErrorIs(t, err, context.Canceled)
+	require.True(t, result.Partial)
+	require.Zero(t, result.Count)
+
+	// the deadline expires while the model is still downloading, so nothing is counted.
+	stalled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		close(stalled)
+	}))
+	defer server.Close()
+	slow, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithCustomModels(map[string]string{"slow": server.URL + "/model.gguf"}),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	result, err = slow.CountTokensPartial(ctx, "slow", prompt)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Less(t, time.Since(start), 10*time.Second, "the download should be aborted")
+	require.Equal(t, ollamatokenizer.PartialCount{Partial: true}, result)
+	<-stalled
+
+	// whether the deadline hits mid-chunking depends on the machine, the result is consistent either way.
+	start = time.Now()
+	_, err = tokenizer.CountTokensPartial(context.Background(), "tiny", prompt)
+	require.NoError(t, err)
+	ctx, cancel = context.WithTimeout(context.Background(), time.Since(start)/2)
+	defer cancel()
+	result, err = tokenizer.CountTokensPartial(ctx, "tiny", prompt)
+	if result.Partial {
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.Less(t, result.CountedBytes, len(prompt))
+		require.Less(t, result.Count, full)
+	} else {
+		require.NoError(t, err)
+		require.Equal(t, full, result.Count)
+	}
+}
+
+func TestValidModelName(t *testing.T) {
+	defer quiet()()
+
+	for _, name := range []string{"tiny", "llama-3.1", "llama3.1:8b", "hf.co/org/model_v2"} {
+		require.True(t, ollamatokenizer.ValidModelName(name), name)
+	}
+	for _, name := range []string{"", "..", "../etc/passwd", "a/../b", "/abs", "trailing/", "a//b", "line\nbreak", "tab\t", "spa ce", "ünïcode", strings.Repeat("a", 257)} {
+		require.False(t, ollamatokenizer.ValidModelName(name), name)
+	}
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+	err = tokenizer.AddModel("../escape", "https://example.com/model.gguf")
+	require.ErrorIs(t, err, ollamatokenizer.ErrInvalidModelName)
+
+	_, err = ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithCustomModels(map[string]string{"bad\rname": "https://example.com/model.gguf"}),
+	)
+	require.ErrorIs(t, err, ollamatokenizer.ErrInvalidModelName)
+}
+
+func TestPruneCache(t *testing.T) {
+	defer quiet()()
+
+	home, err := os.UserHomeDir()
+	require.NoError(t, err)
+	tiny, err := os.ReadFile(filepath.Join(home, ".libollama", "models", "tiny", "model.gguf"))
+	require.NoError(t, err)
+
+	// work on a cache of its own, pruning must not touch the shared one.
+	t.Setenv("HOME", t.TempDir())
+	home, err = os.UserHomeDir()
+	require.NoError(t, err)
+	now := time.Now()
+	for i, model := range []string{"old", "older", "recent"} {
+		dir := filepath.Join(home, ".libollama", "models", model)
+		require.NoError(t, os.MkdirAll(dir, 0o755))
+		path := filepath.Join(dir, "model.gguf")
+		require.NoError(t, os.WriteFile(path, tiny, 0o644))
+		age := []time.Duration{48 * time.Hour, 72 * time.Hour, time.Minute}[i]
+		require.NoError(t, os.Chtimes(path, now.Add(-age), now.Add(-age)))
+	}
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithModelMap(map[string]string{
+			"old":    "http://127.0.0.1:1/model.gguf",
+			"older":  "http://127.0.0.1:1/model.gguf",
+			"recent": "http://127.0.0.1:1/model.gguf",
+		}),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	entries, total, err := tokenizer.CacheStats()
+	require.NoError(t, err)
+	require.Equal(t, 3, entries)
+	require.Equal(t, int64(3*len(tiny)), total)
+
+	// loading marks the file as used, so it survives pruning by age.
+	_, err = tokenizer.CountTokens("old", "Hello world!")
+	require.NoError(t, err)
+
+	removed, freed, err := tokenizer.PruneCache(ollamatokenizer.CachePrunePolicy{MaxAge: 24 * time.Hour})
+	require.NoError(t, err)
+	require.Equal(t, 1, removed)
+	require.Equal(t, int64(len(tiny)), freed)
+	require.NoFileExists(t, filepath.Join(home, ".libollama", "models", "older", "model.gguf"))
+
+	// the loaded model is kept even if it is the least recently used.
+	require.NoError(t, os.Chtimes(filepath.Join(home, ".libollama", "models", "old", "model.gguf"), now.Add(-time.Hour), now.Add(-time.Hour)))
+	removed, _, err = tokenizer.PruneCache(ollamatokenizer.CachePrunePolicy{MaxBytes: 1})
+	require.NoError(t, err)
+	require.Equal(t, 1, removed)
+	require.FileExists(t, filepath.Join(home, ".libollama", "models", "old", "model.gguf"))
+
+	entries, _, err = tokenizer.CacheStats()
+	require.NoError(t, err)
+	require.Equal(t, 1, entries)
+
+	_, _, err = tokenizer.PruneCache(ollamatokenizer.CachePrunePolicy{MaxAge: -time.Hour})
+	require.Error(t, err)
+}
+
+func TestCountChatTokensCumulative(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	messages := []ollamatokenizer.ChatMessage{
+		{Role: "system", Content: "You are a helpful assistant."},
+		{Role: "user", Content: "Hello world!"},
+		{Role: "assistant", Content: "Hi, how can I help?"},
+	}
+	cumulative, total, err := tokenizer.CountChatTokensCumulative("tiny", messages)
+	require.NoError(t, err)
+	require.Len(t, cumulative, len(messages))
+	require.Equal(t, cumulative[len(cumulative)-1], total)
+	require.True(t, slices.IsSorted(cumulative))
+	for _, model := range []string{"tiny", "phi-3"} {
+		_, total, err := tokenizer.CountChatTokensCumulative(model, messages)
+		require.NoError(t, err)
+		want, err := tokenizer.CountChatTokens(model, messages)
+		require.NoError(t, err)
+		require.Equal(t, want, total, "the total should be the count of the rendered conversation")
+	}
+
+	// the role markers add overhead on top of the content.
+	content, err := tokenizer.CountTokens("tiny", messages[0].Content)
+	require.NoError(t, err)
+	require.Greater(t, cumulative[0], content)
+
+	// appending a message keeps the running totals of the earlier ones.
+	prefix, prefixTotal, err := tokenizer.CountChatTokensCumulative("tiny", messages[:2])
+	require.NoError(t, err)
+	require.Equal(t, cumulative[:2], prefix)
+	require.Equal(t, cumulative[1], prefixTotal)
+
+	cumulative, total, err = tokenizer.CountChatTokensCumulative("tiny", nil)
+	require.NoError(t, err)
+	require.Empty(t, cumulative)
+	require.Zero(t, total)
+
+	_, _, err = tokenizer.CountChatTokensCumulative("invalid-model", messages)
+	require.Error(t, err)
+}
+
+func TestCountChatTokens(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithChatTemplate("phi-3", "{{ range .Messages }}<|{{ .Role }}|>\n{{ .Content }}<|end|>\n{{ end }}<|assistant|>\n"),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	messages := []ollamatokenizer.ChatMessage{
+		{Role: "system", Content: "You are a helpful assistant."},
+		{Role: "user", Content: "Hello world!"},
+	}
+
+	// tiny doesn't embed a chat template, so the messages are rendered in the ChatML layout.
+	count, err := tokenizer.CountChatTokens("tiny", messages)
+	require.NoError(t, err)
+	want, err := tokenizer.CountTokens("tiny", "<|im_start|>system\nYou are a helpful assistant.<|im_end|>\n<|im_start|>user\nHello world!<|im_end|>\n<|im_start|>assistant\n")
+	require.NoError(t, err)
+	require.Equal(t, want, count)
+	raw, err := tokenizer.CountTokens("tiny", messages[0].Content+messages[1].Content)
+	require.NoError(t, err)
+	require.Greater(t, count, raw, "the template adds the role markers")
+
+	count, err = tokenizer.CountChatTokens("phi-3", messages)
+	require.NoError(t, err)
+	want, err = tokenizer.CountTokens("phi-3", "<|system|>\nYou are a helpful assistant.<|end|>\n<|user|>\nHello world!<|end|>\n<|assistant|>\n")
+	require.NoError(t, err)
+	require.Equal(t, want, count, "the configured template should be used")
+
+	_, err = tokenizer.CountChatTokens("invalid-model", messages)
+	require.ErrorIs(t, err, ollamatokenizer.ErrModelNotFound)
+
+	_, err = ollamatokenizer.NewTokenizer(ollamatokenizer.TokenizerWithChatTemplate("tiny", "{{ .Messages"))
+	require.Error(t, err, "an invalid template should be rejected")
+}
+
+func TestEncodeWithBOSAndEOS(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	special, err := tokenizer.SpecialTokens("tiny")
+	require.NoError(t, err)
+	require.True(t, special.BOS.Present)
+	require.True(t, special.EOS.Present)
+
+	plain, err := tokenizer.Encode("tiny", "Hello world!")
+	require.NoError(t, err)
+	require.Equal(t, special.BOS.ID, plain.IDs[0], "the model adds BOS by default")
+
+	enc, err := tokenizer.Encode("tiny", "Hello world!", ollamatokenizer.EncodeWithBOS(false))
+	require.NoError(t, err)
+	require.Equal(t, plain.IDs[1:], enc.IDs)
+
+	enc, err = tokenizer.Encode("tiny", "Hello world!", ollamatokenizer.EncodeWithBOS(true))
+	require.NoError(t, err)
+	require.Equal(t, plain.IDs, enc.IDs, "BOS should not be added twice")
+
+	enc, err = tokenizer.Encode("tiny", "Hello world!", ollamatokenizer.EncodeWithBOS(false), ollamatokenizer.EncodeWithEOS(true))
+	require.NoError(t, err)
+	require.Equal(t, append(slices.Clone(plain.IDs[1:]), special.EOS.ID), enc.IDs)
+
+	enc, err = tokenizer.Encode("tiny", "Hello world!", ollamatokenizer.EncodeWithEOS(false))
+	require.NoError(t, err)
+	require.Equal(t, plain.IDs, enc.IDs, "the model adds no EOS by default")
+
+	enc, err = tokenizer.Encode("tiny", "", ollamatokenizer.EncodeWithBOS(false), ollamatokenizer.EncodeWithEOS(true))
+	require.NoError(t, err)
+	require.Equal(t, []int{special.EOS.ID}, enc.IDs)
+}
+
+func TestTokenizeWithSpecial(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	for _, model := range []string{"tiny", "phi-3", "granite-embedding-30m"} {
+		t.Run(model, func(t *testing.T) {
+			special, err := tokenizer.SpecialTokens(model)
+			require.NoError(t, err)
+			plain, err := tokenizer.Tokenize(model, "Hello world!")
+			require.NoError(t, err)
+
+			tokens, err := tokenizer.TokenizeWithSpecial(model, "Hello world!", true, true)
+			require.NoError(t, err, "adding undefined tokens should be a no-op")
+			if special.BOS.Present {
+				require.Equal(t, special.BOS.ID, tokens[0])
+			}
+			if special.EOS.Present {
+				require.Equal(t, special.EOS.ID, tokens[len(tokens)-1])
+			}
+
+			tokens, err = tokenizer.TokenizeWithSpecial(model, "Hello world!", false, false)
+			require.NoError(t, err)
+			if special.BOS.Present {
+				require.NotEqual(t, special.BOS.ID, tokens[0])
+			}
+			if special.EOS.Present {
+				require.NotEqual(t, special.EOS.ID, tokens[len(tokens)-1])
+			}
+			require.Subset(t, plain, tokens)
+
+			again, err := tokenizer.Tokenize(model, "Hello world!")
+			require.NoError(t, err)
+			require.Equal(t, plain, again, "the default should not change")
+		})
+	}
+
+	_, err = tokenizer.TokenizeWithSpecial("invalid-model", "Hello world!", true, false)
+	require.ErrorIs(t, err, ollamatokenizer.ErrModelNotFound)
+}
+
+func TestCountTokensBatchStats(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	var prompts []string
+	var counts []int
+	for i := 1; i <= 100; i++ {
+		prompt := strings.Repeat("a", i)
+		prompts = append(prompts, prompt)
+		count, err := tokenizer.CountTokens("tiny", prompt)
+		require.NoError(t, err)
+		counts = append(counts, count)
+	}
+	slices.Sort(counts)
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+
+	stats, err := tokenizer.CountTokensBatchStats("tiny", prompts)
+	require.NoError(t, err)
+	require.Equal(t, ollamatokenizer.BatchStats{
+		Prompts: 100,
+		Total:   total,
+		Min:     counts[0],
+		Max:     counts[99],
+		Mean:    float64(total) / 100,
+		P50:     counts[49],
+		P95:     counts[94],
+		P99:     counts[98],
+	}, stats)
+
+	stats, err = tokenizer.CountTokensBatchStats("tiny", nil)
+	require.NoError(t, err)
+	require.Equal(t, ollamatokenizer.BatchStats{}, stats)
+
+	_, err = tokenizer.CountTokensBatchStats("invalid-model", prompts)
+	require.ErrorContains(t, err, "prompt 0")
+}
+
+func TestModelMirrors(t *testing.T) {
+	defer quiet()()
+
+	home, err := os.UserHomeDir()
+	require.NoError(t, err)
+	tiny, err := os.ReadFile(filepath.Join(home, ".libollama", "models", "tiny", "model.gguf"))
+	require.NoError(t, err)
+	var downloads atomic.Int64
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		downloads.Add(1)
+		_, _ = w.Write(tiny)
+	}))
+	defer mirror.Close()
+
+	// an empty cache, so the models are downloaded.
+	t.Setenv("HOME", t.TempDir())
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithModelMap(map[string]string{
+			"mirrored": "gguf:http://127.0.0.1:1/model.gguf|" + mirror.URL + "/model.gguf",
+			"down":     "http://127.0.0.1:1/model.gguf|http://127.0.0.1:1/mirror.gguf",
+		}),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	count, err := tokenizer.CountTokens("mirrored", "Hello world!")
+	require.NoError(t, err, "the mirror should be used when the primary url is down")
+	require.Equal(t, 5, count)
+	require.Equal(t, int64(1), downloads.Load())
+
+	err = tokenizer.AddModel("added", "http://127.0.0.1:1/model.gguf", ollamatokenizer.ModelWithMirrors(mirror.URL+"/model.gguf"))
+	require.NoError(t, err)
+	_, err = tokenizer.CountTokens("added", "Hello world!")
+	require.NoError(t, err)
+	require.Equal(t, int64(2), downloads.Load())
+
+	_, err = tokenizer.CountTokens("down", "Hello world!")
+	require.ErrorContains(t, err, "mirror.gguf", "the error should cover every source")
+
+	err = tokenizer.AddModel("bad", "http://127.0.0.1:1/model.gguf", ollamatokenizer.ModelWithMirrors("a|b"))
+	require.Error(t, err)
+}
+
+func TestBatchConcurrency(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithBatchConcurrency(2),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	prompts := make([]string, 200)
+	for i := range prompts {
+		prompts[i] = fmt.Sprintf("Document %d: %s", i, strings.Repeat("The quick brown fox. ", i%16+1))
+	}
+
+	// watch the calls in flight while the batch runs, the pool never runs more than two.
+	done := make(chan struct{})
+	var maxInFlight atomic.Int64
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				if n := int64(tokenizer.InFlight()); n > maxInFlight.Load() {
+					maxInFlight.Store(n)
+				}
+			}
+		}
+	}()
+	counts, err := tokenizer.CountTokensBatch("tiny", prompts)
+	require.NoError(t, err)
+	tokens, err := tokenizer.TokenizeBatch("tiny", prompts)
+	require.NoError(t, err)
+	close(done)
+	require.LessOrEqual(t, maxInFlight.Load(), int64(2))
+
+	for i, prompt := range prompts {
+		want, err := tokenizer.Tokenize("tiny", prompt)
+		require.NoError(t, err)
+		require.Equal(t, want, tokens[i])
+		require.Equal(t, len(want), counts[i])
+	}
+
+	_, err = tokenizer.CountTokensBatch("invalid-model", prompts)
+	require.ErrorContains(t, err, "prompt 0")
+	_, err = tokenizer.TokenizeBatch("invalid-model", prompts)
+	require.ErrorContains(t, err, "prompt 0")
+
+	_, err = ollamatokenizer.NewTokenizer(ollamatokenizer.TokenizerWithBatchConcurrency(0))
+	require.Error(t, err)
+}
+
+func TestUnknownModelSuggestions(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	_, err = tokenizer.CountTokens("tin", "Hello world!")
+	require.ErrorIs(t, err, ollamatokenizer.ErrUnknownModel)
+	var unknown *ollamatokenizer.UnknownModelError
+	require.ErrorAs(t, err, &unknown)
+	require.Equal(t, "tin", unknown.Model)
+	require.Equal(t, "tiny", unknown.Suggestions[0])
+	require.ErrorContains(t, err, "unknown model 'tin'; did you mean 'tiny'")
+
+	// aliases of a model family suggest its canonical model.
+	_, err = tokenizer.Tokenize("llama3", "Hello world!")
+	require.ErrorAs(t, err, &unknown)
+	require.Contains(t, unknown.Suggestions, "llama-3.1")
+
+	_, err = tokenizer.CountTokens("completely-different-name", "Hello world!")
+	require.ErrorAs(t, err, &unknown)
+	require.Empty(t, unknown.Suggestions)
+	require.EqualError(t, unknown, "unknown model 'completely-different-name'")
+
+	err = tokenizer.RemoveModel("tinyy")
+	require.ErrorIs(t, err, ollamatokenizer.ErrUnknownModel)
+}
+
+func TestCountTokensStream(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	text := strings.Repeat("The quick brown fox jumps over the lazy dog. Größe, 東京, 🚀!\n", 2000)
+	want, err := tokenizer.CountTokens("tiny", text)
+	require.NoError(t, err)
+
+	var calls []int
+	count, err := tokenizer.CountTokensStream(context.Background(), "tiny", strings.NewReader(text), func(n int) {
+		calls = append(calls, n)
+	})
+	require.NoError(t, err)
+	require.Equal(t, want, count, "the count should equal CountTokens of the whole text")
+	reader, err := tokenizer.CountTokensReader("tiny", strings.NewReader(text))
+	require.NoError(t, err)
+	require.Equal(t, reader, count, "the count should equal CountTokensReader")
+	require.NotEmpty(t, calls)
+	require.Equal(t, count, calls[len(calls)-1], "the last progress call should report the total")
+	require.True(t, slices.IsSorted(calls))
+
+	// short reads are buffered up to a chunk.
+	small := "Größe, 東京, 🚀!"
+	want, err = tokenizer.CountTokens("tiny", small)
+	require.NoError(t, err)
+	count, err = tokenizer.CountTokensStream(context.Background(), "tiny", iotest.OneByteReader(strings.NewReader(small)), nil)
+	require.NoError(t, err)
+	require.Equal(t, want, count)
+
+	// without whitespace, chunks are cut between characters, never within one.
+	tokenizerStrict, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithInvalidUTF8(ollamatokenizer.InvalidUTF8Error),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+	_, err = tokenizerStrict.CountTokensStream(context.Background(), "tiny", strings.NewReader(strings.Repeat("東京🚀", 10000)), nil)
+	require.NoError(t, err, "a character split across pieces would be invalid UTF-8")
+
+	empty, err := tokenizer.CountTokens("tiny", "")
+	require.NoError(t, err)
+	count, err = tokenizer.CountTokensStream(context.Background(), "tiny", strings.NewReader(""), nil)
+	require.NoError(t, err)
+	require.Equal(t, empty, count)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = tokenizer.CountTokensStream(ctx, "tiny", strings.NewReader(text), nil)
+	require.ErrorIs(t, err, context.Canceled)
+
+	_, err = tokenizer.CountTokensStream(context.Background(), "invalid-model", strings.NewReader(text), nil)
+	require.Error(t, err)
+}
+
+func TestConcatTokens(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	for _, split := range []int{1, 3, 5, 6, 9} {
+		text := "Hello world!"
+		a, err := tokenizer.Tokenize("tiny", text[:split])
+		require.NoError(t, err)
+		b, err := tokenizer.Tokenize("tiny", text[split:])
+		require.NoError(t, err)
+		want, err := tokenizer.Tokenize("tiny", text)
+		require.NoError(t, err)
+
+		joined, err := tokenizer.ConcatTokens("tiny", a, b)
+		require.NoError(t, err)
+		require.Equal(t, want, joined, "split at %d", split)
+	}
+
+	a, err := tokenizer.Tokenize("tiny", "Hello")
+	require.NoError(t, err)
+	joined, err := tokenizer.ConcatTokens("tiny", a, nil)
+	require.NoError(t, err)
+	require.Equal(t, a, joined)
+	joined, err = tokenizer.ConcatTokens("tiny", nil, a)
+	require.NoError(t, err)
+	require.Equal(t, a, joined)
+
+	// the joined text is kept, even where the boundary can't be merged again.
+	a, err = tokenizer.Tokenize("phi-3", "Hello")
+	require.NoError(t, err)
+	b, err := tokenizer.Tokenize("phi-3", " world!")
+	require.NoError(t, err)
+	joined, err = tokenizer.ConcatTokens("phi-3", a, b)
+	require.NoError(t, err)
+	text, err := tokenizer.Detokenize("phi-3", joined)
+	require.NoError(t, err)
+	joinedText, err := tokenizer.Detokenize("phi-3", slices.Concat(a, b[1:]))
+	require.NoError(t, err)
+	require.Equal(t, joinedText, text)
+	special, err := tokenizer.SpecialTokens("phi-3")
+	require.NoError(t, err)
+	require.Equal(t, special.BOS.ID, joined[0])
+	require.NotContains(t, joined[1:], special.BOS.ID, "BOS should only start the sequence")
+
+	_, err = tokenizer.ConcatTokens("tiny", []int{0, 1 << 20}, nil)
+	require.ErrorIs(t, err, ollamatokenizer.ErrUnknownTokenID)
+}
+
+func TestCountTokensAuthoritative(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithCustomModels(map[string]string{
+			"tiktoken-enc": "tiktoken:cl100k_base",
+		}),
+		ollamatokenizer.TokenizerWithAuthoritativeBackends(map[string]string{
+			"tiny":         ollamatokenizer.BackendGGUF,
+			"tiktoken-enc": ollamatokenizer.BackendGGUF,
+		}),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	want, err := tokenizer.CountTokens("tiny", "Hello world!")
+	require.NoError(t, err)
+	count, err := tokenizer.CountTokensAuthoritative("tiny", "Hello world!")
+	require.NoError(t, err)
+	require.Equal(t, want, count)
+
+	_, err = tokenizer.CountTokensAuthoritative("tiktoken-enc", "Hello world!")
+	require.ErrorContains(t, err, "authoritative backend is gguf", "a different configured backend should fail")
+	_, err = tokenizer.CountTokensAuthoritative("phi-3", "Hello world!")
+	require.Error(t, err, "models without an authoritative backend should fail")
+	_, err = tokenizer.CountTokensAuthoritative("tinyy", "Hello world!")
+	require.ErrorIs(t, err, ollamatokenizer.ErrUnknownModel)
+
+	_, err = ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithAuthoritativeBackends(map[string]string{"tiny": "onnx"}),
+	)
+	require.Error(t, err)
+}
+
+func TestEstimateCost(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithPricing(map[string]float64{"tiny": 0.5}),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	want, err := tokenizer.CountTokens("tiny", "Hello world!")
+	require.NoError(t, err)
+
+	tokens, cost, err := tokenizer.EstimateCost("tiny", "Hello world!", 2)
+	require.NoError(t, err)
+	require.Equal(t, want, tokens)
+	require.InDelta(t, float64(want)/1000*2, cost, 1e-12)
+
+	tokens, cost, err = tokenizer.EstimateCost("tiny", "Hello world!", 0)
+	require.NoError(t, err)
+	require.Equal(t, want, tokens)
+	require.InDelta(t, float64(want)/1000*0.5, cost, 1e-12, "the registered price should be used")
+
+	tokens, cost, err = tokenizer.EstimateCostBatch("tiny", []string{"Hello world!", "Hello world!"}, 0)
+	require.NoError(t, err)
+	require.Equal(t, 2*want, tokens)
+	require.InDelta(t, float64(2*want)/1000*0.5, cost, 1e-12)
+
+	_, _, err = tokenizer.EstimateCost("phi-3", "Hello world!", 0)
+	require.Error(t, err, "phi-3 has no registered price")
+	_, _, err = tokenizer.EstimateCost("tiny", "Hello world!", -1)
+	require.Error(t, err)
+	_, err = ollamatokenizer.NewTokenizer(ollamatokenizer.TokenizerWithPricing(map[string]float64{"tiny": math.NaN()}))
+	require.Error(t, err)
+}
+
+var updateGolden = flag.Bool("update-golden", false, "record the golden counts in testdata/golden_counts.json")
+
+// TestGoldenCounts fails when counts drift from the recorded ones. After an intended change,
+// record them again with: go test -run TestGoldenCounts -update-golden
+func TestGoldenCounts(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	cases := ollamatokenizer.GoldenCases()
+	require.NotEmpty(t, cases)
+	if *updateGolden {
+		recorded, err := ollamatokenizer.RecordGoldenCases(tokenizer, cases)
+		require.NoError(t, err)
+		f, err := os.Create(filepath.Join("testdata", "golden_counts.json"))
+		require.NoError(t, err)
+		defer f.Close()
+		require.NoError(t, ollamatokenizer.WriteGoldenCases(f, recorded))
+		return
+	}
+	require.NoError(t, ollamatokenizer.VerifyGoldenCases(tokenizer, cases))
+}
+
+func TestVerifyGoldenCases(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	recorded, err := ollamatokenizer.RecordGoldenCases(tokenizer, []ollamatokenizer.GoldenCase{
+		{Model: "tiny", Text: "Hello world!"},
+		{Model: "phi-3", Text: "Größe, 東京, 🚀!"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, ollamatokenizer.VerifyGoldenCases(tokenizer, recorded))
+
+	var buf strings.Builder
+	require.NoError(t, ollamatokenizer.WriteGoldenCases(&buf, recorded))
+	read, err := ollamatokenizer.ReadGoldenCases(strings.NewReader(buf.String()))
+	require.NoError(t, err)
+	require.Equal(t, recorded, read)
+
+	drifted := slices.Clone(recorded)
+	drifted[1].Count++
+	err = ollamatokenizer.VerifyGoldenCases(tokenizer, drifted)
+	require.ErrorContains(t, err, "golden case 1")
+	require.NotContains(t, err.Error(), "golden case 0")
+
+	err = ollamatokenizer.VerifyGoldenCases(tokenizer, []ollamatokenizer.GoldenCase{{Model: "invalid-model", Text: "x"}})
+	require.ErrorIs(t, err, ollamatokenizer.ErrUnknownModel)
+}
+
+func TestCountToolTokens(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	weather := ollamatokenizer.ToolDef{
+		Name:        "get_weather",
+		Description: "Get the current weather of a city",
+		Parameters:  json.RawMessage(`{"type":"object","properties":{"city":{"type":"string"}},"required":["city"]}`),
+	}
+	search := ollamatokenizer.ToolDef{Name: "search", Description: "Search the web"}
+
+	one, err := tokenizer.CountToolTokens("tiny", []ollamatokenizer.ToolDef{weather})
+	require.NoError(t, err)
+	schema, err := tokenizer.CountTokens("tiny", string(weather.Parameters))
+	require.NoError(t, err)
+	// the name, description and the surrounding tool format add overhead on top of the schema.
+	require.Greater(t, one, schema)
+
+	two, err := tokenizer.CountToolTokens("tiny", []ollamatokenizer.ToolDef{weather, search})
+	require.NoError(t, err)
+	require.Greater(t, two, one)
+
+	count, err := tokenizer.CountToolTokens("tiny", nil)
+	require.NoError(t, err)
+	require.Zero(t, count)
+
+	_, err = tokenizer.CountToolTokens("tiny", []ollamatokenizer.ToolDef{{Description: "no name"}})
+	require.ErrorContains(t, err, "missing name")
+	_, err = tokenizer.CountToolTokens("tiny", []ollamatokenizer.ToolDef{{Name: "broken", Parameters: json.RawMessage(`{"type":`)}})
+	require.ErrorContains(t, err, "invalid parameters schema")
+}
+
+// fakeClock is a Clock that only advances when waited on or advanced.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) After(d time.Duration) <-chan time.Time {
+	f.Advance(d)
+	fired := make(chan time.Time, 1)
+	fired <- f.Now()
+	return fired
+}
+
+func (f *fakeClock) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+}
+
+func TestClock(t *testing.T) {
+	defer quiet()()
+
+	_, err := ollamatokenizer.NewTokenizer(ollamatokenizer.TokenizerWithClock(nil))
+	require.Error(t, err)
+
+	home, err := os.UserHomeDir()
+	require.NoError(t, err)
+	tiny, err := os.ReadFile(filepath.Join(home, ".libollama", "models", "tiny", "model.gguf"))
+	require.NoError(t, err)
+	t.Setenv("HOME", t.TempDir())
+	home, err = os.UserHomeDir()
+	require.NoError(t, err)
+	for _, model := range []string{"tiny", "cached"} {
+		dir := filepath.Join(home, ".libollama", "models", model)
+		require.NoError(t, os.MkdirAll(dir, 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "model.gguf"), tiny, 0o644))
+	}
+
+	clock := &fakeClock{now: time.Now()}
+	prompt := strings.Repeat("Throttled tokens. ", 100)
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithMaxTokensPerSecond(100),
+		ollamatokenizer.TokenizerWithClock(clock),
+		ollamatokenizer.TokenizerWithModelMap(map[string]string{
+			"tiny":   "http://127.0.0.1:1/model.gguf",
+			"cached": "http://127.0.0.1:1/model.gguf",
+		}),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	// the throttle waits on the clock: the second call advances it instead of sleeping.
+	count, err := tokenizer.CountTokens("tiny", prompt)
+	require.NoError(t, err)
+	before := clock.Now()
+	start := time.Now()
+	_, err = tokenizer.Tokenize("tiny", prompt)
+	require.NoError(t, err)
+	require.Less(t, time.Since(start), 500*time.Millisecond)
+	require.GreaterOrEqual(t, clock.Now().Sub(before), time.Duration(count-100)*time.Second/100)
+
+	// the age of cached files is measured on the clock too.
+	removed, _, err := tokenizer.PruneCache(ollamatokenizer.CachePrunePolicy{MaxAge: 24 * time.Hour})
+	require.NoError(t, err)
+	require.Zero(t, removed)
+	clock.Advance(48 * time.Hour)
+	removed, _, err = tokenizer.PruneCache(ollamatokenizer.CachePrunePolicy{MaxAge: 24 * time.Hour})
+	require.NoError(t, err)
+	require.Equal(t, 1, removed, "only the unloaded model is pruned")
+	require.NoFileExists(t, filepath.Join(home, ".libollama", "models", "cached", "model.gguf"))
+}
+
+func TestMaxTokensPerSecondCtx(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	newTokenizer := func(opts ...ollamatokenizer.TokenizerOption) ollamatokenizer.Tokenizer {
+		tokenizer, err := ollamatokenizer.NewTokenizer(append([]ollamatokenizer.TokenizerOption{
+			ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+			ollamatokenizer.TokenizerWithMaxTokensPerSecond(1),
+		}, opts...)...)
+		require.NoError(t, err, "failed to initialize tokenizer")
+		return tokenizer
+	}
+	prompt := strings.Repeat("Throttled tokens. ", 100)
+
+	// the overdrawn budget takes minutes to refill, a waiting call gives up with its context.
+	blocking := newTokenizer()
+	_, err := blocking.CountTokens("tiny", prompt)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = blocking.CountTokensCtx(ctx, "tiny", prompt)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Less(t, time.Since(start), 5*time.Second)
+
+	// with fail fast, the call fails right away instead of waiting.
+	failFast := newTokenizer(ollamatokenizer.TokenizerWithFailFast(true))
+	_, err = failFast.CountTokens("tiny", prompt)
+	require.NoError(t, err)
+	_, err = failFast.CountTokens("tiny", prompt)
+	require.ErrorIs(t, err, ollamatokenizer.ErrRateLimited)
+}
+
+func TestTokenizeCtx(t *testing.T) {
+	defer quiet()()
+
+	// a model source that never answers, until the request is aborted.
+	aborted := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		close(aborted)
+	}))
+	defer server.Close()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithCustomModels(map[string]string{"slow": server.URL + "/model.gguf"}),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	tokens, err := tokenizer.TokenizeCtx(context.Background(), "tiny", "Hello world!")
+	require.NoError(t, err)
+	want, err := tokenizer.Tokenize("tiny", "Hello world!")
+	require.NoError(t, err)
+	require.Equal(t, want, tokens)
+	count, err := tokenizer.CountTokensCtx(context.Background(), "tiny", "Hello world!")
+	require.NoError(t, err)
+	require.Equal(t, len(want), count)
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = tokenizer.TokenizeCtx(canceled, "tiny", "Hello world!")
+	require.ErrorIs(t, err, context.Canceled)
+	_, err = tokenizer.CountTokensCtx(canceled, "tiny", "Hello world!")
+	require.ErrorIs(t, err, context.Canceled)
+
+	// the download of the model is aborted once the deadline passes.
+	t.Setenv("HOME", t.TempDir())
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = tokenizer.CountTokensCtx(ctx, "slow", "Hello world!")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Less(t, time.Since(start), 5*time.Second)
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the download request was not aborted")
+	}
+}
+
+func TestTokenizeWithOffsets(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	for _, model := range []string{"tiny", "phi-3"} {
+		for _, input := range []string{"Hello world!", "Größe 東京 🚀 test", ""} {
+			t.Run(model+"/"+input, func(t *testing.T) {
+				spans, err := tokenizer.TokenizeWithOffsets(model, input)
+				require.NoError(t, err)
+				tokens, err := tokenizer.Tokenize(model, input)
+				require.NoError(t, err)
+				require.Len(t, spans, len(tokens))
+
+				var covered strings.Builder
+				cursor := 0
+				for i, s := range spans {
+					require.Equal(t, tokens[i], s.ID)
+					require.Equal(t, cursor, s.Start, "span %d should start where the previous ended", i)
+					require.GreaterOrEqual(t, s.End, s.Start)
+					covered.WriteString(input[s.Start:s.End])
+					cursor = s.End
+				}
+				require.Equal(t, input, covered.String(), "spans should cover the whole input")
+			})
+		}
+	}
+
+	// "ö" takes bytes 2 and 3, a character based model covers both with the same span.
+	spans, err := tokenizer.TokenizeWithOffsets("phi-3", "Größe")
+	require.NoError(t, err)
+	i := slices.IndexFunc(spans, func(s ollamatokenizer.TokenSpan) bool { return s.Start <= 2 && s.End > 2 })
+	require.GreaterOrEqual(t, i, 0)
+	require.GreaterOrEqual(t, spans[i].End, 4, "the span holding ö should include both of its bytes")
+
+	_, err = tokenizer.TokenizeWithOffsets("invalid-model", "Hello")
+	require.Error(t, err)
+
+	// spans refer to the original prompt, not to the one with its invalid bytes and line endings normalized.
+	for _, mode := range []ollamatokenizer.InvalidUTF8Mode{ollamatokenizer.InvalidUTF8ReplaceChar, ollamatokenizer.InvalidUTF8Strip} {
+		for _, lineEndings := range []ollamatokenizer.LineEndingMode{ollamatokenizer.LineEndingLF, ollamatokenizer.LineEndingStrip} {
+			normalizing, err := ollamatokenizer.NewTokenizer(
+				ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+				ollamatokenizer.TokenizerWithInvalidUTF8(mode),
+				ollamatokenizer.TokenizerWithLineEndingNormalization(lineEndings),
+			)
+			require.NoError(t, err, "failed to initialize tokenizer")
+			input := "Hello\xff\xfe world\r\nnext line\r\xc3"
+			spans, err := normalizing.TokenizeWithOffsets("tiny", input)
+			require.NoError(t, err)
+			tokens, err := normalizing.Tokenize("tiny", input)
+			require.NoError(t, err)
+			require.Len(t, spans, len(tokens))
+
+			cursor := 0
+			for i, s := range spans {
+				require.Equal(t, tokens[i], s.ID)
+				require.Equal(t, cursor, s.Start, "span %d should start where the previous ended", i)
+				require.GreaterOrEqual(t, s.End, s.Start)
+				cursor = s.End
+			}
+			require.Equal(t, len(input), cursor, "spans should cover the whole input")
+			world := slices.IndexFunc(spans, func(s ollamatokenizer.TokenSpan) bool { return strings.Contains(input[s.Start:s.End], "world") })
+			require.GreaterOrEqual(t, world, 0, "a span should hold world at its original offset")
+			normalizing.Close()
+		}
+	}
+}
+
+func TestTokenizeToPieces(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	// unescape reverses the \xNN escapes of invalid bytes.
+	unescape := func(piece string) string {
+		var sb strings.Builder
+		for i := 0; i < len(piece); i++ {
+			if strings.HasPrefix(piece[i:], `\x`) && i+4 <= len(piece) {
+				var b byte
+				_, err := fmt.Sscanf(piece[i+2:i+4], "%02x", &b)
+				require.NoError(t, err)
+				sb.WriteByte(b)
+				i += 3
+				continue
+			}
+			sb.WriteByte(piece[i])
+		}
+		return sb.String()
+	}
+
+	for _, model := range []string{"tiny", "phi-3"} {
+		input := "Hello world! Größe 東京 🚀"
+		detailed, err := tokenizer.TokenizeDetailed(model, input)
+		require.NoError(t, err)
+		tokens, err := tokenizer.Tokenize(model, input)
+		require.NoError(t, err)
+		require.Equal(t, tokens, detailed.IDs)
+		require.Len(t, detailed.Pieces, len(tokens))
+
+		// Pieces are the raw pieces of TokenizePieces, Escaped are what TokenizeToPieces returns.
+		tokenPieces, err := tokenizer.TokenizePieces(model, input)
+		require.NoError(t, err)
+		for i, p := range tokenPieces {
+			require.Equal(t, p.Piece, detailed.Pieces[i])
+			require.Equal(t, p.Piece, unescape(detailed.Escaped[i]))
+		}
+		pieces, err := tokenizer.TokenizeToPieces(model, input)
+		require.NoError(t, err)
+		require.Equal(t, detailed.Escaped, pieces)
+
+		// the pieces are valid UTF-8 and decode back to the detokenized text, which drops the BOS
+		// token and the space prefixed by the model.
+		text, err := tokenizer.Detokenize(model, tokens)
+		require.NoError(t, err)
+		special, err := tokenizer.SpecialTokens(model)
+		require.NoError(t, err)
+		var joined strings.Builder
+		for i, p := range pieces {
+			require.True(t, utf8.ValidString(p), "piece %q should be valid UTF-8", p)
+			if special.BOS.Present && tokens[i] == special.BOS.ID {
+				continue
+			}
+			joined.WriteString(unescape(p))
+		}
+		require.Equal(t, text, strings.TrimPrefix(joined.String(), " "))
+	}
+
+	// the tiny vocabulary has no multibyte characters, they are split into escaped byte tokens.
+	pieces, err := tokenizer.TokenizeToPieces("tiny", "東")
+	require.NoError(t, err)
+	require.Contains(t, strings.Join(pieces, ""), `\xe6`)
+
+	_, err = tokenizer.TokenizeToPieces("invalid-model", "Hello")
+	require.Error(t, err)
+}
+
+func TestTruncateToTokens(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	prompt := "Hello world! Größe 東京 🚀 and some more words at the end."
+	for _, model := range []string{"tiny", "phi-3"} {
+		total, err := tokenizer.CountTokens(model, prompt)
+		require.NoError(t, err)
+
+		whole, err := tokenizer.TruncateToTokens(model, prompt, total)
+		require.NoError(t, err)
+		require.Equal(t, prompt, whole, "a prompt that fits is kept")
+
+		for _, keepTail := range []bool{false, true} {
+			for _, maxTokens := range []int{0, 1, 5, total / 2, total - 1} {
+				truncated, err := tokenizer.TruncateToTokens(model, prompt, maxTokens, ollamatokenizer.TruncateKeepTail(keepTail))
+				require.NoError(t, err)
+				require.True(t, utf8.ValidString(truncated), "%q should not split a character", truncated)
+				if keepTail {
+					require.True(t, strings.HasSuffix(prompt, truncated))
+				} else {
+					require.True(t, strings.HasPrefix(prompt, truncated))
+				}
+				count, err := tokenizer.CountTokens(model, truncated)
+				require.NoError(t, err)
+				require.LessOrEqual(t, count, maxTokens, "%s: %q exceeds the budget", model, truncated)
+			}
+		}
+	}
+
+	// the cut is between two tokens: "Hello world!" is never cut inside of " world".
+	truncated, err := tokenizer.TruncateToTokens("tiny", "Hello world!", 3)
+	require.NoError(t, err)
+	require.Equal(t, "Hello", truncated)
+
+	_, err = tokenizer.TruncateToTokens("tiny", prompt, -1)
+	require.Error(t, err)
+	_, err = tokenizer.TruncateToTokens("invalid-model", prompt, 5)
+	require.Error(t, err)
+}
+
+func TestChunkByTokens(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	text := strings.Repeat("Hello world! Größe 東京 🚀 and some more words. ", 5)
+	for _, model := range []string{"tiny", "phi-3"} {
+		for _, overlap := range []int{0, 3} {
+			chunks, err := tokenizer.ChunkByTokens(model, text, 16, overlap)
+			require.NoError(t, err)
+			require.Greater(t, len(chunks), 1)
+
+			for i, chunk := range chunks {
+				require.True(t, utf8.ValidString(chunk), "chunk %d should not split a character", i)
+				count, err := tokenizer.CountTokens(model, chunk)
+				require.NoError(t, err)
+				require.LessOrEqual(t, count, 16, "chunk %d exceeds the limit", i)
+			}
+
+			if overlap == 0 {
+				require.Equal(t, text, strings.Join(chunks, ""), "chunks without overlap should concatenate to the text")
+				continue
+			}
+			require.True(t, strings.HasPrefix(text, chunks[0]))
+			require.True(t, strings.HasSuffix(text, chunks[len(chunks)-1]))
+		}
+	}
+
+	// each chunk starts with the end of the previous one. The overlap is "up to" overlapTokens:
+	// a character split into more byte tokens than that can't be shared, so this uses ASCII text.
+	chunks, err := tokenizer.ChunkByTokens("tiny", strings.Repeat("Hello world! ", 10), 16, 3)
+	require.NoError(t, err)
+	require.Greater(t, len(chunks), 1)
+	for i := 1; i < len(chunks); i++ {
+		shared := 0
+		for n := 1; n <= min(len(chunks[i-1]), len(chunks[i])); n++ {
+			if strings.HasSuffix(chunks[i-1], chunks[i][:n]) {
+				shared = n
+			}
+		}
+		require.Positive(t, shared, "chunk %d should overlap with the previous one", i)
+	}
+
+	chunks, err = tokenizer.ChunkByTokens("tiny", "Hello world!", 100, 10)
+	require.NoError(t, err)
+	require.Equal(t, []string{"Hello world!"}, chunks)
+
+	_, err = tokenizer.ChunkByTokens("tiny", text, 10, 10)
+	require.Error(t, err, "an overlap as large as the chunk size should fail")
+	_, err = tokenizer.ChunkByTokens("tiny", text, 10, 20)
+	require.Error(t, err)
+	_, err = tokenizer.ChunkByTokens("tiny", text, 0, 0)
+	require.Error(t, err)
+	_, err = tokenizer.ChunkByTokens("tiny", text, 1, 0)
+	require.Error(t, err, "a single token and the BOS token don't fit into one token")
+}
+
+func TestMaxInputBytes(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	_, err := ollamatokenizer.NewTokenizer(ollamatokenizer.TokenizerWithMaxInputBytes(-1))
+	require.Error(t, err)
+
+	largeInput := strings.Repeat("This is a large text input that will be repeated to exceed the 16KB limit. ", 500)
+	limited, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+	_, err = limited.Tokenize("tiny", largeInput)
+	require.ErrorIs(t, err, ollamatokenizer.ErrInputTooLarge, "the 16 KiB limit should apply by default")
+	var tooLarge *ollamatokenizer.InputTooLargeError
+	require.ErrorAs(t, err, &tooLarge)
+	require.Equal(t, len(largeInput), tooLarge.Size)
+	require.Equal(t, 16*1024, tooLarge.Limit)
+
+	// counting isn't limited, and an unlimited Tokenize returns as many tokens.
+	count, err := limited.CountTokens("tiny", largeInput)
+	require.NoError(t, err)
+	unlimited, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithMaxInputBytes(0),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+	tokens, err := unlimited.Tokenize("tiny", largeInput)
+	require.NoError(t, err)
+	require.Len(t, tokens, count)
+
+	lowered, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithMaxInputBytes(8),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+	_, err = lowered.Tokenize("tiny", "Hello")
+	require.NoError(t, err)
+	_, err = lowered.Tokenize("tiny", "Hello world!")
+	require.ErrorAs(t, err, &tooLarge)
+	require.Equal(t, 12, tooLarge.Size)
+	require.Equal(t, 8, tooLarge.Limit)
+}
+
+func TestErrorClasses(t *testing.T) {
+	defer quiet()()
+
+	t.Setenv("HOME", t.TempDir())
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		// nothing listens on port 1, so the download of the model fails.
+		ollamatokenizer.TokenizerWithCustomModels(map[string]string{
+			"unreachable": "http://127.0.0.1:1/model.gguf",
+			"missing":     "file:///nonexistent/model.gguf",
+		}),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	_, err = tokenizer.CountTokens("invalid-model", "Hello")
+	require.ErrorIs(t, err, ollamatokenizer.ErrModelNotFound)
+	require.NotErrorIs(t, err, ollamatokenizer.ErrBackendUnavailable)
+
+	for _, model := range []string{"unreachable", "missing"} {
+		_, err = tokenizer.CountTokens(model, "Hello")
+		require.ErrorIs(t, err, ollamatokenizer.ErrBackendUnavailable, model)
+		require.NotErrorIs(t, err, ollamatokenizer.ErrModelNotFound, model)
+	}
+
+	_, err = tokenizer.Tokenize("unreachable", strings.Repeat("x", 32*1024))
+	require.ErrorIs(t, err, ollamatokenizer.ErrInputTooLarge, "the input is checked before the model is loaded")
+}
+
+func TestCacheDir(t *testing.T) {
+	defer quiet()()
+
+	home, err := os.UserHomeDir()
+	require.NoError(t, err)
+	tiny, err := os.ReadFile(filepath.Join(home, ".libollama", "models", "tiny", "model.gguf"))
+	require.NoError(t, err)
+
+	var requests atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		_, _ = w.Write(tiny)
+	}))
+	defer server.Close()
+
+	_, err = ollamatokenizer.NewTokenizer(ollamatokenizer.TokenizerWithCacheDir(""))
+	require.Error(t, err)
+
+	dir := t.TempDir()
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	newTokenizer := func() ollamatokenizer.Tokenizer {
+		tokenizer, err := ollamatokenizer.NewTokenizer(
+			ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+			ollamatokenizer.TokenizerWithCacheDir(dir),
+			ollamatokenizer.TokenizerWithModelMap(map[string]string{"cached": server.URL + "/model.gguf"}),
+		)
+		require.NoError(t, err, "failed to initialize tokenizer")
+		return tokenizer
+	}
+
+	want, err := newTokenizer().Tokenize("cached", "Hello world!")
+	require.NoError(t, err)
+	require.Equal(t, int64(1), requests.Load())
+	cached := filepath.Join(dir, "cached", "model.gguf")
+	require.FileExists(t, cached)
+	require.FileExists(t, cached+".sha256")
+
+	// a new instance, like after a restart, uses the cached file without any request.
+	tokens, err := newTokenizer().Tokenize("cached", "Hello world!")
+	require.NoError(t, err)
+	require.Equal(t, want, tokens)
+	require.Equal(t, int64(1), requests.Load())
+
+	// a corrupt file fails the checksum and is downloaded again.
+	corrupt := slices.Clone(tiny)
+	corrupt[len(corrupt)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(cached, corrupt, 0o644))
+	tokens, err = newTokenizer().Tokenize("cached", "Hello world!")
+	require.NoError(t, err)
+	require.Equal(t, want, tokens)
+	require.Equal(t, int64(2), requests.Load())
+	data, err := os.ReadFile(cached)
+	require.NoError(t, err)
+	require.Equal(t, tiny, data)
+
+	// a verified file is checked again by the same instance once it changed, e.g. after an unload.
+	tokenizer := newTokenizer()
+	_, err = tokenizer.Tokenize("cached", "Hello world!")
+	require.NoError(t, err)
+	require.NoError(t, tokenizer.UnloadModel("cached"))
+	require.NoError(t, os.WriteFile(cached, corrupt, 0o644))
+	tokens, err = tokenizer.Tokenize("cached", "Hello world!")
+	require.NoError(t, err)
+	require.Equal(t, want, tokens)
+	require.Equal(t, int64(3), requests.Load())
+
+	// downloads are renamed into place, no temporary files are left behind.
+	entries, err := os.ReadDir(filepath.Join(dir, "cached"))
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+}
+
+func TestUnloadModel(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithPreloadedModels("tiny", "phi-3"),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	want, err := tokenizer.Tokenize("tiny", "Hello world!")
+	require.NoError(t, err)
+	loaded := tokenizer.ApproxMemoryUsage()
+
+	// unloading tiny doesn't disturb concurrent tokenizations with phi-3.
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 25 {
+				if _, err := tokenizer.Tokenize("phi-3", "Hello world!"); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	require.NoError(t, tokenizer.UnloadModel("tiny"))
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	require.Less(t, tokenizer.ApproxMemoryUsage(), loaded)
+	require.Contains(t, tokenizer.AvailableModels(), "tiny", "an unloaded model stays configured")
+
+	// unloading again does nothing, the next use loads the model again.
+	require.NoError(t, tokenizer.UnloadModel("tiny"))
+	tokens, err := tokenizer.Tokenize("tiny", "Hello world!")
+	require.NoError(t, err)
+	require.Equal(t, want, tokens)
+	require.Equal(t, loaded, tokenizer.ApproxMemoryUsage())
+
+	require.ErrorIs(t, tokenizer.UnloadModel("invalid-model"), ollamatokenizer.ErrUnknownModel)
+}
+
+// closingCache is a ResultCache recording whether it was closed.
+type closingCache struct {
+	ollamatokenizer.ResultCache
+	closed atomic.Bool
+}
+
+func (c *closingCache) Close() error {
+	c.closed.Store(true)
+	return nil
+}
+
+func TestClose(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	cache := &closingCache{ResultCache: ollamatokenizer.NewLRUResultCache(16)}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithPreloadedModels("tiny", "phi-3"),
+		ollamatokenizer.TokenizerWithResultCacheBackend(cache),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+	require.Len(t, tokenizer.LoadedModels(), 2)
+
+	require.NoError(t, tokenizer.Close())
+	require.Empty(t, tokenizer.LoadedModels(), "all models should be freed")
+	require.Zero(t, tokenizer.ApproxMemoryUsage())
+	require.True(t, cache.closed.Load(), "the result cache should be closed")
+
+	// a download of the background preload is aborted instead of waited for.
+	t.Setenv("HOME", t.TempDir())
+	requested := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(requested)
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	tokenizer, err = ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithCustomModels(map[string]string{"slow": server.URL + "/slow.gguf"}),
+		ollamatokenizer.TokenizerWithBackgroundPreload("slow"),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+	<-requested
+	start := time.Now()
+	require.NoError(t, tokenizer.Close())
+	require.Less(t, time.Since(start), 10*time.Second)
+	require.ErrorIs(t, tokenizer.WaitReady(context.Background()), context.Canceled)
+}
+
+func TestMaxLoadedModels(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	_, err := ollamatokenizer.NewTokenizer(ollamatokenizer.TokenizerWithMaxLoadedModels(-1))
+	require.Error(t, err)
+
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithMaxLoadedModels(2),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+	require.Empty(t, tokenizer.LoadedModels())
+
+	for _, model := range []string{"tiny", "phi-3"} {
+		_, err := tokenizer.CountTokens(model, "Hello world!")
+		require.NoError(t, err)
+	}
+	require.Equal(t, []string{"phi-3", "tiny"}, tokenizer.LoadedModels())
+
+	// tiny is used again, so phi-3 is the least recently used model when a third one is loaded.
+	_, err = tokenizer.CountTokens("tiny", "Hello world!")
+	require.NoError(t, err)
+	_, err = tokenizer.CountTokens("granite-embedding-30m", "Hello world!")
+	require.NoError(t, err)
+	require.Equal(t, []string{"granite-embedding-30m", "tiny"}, tokenizer.LoadedModels())
+
+	// concurrent calls load and evict models while others are in use, the results stay correct.
+	want, err := tokenizer.Tokenize("phi-3", "Hello world!")
+	require.NoError(t, err)
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, model := range []string{"tiny", "granite-embedding-30m", "phi-3"} {
+				tokens, err := tokenizer.Tokenize(model, "Hello world!")
+				require.NoError(t, err)
+				if model == "phi-3" {
+					require.Equal(t, want, tokens)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	require.LessOrEqual(t, len(tokenizer.LoadedModels()), 3, "only models in use may exceed the limit")
+}
+
+// recordingCollector records the observed calls.
+type recordingCollector struct {
+	mu      sync.Mutex
+	calls   []ollamatokenizer.CallMetrics
+	retries []ollamatokenizer.RetryMetrics
+}
+
+func (r *recordingCollector) ObserveCall(call ollamatokenizer.CallMetrics) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, call)
+}
+
+func (r *recordingCollector) ObserveRetry(retry ollamatokenizer.RetryMetrics) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.retries = append(r.retries, retry)
+}
+
+func (r *recordingCollector) last() ollamatokenizer.CallMetrics {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.calls[len(r.calls)-1]
+}
+
+func TestMetrics(t *testing.T) {
+	defer quiet()()
+
+	_, err := ollamatokenizer.NewTokenizer(ollamatokenizer.TokenizerWithMetrics(nil))
+	require.Error(t, err)
+
+	collector := &recordingCollector{}
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithMetrics(collector),
+		ollamatokenizer.TokenizerWithResultCache(10),
+		ollamatokenizer.TokenizerWithFallbackModel("tiny"),
+		ollamatokenizer.TokenizerWithLoadFailureFallback(true),
+		// nothing listens on port 1, so the download of the model fails.
+		ollamatokenizer.TokenizerWithCustomModels(map[string]string{"unreachable-model": "http://127.0.0.1:1/model.gguf"}),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	count, err := tokenizer.CountTokens("tiny", "Hello world!")
+	require.NoError(t, err)
+	call := collector.last()
+	require.Equal(t, ollamatokenizer.OperationCount, call.Operation)
+	require.Equal(t, "tiny", call.Model)
+	require.Equal(t, count, call.Tokens)
+	require.False(t, call.FallbackUsed)
+	require.False(t, call.Cached)
+	require.NoError(t, call.Err)
+	require.GreaterOrEqual(t, call.Duration, time.Duration(0))
+
+	_, err = tokenizer.CountTokens("tiny", "Hello world!")
+	require.NoError(t, err)
+	require.True(t, collector.last().Cached)
+
+	tokens, err := tokenizer.Tokenize("unreachable-model", "Hello world!")
+	require.NoError(t, err)
+	call = collector.last()
+	require.Equal(t, ollamatokenizer.OperationTokenize, call.Operation)
+	require.Equal(t, "unreachable-model", call.Model)
+	require.Equal(t, len(tokens), call.Tokens)
+	require.True(t, call.FallbackUsed)
+
+	_, err = tokenizer.Tokenize("invalid-model", "Hello world!")
+	require.Error(t, err)
+	call = collector.last()
+	require.ErrorIs(t, call.Err, ollamatokenizer.ErrUnknownModel)
+	require.Zero(t, call.Tokens)
+	require.False(t, call.FallbackUsed)
+}
+
+func TestRetry(t *testing.T) {
+	defer quiet()()
+
+	home, err := os.UserHomeDir()
+	require.NoError(t, err)
+	tiny, err := os.ReadFile(filepath.Join(home, ".libollama", "models", "tiny", "model.gguf"))
+	require.NoError(t, err)
+	t.Setenv("HOME", t.TempDir())
+
+	// the flaky model fails twice before it is served, the missing one is never there.
+	var flakyRequests, missingRequests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/flaky.gguf":
+			if flakyRequests.Add(1) <= 2 {
+				http.Error(w, "try again", http.StatusBadGateway)
+				return
+			}
+			_, _ = w.Write(tiny)
+		default:
+			missingRequests.Add(1)
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	_, err = ollamatokenizer.NewTokenizer(ollamatokenizer.TokenizerWithRetry(0, time.Millisecond))
+	require.Error(t, err)
+
+	collector := &recordingCollector{}
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithCustomModels(map[string]string{
+			"flaky":   server.URL + "/flaky.gguf",
+			"missing": server.URL + "/missing.gguf",
+		}),
+		ollamatokenizer.TokenizerWithRetry(3, time.Millisecond),
+		ollamatokenizer.TokenizerWithMetrics(collector),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	_, err = tokenizer.Tokenize("flaky", "Hello world!")
+	require.NoError(t, err, "transient failures should be retried")
+	require.Equal(t, int32(3), flakyRequests.Load())
+	require.Len(t, collector.retries, 2)
+	require.Equal(t, "flaky", collector.retries[0].Model)
+	require.Equal(t, 2, collector.retries[0].Attempt)
+	require.Equal(t, 3, collector.retries[1].Attempt)
+
+	_, err = tokenizer.Tokenize("missing", "Hello world!")
+	require.Error(t, err)
+	require.Equal(t, int32(1), missingRequests.Load(), "a 404 should not be retried")
+	require.Len(t, collector.retries, 2)
+
+	// the backoff waits on the clock and is capped, however large the base delay.
+	flakyRequests.Store(0)
+	clock := &fakeClock{now: time.Now()}
+	collector = &recordingCollector{}
+	tokenizer, err = ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithCustomModels(map[string]string{"flaky-slow": server.URL + "/flaky.gguf"}),
+		ollamatokenizer.TokenizerWithRetry(3, 24*time.Hour),
+		ollamatokenizer.TokenizerWithMetrics(collector),
+		ollamatokenizer.TokenizerWithClock(clock),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+	before := clock.Now()
+	start := time.Now()
+	_, err = tokenizer.Tokenize("flaky-slow", "Hello world!")
+	require.NoError(t, err)
+	require.Less(t, time.Since(start), 5*time.Second)
+	require.Len(t, collector.retries, 2)
+	var waited time.Duration
+	for _, retry := range collector.retries {
+		require.LessOrEqual(t, retry.Delay, 45*time.Second, "the backoff should be capped")
+		waited += retry.Delay
+	}
+	require.Equal(t, waited, clock.Now().Sub(before))
+}
+
+func TestEstimateTokens(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	prompt := strings.Repeat("The quick brown fox jumps over the lazy dog. ", 10)
+	estimate, err := tokenizer.EstimateTokens("tiny", prompt)
+	require.NoError(t, err)
+	require.Equal(t, 113, estimate, "450 ASCII characters at 4 per token")
+	require.NotContains(t, tokenizer.LoadedModels(), "tiny", "estimating should not load the model")
+
+	estimate, err = tokenizer.EstimateTokens("tiny", "日本語")
+	require.NoError(t, err)
+	require.Equal(t, 3, estimate, "non-ASCII characters count one token each")
+
+	estimate, err = tokenizer.EstimateTokens("tiny", "")
+	require.NoError(t, err)
+	require.Zero(t, estimate)
+
+	count, err := tokenizer.CountTokens("tiny", prompt)
+	require.NoError(t, err)
+	estimate, err = tokenizer.EstimateTokens("tiny", prompt)
+	require.NoError(t, err)
+	require.Equal(t, count, estimate, "loaded models should count exactly")
+
+	_, err = tokenizer.EstimateTokens("invalid-model", prompt)
+	require.ErrorIs(t, err, ollamatokenizer.ErrModelNotFound)
+}
+
+func TestCountTokensReader(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+		ollamatokenizer.TokenizerWithLineEndingNormalization(ollamatokenizer.LineEndingLF),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+
+	// multi-byte characters, line endings and invalid bytes end up on the chunk and read boundaries.
+	var sb strings.Builder
+	for i := 0; sb.Len() < 100*1024; i++ {
+		fmt.Fprintf(&sb, "Line %d with ümlauts, 日本語 and 😀\r\n", i)
+		if i%97 == 0 {
+			sb.WriteString("\xff\xfe invalid\r")
+		}
+	}
+	text := sb.String()
+	want, err := tokenizer.CountTokens("tiny", text)
+	require.NoError(t, err)
+
+	readers := map[string]func() io.Reader{
+		"whole":    func() io.Reader { return strings.NewReader(text) },
+		"one byte": func() io.Reader { return iotest.OneByteReader(strings.NewReader(text)) },
+		"half":     func() io.Reader { return iotest.HalfReader(strings.NewReader(text)) },
+		"data eof": func() io.Reader { return iotest.DataErrReader(strings.NewReader(text)) },
+	}
+	for name, reader := range readers {
+		t.Run(name, func(t *testing.T) {
+			count, err := tokenizer.CountTokensReader("tiny", reader())
+			require.NoError(t, err)
+			require.Equal(t, want, count, "the count should equal CountTokens of the whole text")
+		})
+	}
+
+	for _, small := range []string{"", "Hello world!", "\r"} {
+		want, err := tokenizer.CountTokens("tiny", small)
+		require.NoError(t, err)
+		count, err := tokenizer.CountTokensReader("tiny", iotest.OneByteReader(strings.NewReader(small)))
+		require.NoError(t, err)
+		require.Equal(t, want, count, "count of %q", small)
+	}
+
+	_, err = tokenizer.CountTokensReader("tiny", iotest.ErrReader(errors.New("broken")))
+	require.Error(t, err)
+	_, err = tokenizer.CountTokensReader("invalid-model", strings.NewReader("Hello"))
+	require.ErrorIs(t, err, ollamatokenizer.ErrModelNotFound)
+}
@@ -0,0 +1,109 @@
+// Package tokenizergrpc serves an ollamatokenizer.Tokenizer over gRPC, see tokenizer.proto.
+package tokenizergrpc
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative tokenizer.proto
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/contenox/ollamatokenizer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Service implements TokenizerServer on top of a tokenizer.
+// Register it with RegisterTokenizerServer.
+type Service struct {
+	UnimplementedTokenizerServer
+
+	tokenizer ollamatokenizer.Tokenizer
+}
+
+// NewService returns a service tokenizing with the given tokenizer.
+func NewService(tokenizer ollamatokenizer.Tokenizer) *Service {
+	return &Service{tokenizer: tokenizer}
+}
+
+// Tokenize implements TokenizerServer.
+func (s *Service) Tokenize(ctx context.Context, req *TokenizeRequest) (*TokenizeResponse, error) {
+	if !ollamatokenizer.ValidModelName(req.GetModel()) {
+		return nil, status.Error(codes.InvalidArgument, "invalid model name")
+	}
+	tokens, err := s.tokenizer.TokenizeCtx(ctx, req.GetModel(), req.GetPrompt())
+	if err != nil {
+		return nil, toStatus("tokenize failed", err)
+	}
+	ids := make([]int32, len(tokens))
+	for i, t := range tokens {
+		ids[i] = int32(t)
+	}
+	return &TokenizeResponse{Tokens: ids, Count: int32(len(tokens))}, nil
+}
+
+// CountTokens implements TokenizerServer.
+func (s *Service) CountTokens(ctx context.Context, req *CountTokensRequest) (*CountTokensResponse, error) {
+	if !ollamatokenizer.ValidModelName(req.GetModel()) {
+		return nil, status.Error(codes.InvalidArgument, "invalid model name")
+	}
+	res, err := s.tokenizer.CountTokensDetailedCtx(ctx, req.GetModel(), req.GetPrompt())
+	if err != nil {
+		return nil, toStatus("count tokens failed", err)
+	}
+	resp := &CountTokensResponse{Count: int32(res.Count)}
+	if res.UsedFallback {
+		resp.ModelUsed, resp.UsedFallback = res.Model, true
+	}
+	return resp, nil
+}
+
+// AvailableModels implements TokenizerServer.
+func (s *Service) AvailableModels(context.Context, *AvailableModelsRequest) (*AvailableModelsResponse, error) {
+	return &AvailableModelsResponse{Models: s.tokenizer.AvailableModels()}, nil
+}
+
+// TokenizeStream implements TokenizerServer.
+func (s *Service) TokenizeStream(stream Tokenizer_TokenizeStreamServer) error {
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		resp, err := s.Tokenize(stream.Context(), req)
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+}
+
+// toStatus maps the error classes of the tokenizer to gRPC status codes,
+// like the HTTP server maps them to status codes.
+func toStatus(msg string, err error) error {
+	code := codes.Internal
+	switch {
+	case errors.Is(err, context.Canceled):
+		code = codes.Canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		code = codes.DeadlineExceeded
+	case errors.Is(err, ollamatokenizer.ErrModelNotFound):
+		code = codes.NotFound
+	case errors.Is(err, ollamatokenizer.ErrInputTooLarge),
+		errors.Is(err, ollamatokenizer.ErrInvalidUTF8),
+		errors.Is(err, ollamatokenizer.ErrInvalidModelName):
+		code = codes.InvalidArgument
+	case errors.Is(err, ollamatokenizer.ErrBackendUnavailable),
+		errors.Is(err, ollamatokenizer.ErrOfflineMode):
+		code = codes.Unavailable
+	case errors.Is(err, ollamatokenizer.ErrOverloaded),
+		errors.Is(err, ollamatokenizer.ErrRateLimited):
+		code = codes.ResourceExhausted
+	}
+	return status.Errorf(code, "%s: %v", msg, err)
+}
@@ -0,0 +1,124 @@
+package tokenizergrpc_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/contenox/ollamatokenizer"
+	"github.com/contenox/ollamatokenizer/tokenizergrpc"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func quiet() func() {
+	null, _ := os.Open(os.DevNull)
+	sout := os.Stdout
+	serr := os.Stderr
+	os.Stdout = null
+	os.Stderr = null
+	log.SetOutput(null)
+	return func() {
+		defer null.Close()
+		os.Stdout = sout
+		os.Stderr = serr
+		log.SetOutput(os.Stderr)
+	}
+}
+
+func newClient(t *testing.T, tokenizer ollamatokenizer.Tokenizer) tokenizergrpc.TokenizerClient {
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	tokenizergrpc.RegisterTokenizerServer(server, tokenizergrpc.NewService(tokenizer))
+	go func() { _ = server.Serve(lis) }()
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return lis.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return tokenizergrpc.NewTokenizerClient(conn)
+}
+
+func TestService(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+	client := newClient(t, tokenizer)
+	ctx := context.Background()
+
+	want, err := tokenizer.Tokenize("tiny", "Hello world!")
+	require.NoError(t, err)
+
+	tokenized, err := client.Tokenize(ctx, &tokenizergrpc.TokenizeRequest{Model: "tiny", Prompt: "Hello world!"})
+	require.NoError(t, err)
+	require.Len(t, tokenized.GetTokens(), len(want))
+	for i, id := range tokenized.GetTokens() {
+		require.Equal(t, want[i], int(id))
+	}
+	require.Equal(t, int32(len(want)), tokenized.GetCount())
+
+	counted, err := client.CountTokens(ctx, &tokenizergrpc.CountTokensRequest{Model: "tiny", Prompt: "Hello world!"})
+	require.NoError(t, err)
+	require.Equal(t, int32(len(want)), counted.GetCount())
+	require.False(t, counted.GetUsedFallback())
+
+	models, err := client.AvailableModels(ctx, &tokenizergrpc.AvailableModelsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, tokenizer.AvailableModels(), models.GetModels())
+
+	_, err = client.CountTokens(ctx, &tokenizergrpc.CountTokensRequest{Model: "invalid-model", Prompt: "Hello"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.Tokenize(ctx, &tokenizergrpc.TokenizeRequest{Model: "../escape", Prompt: "Hello"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestTokenizeStream(t *testing.T) {
+	defer quiet()()
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokenizer, err := ollamatokenizer.NewTokenizer(
+		ollamatokenizer.TokenizerWithHTTPClient(httpClient),
+	)
+	require.NoError(t, err, "failed to initialize tokenizer")
+	client := newClient(t, tokenizer)
+
+	stream, err := client.TokenizeStream(context.Background())
+	require.NoError(t, err)
+	prompts := []string{"Hello world!", "", "Hi"}
+	for _, prompt := range prompts {
+		require.NoError(t, stream.Send(&tokenizergrpc.TokenizeRequest{Model: "tiny", Prompt: prompt}))
+	}
+	require.NoError(t, stream.CloseSend())
+	for _, prompt := range prompts {
+		resp, err := stream.Recv()
+		require.NoError(t, err)
+		tokens, err := tokenizer.Tokenize("tiny", prompt)
+		require.NoError(t, err)
+		require.Equal(t, int32(len(tokens)), resp.GetCount(), "responses should be in request order")
+	}
+	_, err = stream.Recv()
+	require.True(t, errors.Is(err, io.EOF))
+
+	stream, err = client.TokenizeStream(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&tokenizergrpc.TokenizeRequest{Model: "invalid-model", Prompt: "Hello"}))
+	_, err = stream.Recv()
+	require.Equal(t, codes.NotFound, status.Code(err), "a failing request should end the stream")
+}
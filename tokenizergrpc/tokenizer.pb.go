@@ -0,0 +1,408 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
+// source: tokenizer.proto
+
+package tokenizergrpc
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type TokenizeRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Model         string                 `protobuf:"bytes,1,opt,name=model,proto3" json:"model,omitempty"`
+	Prompt        string                 `protobuf:"bytes,2,opt,name=prompt,proto3" json:"prompt,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *TokenizeRequest) Reset() {
+	*x = TokenizeRequest{}
+	mi := &file_tokenizer_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TokenizeRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TokenizeRequest) ProtoMessage() {}
+
+func (x *TokenizeRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_tokenizer_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TokenizeRequest.ProtoReflect.Descriptor instead.
+func (*TokenizeRequest) Descriptor() ([]byte, []int) {
+	return file_tokenizer_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *TokenizeRequest) GetModel() string {
+	if x != nil {
+		return x.Model
+	}
+	return ""
+}
+
+func (x *TokenizeRequest) GetPrompt() string {
+	if x != nil {
+		return x.Prompt
+	}
+	return ""
+}
+
+type TokenizeResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Tokens        []int32                `protobuf:"varint,1,rep,packed,name=tokens,proto3" json:"tokens,omitempty"`
+	Count         int32                  `protobuf:"varint,2,opt,name=count,proto3" json:"count,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *TokenizeResponse) Reset() {
+	*x = TokenizeResponse{}
+	mi := &file_tokenizer_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TokenizeResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TokenizeResponse) ProtoMessage() {}
+
+func (x *TokenizeResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_tokenizer_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TokenizeResponse.ProtoReflect.Descriptor instead.
+func (*TokenizeResponse) Descriptor() ([]byte, []int) {
+	return file_tokenizer_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *TokenizeResponse) GetTokens() []int32 {
+	if x != nil {
+		return x.Tokens
+	}
+	return nil
+}
+
+func (x *TokenizeResponse) GetCount() int32 {
+	if x != nil {
+		return x.Count
+	}
+	return 0
+}
+
+type CountTokensRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Model         string                 `protobuf:"bytes,1,opt,name=model,proto3" json:"model,omitempty"`
+	Prompt        string                 `protobuf:"bytes,2,opt,name=prompt,proto3" json:"prompt,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CountTokensRequest) Reset() {
+	*x = CountTokensRequest{}
+	mi := &file_tokenizer_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CountTokensRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CountTokensRequest) ProtoMessage() {}
+
+func (x *CountTokensRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_tokenizer_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CountTokensRequest.ProtoReflect.Descriptor instead.
+func (*CountTokensRequest) Descriptor() ([]byte, []int) {
+	return file_tokenizer_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *CountTokensRequest) GetModel() string {
+	if x != nil {
+		return x.Model
+	}
+	return ""
+}
+
+func (x *CountTokensRequest) GetPrompt() string {
+	if x != nil {
+		return x.Prompt
+	}
+	return ""
+}
+
+type CountTokensResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Count int32                  `protobuf:"varint,1,opt,name=count,proto3" json:"count,omitempty"`
+	// model_used and used_fallback are only set if the count comes from the load failure fallback.
+	ModelUsed     string `protobuf:"bytes,2,opt,name=model_used,json=modelUsed,proto3" json:"model_used,omitempty"`
+	UsedFallback  bool   `protobuf:"varint,3,opt,name=used_fallback,json=usedFallback,proto3" json:"used_fallback,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CountTokensResponse) Reset() {
+	*x = CountTokensResponse{}
+	mi := &file_tokenizer_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CountTokensResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CountTokensResponse) ProtoMessage() {}
+
+func (x *CountTokensResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_tokenizer_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CountTokensResponse.ProtoReflect.Descriptor instead.
+func (*CountTokensResponse) Descriptor() ([]byte, []int) {
+	return file_tokenizer_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *CountTokensResponse) GetCount() int32 {
+	if x != nil {
+		return x.Count
+	}
+	return 0
+}
+
+func (x *CountTokensResponse) GetModelUsed() string {
+	if x != nil {
+		return x.ModelUsed
+	}
+	return ""
+}
+
+func (x *CountTokensResponse) GetUsedFallback() bool {
+	if x != nil {
+		return x.UsedFallback
+	}
+	return false
+}
+
+type AvailableModelsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AvailableModelsRequest) Reset() {
+	*x = AvailableModelsRequest{}
+	mi := &file_tokenizer_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AvailableModelsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AvailableModelsRequest) ProtoMessage() {}
+
+func (x *AvailableModelsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_tokenizer_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AvailableModelsRequest.ProtoReflect.Descriptor instead.
+func (*AvailableModelsRequest) Descriptor() ([]byte, []int) {
+	return file_tokenizer_proto_rawDescGZIP(), []int{4}
+}
+
+type AvailableModelsResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Models        []string               `protobuf:"bytes,1,rep,name=models,proto3" json:"models,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AvailableModelsResponse) Reset() {
+	*x = AvailableModelsResponse{}
+	mi := &file_tokenizer_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AvailableModelsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AvailableModelsResponse) ProtoMessage() {}
+
+func (x *AvailableModelsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_tokenizer_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AvailableModelsResponse.ProtoReflect.Descriptor instead.
+func (*AvailableModelsResponse) Descriptor() ([]byte, []int) {
+	return file_tokenizer_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *AvailableModelsResponse) GetModels() []string {
+	if x != nil {
+		return x.Models
+	}
+	return nil
+}
+
+var File_tokenizer_proto protoreflect.FileDescriptor
+
+const file_tokenizer_proto_rawDesc = "" +
+	"\n" +
+	"\x0ftokenizer.proto\x12\x12ollamatokenizer.v1\"?\n" +
+	"\x0fTokenizeRequest\x12\x14\n" +
+	"\x05model\x18\x01 \x01(\tR\x05model\x12\x16\n" +
+	"\x06prompt\x18\x02 \x01(\tR\x06prompt\"@\n" +
+	"\x10TokenizeResponse\x12\x16\n" +
+	"\x06tokens\x18\x01 \x03(\x05R\x06tokens\x12\x14\n" +
+	"\x05count\x18\x02 \x01(\x05R\x05count\"B\n" +
+	"\x12CountTokensRequest\x12\x14\n" +
+	"\x05model\x18\x01 \x01(\tR\x05model\x12\x16\n" +
+	"\x06prompt\x18\x02 \x01(\tR\x06prompt\"o\n" +
+	"\x13CountTokensResponse\x12\x14\n" +
+	"\x05count\x18\x01 \x01(\x05R\x05count\x12\x1d\n" +
+	"\n" +
+	"model_used\x18\x02 \x01(\tR\tmodelUsed\x12#\n" +
+	"\rused_fallback\x18\x03 \x01(\bR\fusedFallback\"\x18\n" +
+	"\x16AvailableModelsRequest\"1\n" +
+	"\x17AvailableModelsResponse\x12\x16\n" +
+	"\x06models\x18\x01 \x03(\tR\x06models2\x8f\x03\n" +
+	"\tTokenizer\x12U\n" +
+	"\bTokenize\x12#.ollamatokenizer.v1.TokenizeRequest\x1a$.ollamatokenizer.v1.TokenizeResponse\x12^\n" +
+	"\vCountTokens\x12&.ollamatokenizer.v1.CountTokensRequest\x1a'.ollamatokenizer.v1.CountTokensResponse\x12j\n" +
+	"\x0fAvailableModels\x12*.ollamatokenizer.v1.AvailableModelsRequest\x1a+.ollamatokenizer.v1.AvailableModelsResponse\x12_\n" +
+	"\x0eTokenizeStream\x12#.ollamatokenizer.v1.TokenizeRequest\x1a$.ollamatokenizer.v1.TokenizeResponse(\x010\x01B3Z1github.com/contenox/ollamatokenizer/tokenizergrpcb\x06proto3"
+
+var (
+	file_tokenizer_proto_rawDescOnce sync.Once
+	file_tokenizer_proto_rawDescData []byte
+)
+
+func file_tokenizer_proto_rawDescGZIP() []byte {
+	file_tokenizer_proto_rawDescOnce.Do(func() {
+		file_tokenizer_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_tokenizer_proto_rawDesc), len(file_tokenizer_proto_rawDesc)))
+	})
+	return file_tokenizer_proto_rawDescData
+}
+
+var file_tokenizer_proto_msgTypes = make([]protoimpl.MessageInfo, 6)
+var file_tokenizer_proto_goTypes = []any{
+	(*TokenizeRequest)(nil),         // 0: ollamatokenizer.v1.TokenizeRequest
+	(*TokenizeResponse)(nil),        // 1: ollamatokenizer.v1.TokenizeResponse
+	(*CountTokensRequest)(nil),      // 2: ollamatokenizer.v1.CountTokensRequest
+	(*CountTokensResponse)(nil),     // 3: ollamatokenizer.v1.CountTokensResponse
+	(*AvailableModelsRequest)(nil),  // 4: ollamatokenizer.v1.AvailableModelsRequest
+	(*AvailableModelsResponse)(nil), // 5: ollamatokenizer.v1.AvailableModelsResponse
+}
+var file_tokenizer_proto_depIdxs = []int32{
+	0, // 0: ollamatokenizer.v1.Tokenizer.Tokenize:input_type -> ollamatokenizer.v1.TokenizeRequest
+	2, // 1: ollamatokenizer.v1.Tokenizer.CountTokens:input_type -> ollamatokenizer.v1.CountTokensRequest
+	4, // 2: ollamatokenizer.v1.Tokenizer.AvailableModels:input_type -> ollamatokenizer.v1.AvailableModelsRequest
+	0, // 3: ollamatokenizer.v1.Tokenizer.TokenizeStream:input_type -> ollamatokenizer.v1.TokenizeRequest
+	1, // 4: ollamatokenizer.v1.Tokenizer.Tokenize:output_type -> ollamatokenizer.v1.TokenizeResponse
+	3, // 5: ollamatokenizer.v1.Tokenizer.CountTokens:output_type -> ollamatokenizer.v1.CountTokensResponse
+	5, // 6: ollamatokenizer.v1.Tokenizer.AvailableModels:output_type -> ollamatokenizer.v1.AvailableModelsResponse
+	1, // 7: ollamatokenizer.v1.Tokenizer.TokenizeStream:output_type -> ollamatokenizer.v1.TokenizeResponse
+	4, // [4:8] is the sub-list for method output_type
+	0, // [0:4] is the sub-list for method input_type
+	0, // [0:0] is the sub-list for extension type_name
+	0, // [0:0] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_tokenizer_proto_init() }
+func file_tokenizer_proto_init() {
+	if File_tokenizer_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_tokenizer_proto_rawDesc), len(file_tokenizer_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   6,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_tokenizer_proto_goTypes,
+		DependencyIndexes: file_tokenizer_proto_depIdxs,
+		MessageInfos:      file_tokenizer_proto_msgTypes,
+	}.Build()
+	File_tokenizer_proto = out.File
+	file_tokenizer_proto_goTypes = nil
+	file_tokenizer_proto_depIdxs = nil
+}
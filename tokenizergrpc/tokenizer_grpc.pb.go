@@ -0,0 +1,244 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.6.0
+// - protoc             (unknown)
+// source: tokenizer.proto
+
+package tokenizergrpc
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Tokenizer_Tokenize_FullMethodName        = "/ollamatokenizer.v1.Tokenizer/Tokenize"
+	Tokenizer_CountTokens_FullMethodName     = "/ollamatokenizer.v1.Tokenizer/CountTokens"
+	Tokenizer_AvailableModels_FullMethodName = "/ollamatokenizer.v1.Tokenizer/AvailableModels"
+	Tokenizer_TokenizeStream_FullMethodName  = "/ollamatokenizer.v1.Tokenizer/TokenizeStream"
+)
+
+// TokenizerClient is the client API for Tokenizer service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Tokenizer exposes the tokenizer of a model over gRPC, mirroring the JSON endpoints of the HTTP server.
+type TokenizerClient interface {
+	// Tokenize returns the token IDs of the prompt.
+	Tokenize(ctx context.Context, in *TokenizeRequest, opts ...grpc.CallOption) (*TokenizeResponse, error)
+	// CountTokens returns the number of tokens of the prompt.
+	CountTokens(ctx context.Context, in *CountTokensRequest, opts ...grpc.CallOption) (*CountTokensResponse, error)
+	// AvailableModels returns the configured models.
+	AvailableModels(ctx context.Context, in *AvailableModelsRequest, opts ...grpc.CallOption) (*AvailableModelsResponse, error)
+	// TokenizeStream tokenizes each request of the stream, responding in request order.
+	// A failing request ends the stream with its error.
+	TokenizeStream(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[TokenizeRequest, TokenizeResponse], error)
+}
+
+type tokenizerClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewTokenizerClient(cc grpc.ClientConnInterface) TokenizerClient {
+	return &tokenizerClient{cc}
+}
+
+func (c *tokenizerClient) Tokenize(ctx context.Context, in *TokenizeRequest, opts ...grpc.CallOption) (*TokenizeResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(TokenizeResponse)
+	err := c.cc.Invoke(ctx, Tokenizer_Tokenize_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *tokenizerClient) CountTokens(ctx context.Context, in *CountTokensRequest, opts ...grpc.CallOption) (*CountTokensResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(CountTokensResponse)
+	err := c.cc.Invoke(ctx, Tokenizer_CountTokens_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *tokenizerClient) AvailableModels(ctx context.Context, in *AvailableModelsRequest, opts ...grpc.CallOption) (*AvailableModelsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(AvailableModelsResponse)
+	err := c.cc.Invoke(ctx, Tokenizer_AvailableModels_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *tokenizerClient) TokenizeStream(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[TokenizeRequest, TokenizeResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Tokenizer_ServiceDesc.Streams[0], Tokenizer_TokenizeStream_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[TokenizeRequest, TokenizeResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Tokenizer_TokenizeStreamClient = grpc.BidiStreamingClient[TokenizeRequest, TokenizeResponse]
+
+// TokenizerServer is the server API for Tokenizer service.
+// All implementations must embed UnimplementedTokenizerServer
+// for forward compatibility.
+//
+// Tokenizer exposes the tokenizer of a model over gRPC, mirroring the JSON endpoints of the HTTP server.
+type TokenizerServer interface {
+	// Tokenize returns the token IDs of the prompt.
+	Tokenize(context.Context, *TokenizeRequest) (*TokenizeResponse, error)
+	// CountTokens returns the number of tokens of the prompt.
+	CountTokens(context.Context, *CountTokensRequest) (*CountTokensResponse, error)
+	// AvailableModels returns the configured models.
+	AvailableModels(context.Context, *AvailableModelsRequest) (*AvailableModelsResponse, error)
+	// TokenizeStream tokenizes each request of the stream, responding in request order.
+	// A failing request ends the stream with its error.
+	TokenizeStream(grpc.BidiStreamingServer[TokenizeRequest, TokenizeResponse]) error
+	mustEmbedUnimplementedTokenizerServer()
+}
+
+// UnimplementedTokenizerServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedTokenizerServer struct{}
+
+func (UnimplementedTokenizerServer) Tokenize(context.Context, *TokenizeRequest) (*TokenizeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method Tokenize not implemented")
+}
+func (UnimplementedTokenizerServer) CountTokens(context.Context, *CountTokensRequest) (*CountTokensResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method CountTokens not implemented")
+}
+func (UnimplementedTokenizerServer) AvailableModels(context.Context, *AvailableModelsRequest) (*AvailableModelsResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method AvailableModels not implemented")
+}
+func (UnimplementedTokenizerServer) TokenizeStream(grpc.BidiStreamingServer[TokenizeRequest, TokenizeResponse]) error {
+	return status.Error(codes.Unimplemented, "method TokenizeStream not implemented")
+}
+func (UnimplementedTokenizerServer) mustEmbedUnimplementedTokenizerServer() {}
+func (UnimplementedTokenizerServer) testEmbeddedByValue()                   {}
+
+// UnsafeTokenizerServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to TokenizerServer will
+// result in compilation errors.
+type UnsafeTokenizerServer interface {
+	mustEmbedUnimplementedTokenizerServer()
+}
+
+func RegisterTokenizerServer(s grpc.ServiceRegistrar, srv TokenizerServer) {
+	// If the following call panics, it indicates UnimplementedTokenizerServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Tokenizer_ServiceDesc, srv)
+}
+
+func _Tokenizer_Tokenize_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TokenizeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TokenizerServer).Tokenize(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Tokenizer_Tokenize_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TokenizerServer).Tokenize(ctx, req.(*TokenizeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Tokenizer_CountTokens_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CountTokensRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TokenizerServer).CountTokens(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Tokenizer_CountTokens_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TokenizerServer).CountTokens(ctx, req.(*CountTokensRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Tokenizer_AvailableModels_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AvailableModelsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TokenizerServer).AvailableModels(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Tokenizer_AvailableModels_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TokenizerServer).AvailableModels(ctx, req.(*AvailableModelsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Tokenizer_TokenizeStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(TokenizerServer).TokenizeStream(&grpc.GenericServerStream[TokenizeRequest, TokenizeResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Tokenizer_TokenizeStreamServer = grpc.BidiStreamingServer[TokenizeRequest, TokenizeResponse]
+
+// Tokenizer_ServiceDesc is the grpc.ServiceDesc for Tokenizer service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Tokenizer_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "ollamatokenizer.v1.Tokenizer",
+	HandlerType: (*TokenizerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Tokenize",
+			Handler:    _Tokenizer_Tokenize_Handler,
+		},
+		{
+			MethodName: "CountTokens",
+			Handler:    _Tokenizer_CountTokens_Handler,
+		},
+		{
+			MethodName: "AvailableModels",
+			Handler:    _Tokenizer_AvailableModels_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "TokenizeStream",
+			Handler:       _Tokenizer_TokenizeStream_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "tokenizer.proto",
+}
@@ -0,0 +1,121 @@
+package ollamatokenizer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ToolDef is a tool (function) definition passed to a chat model for function calling.
+type ToolDef struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// Parameters is the JSON schema of the arguments, e.g. {"type":"object","properties":{...}}.
+	Parameters json.RawMessage `json:"parameters,omitempty"`
+}
+
+// toolFormat is how a model family serializes the tool definitions into the prompt.
+type toolFormat struct {
+	// header and footer enclose the definitions, separator is put between two definitions.
+	header    string
+	separator string
+	footer    string
+	// indent is the JSON indentation of a definition, empty for compact JSON.
+	indent string
+}
+
+// toolFormats are the tool formats of the model families by canonical name, following their chat templates.
+var toolFormats = map[string]toolFormat{
+	"llama-3.1": llamaToolFormat,
+	"llama-3.2": llamaToolFormat,
+}
+
+var llamaToolFormat = toolFormat{
+	header: "Given the following functions, please respond with a JSON for a function call with its proper arguments that best answers the given prompt.\n\n" +
+		"Respond in the format {\"name\": function name, \"parameters\": dictionary of argument name and its value}. Do not use variables.\n\n",
+	separator: "\n\n",
+	footer:    "\n\n",
+	indent:    "    ",
+}
+
+// defaultToolFormat is used for models without a known tool format: the <tools> layout of
+// Hermes style templates (e.g. Qwen), one compact JSON definition per line.
+var defaultToolFormat = toolFormat{
+	header:    "# Tools\n\nYou may call one or more functions to assist with the user query.\n\nYou are provided with function signatures within <tools></tools> XML tags:\n<tools>\n",
+	separator: "\n",
+	footer:    "\n</tools>\n\n",
+}
+
+// toolFormatOf returns the tool format of the model, matched by name like the family mappings.
+func toolFormatOf(modelName string) toolFormat {
+	for name, format := range toolFormats {
+		if strings.HasPrefix(modelName, name) {
+			return format
+		}
+	}
+	return defaultToolFormat
+}
+
+// toolsText returns the tool definitions as serialized into the prompt by the format.
+func toolsText(format toolFormat, tools []ToolDef) (string, error) {
+	var sb strings.Builder
+	sb.WriteString(format.header)
+	for i, tool := range tools {
+		if tool.Name == "" {
+			return "", fmt.Errorf("tool %d: missing name", i)
+		}
+		if len(tool.Parameters) > 0 && !json.Valid(tool.Parameters) {
+			return "", fmt.Errorf("tool %d (%s): invalid parameters schema", i, tool.Name)
+		}
+		def := struct {
+			Type     string  `json:"type"`
+			Function ToolDef `json:"function"`
+		}{Type: "function", Function: tool}
+		// the definitions are written like the chat templates write them, without escaping <, > and &
+		// for HTML, which json.Marshal would do.
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", format.indent)
+		if err := enc.Encode(def); err != nil {
+			return "", fmt.Errorf("tool %d (%s): %w", i, tool.Name, err)
+		}
+		data := bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+		if i > 0 {
+			sb.WriteString(format.separator)
+		}
+		sb.Write(data)
+	}
+	sb.WriteString(format.footer)
+	return sb.String(), nil
+}
+
+// CountToolTokens implements Tokenizer.
+func (c *ollamatokenizer) CountToolTokens(modelName string, tools []ToolDef) (int, error) {
+	if len(tools) == 0 {
+		return 0, nil
+	}
+
+	if err := c.waitThrottle(context.Background()); err != nil {
+		return 0, err
+	}
+	model, used, release, err := c.acquireModelOrFallback(modelName)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	// the format follows the model that counts, so a fallback counts in its own format.
+	text, err := toolsText(toolFormatOf(used), tools)
+	if err != nil {
+		return 0, err
+	}
+	text, err = c.preprocess(text)
+	if err != nil {
+		return 0, err
+	}
+	// the definitions are part of a longer prompt, so no BOS is counted for them.
+	return c.countChunks(model, text, false)
+}
@@ -0,0 +1,32 @@
+package ollamatokenizer
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestToolsText(t *testing.T) {
+	tool := ToolDef{
+		Name:        "compare",
+		Description: "Returns whether a < b && b > c",
+		Parameters:  json.RawMessage(`{"type":"object","properties":{"a":{"type":"string","description":"<html> & text"}}}`),
+	}
+
+	text, err := toolsText(defaultToolFormat, []ToolDef{tool})
+	require.NoError(t, err)
+	require.Equal(t, defaultToolFormat.header+
+		`{"type":"function","function":{"name":"compare","description":"Returns whether a < b && b > c","parameters":{"type":"object","properties":{"a":{"type":"string","description":"<html> & text"}}}}}`+
+		defaultToolFormat.footer, text)
+
+	// indented definitions aren't escaped either, and no encoder newline ends up before the separator.
+	text, err = toolsText(llamaToolFormat, []ToolDef{tool, tool})
+	require.NoError(t, err)
+	require.Contains(t, text, `"description": "Returns whether a < b && b > c"`)
+	require.NotContains(t, text, `\u003c`)
+	require.NotContains(t, text, `\u0026`)
+	require.Contains(t, text, "}"+llamaToolFormat.separator+"{")
+	require.True(t, strings.HasSuffix(text, "}"+llamaToolFormat.footer))
+}
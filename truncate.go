@@ -0,0 +1,122 @@
+package ollamatokenizer
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"unicode/utf8"
+
+	"github.com/ollama/ollama/llama"
+)
+
+// TruncateOption configures a single TruncateToTokens call.
+type TruncateOption func(*truncateConfig) error
+
+type truncateConfig struct {
+	keepTail bool
+}
+
+// TruncateKeepTail keeps the end of the prompt instead of its start, e.g. to keep the most recent
+// turns of a conversation.
+func TruncateKeepTail(enabled bool) TruncateOption {
+	return func(cfg *truncateConfig) error {
+		cfg.keepTail = enabled
+		return nil
+	}
+}
+
+// TruncateToTokens implements Tokenizer.
+func (c *ollamatokenizer) TruncateToTokens(modelName, prompt string, maxTokens int, opts ...TruncateOption) (string, error) {
+	var cfg truncateConfig
+	for _, opt := range opts {
+		if err := opt(&cfg); err != nil {
+			return "", fmt.Errorf("invalid truncate option: %w", err)
+		}
+	}
+	if maxTokens < 0 {
+		return "", fmt.Errorf("invalid max tokens: %d", maxTokens)
+	}
+	prompt, err := c.preprocess(prompt)
+	if err != nil {
+		return "", err
+	}
+
+	if err := c.waitThrottle(context.Background()); err != nil {
+		return "", err
+	}
+	model, _, release, err := c.acquireModelOrFallback(modelName)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	count := func(s string) (int, error) {
+		return c.countChunks(model, s, true)
+	}
+	n, err := count(prompt)
+	if err != nil {
+		return "", err
+	}
+	if n <= maxTokens {
+		return prompt, nil
+	}
+
+	cuts, err := c.tokenBoundaries(model, prompt, cfg.keepTail)
+	if err != nil {
+		return "", err
+	}
+	part := func(cut int) string {
+		if cfg.keepTail {
+			return prompt[cut:]
+		}
+		return prompt[:cut]
+	}
+
+	// binary search the longest part that fits, starting from the longest cut.
+	// The cuts are ordered from the shortest to the longest part, the empty part always fits.
+	lo, hi := 0, len(cuts)-1
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		n, err := count(part(cuts[mid]))
+		if err != nil {
+			return "", err
+		}
+		if n <= maxTokens {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return part(cuts[lo]), nil
+}
+
+// tokenBoundaries returns the byte offsets between the tokens of the prompt that are also character
+// boundaries, ordered so that the prompt up to (or from, if tail is set) the offset grows.
+// The first offset always gives the empty part, the last one the whole prompt.
+func (c *ollamatokenizer) tokenBoundaries(model *llama.Model, prompt string, tail bool) ([]int, error) {
+	// tokenize in chunks, so prompts of any size can be truncated.
+	tokens, err := c.tokenizeChunks(model, prompt)
+	if err != nil {
+		return nil, err
+	}
+	pieces := make([]TokenPiece, len(tokens))
+	for i, id := range tokens {
+		pieces[i] = TokenPiece{ID: id, Piece: model.TokenToPiece(id)}
+	}
+	alignPieces(prompt, pieces)
+
+	cuts := []int{0, len(prompt)}
+	for _, p := range pieces {
+		cuts = append(cuts, p.Start, p.End)
+	}
+	// a byte-level token may end inside of a character, cutting there would produce invalid UTF-8.
+	cuts = slices.DeleteFunc(cuts, func(cut int) bool {
+		return cut < len(prompt) && !utf8.RuneStart(prompt[cut])
+	})
+	slices.Sort(cuts)
+	cuts = slices.Compact(cuts)
+	if tail {
+		slices.Reverse(cuts)
+	}
+	return cuts, nil
+}